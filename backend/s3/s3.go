@@ -6661,6 +6661,14 @@ func (o *Object) prepareUpload(ctx context.Context, src fs.ObjectInfo, options [
 			ui.req.ContentType = aws.String(value)
 		case "x-amz-tagging":
 			ui.req.Tagging = aws.String(value)
+		case "x-amz-object-lock-mode":
+			ui.req.ObjectLockMode = types.ObjectLockMode(value)
+		case "x-amz-object-lock-retain-until-date":
+			retainUntil, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return ui, fmt.Errorf("failed to parse %s: %w", key, err)
+			}
+			ui.req.ObjectLockRetainUntilDate = &retainUntil
 		default:
 			const amzMetaPrefix = "x-amz-meta-"
 			if strings.HasPrefix(lowerKey, amzMetaPrefix) {
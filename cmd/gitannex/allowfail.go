@@ -0,0 +1,34 @@
+package gitannex
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/rclone/rclone/fs/fserrors"
+)
+
+// isTransientError reports whether `err` is likely to go away on its own,
+// e.g. a network failure, rather than pointing at a problem with the configs
+// or the content.
+func isTransientError(err error) bool {
+	return fserrors.IsRetryError(err) || fserrors.ShouldRetry(err)
+}
+
+// allowFailure returns nil in place of `err`, the error from a TRANSFER
+// handler, when the "rcloneallowfail" config is enabled and `err` is a
+// transient transfer failure. Git-annex has already been told that the
+// transfer failed, and it may try another remote, so there is no reason to end
+// the session. Any other error is returned as is.
+func (s *server) allowFailure(err error) error {
+	var transferFailed *ErrTransferFailed
+	if !errors.As(err, &transferFailed) || !isTransientError(err) {
+		return err
+	}
+	cfg, cfgErr := s.getSessionConfig()
+	if cfgErr != nil || !cfg.allowFail {
+		return err
+	}
+	s.countError(err)
+	s.sendInfo(fmt.Sprintf("allow-fail: swallowed transient error: %v", err))
+	return nil
+}
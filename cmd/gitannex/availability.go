@@ -0,0 +1,29 @@
+package gitannex
+
+import (
+	"github.com/rclone/rclone/fs"
+)
+
+// computeAvailability returns "LOCAL" when `remoteFs` keeps its content on
+// this machine, e.g. the local backend or a crypt remote wrapping it, and
+// "GLOBAL" otherwise. Aliases of local paths are local too, since the alias
+// backend returns the Fs it points to.
+func computeAvailability(remoteFs fs.Fs) string {
+	if fs.UnWrapFs(remoteFs).Features().IsLocal {
+		return "LOCAL"
+	}
+	return "GLOBAL"
+}
+
+// availability returns the availability of this remote. Git-annex may ask
+// before the configs are known, in which case we assume a cloud service.
+func (s *server) availability() string {
+	if !s.configsDone {
+		return "GLOBAL"
+	}
+	prefixFs, err := s.getPrefixFs(s.sessionContext())
+	if err != nil {
+		return "GLOBAL"
+	}
+	return computeAvailability(prefixFs)
+}
@@ -0,0 +1,67 @@
+package gitannex
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// readBandwidthSchedule reads the bandwidth timetable in the file at `path`,
+// in the format of rclone's --bwlimit flag, e.g. "08:00,1M 00:00,off". Its
+// entries may be split across lines.
+func readBandwidthSchedule(path string) (fs.BwTimetable, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bandwidth schedule: %w", err)
+	}
+	var timetable fs.BwTimetable
+	if err := timetable.Set(strings.Join(strings.Fields(string(contents)), " ")); err != nil {
+		return nil, fmt.Errorf("failed to parse bandwidth schedule %q: %w", path, err)
+	}
+	return timetable, nil
+}
+
+// installBandwidthSchedule reads the timetable named by the
+// "rclonebandwidthschedule" config, if any, and applies it like
+// [server.installBwLimit]. [server.applyBandwidthSchedule] then keeps the limit
+// up to date as time passes.
+func (s *server) installBandwidthSchedule() error {
+	if s.configRcloneBandwidthSchedule == "" {
+		return nil
+	}
+	if s.configRcloneBwLimit != "" {
+		return errors.New("rclonebwlimit and rclonebandwidthschedule cannot both be set")
+	}
+	timetable, err := readBandwidthSchedule(s.configRcloneBandwidthSchedule)
+	if err != nil {
+		return err
+	}
+	s.bwSchedule = timetable
+	s.bwScheduleLimit = nil
+	s.applyBandwidthSchedule()
+	return nil
+}
+
+// applyBandwidthSchedule sets the bandwidth limit that the installed schedule
+// prescribes for the current time. It is called before each transfer, and
+// only changes the limit when a new time slot has begun.
+func (s *server) applyBandwidthSchedule() {
+	if len(s.bwSchedule) == 0 {
+		return
+	}
+	now := time.Now
+	if s.now != nil {
+		now = s.now
+	}
+	limit := s.bwSchedule.LimitAt(now()).Bandwidth
+	if s.bwScheduleLimit != nil && *s.bwScheduleLimit == limit {
+		return
+	}
+	s.setTokenBucketLimit(limit)
+	s.bwScheduleLimit = &limit
+	s.bwLimitInstalled = true
+}
@@ -0,0 +1,95 @@
+package gitannex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/filter"
+	"github.com/rclone/rclone/fs/list"
+)
+
+// dirListing is the set of object names in a directory at some point in time.
+type dirListing struct {
+	names    map[string]struct{}
+	listedAt time.Time
+}
+
+func (l *dirListing) contains(name string) bool {
+	_, ok := l.names[name]
+	return ok
+}
+
+// parseCheckPresentWindow parses the "rclonecheckpresentwindow" config. A
+// window of zero disables listing-based CHECKPRESENT.
+func parseCheckPresentWindow(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	window, err := fs.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse checkpresent window %q: %w", value, err)
+	}
+	if window < 0 {
+		return 0, fmt.Errorf("checkpresent window must not be negative: %q", value)
+	}
+	return window, nil
+}
+
+// findKeyInListing is like [findKey], but consults a listing of `remoteFs`
+// instead of looking up `key` directly. Git-annex waits for each CHECKPRESENT
+// reply before sending the next, so we cannot batch the messages themselves.
+// Instead, one listing answers every CHECKPRESENT that arrives within `window`
+// of it, which turns a run of N lookups, e.g. from `git annex fsck --fast`,
+// into a handful of listings.
+//
+// This only makes sense when every key lives in the same directory, i.e. in
+// the "nodir" layout.
+//
+// When `fi` is not nil, the listing leaves out the objects that it excludes,
+// and keys that it would exclude are looked up by name instead.
+func (s *server) findKeyInListing(ctx context.Context, fsString string, remoteFs fs.Fs, key string, window time.Duration, fi *filter.Filter) error {
+	if filterExcludesKey(fi, key) {
+		return findKey(ctx, remoteFs, key)
+	}
+	listing, ok := s.checkpresentListings[fsString]
+	if !ok || time.Since(listing.listedAt) >= window {
+		includeAll := fi == nil
+		if fi != nil {
+			ctx = filter.ReplaceConfig(ctx, fi)
+		}
+		entries, err := list.DirSorted(ctx, remoteFs, includeAll, "")
+		// Nothing has been stored yet.
+		if errors.Is(err, fs.ErrorDirNotFound) {
+			entries, err = nil, nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to list directory: %w", err)
+		}
+		listing = &dirListing{
+			names:    make(map[string]struct{}, len(entries)),
+			listedAt: time.Now(),
+		}
+		for _, entry := range entries {
+			if _, isObject := entry.(fs.Object); isObject {
+				listing.names[entry.Remote()] = struct{}{}
+			}
+		}
+		if s.checkpresentListings == nil {
+			s.checkpresentListings = make(map[string]*dirListing)
+		}
+		s.checkpresentListings[fsString] = listing
+	}
+	if listing.contains(key) || (listing.contains(manifestName(key)) && !listing.contains(partialName(key))) {
+		return nil
+	}
+	return fs.ErrorObjectNotFound
+}
+
+// forgetListing discards the listing of the directory named by `fsString`,
+// which must be called whenever this session modifies that directory.
+func (s *server) forgetListing(fsString string) {
+	delete(s.checkpresentListings, fsString)
+}
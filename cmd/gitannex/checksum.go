@@ -0,0 +1,102 @@
+package gitannex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/hash"
+)
+
+const (
+	checksumAuto = "auto"
+	checksumNone = "none"
+)
+
+// selectHashType returns the hash type that verifies stored objects, according
+// to `preference`, the value of the "rclonechecksum" config. "auto" picks the
+// hash that `remoteFs` has in common with `localFs`, which is the one
+// [operations.CopyFile] compares when it uploads. It returns [hash.None] when
+// verification is disabled or when "auto" finds no common hash.
+func selectHashType(remoteFs, localFs fs.Info, preference string) (hash.Type, error) {
+	supported := remoteFs.Hashes()
+	switch preference {
+	case checksumNone:
+		return hash.None, nil
+	case checksumAuto, "":
+		return supported.Overlap(localFs.Hashes()).GetOne(), nil
+	}
+	var hashType hash.Type
+	if err := hashType.Set(preference); err != nil {
+		return hash.None, fmt.Errorf("failed to parse checksum %q: %w", preference, err)
+	}
+	if hashType == hash.None {
+		return hash.None, nil
+	}
+	if !supported.Contains(hashType) {
+		return hash.None, fmt.Errorf("checksum %q is not supported by the remote, which supports %v", preference, supported)
+	}
+	return hashType, nil
+}
+
+// errSizeMismatch is returned when a stored object is not as large as the local
+// file it was uploaded from.
+var errSizeMismatch = errors.New("size mismatch")
+
+// verifyStoredSize checks that the object named `key` in `remoteFs` is `size`
+// bytes long. Some backends acknowledge writes that later turn out truncated,
+// so a mismatched object is removed rather than left for CHECKPRESENT to find,
+// unless it is `locked` against deletion.
+func verifyStoredSize(ctx context.Context, remoteFs fs.Fs, key string, size int64, locked bool) error {
+	obj, err := remoteFs.NewObject(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to find stored object: %w", err)
+	}
+	if obj.Size() == size {
+		return nil
+	}
+	mismatch := fmt.Errorf("%w: uploaded %d expected %d", errSizeMismatch, obj.Size(), size)
+	if locked {
+		return fmt.Errorf("%w, and the object is locked, so it was left in place; do not trust it until its retention ends", mismatch)
+	}
+	if err := obj.Remove(ctx); err != nil {
+		return fmt.Errorf("%w, and failed to remove it: %w", mismatch, err)
+	}
+	return mismatch
+}
+
+// verifyStored checks that the object named `key` in `remoteFs` has the same
+// checksum as the local file at `localPath`. It does nothing when `hashType`
+// is [hash.None] or when the remote cannot report a checksum for the object.
+func verifyStored(ctx context.Context, remoteFs fs.Fs, key, localPath string, hashType hash.Type) (err error) {
+	if hashType == hash.None {
+		return nil
+	}
+	obj, err := remoteFs.NewObject(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to find stored object: %w", err)
+	}
+	remoteSum, err := obj.Hash(ctx, hashType)
+	if err != nil {
+		return fmt.Errorf("failed to get %v of stored object: %w", hashType, err)
+	}
+	if remoteSum == "" {
+		return nil
+	}
+
+	f, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to open local file: %w", err)
+	}
+	defer fs.CheckClose(f, &err)
+	localSums, err := hash.StreamTypes(f, hash.NewHashSet(hashType))
+	if err != nil {
+		return fmt.Errorf("failed to hash local file: %w", err)
+	}
+	if !hash.Equals(localSums[hashType], remoteSum) {
+		return fmt.Errorf("%v differ: local %s, remote %s", hashType, localSums[hashType], remoteSum)
+	}
+	return nil
+}
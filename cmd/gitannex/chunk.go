@@ -0,0 +1,244 @@
+package gitannex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/accounting"
+	"github.com/rclone/rclone/fs/operations"
+)
+
+// chunkName returns the name of the object holding the i-th chunk of `key`.
+// Chunks are named like "KEY.000", "KEY.001", and so on.
+func chunkName(key string, i int) string {
+	return fmt.Sprintf("%s.%03d", key, i)
+}
+
+// manifestName returns the name of the object that records how many chunks
+// hold `key`, e.g. "KEY.chunks". It is uploaded after the last chunk, so a key
+// stored in chunks is only present once its manifest exists.
+func manifestName(key string) string {
+	return key + ".chunks"
+}
+
+// chunkManifest is the contents of the manifest of a key stored in chunks.
+type chunkManifest struct {
+	// The number of chunks, named by [chunkName] from 0.
+	count int
+	// The size of the key, which is the sum of the sizes of its chunks.
+	size int64
+}
+
+// writeChunkManifest uploads the manifest of `key`, with the modification
+// time of the local file it was stored from.
+func writeChunkManifest(ctx context.Context, remoteFs fs.Fs, key string, manifest chunkManifest, modTime time.Time) error {
+	contents := fmt.Sprintf("%d %d\n", manifest.count, manifest.size)
+	in := io.NopCloser(strings.NewReader(contents))
+	if _, err := operations.RcatSize(ctx, remoteFs, manifestName(key), in, int64(len(contents)), modTime, nil); err != nil {
+		return fmt.Errorf("failed to upload chunk manifest: %w", err)
+	}
+	return nil
+}
+
+// readChunkManifest reads the manifest of `key`. It returns
+// [fs.ErrorObjectNotFound] when there is none, i.e. when `key` was not stored
+// in chunks, or its store has not finished.
+func readChunkManifest(ctx context.Context, remoteFs fs.Fs, key string) (chunkManifest, error) {
+	obj, err := remoteFs.NewObject(ctx, manifestName(key))
+	if err != nil {
+		return chunkManifest{}, err
+	}
+	in, err := operations.Open(ctx, obj)
+	if err != nil {
+		return chunkManifest{}, fmt.Errorf("failed to open chunk manifest: %w", err)
+	}
+	contents, err := io.ReadAll(in)
+	_ = in.Close()
+	if err != nil {
+		return chunkManifest{}, fmt.Errorf("failed to read chunk manifest: %w", err)
+	}
+	var manifest chunkManifest
+	if _, err := fmt.Sscanf(string(contents), "%d %d", &manifest.count, &manifest.size); err != nil || manifest.count <= 0 || manifest.size < 0 {
+		return chunkManifest{}, fmt.Errorf("invalid chunk manifest %q", contents)
+	}
+	return manifest, nil
+}
+
+// removeChunkManifest deletes the manifest of `key`, if any, which makes the
+// key absent until a new manifest is written.
+func removeChunkManifest(ctx context.Context, remoteFs fs.Fs, key string) error {
+	obj, err := remoteFs.NewObject(ctx, manifestName(key))
+	if errors.Is(err, fs.ErrorObjectNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to find chunk manifest: %w", err)
+	}
+	if err := operations.DeleteFile(ctx, obj); err != nil {
+		return fmt.Errorf("failed to delete chunk manifest: %w", err)
+	}
+	return nil
+}
+
+// storeChunked uploads the local file at `localPath` to `remoteFs` as a
+// sequence of objects named by [chunkName], each holding at most `chunkSize`
+// bytes, followed by their manifest. When the store fails, the chunks it
+// uploaded are deleted.
+func storeChunked(ctx context.Context, remoteFs fs.Fs, key, localPath string, chunkSize int64) error {
+	_, err := storeChunkedFrom(ctx, remoteFs, key, localPath, chunkSize, 0, nil)
+	if err != nil {
+		if _, removeErr := removeChunksFrom(ctx, remoteFs, key, 0); removeErr != nil {
+			fs.Errorf(nil, "Failed to delete the chunks of %s: %v", key, removeErr)
+		}
+	}
+	return err
+}
+
+// storeChunkedFrom is like [storeChunked], but skips the first `offset` bytes
+// of the local file, which must be a multiple of `chunkSize`, calls
+// `progress`, when not nil, with the offset reached after each chunk, and
+// leaves the chunks it uploaded behind when it fails. It returns the number of
+// bytes uploaded.
+//
+// The manifest of a previous store of `key` is deleted first, and any of its
+// chunks beyond the last one of this store are deleted before the new manifest
+// is written.
+func storeChunkedFrom(ctx context.Context, remoteFs fs.Fs, key, localPath string, chunkSize, offset int64, progress func(offset int64) error) (sent int64, err error) {
+	if err := removeChunkManifest(ctx, remoteFs, key); err != nil {
+		return 0, err
+	}
+	f, err := os.Open(localPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open local file: %w", err)
+	}
+	defer fs.CheckClose(f, &err)
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat local file: %w", err)
+	}
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("failed to seek local file: %w", err)
+	}
+
+	remaining := info.Size() - offset
+	i := int(offset / chunkSize)
+	for ; remaining > 0; i++ {
+		size := min(chunkSize, remaining)
+		in := io.NopCloser(io.LimitReader(f, size))
+		if _, err = operations.RcatSize(ctx, remoteFs, chunkName(key, i), in, size, info.ModTime(), nil); err != nil {
+			return sent, fmt.Errorf("failed to upload chunk %d: %w", i, err)
+		}
+		remaining -= size
+		sent += size
+		if progress != nil {
+			if err = progress(offset + sent); err != nil {
+				return sent, err
+			}
+		}
+	}
+	if _, err = removeChunksFrom(ctx, remoteFs, key, i); err != nil {
+		return sent, fmt.Errorf("failed to delete stale chunks: %w", err)
+	}
+	return sent, writeChunkManifest(ctx, remoteFs, key, chunkManifest{count: i, size: info.Size()}, info.ModTime())
+}
+
+// retrieveChunked reassembles the chunks that the manifest of `key` lists into
+// a new file at `localPath`, copying through a buffer of `bufferSize` bytes.
+// It returns [fs.ErrorObjectNotFound] when there is no manifest. On failure,
+// the partially written file is removed.
+func retrieveChunked(ctx context.Context, remoteFs fs.Fs, key, localPath string, bufferSize int) (err error) {
+	manifest, err := readChunkManifest(ctx, remoteFs, key)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to create local file: %w", err)
+	}
+	defer func() {
+		fs.CheckClose(out, &err)
+		if err != nil {
+			_ = os.Remove(localPath)
+		}
+	}()
+
+	buf := make([]byte, bufferSize)
+	var size int64
+	for i := range manifest.count {
+		chunk, err := remoteFs.NewObject(ctx, chunkName(key, i))
+		if err != nil {
+			return fmt.Errorf("failed to find chunk %d: %w", i, err)
+		}
+		if err = copyChunk(ctx, out, chunk, buf); err != nil {
+			return fmt.Errorf("failed to download chunk %d: %w", i, err)
+		}
+		size += chunk.Size()
+	}
+	if size != manifest.size {
+		return fmt.Errorf("chunks hold %d bytes, but the manifest lists %d", size, manifest.size)
+	}
+	return nil
+}
+
+// copyChunk appends the contents of `chunk` to `out`, copying through `buf`.
+func copyChunk(ctx context.Context, out io.Writer, chunk fs.Object, buf []byte) (err error) {
+	tr := accounting.Stats(ctx).NewTransfer(chunk, nil)
+	defer func() {
+		tr.Done(ctx, err)
+	}()
+	var in io.ReadCloser
+	in, err = operations.Open(ctx, chunk)
+	if err != nil {
+		return err
+	}
+	in = tr.Account(ctx, in).WithBuffer()
+	defer fs.CheckClose(in, &err)
+	_, err = copyWithBuffer(out, in, buf)
+	return err
+}
+
+// removeChunks deletes the manifest of `key`, then every chunk of it, and the
+// partial object of an interrupted resumable store. It returns the number of
+// chunks that were deleted.
+func removeChunks(ctx context.Context, remoteFs fs.Fs, key string) (int, error) {
+	if err := removeChunkManifest(ctx, remoteFs, key); err != nil {
+		return 0, err
+	}
+	n, err := removeChunksFrom(ctx, remoteFs, key, 0)
+	if err != nil {
+		return n, err
+	}
+	return n, removePartial(ctx, remoteFs, key)
+}
+
+// removeChunksFrom deletes the chunks of `key` from the `first` one up to the
+// first that is missing. It returns the number of chunks that were deleted.
+func removeChunksFrom(ctx context.Context, remoteFs fs.Fs, key string, first int) (int, error) {
+	for i := first; ; i++ {
+		chunk, err := remoteFs.NewObject(ctx, chunkName(key, i))
+		if errors.Is(err, fs.ErrorObjectNotFound) {
+			return i - first, nil
+		}
+		if err != nil {
+			return i - first, fmt.Errorf("failed to find chunk %d: %w", i, err)
+		}
+		if err := operations.DeleteFile(ctx, chunk); err != nil {
+			return i - first, fmt.Errorf("failed to delete chunk %d: %w", i, err)
+		}
+	}
+}
+
+// chunkedSize returns the size of `key` that its manifest lists. It returns
+// [fs.ErrorObjectNotFound] when there is no manifest.
+func chunkedSize(ctx context.Context, remoteFs fs.Fs, key string) (int64, error) {
+	manifest, err := readChunkManifest(ctx, remoteFs, key)
+	return manifest.size, err
+}
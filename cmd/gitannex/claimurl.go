@@ -0,0 +1,69 @@
+package gitannex
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// rcloneURLScheme is the scheme of URLs that address a key by its rclone
+// remote and path, e.g. "rclone://myremote/prefix/KEY".
+const rcloneURLScheme = "rclone"
+
+// parseRcloneURL splits a URL such as "rclone://myremote/prefix/KEY" into the
+// name of the rclone remote, "myremote", and the path within it,
+// "prefix/KEY".
+func parseRcloneURL(rawURL string) (remoteName, p string, err error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to parse URL: %w", err)
+	}
+	if u.Scheme != rcloneURLScheme {
+		return "", "", fmt.Errorf("URL scheme must be %q: %q", rcloneURLScheme, rawURL)
+	}
+	if u.Host == "" {
+		return "", "", fmt.Errorf("URL has no remote name: %q", rawURL)
+	}
+	p = strings.TrimPrefix(u.Path, "/")
+	if p == "" || !isLocalPath(p) {
+		return "", "", fmt.Errorf("URL has no valid path: %q", rawURL)
+	}
+	return u.Host, p, nil
+}
+
+// claimsRcloneURL reports whether the remote name and path of an rclone URL
+// address a key in this remote, i.e. the remote is "rcloneremotename" and the
+// path names a file directly in "rcloneprefix", within "rclonenamespace" if it
+// is set.
+func (s *server) claimsRcloneURL(remoteName, p string) bool {
+	if remoteName != strings.TrimSuffix(s.configRcloneRemoteName, ":") {
+		return false
+	}
+	dir, key := path.Split(p)
+	return key != "" && path.Clean(dir) == strings.Trim(path.Clean(s.namespacedPrefix(s.configPrefix)), "/")
+}
+
+// handleClaimURL replies to "CLAIMURL URL" with "CLAIMURL-SUCCESS" when the URL
+// is an rclone URL of this remote. Other URLs are left for git-annex to handle
+// elsewhere, so not claiming them is not an error.
+func (s *server) handleClaimURL(message *messageParser) error {
+	argURL := message.finalParameter()
+	if argURL == "" {
+		return &ErrProtocolParse{protocolError(codeError, errors.New("failed to parse URL for CLAIMURL"))}
+	}
+
+	if err := s.queryConfigs(); err != nil {
+		s.sendMsg("CLAIMURL-FAILURE")
+		return &ErrConfigMissing{protocolError("CLAIMURL-FAILURE", fmt.Errorf("error getting configs: %w", err))}
+	}
+
+	remoteName, p, err := parseRcloneURL(argURL)
+	if err != nil || !s.claimsRcloneURL(remoteName, p) {
+		s.sendMsg("CLAIMURL-FAILURE")
+		return nil
+	}
+	s.sendMsg("CLAIMURL-SUCCESS")
+	return nil
+}
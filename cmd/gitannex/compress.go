@@ -0,0 +1,30 @@
+package gitannex
+
+import (
+	"fmt"
+	"strconv"
+
+	// The "rclonecompress" config wraps the remote in a compress remote, so
+	// the compress backend must be registered even if no other code imports
+	// it.
+	_ "github.com/rclone/rclone/backend/compress"
+)
+
+// parseCompression parses the "rclonecompress" and "rclonecompresslevel"
+// configs. It returns whether stored objects are compressed, and if so, with
+// which gzip level.
+func parseCompression(compress, level string) (enabled bool, gzipLevel int, err error) {
+	enabled, err = parseBoolConfig("compress", compress)
+	if err != nil || !enabled {
+		return false, 0, err
+	}
+	if level == "" {
+		return true, 6, nil
+	}
+	gzipLevel, err = strconv.Atoi(level)
+	// These are the levels that the compress backend accepts.
+	if err != nil || gzipLevel < -2 || gzipLevel > 9 {
+		return false, 0, fmt.Errorf("compress level must be an integer from -2 to 9: %q", level)
+	}
+	return true, gzipLevel, nil
+}
@@ -2,8 +2,14 @@ package gitannex
 
 import (
 	"fmt"
+	"os"
+	"path"
+	"regexp"
 	"slices"
+	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/rclone/rclone/fs"
 	"github.com/rclone/rclone/fs/config"
@@ -16,6 +22,62 @@ const (
 	configRemoteName configID = iota
 	configPrefix
 	configLayout
+	configBwLimit
+	configChunkSize
+	configProtocolTimeout
+	configCutoffSize
+	configLogLevel
+	configEncrypt
+	configKeyTypePrefix
+	configSkipConnectTest
+	configCheckPresentWindow
+	configChecksum
+	configPreserveModTime
+	configProxyURL
+	configExcludeKeys
+	configMaxTransferSize
+	configAllowedBackends
+	configProgress
+	configCacheDir
+	configPathSeparator
+	configObjectCache
+	configACL
+	configKMSKey
+	configEncryptionType
+	configDebugHTTP
+	configResumeTransfer
+	configStorageClass
+	configRetrievalStorageClass
+	configPublicLinks
+	configNamespace
+	configTemporaryPrefix
+	configObjectLocking
+	configObjectLockRetention
+	configCompress
+	configCompressLevel
+	configSnapshotPrefix
+	configBandwidthSchedule
+	configAllowFail
+	configWarmCache
+	configOverwriteExisting
+	configIgnoreCase
+	configRetryDelay
+	configRetryMaxDelay
+	configSHA256Verify
+	configLockFile
+	configPiggybackConfig
+	configCheckInterval
+	configObjectPrefix
+	configFilterFlags
+	configCopyFlag
+	configPrefixCreateOnPrepare
+	configTagging
+	configVerifySize
+	configGzip
+	configGzipLevel
+	configFailOnAbsent
+	configConnectionsPerServer
+	configCopyBuffer
 )
 
 // configDefinition describes a configuration value required by this command. We
@@ -25,11 +87,21 @@ type configDefinition struct {
 	names        []string
 	description  string
 	defaultValue string
+	// When true, an empty value is acceptable even though defaultValue is
+	// empty.
+	optional bool
+	// When not empty, the environment variable that supplies the value when
+	// git-annex sends an empty one. It takes precedence over defaultValue.
+	envVar string
 }
 
 const (
-	defaultRclonePrefix = "git-annex-rclone"
-	defaultRcloneLayout = "nodir"
+	defaultRclonePrefix             = "git-annex-rclone"
+	defaultRcloneLayout             = "nodir"
+	defaultRcloneProtocolTimeout    = "60s"
+	defaultRcloneCutoffSize         = "5G"
+	defaultRcloneCheckPresentWindow = "10ms"
+	defaultRclonePathSeparator      = "/"
 )
 
 var requiredConfigs = []configDefinition{
@@ -39,14 +111,16 @@ var requiredConfigs = []configDefinition{
 		description: "Name of the rclone remote to use. " +
 			"Must match a remote known to rclone. " +
 			"(Note that rclone remotes are a distinct concept from git-annex remotes.)",
+		envVar: standaloneRemoteEnvVar,
 	},
 	{
 		id:    configPrefix,
 		names: []string{"rcloneprefix", "prefix"},
 		description: "Directory where rclone will write git-annex content. " +
-			fmt.Sprintf("If not specified, defaults to %q. ", defaultRclonePrefix) +
+			fmt.Sprintf("If not specified, defaults to %q, followed by the name of the git remote when git-annex provides it, e.g. %q. ", defaultRclonePrefix, defaultRclonePrefix+"/MyRemote") +
 			"This directory will be created on init if it does not exist.",
 		defaultValue: defaultRclonePrefix,
+		envVar:       "RCLONE_GITANNEX_PREFIX",
 	},
 	{
 		id:    configLayout,
@@ -55,9 +129,522 @@ var requiredConfigs = []configDefinition{
 			fmt.Sprintf("Must be one of %v. ", allLayoutModes()) +
 			fmt.Sprintf("If empty, defaults to %q.", defaultRcloneLayout),
 		defaultValue: defaultRcloneLayout,
+		envVar:       "RCLONE_GITANNEX_LAYOUT",
+	},
+	{
+		id:    configBwLimit,
+		names: []string{"rclonebwlimit"},
+		description: "Bandwidth limit for transfers, in the same format as rclone's --bwlimit flag, e.g. \"10M\" or \"1M:off\". " +
+			"The limit is removed when the session ends. If empty, transfers are not limited.",
+		optional: true,
+	},
+	{
+		id:    configChunkSize,
+		names: []string{"rclonechunksize"},
+		description: "When nonzero, files larger than this size, e.g. \"100M\", are stored as a sequence of chunks named KEY.000, KEY.001, etc. " +
+			"A manifest named KEY.chunks is uploaded after the last chunk, and the key only counts as present once it exists. " +
+			"This helps with backends that limit file sizes. If empty, defaults to \"0\", which disables chunking.",
+		defaultValue: "0",
+	},
+	{
+		id:    configProtocolTimeout,
+		names: []string{"rcloneprotocoltimeout"},
+		description: "How long to wait for git-annex to accept a message before giving up on the session, e.g. \"30s\" or \"5m\". " +
+			"A value of \"0\" disables the timeout. " +
+			fmt.Sprintf("If empty, defaults to %q.", defaultRcloneProtocolTimeout),
+		defaultValue: defaultRcloneProtocolTimeout,
+	},
+	{
+		id:    configCutoffSize,
+		names: []string{"rclonecutoffsize"},
+		description: "Files larger than this size are uploaded as a stream when the remote supports it, " +
+			"which lets backends such as S3 switch to multipart uploads. A value of \"0\" disables streaming. " +
+			fmt.Sprintf("If empty, defaults to %q.", defaultRcloneCutoffSize),
+		defaultValue: defaultRcloneCutoffSize,
+	},
+	{
+		id:    configLogLevel,
+		names: []string{"rcloneloglevel"},
+		description: "Log level for rclone's own logging, which goes to stderr. Must be one of DEBUG, INFO, NOTICE, or ERROR. " +
+			"This has the same effect as rclone's --log-level flag, which cannot be passed when git-annex runs rclone. " +
+			"If empty, rclone's default is used.",
+		optional: true,
+	},
+	{
+		id:    configEncrypt,
+		names: []string{"rcloneencrypt"},
+		description: "Password with which to encrypt the names and contents of stored objects using rclone's crypt backend. " +
+			"Objects cannot be read without it, so do not lose it. initremote and enableremote move the password to git-annex's creds, which stay in the local repository, " +
+			"and leave \"creds\" in its place in the git-annex branch. If empty, objects are stored unencrypted.",
+		optional: true,
+	},
+	{
+		id:    configKeyTypePrefix,
+		names: []string{"rclonekeytypeprefix"},
+		description: "JSON object mapping annex key types to directories within rcloneprefix, e.g. {\"SHA256\":\"cold/\",\"WORM\":\"hot/\"}. " +
+			"A key's type is the part of the key before the first \"-\", and a type like \"SHA256E\" also matches \"SHA256\". " +
+			"Keys whose type is not listed are stored directly in rcloneprefix. If empty, all keys are stored directly in rcloneprefix.",
+		optional: true,
+	},
+	{
+		id:    configSkipConnectTest,
+		names: []string{"rcloneskipconnecttest"},
+		description: "When \"yes\", initremote does not check that the rcloneprefix directory is writable by uploading, reading, and deleting an empty file. " +
+			"This saves a few round trips to the remote. If empty, defaults to \"no\".",
+		defaultValue: "no",
+	},
+	{
+		id:    configCheckPresentWindow,
+		names: []string{"rclonecheckpresentwindow"},
+		description: "With the nodir layout, CHECKPRESENT answers come from a listing of rcloneprefix that is reused for this long, e.g. \"10ms\" or \"1s\". " +
+			"This replaces a lookup per key with one listing per window when git-annex checks many keys in a row, e.g. during fsck. " +
+			"A value of \"0\" disables listings. " +
+			fmt.Sprintf("If empty, defaults to %q.", defaultRcloneCheckPresentWindow),
+		defaultValue: defaultRcloneCheckPresentWindow,
+	},
+	{
+		id:    configChecksum,
+		names: []string{"rclonechecksum"},
+		description: "Hash with which stored objects are verified, e.g. \"md5\" or \"sha256\". It must be supported by the remote. " +
+			fmt.Sprintf("%q picks the hash that rclone already compares when copying, and %q disables verification. ", checksumAuto, checksumNone) +
+			"Verification costs a request for the stored object's checksum and a full read of the local file per store, " +
+			"except when the copy already compared the same hash. " +
+			fmt.Sprintf("If empty, defaults to %q.", checksumAuto),
+		defaultValue: checksumAuto,
+	},
+	{
+		id:    configPreserveModTime,
+		names: []string{"rclonepreservemtime"},
+		description: "When \"yes\", stored objects keep the modification time of the local file, and retrieved files get the modification time of the stored object. " +
+			"This matters for key types such as WORM, which include the modification time. If empty, defaults to \"no\".",
+		defaultValue: "no",
+	},
+	{
+		id:    configProxyURL,
+		names: []string{"rcloneproxyurl"},
+		description: "URL of an HTTP proxy through which rclone sends all backend traffic, e.g. \"http://proxy.example.com:3128\". " +
+			"It overrides the HTTPS_PROXY and HTTP_PROXY environment variables of the rclone process that git-annex starts for this remote. If empty, rclone uses the proxy from the environment, if any.",
+		optional: true,
+	},
+	{
+		id:    configExcludeKeys,
+		names: []string{"rcloneexcludekeys"},
+		description: "Comma-separated list of glob patterns, e.g. \"SHA1-*,*.pdf\". Keys matching any pattern are refused by store. " +
+			"Keys that are already stored can still be checked and retrieved. If empty, no keys are excluded.",
+		optional: true,
+	},
+	{
+		id:    configMaxTransferSize,
+		names: []string{"rclonemaxtransfersize"},
+		description: "When nonzero, store and retrieve refuse files larger than this size, e.g. \"10G\". " +
+			"If empty, defaults to \"0\", which means there is no limit.",
+		defaultValue: "0",
+	},
+	{
+		id:    configAllowedBackends,
+		names: []string{"rcloneallowedbackends"},
+		description: "Comma-separated list of rclone backends, e.g. \"s3,local,sftp\". " +
+			"Initremote refuses a remote whose backend is not in the list. If empty, all backends are allowed.",
+		optional: true,
+	},
+	{
+		id:    configProgress,
+		names: []string{"rcloneprogress"},
+		description: "When \"yes\", store and retrieve render rclone's transfer progress on stderr. " +
+			"If empty, defaults to \"no\".",
+		defaultValue: "no",
+	},
+	{
+		id:    configCacheDir,
+		names: []string{"rclonecachedir"},
+		description: "Directory in which rclone keeps its cache, in the same format as rclone's --cache-dir flag. " +
+			"This is useful where the user cache directory is unavailable, e.g. in a container. " +
+			"The directory is created if needed and is not cleaned up when the session ends. If empty, rclone's default is used.",
+		optional: true,
+	},
+	{
+		id:    configPathSeparator,
+		names: []string{"rclonepathseparator"},
+		description: "Character that separates the directories that rclonelayout creates within rcloneprefix, e.g. \"\\\" for backends that expect Windows-style paths. " +
+			"The rcloneprefix itself is used as given. " +
+			fmt.Sprintf("If empty, defaults to %q.", defaultRclonePathSeparator),
+		defaultValue: defaultRclonePathSeparator,
+	},
+	{
+		id:    configObjectCache,
+		names: []string{"rcloneobjectcache"},
+		description: "When \"yes\", retrieve reads through rclone's cache backend, which keeps recently retrieved objects on local disk in the rclone cache directory. " +
+			"Store does not use the cache. Removed keys may still be served from the cache until it expires. If empty, defaults to \"no\".",
+		defaultValue: "no",
+	},
+	{
+		id:    configACL,
+		names: []string{"rcloneacl"},
+		description: "ACL to give stored objects, e.g. \"private\" or \"public-read\", overriding the \"acl\" option of the rclone remote. " +
+			"Only backends with an \"acl\" option, such as s3, use it. If empty, the remote's own setting applies.",
+		optional: true,
+	},
+	{
+		id:    configKMSKey,
+		names: []string{"rclonekmskey"},
+		description: "ARN or alias of the AWS KMS key with which s3 encrypts stored objects, overriding the \"sse_kms_key_id\" option of the rclone remote. " +
+			"Implies rcloneencryptiontype=aws:kms. If empty, the remote's own setting applies.",
+		optional: true,
+	},
+	{
+		id:    configEncryptionType,
+		names: []string{"rcloneencryptiontype"},
+		description: "Server-side encryption with which s3 stores objects, either \"aws:kms\" or \"AES256\", overriding the \"server_side_encryption\" option of the rclone remote. " +
+			"If empty, the remote's own setting applies.",
+		optional: true,
+	},
+	{
+		id:    configDebugHTTP,
+		names: []string{"rclonedebughttp"},
+		description: "When \"yes\", rclone logs the headers of every HTTP request and response at the DEBUG level, like its --dump headers flag, and raises the log level to DEBUG. " +
+			"Authorization headers are redacted. If empty, defaults to \"no\".",
+		defaultValue: "no",
+	},
+	{
+		id:    configResumeTransfer,
+		names: []string{"rcloneresumetransfer"},
+		description: "When \"yes\", an interrupted chunked store (see rclonechunksize) resumes from the last stored chunk, which is recorded in an object named KEY.partial. " +
+			"Unchunked stores start over, since most backends cannot append to an object. If empty, defaults to \"no\".",
+		defaultValue: "no",
+	},
+	{
+		id:    configStorageClass,
+		names: []string{"rclonestorageclass"},
+		description: "Storage class with which s3 stores objects, e.g. \"STANDARD\", \"GLACIER\", or \"INTELLIGENT_TIERING\", overriding the \"storage_class\" option of the rclone remote. " +
+			"If empty, the remote's own setting applies.",
+		optional: true,
+	},
+	{
+		id:    configRetrievalStorageClass,
+		names: []string{"rcloneretrievalstorageclass"},
+		description: "When set, each retrieval first asks s3 to restore the object from an archive storage class like GLACIER, with this priority: \"Standard\", \"Expedited\", or \"Bulk\". " +
+			"A retrieval fails until the restore is done. If empty, archived objects are not restored.",
+		optional: true,
+	},
+	{
+		id:    configPublicLinks,
+		names: []string{"rclonepubliclinks", "rclonepubliclink"},
+		description: "When \"yes\", \"git annex whereis\" shows a public link to each key, made like \"rclone link\", on backends that support them. " +
+			"Anyone with the link can download the key. If empty, defaults to \"no\".",
+		defaultValue: "no",
+	},
+	{
+		id:    configNamespace,
+		names: []string{"rclonenamespace"},
+		description: "Directory, e.g. \"team-a\", prepended to rcloneprefix to keep git-annex remotes that share an rclone remote apart. " +
+			"It may only contain letters, digits, \"_\", and \"-\". If empty, no directory is prepended.",
+		optional: true,
+	},
+	{
+		id:    configTemporaryPrefix,
+		names: []string{"rclonetemporaryprefix"},
+		description: "Directory, e.g. \"git-annex-tmp\", in which each key is uploaded before it is moved into rcloneprefix, so that a key is never seen half-written. " +
+			"It must differ from rcloneprefix. Chunked uploads (see rclonechunksize) do not use it. If empty, keys are uploaded in place.",
+		optional: true,
+	},
+	{
+		id:    configObjectLocking,
+		names: []string{"rcloneobjectlocking"},
+		description: "When \"yes\", each key stored on s3 is locked with Object Lock in COMPLIANCE mode for rcloneobjectlockretention, and REMOVE fails. " +
+			"The bucket must have Object Lock enabled, and remotes of other backends are rejected. If empty, defaults to \"no\".",
+		defaultValue: "no",
+	},
+	{
+		id:           configObjectLockRetention,
+		names:        []string{"rcloneobjectlockretention"},
+		description:  "How long, e.g. \"30d\", each key stays locked when rcloneobjectlocking is enabled. If empty, defaults to \"365d\".",
+		defaultValue: "365d",
+	},
+	{
+		id:    configCompress,
+		names: []string{"rclonecompress"},
+		description: "When \"yes\", objects are gzipped before upload with rclone's compress backend, which changes their names on the remote. " +
+			"Objects that do not compress well are stored as they are. If empty, defaults to \"no\".",
+		defaultValue: "no",
+	},
+	{
+		id:           configCompressLevel,
+		names:        []string{"rclonecompresslevel"},
+		description:  "Gzip level, from -2 to 9, with which rclonecompress compresses objects. If empty, defaults to \"6\".",
+		defaultValue: "6",
+	},
+	{
+		id:    configSnapshotPrefix,
+		names: []string{"rclonesnapshotprefix"},
+		description: "Directory, e.g. \"snap/2024-01-01\", to which keys are stored instead of rcloneprefix. Keys are still found in rcloneprefix and in every other snapshot in the same parent directory, " +
+			"but REMOVE only deletes them from rcloneprefix, so snapshots are never changed. If empty, keys are stored in rcloneprefix.",
+		optional: true,
+	},
+	{
+		id:    configBandwidthSchedule,
+		names: []string{"rclonebandwidthschedule"},
+		description: "Path to a file holding a bandwidth timetable in the format of rclone's --bwlimit flag, e.g. \"08:00,1M 00:00,off\". " +
+			"The limit is updated before each transfer and removed when the session ends. It cannot be combined with rclonebwlimit. If empty, there is no schedule.",
+		optional: true,
+	},
+	{
+		id:    configAllowFail,
+		names: []string{"rcloneallowfail"},
+		description: "When \"yes\", a STORE or RETRIEVE that fails with a transient error, e.g. a network failure, is still reported as a failure, but does not end the session, " +
+			"so git-annex can go on with other keys and remotes. If empty, defaults to \"no\".",
+		defaultValue: "no",
+	},
+	{
+		id:    configWarmCache,
+		names: []string{"rclonewarmcache"},
+		description: "When \"yes\", PREPARE starts listing every object in rcloneprefix in the background, and CHECKPRESENT answers from that listing for the keys it found. " +
+			"This helps when listing is faster than looking up many keys one by one. If empty, defaults to \"no\".",
+		defaultValue: "no",
+	},
+	{
+		id:    configOverwriteExisting,
+		names: []string{"rcloneoverwriteexisting"},
+		description: "When \"no\", STORE reports success without uploading when an object named after the key already exists, e.g. on append-only storage. " +
+			"If empty, defaults to \"yes\", which overwrites the object.",
+		defaultValue: "yes",
+	},
+	{
+		id:    configIgnoreCase,
+		names: []string{"rcloneignorecase"},
+		description: "When \"yes\", CHECKPRESENT also accepts an object whose name differs from the key only in case, as on some Windows remotes. " +
+			"Each such check lists the key's directory. If empty, defaults to \"no\".",
+		defaultValue: "no",
+	},
+	{
+		id:    configRetryDelay,
+		names: []string{"rcloneretrydelay"},
+		description: "How long to wait before retrying a transfer that failed with a transient error, doubled after each attempt, up to rclone's --retries attempts. " +
+			fmt.Sprintf("If empty, defaults to %q.", defaultRetryDelay),
+		defaultValue: defaultRetryDelay,
+	},
+	{
+		id:           configRetryMaxDelay,
+		names:        []string{"rcloneretrymaxdelay"},
+		description:  fmt.Sprintf("The longest wait between retries of a transfer. If empty, defaults to %q.", defaultRetryMaxDelay),
+		defaultValue: defaultRetryMaxDelay,
+	},
+	{
+		id:    configSHA256Verify,
+		names: []string{"rclonesha256verify"},
+		description: "When \"yes\", RETRIEVE checks that the SHA-256 hash of a retrieved SHA256 or SHA256E key matches the hash in the key, and deletes the file if not. " +
+			"Keys of other types are not checked. If empty, defaults to \"no\".",
+		defaultValue: "no",
+	},
+	{
+		id:    configLockFile,
+		names: []string{"rclonelockfile"},
+		description: "Path of a local file to lock while initializing the remote, so that processes sharing it do not race. " +
+			"INITREMOTE takes an exclusive lock, and transfers a shared one. Ignored on Windows. If empty, nothing is locked.",
+		optional: true,
+	},
+	{
+		id:    configPiggybackConfig,
+		names: []string{"rclonepiggybackconfig"},
+		description: "Path of an rclone config file whose remotes are used in addition to those in rclone's own config file, e.g. one committed alongside the repo. " +
+			"Its remotes win over those with the same names. If empty, only rclone's own config file is used.",
+		optional: true,
+	},
+	{
+		id:    configCheckInterval,
+		names: []string{"rclonecheckinterval"},
+		description: "How often to check, in the background, that a sample of 1% of the recently transferred keys is still present, e.g. \"1h\". " +
+			"A key that has gone missing is reported with an INFO message. If empty, no checks are made.",
+		optional: true,
+	},
+	{
+		id:    configObjectPrefix,
+		names: []string{"rcloneobjectprefix"},
+		description: "Directory inserted between the directories of rclonelayout and each key, e.g. \"objects\" stores keys as rcloneprefix/f87/4d1/objects/KEY. " +
+			"It must be a relative path without \"..\". If empty, keys are stored directly in the layout's directories.",
+		optional: true,
+	},
+	{
+		id:    configFilterFlags,
+		names: []string{"rclonefilterflags"},
+		description: "Rclone filter flags, e.g. \"--exclude=*.DS_Store --exclude .metadata\", that hide objects from listings of rcloneprefix. " +
+			"Only --filter, --include, --exclude, their -from variants, and --ignore-case are accepted. Keys are still found by name.",
+		optional: true,
+	},
+	{
+		id:    configCopyFlag,
+		names: []string{"rclonecopyflag"},
+		description: "Rclone flags, e.g. \"--ignore-checksum --multi-thread-streams=0\", that apply to each TRANSFER. " +
+			"Any of rclone's global flags is accepted except --dry-run and --interactive.",
+		optional: true,
+	},
+	{
+		id:    configPrefixCreateOnPrepare,
+		names: []string{"rcloneprefixcreateonprepare"},
+		description: "When \"yes\", prepare creates the rcloneprefix directory if it does not exist. " +
+			"Set to \"no\" for read-only remotes, where creating a directory would fail; the first store then creates it. If empty, defaults to \"yes\".",
+		defaultValue: "yes",
+	},
+	{
+		id:    configTagging,
+		names: []string{"rclonetagging"},
+		description: "A JSON object of tags to apply to each stored key, e.g. {\"project\":\"annex\",\"env\":\"prod\"}. " +
+			"Only s3 remotes support tags. Stored keys are tagged once, and retrieving or removing them does not change their tags.",
+		optional: true,
+	},
+	{
+		id:    configVerifySize,
+		names: []string{"rcloneverifysize"},
+		description: "When \"yes\", each stored object's size is compared with the local file's, and the object is removed when they differ. " +
+			"This catches truncated uploads on remotes that cannot report a checksum. If empty, defaults to \"no\".",
+		defaultValue: "no",
+	},
+	{
+		id:    configGzip,
+		names: []string{"rclonegzip"},
+		description: "When \"yes\", each key is gzipped before upload and gunzipped on retrieval, under its own name and without the compress backend's metadata. " +
+			"A remote must always be used with the same setting. Keys stored in chunks are not gzipped. If empty, defaults to \"no\".",
+		defaultValue: "no",
+	},
+	{
+		id:           configGzipLevel,
+		names:        []string{"rclonegziplevel"},
+		description:  "The gzip level, from 1 to 9, used when rclonegzip is enabled. If empty, defaults to \"6\".",
+		defaultValue: "6",
+	},
+	{
+		id:    configFailOnAbsent,
+		names: []string{"rclonefailonabsent"},
+		description: "When \"yes\", once a key to retrieve is missing, every later transfer in the same session fails too, " +
+			"so that e.g. a restore stops rather than skipping missing content. If empty, defaults to \"no\".",
+		defaultValue: "no",
+	},
+	{
+		id:    configConnectionsPerServer,
+		names: []string{"rcloneconnectionsperserver"},
+		description: "The maximum number of simultaneous connections to the remote, for servers that allow only a few. " +
+			"Only the sftp and ftp backends support this; others ignore it with a warning. If empty, the backend's default applies.",
+		optional: true,
+	},
+	{
+		id:    configCopyBuffer,
+		names: []string{"rclonecopybuffer"},
+		description: "The size of the buffer, e.g. \"16M\", through which chunked and gzipped keys are copied, from 4K to 1G. " +
+			"Larger buffers make fewer, larger reads, which suits high-latency object storage. If empty, defaults to \"16M\".",
+		defaultValue: "16M",
 	},
 }
 
+// sanitizeGitRemoteName makes the name of a git remote safe to use as a single
+// path component by replacing whitespace and path separators with underscores.
+func sanitizeGitRemoteName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) || r == '/' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// parseBoolConfig parses a boolean config such as "rcloneskipconnecttest". Like
+// git-annex's own boolean configs, it accepts "yes" and "no", as well as the
+// values understood by [strconv.ParseBool].
+func parseBoolConfig(name, value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "yes":
+		return true, nil
+	case "no", "":
+		return false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse %s %q: must be \"yes\" or \"no\"", name, value)
+	}
+	return b, nil
+}
+
+// parsePathSeparator parses the "rclonepathseparator" config, which must be a
+// single character other than ":". An empty value means "/".
+func parsePathSeparator(value string) (string, error) {
+	if value == "" {
+		return defaultRclonePathSeparator, nil
+	}
+	if utf8.RuneCountInString(value) != 1 || value == ":" {
+		return "", fmt.Errorf("path separator must be a single character other than \":\": %q", value)
+	}
+	return value, nil
+}
+
+// parseServerSideEncryption validates the "rcloneencryptiontype" and
+// "rclonekmskey" configs and returns the server-side encryption to request,
+// which is "aws:kms" when only a KMS key is given.
+func parseServerSideEncryption(encryptionType, kmsKey string) (string, error) {
+	switch encryptionType {
+	case "":
+		if kmsKey != "" {
+			return "aws:kms", nil
+		}
+		return "", nil
+	case "aws:kms":
+		return encryptionType, nil
+	case "AES256":
+		if kmsKey != "" {
+			return "", fmt.Errorf("encryption type %q cannot use a KMS key", encryptionType)
+		}
+		return encryptionType, nil
+	}
+	return "", fmt.Errorf("encryption type must be \"aws:kms\" or \"AES256\": %q", encryptionType)
+}
+
+// namespaceRegexp matches the values allowed for the "rclonenamespace" config.
+var namespaceRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// parseNamespace validates the "rclonenamespace" config, which may be empty.
+func parseNamespace(value string) (string, error) {
+	if value != "" && !namespaceRegexp.MatchString(value) {
+		return "", fmt.Errorf("namespace may only contain letters, digits, \"_\", and \"-\": %q", value)
+	}
+	return value, nil
+}
+
+// validateTemporaryPrefix checks that the "rclonetemporaryprefix" config,
+// if set, names a different directory than the "rcloneprefix" config.
+func validateTemporaryPrefix(temporaryPrefix, prefix string) error {
+	if temporaryPrefix == "" {
+		return nil
+	}
+	if path.Clean("/"+temporaryPrefix) == path.Clean("/"+prefix) {
+		return fmt.Errorf("temporary prefix must differ from prefix: %q", temporaryPrefix)
+	}
+	return nil
+}
+
+// parseRestoreTier validates the "rcloneretrievalstorageclass" config, which is
+// the priority with which s3 restores archived objects.
+func parseRestoreTier(value string) (string, error) {
+	switch value {
+	case "", "Standard", "Expedited", "Bulk":
+		return value, nil
+	}
+	return "", fmt.Errorf("retrieval storage class must be \"Standard\", \"Expedited\", or \"Bulk\": %q", value)
+}
+
+// parseSizeConfig parses a size config such as "rclonechunksize", e.g. "100M".
+// Plain numbers are interpreted as KiB, like rclone's size flags. A size of zero
+// means the feature controlled by the config is disabled.
+func parseSizeConfig(name, value string) (int64, error) {
+	var size fs.SizeSuffix
+	if value == "" {
+		return 0, nil
+	}
+	if err := size.Set(value); err != nil {
+		return 0, fmt.Errorf("failed to parse %s %q: %w", name, value, err)
+	}
+	if size < 0 {
+		return 0, fmt.Errorf("%s must not be negative: %q", name, value)
+	}
+	return int64(size), nil
+}
+
 func (c *configDefinition) getCanonicalName() string {
 	if len(c.names) < 1 {
 		panic(fmt.Errorf("configDefinition must have at least one name: %v", c))
@@ -78,6 +665,14 @@ func (c *configDefinition) fullDescription() string {
 	return fmt.Sprintf("(synonyms: %s) %s", commaSeparatedSynonyms, c.description)
 }
 
+// definedByEnv reports whether the remote `name` is defined by
+// RCLONE_CONFIG_* environment variables, e.g. by [loadPiggybackConfig].
+// [config.GetRemoteNames] lists such remotes in lowercase, so it misses them
+// when `name` is not.
+func definedByEnv(name string) bool {
+	return os.Getenv(fs.ConfigToEnv(name, "type")) != ""
+}
+
 // validateRemoteName validates the "rcloneremotename" config that we receive
 // from git-annex. It returns nil iff `value` is valid. Otherwise, it returns a
 // descriptive error suitable for sending back to git-annex via stdout.
@@ -85,8 +680,9 @@ func (c *configDefinition) fullDescription() string {
 // The value is only valid when:
 //  1. It is the exact name of an existing remote.
 //  2. It is an fspath string that names an existing remote or a backend. The
-//     string may include options, but it must not include a path. (That's what
-//     the "rcloneprefix" config is for.)
+//     string may include options, e.g. ":s3,provider=AWS,env_auth=true:", but
+//     it must not include a path. (That's what the "rcloneprefix" config is
+//     for.)
 //
 // While backends are not remote names, per se, they are permitted for
 // compatibility with [fstest]. We could guard this behavior behind
@@ -100,7 +696,7 @@ func validateRemoteName(value string) error {
 	// we would incorrectly identify file names as valid remote names. We also
 	// avoid [config.FileSections] because it will miss remotes that are defined
 	// by environment variables.
-	if slices.Contains(remoteNames, value) {
+	if slices.Contains(remoteNames, value) || definedByEnv(value) {
 		return nil
 	}
 	parsed, err := fspath.Parse(value)
@@ -113,7 +709,7 @@ func validateRemoteName(value string) error {
 	// Now that we've established `value` is an fspath string that does not
 	// include a path component, we only need to check whether it names an
 	// existing remote or backend.
-	if slices.Contains(remoteNames, parsed.Name) {
+	if slices.Contains(remoteNames, parsed.Name) || definedByEnv(parsed.Name) {
 		return nil
 	}
 	maybeBackend := strings.HasPrefix(value, ":")
@@ -121,11 +717,38 @@ func validateRemoteName(value string) error {
 		return fmt.Errorf("remote does not exist: %s", value)
 	}
 	// Strip the leading colon before searching for the backend. For instance,
-	// search for "local" instead of ":local". Note that `parsed.Name` already
-	// omits any config options baked into the string.
+	// search for "local" instead of ":local". The value may be a connection
+	// string like ":s3,provider=AWS,env_auth=true:", so we also discard
+	// everything from the first comma onward. (`parsed.Name` should already omit
+	// any config options baked into the string, but splitting here means we
+	// never pass an option to [fs.Find].)
 	trimmedBackendName := strings.TrimPrefix(parsed.Name, ":")
+	trimmedBackendName, _, _ = strings.Cut(trimmedBackendName, ",")
 	if _, err = fs.Find(trimmedBackendName); err != nil {
 		return fmt.Errorf("backend does not exist: %s", trimmedBackendName)
 	}
 	return nil
 }
+
+// validateAllowedBackend checks the backend of `remoteName`, e.g. "s3" for a
+// remote of type s3, against the "rcloneallowedbackends" config, a
+// comma-separated list of backend names. An empty list allows all backends.
+func validateAllowedBackend(remoteName, allowedBackends string) error {
+	var allowed []string
+	for _, backend := range strings.Split(allowedBackends, ",") {
+		if backend = strings.TrimSpace(backend); backend != "" {
+			allowed = append(allowed, backend)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil
+	}
+	fsInfo, _, _, _, err := fs.ParseRemote(remoteName)
+	if err != nil {
+		return fmt.Errorf("failed to find backend of %s: %w", remoteName, err)
+	}
+	if !slices.Contains(allowed, fsInfo.Name) {
+		return fmt.Errorf("backend not in rcloneallowedbackends: %s", fsInfo.Name)
+	}
+	return nil
+}
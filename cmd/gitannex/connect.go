@@ -0,0 +1,92 @@
+package gitannex
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/rclone/rclone/fs/cache"
+	"github.com/rclone/rclone/fs/operations"
+)
+
+// connectTestFileName is the name of the file, relative to the "rcloneprefix"
+// directory, that the connection test writes and then deletes.
+const connectTestFileName = ".rclone-gitannex-init"
+
+// testConnection checks that the "rcloneprefix" directory is writable by
+// creating it, uploading an empty file, reading the file back, and deleting it.
+func (s *server) testConnection(ctx context.Context) error {
+	if s.dryRun {
+		s.sendInfo("[dry-run] skipping connection test")
+		return nil
+	}
+	prefixFs, err := s.getPrefixFs(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get remote fs: %w", err)
+	}
+	if err := prefixFs.Mkdir(ctx, ""); err != nil {
+		return fmt.Errorf("failed to create prefix directory: %w", err)
+	}
+	in := io.NopCloser(bytes.NewReader(nil))
+	obj, err := operations.RcatSize(ctx, prefixFs, connectTestFileName, in, 0, time.Now(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %w", connectTestFileName, err)
+	}
+	data, err := operations.ReadFile(ctx, obj)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", connectTestFileName, err)
+	}
+	if len(data) != 0 {
+		return fmt.Errorf("read %d bytes from empty file %s", len(data), connectTestFileName)
+	}
+	if err := operations.DeleteFile(ctx, obj); err != nil {
+		return fmt.Errorf("failed to delete %s: %w", connectTestFileName, err)
+	}
+	return nil
+}
+
+// standaloneRemoteEnvVar names the environment variable that gives the remote
+// for --health-check and --migrate-layout when --remote-override is not set.
+const standaloneRemoteEnvVar = "RCLONE_GITANNEX_REMOTE"
+
+// standaloneRemote returns the remote that --health-check and --migrate-layout
+// operate on.
+func standaloneRemote() string {
+	if remoteOverride != "" {
+		return remoteOverride
+	}
+	return os.Getenv(standaloneRemoteEnvVar)
+}
+
+// runHealthCheck checks that `remote` is reachable by listing its root
+// directory, without talking to git-annex. It prints "OK" or "ERROR: <reason>"
+// to `out` and returns the exit code for the process.
+func runHealthCheck(ctx context.Context, out io.Writer, remote string) (exitCode int) {
+	err := checkRemoteHealth(ctx, remote)
+	if err != nil {
+		_, _ = fmt.Fprintf(out, "ERROR: %v\n", err)
+		return 1
+	}
+	_, _ = fmt.Fprintln(out, "OK")
+	return 0
+}
+
+// checkRemoteHealth returns an error if the root directory of `remote` cannot
+// be listed.
+func checkRemoteHealth(ctx context.Context, remote string) error {
+	if remote == "" {
+		return errors.New("no remote given: use --remote-override or " + standaloneRemoteEnvVar)
+	}
+	remoteFs, err := cache.Get(ctx, remote)
+	if err != nil {
+		return fmt.Errorf("failed to get remote fs: %w", err)
+	}
+	if _, err := remoteFs.List(ctx, ""); err != nil {
+		return fmt.Errorf("failed to list remote: %w", err)
+	}
+	return nil
+}
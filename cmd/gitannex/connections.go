@@ -0,0 +1,66 @@
+package gitannex
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// connectionsOptions maps backends that can limit their simultaneous
+// connections to the backend option that does so.
+var connectionsOptions = map[string]string{
+	"ftp":  "concurrency",
+	"sftp": "connections",
+}
+
+// parseConnectionsPerServer parses the "rcloneconnectionsperserver" config. It
+// returns 0 when the config is empty, which leaves the backend's default.
+func parseConnectionsPerServer(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	connections, err := strconv.Atoi(value)
+	if err != nil || connections <= 0 {
+		return 0, fmt.Errorf("connections per server must be a positive integer: %q", value)
+	}
+	return connections, nil
+}
+
+// connectionsOption returns the backend option of `remoteName` that limits its
+// simultaneous connections to the "rcloneconnectionsperserver" config. It
+// returns false when the config is empty, or when the backend has no such
+// option or cannot be found.
+func (s *server) connectionsOption(remoteName string) (backendOption, bool) {
+	cfg, err := s.getSessionConfig()
+	if err != nil || cfg.connectionsPerServer == 0 {
+		return backendOption{}, false
+	}
+	fsInfo, _, _, _, err := fs.ParseRemote(remoteName)
+	if err != nil {
+		return backendOption{}, false
+	}
+	name, ok := connectionsOptions[fsInfo.Name]
+	if !ok {
+		return backendOption{}, false
+	}
+	return backendOption{name, strconv.Itoa(cfg.connectionsPerServer)}, true
+}
+
+// warnUnsupportedConnections tells the user when the
+// "rcloneconnectionsperserver" config is set, but the backend of the
+// "rcloneremotename" config cannot limit its connections. The config is then
+// ignored rather than failing.
+func (s *server) warnUnsupportedConnections() {
+	if s.configRcloneConnectionsPerServer == "" {
+		return
+	}
+	if _, ok := s.connectionsOption(s.configRcloneRemoteName); ok {
+		return
+	}
+	fsInfo, _, _, _, err := fs.ParseRemote(s.configRcloneRemoteName)
+	if err != nil {
+		return
+	}
+	s.sendInfo(fmt.Sprintf("rcloneconnectionsperserver is not supported by the %s backend; ignoring it", fsInfo.Name))
+}
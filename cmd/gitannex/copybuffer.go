@@ -0,0 +1,38 @@
+package gitannex
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/rclone/rclone/fs"
+)
+
+const (
+	defaultCopyBufferSize = 16 * fs.Mebi
+	minCopyBufferSize     = 4 * fs.Kibi
+	maxCopyBufferSize     = fs.Gibi
+)
+
+// parseCopyBufferSize parses the "rclonecopybuffer" config, e.g. "16M", into
+// the size of the buffer through which streaming transfers copy. An empty
+// value yields the default.
+func parseCopyBufferSize(value string) (int, error) {
+	if value == "" {
+		return int(defaultCopyBufferSize), nil
+	}
+	var size fs.SizeSuffix
+	if err := size.Set(value); err != nil {
+		return 0, fmt.Errorf("failed to parse copy buffer %q: %w", value, err)
+	}
+	if size < minCopyBufferSize || size > maxCopyBufferSize {
+		return 0, fmt.Errorf("copy buffer must be from %v to %v: %q", minCopyBufferSize, maxCopyBufferSize, value)
+	}
+	return int(size), nil
+}
+
+// copyWithBuffer copies from `src` to `dst` through `buf`. Unlike
+// [io.CopyBuffer], it always uses the buffer: an *os.File would otherwise
+// take over the copy with its ReadFrom method, which reads 32 KiB at a time.
+func copyWithBuffer(dst io.Writer, src io.Reader, buf []byte) (int64, error) {
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, buf)
+}
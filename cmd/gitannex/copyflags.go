@@ -0,0 +1,72 @@
+package gitannex
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/config/configmap"
+	"github.com/rclone/rclone/fs/config/configstruct"
+)
+
+// forbiddenCopyFlags are the options, named as in [fs.ConfigOptionsInfo], that
+// the "rclonecopyflag" config must not set, because git-annex would be told
+// that transfers succeeded that never happened, or the command would wait for
+// input that git-annex never sends.
+var forbiddenCopyFlags = []string{"dry_run", "interactive"}
+
+// parseCopyFlags parses the "rclonecopyflag" config, e.g. "--ignore-checksum
+// --transfers=2", into rclone's global options, keyed by their names in
+// [fs.ConfigOptionsInfo]. Boolean flags may omit their value, and other flags
+// may give it as the next argument.
+func parseCopyFlags(value string) (configmap.Simple, error) {
+	args := strings.Fields(value)
+	flags := configmap.Simple{}
+	for i := 0; i < len(args); i++ {
+		arg, ok := strings.CutPrefix(args[i], "--")
+		if !ok || arg == "" {
+			return nil, fmt.Errorf("copy flag must start with \"--\": %q", args[i])
+		}
+		flagName, flagValue, hasValue := strings.Cut(arg, "=")
+		name := strings.ReplaceAll(flagName, "-", "_")
+		opt := fs.ConfigOptionsInfo.Get(name)
+		if opt == nil {
+			return nil, fmt.Errorf("unknown copy flag: --%s", flagName)
+		}
+		if slices.Contains(forbiddenCopyFlags, name) {
+			return nil, fmt.Errorf("copy flag is not allowed: --%s", flagName)
+		}
+		if !hasValue {
+			if _, isBool := opt.Default.(bool); isBool {
+				flagValue = "true"
+			} else if i+1 < len(args) {
+				i++
+				flagValue = args[i]
+			} else {
+				return nil, fmt.Errorf("copy flag needs a value: --%s", flagName)
+			}
+		}
+		flags[name] = flagValue
+	}
+	// Catch values of the wrong type now rather than in the middle of a
+	// transfer.
+	if _, err := withCopyFlags(context.Background(), flags); err != nil {
+		return nil, err
+	}
+	return flags, nil
+}
+
+// withCopyFlags returns a copy of `ctx` whose rclone config has the options
+// from [parseCopyFlags] set.
+func withCopyFlags(ctx context.Context, flags configmap.Simple) (context.Context, error) {
+	if len(flags) == 0 {
+		return ctx, nil
+	}
+	ctx, ci := fs.AddConfig(ctx)
+	if err := configstruct.Set(flags, ci); err != nil {
+		return nil, fmt.Errorf("failed to apply copy flags: %w", err)
+	}
+	return ctx, nil
+}
@@ -0,0 +1,49 @@
+package gitannex
+
+import (
+	"github.com/rclone/rclone/fs"
+)
+
+// Costs that git-annex uses to decide which remote to try first. The names and
+// values of the first three follow git-annex's Config/Cost.hs.
+const (
+	cheapRemoteCost       = 100
+	nearlyCheapRemoteCost = 110
+	expensiveRemoteCost   = 200
+	// For backends that are slower than most cloud services, e.g. because
+	// they cannot transfer over more than one connection.
+	slowRemoteCost = 300
+)
+
+// backendCosts maps rclone backend names to their costs. Backends that are not
+// listed cost [expensiveRemoteCost].
+var backendCosts = map[string]int{
+	"local":   cheapRemoteCost,
+	"sftp":    nearlyCheapRemoteCost,
+	"s3":      expensiveRemoteCost,
+	"drive":   expensiveRemoteCost,
+	"dropbox": expensiveRemoteCost,
+	"ftp":     slowRemoteCost,
+}
+
+// defaultCostForBackend returns the cost of a remote of the rclone backend
+// named `name`, e.g. "s3".
+func defaultCostForBackend(name string) int {
+	if cost, ok := backendCosts[name]; ok {
+		return cost
+	}
+	return expensiveRemoteCost
+}
+
+// cost returns the cost of this remote. Git-annex may ask before the configs
+// are known, in which case we assume an expensive remote.
+func (s *server) cost() int {
+	if !s.configsDone {
+		return expensiveRemoteCost
+	}
+	fsInfo, _, _, _, err := fs.ParseRemote(s.configRcloneRemoteName)
+	if err != nil {
+		return expensiveRemoteCost
+	}
+	return defaultCostForBackend(fsInfo.Name)
+}
@@ -0,0 +1,104 @@
+package gitannex
+
+import (
+	"fmt"
+	"strings"
+
+	// The "rcloneencrypt" config wraps the remote in a crypt remote, so the
+	// crypt backend must be registered even if no other code imports it.
+	_ "github.com/rclone/rclone/backend/crypt"
+
+	"github.com/rclone/rclone/fs/config/obscure"
+	"github.com/rclone/rclone/fs/fspath"
+)
+
+// encryptPasswordInCreds is the value that the "rcloneencrypt" config keeps in
+// the git-annex branch once its password has been moved to git-annex's creds.
+const encryptPasswordInCreds = "creds"
+
+// encryptCredsUser is the user sent with the "rcloneencrypt" creds. Crypt
+// remotes only need the password.
+const encryptCredsUser = "rclone"
+
+// queryEncryptPassword sends "GETCREDS rcloneencrypt" and returns the password
+// of git-annex's "CREDS" reply, which is empty when it has no creds.
+func (s *server) queryEncryptPassword() (string, error) {
+	s.sendMsg("GETCREDS rcloneencrypt")
+	message, err := s.getReply()
+	if err != nil {
+		return "", err
+	}
+	keyword, err := message.nextSpaceDelimitedParameter()
+	if err != nil || keyword != "CREDS" {
+		return "", &ErrProtocolParse{protocolError(codeError, fmt.Errorf("failed to parse creds: %s %s", keyword, message.line))}
+	}
+	// Skip the user, which may be empty when there are no creds.
+	_, password, _ := strings.Cut(strings.TrimRight(message.line, "\r\n"), " ")
+	return password, nil
+}
+
+// storeEncryptPassword moves a password given in the "rcloneencrypt" config to
+// git-annex's creds, which are kept in the local repository rather than in the
+// git-annex branch, and leaves [encryptPasswordInCreds] in its place.
+func (s *server) storeEncryptPassword() {
+	if !s.encryptPasswordInConfig {
+		return
+	}
+	s.sendMsg(fmt.Sprintf("SETCREDS rcloneencrypt %s %s", encryptCredsUser, s.configRcloneEncrypt))
+	s.sendMsg("SETCONFIG rcloneencrypt " + encryptPasswordInCreds)
+}
+
+// quoteConfigValue quotes `value` for use in a connection string, e.g.
+// ":crypt,remote='value':". Quotes within the value are escaped by doubling
+// them.
+func quoteConfigValue(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// fsRemoteAndPrefix returns the remote name and prefix from which to build fs
+// strings for objects under `prefix`. When the "rcloneencrypt" config is set,
+// the remote name is a crypt connection string wrapping the prefix directory,
+// so both the names and the contents of stored objects are encrypted. When
+// the "rclonecompress" config is enabled, it is likewise wrapped in a compress
+// connection string. The
+// prefix lies within the "rclonenamespace" directory; see
+// [server.namespacedPrefix].
+func (s *server) fsRemoteAndPrefix(prefix string) (string, string, error) {
+	return s.wrapRemoteAndPrefix(s.configRcloneRemoteName, prefix)
+}
+
+// wrapRemoteAndPrefix is like [server.fsRemoteAndPrefix], but wraps the given
+// remote name rather than the "rcloneremotename" config.
+func (s *server) wrapRemoteAndPrefix(remoteName, prefix string) (string, string, error) {
+	prefix = s.namespacedPrefix(prefix)
+	// The connection limit belongs to the remote that makes the connections,
+	// so it goes on before any wrapping.
+	if option, ok := s.connectionsOption(remoteName); ok {
+		remoteName = remoteWithOption(remoteName, option.name, option.value)
+	}
+	if s.configRcloneEncrypt != "" {
+		var err error
+		// Obscuring is randomized, so do it only once. Otherwise, every lookup
+		// would build a different fs string and miss the cache.
+		if s.obscuredEncryptPassword == "" {
+			s.obscuredEncryptPassword, err = obscure.Obscure(s.configRcloneEncrypt)
+			if err != nil {
+				return "", "", fmt.Errorf("failed to obscure encryption password: %w", err)
+			}
+		}
+		wrappedRemote := fspath.JoinRootPath(strings.TrimSuffix(remoteName, ":")+":", prefix)
+		remoteName = fmt.Sprintf(":crypt,remote=%s,password=%s:", quoteConfigValue(wrappedRemote), s.obscuredEncryptPassword)
+		prefix = ""
+	}
+	cfg, err := s.getSessionConfig()
+	if err != nil {
+		return "", "", err
+	}
+	// Compression wraps encryption, since encrypted data does not compress.
+	if cfg.compress {
+		wrappedRemote := fspath.JoinRootPath(strings.TrimSuffix(remoteName, ":")+":", prefix)
+		remoteName = fmt.Sprintf(":compress,remote=%s,level=%d:", quoteConfigValue(wrappedRemote), cfg.compressLevel)
+		prefix = ""
+	}
+	return remoteName, prefix, nil
+}
@@ -54,6 +54,8 @@ func checkRcloneBinaryVersion(t *testing.T) error {
 
 // countFilesRecursively returns the number of files nested underneath `dir`. It
 // counts files only and excludes directories.
+// countFilesRecursively counts the files in `dir`, excluding the UUID record
+// written by INITREMOTE.
 func countFilesRecursively(t *testing.T, dir string) int {
 	remoteFiles, err := os.ReadDir(dir)
 	require.NoError(t, err)
@@ -63,7 +65,7 @@ func countFilesRecursively(t *testing.T, dir string) int {
 		if f.IsDir() {
 			subdir := filepath.Join(dir, f.Name())
 			count += countFilesRecursively(t, subdir)
-		} else {
+		} else if f.Name() != uuidFileName {
 			count++
 		}
 	}
@@ -257,7 +259,7 @@ func TestEndToEndMigration(t *testing.T) {
 		t.Skipf("Skipping because git-annex-remote-rclone was not found: %s", err)
 	}
 
-	for _, mode := range allLayoutModes() {
+	for _, mode := range compatLayoutModes() {
 		mode := mode
 		t.Run(string(mode), func(t *testing.T) {
 			t.Parallel()
@@ -317,7 +319,7 @@ func TestEndToEndRepoLayoutCompat(t *testing.T) {
 		t.Skipf("Skipping because git-annex-remote-rclone was not found: %s", err)
 	}
 
-	for _, mode := range allLayoutModes() {
+	for _, mode := range compatLayoutModes() {
 		mode := mode
 		t.Run(string(mode), func(t *testing.T) {
 			t.Parallel()
@@ -400,3 +402,100 @@ func TestEndToEndRepoLayoutCompat(t *testing.T) {
 		})
 	}
 }
+
+// TestIntegrationWithRealGitAnnex drives the gitannex command through a real
+// git-annex binary, exercising one file's full lifecycle on a ":local:"
+// backend. Because it is slower than the other end-to-end tests, it only runs
+// when RCLONE_TEST_GITANNEX_INTEGRATION=1.
+func TestIntegrationWithRealGitAnnex(t *testing.T) {
+	if os.Getenv("RCLONE_TEST_GITANNEX_INTEGRATION") != "1" {
+		t.Skip("Skipping because RCLONE_TEST_GITANNEX_INTEGRATION is not set to 1.")
+	}
+	skipE2eTestIfNecessary(t)
+
+	tc := makeE2eTestingContext(t)
+	tc.installRcloneGitannexSymlink(t)
+	tc.createGitRepo(t)
+
+	remoteStorage := filepath.Join(tc.tempDir, "remoteStorage")
+	require.NoError(t, os.Mkdir(remoteStorage, 0700))
+
+	tc.runInRepo(t,
+		"git", "annex", "initremote", "MyRemote",
+		"type=external", "externaltype=rclone-builtin", "encryption=none",
+		"rcloneremotename=:local:",
+		"rcloneprefix="+remoteStorage)
+
+	fooFileContents := []byte("integration test contents")
+	fooFilePath := filepath.Join(tc.ephemeralRepoDir, "foo")
+	require.NoError(t, os.WriteFile(fooFilePath, fooFileContents, 0600))
+	tc.runInRepo(t, "git", "annex", "add", "foo")
+	tc.runInRepo(t, "git", "commit", "-m", "Add foo file")
+	// Git-annex objects are not writable, which prevents `testing` from
+	// cleaning up the temp directory. We can work around this by explicitly
+	// dropping any files we add to the annex.
+	t.Cleanup(func() { tc.runInRepo(t, "git", "annex", "drop", "--force", "foo") })
+
+	// Store the file and verify that it is present.
+	tc.runInRepo(t, "git", "annex", "copy", "--to=MyRemote", "foo")
+	require.Equal(t, 1, countFilesRecursively(t, remoteStorage))
+	require.True(t, findFileWithContents(t, remoteStorage, fooFileContents))
+	tc.runInRepo(t, "git", "annex", "fsck", "--fast", "--from=MyRemote", "foo")
+
+	// Drop the local copy and retrieve it from the remote.
+	tc.runInRepo(t, "git", "annex", "drop", "--force", "foo")
+	tc.runInRepo(t, "git", "annex", "get", "--from=MyRemote", "foo")
+	gotContents, err := os.ReadFile(fooFilePath)
+	require.NoError(t, err)
+	require.Equal(t, fooFileContents, gotContents)
+
+	// Remove the file from the remote.
+	tc.runInRepo(t, "git", "annex", "drop", "--from=MyRemote", "--force", "foo")
+	require.Equal(t, 0, countFilesRecursively(t, remoteStorage))
+}
+
+// TestIntegrationAnnexObjectsLayoutMatchesGitAnnex checks that the
+// "annexobjects" layout puts an object at the same relative path as git-annex
+// puts it in .git/annex/objects.
+func TestIntegrationAnnexObjectsLayoutMatchesGitAnnex(t *testing.T) {
+	if os.Getenv("RCLONE_TEST_GITANNEX_INTEGRATION") != "1" {
+		t.Skip("Skipping because RCLONE_TEST_GITANNEX_INTEGRATION is not set to 1.")
+	}
+	skipE2eTestIfNecessary(t)
+
+	tc := makeE2eTestingContext(t)
+	tc.installRcloneGitannexSymlink(t)
+	tc.createGitRepo(t)
+
+	remoteStorage := filepath.Join(tc.tempDir, "remoteStorage")
+	require.NoError(t, os.Mkdir(remoteStorage, 0700))
+
+	tc.runInRepo(t,
+		"git", "annex", "initremote", "MyRemote",
+		"type=external", "externaltype=rclone-builtin", "encryption=none",
+		"rcloneremotename=:local:",
+		"rcloneprefix="+remoteStorage,
+		"rclonelayout=annexobjects")
+
+	fooFilePath := filepath.Join(tc.ephemeralRepoDir, "foo")
+	require.NoError(t, os.WriteFile(fooFilePath, []byte("annexobjects contents"), 0600))
+	tc.runInRepo(t, "git", "annex", "add", "foo")
+	tc.runInRepo(t, "git", "commit", "-m", "Add foo file")
+	t.Cleanup(func() { tc.runInRepo(t, "git", "annex", "drop", "--force", "foo") })
+	tc.runInRepo(t, "git", "annex", "copy", "--to=MyRemote", "foo")
+
+	// Find the object's path relative to .git/annex/objects.
+	objectsDir := filepath.Join(tc.ephemeralRepoDir, ".git", "annex", "objects")
+	var objectPaths []string
+	require.NoError(t, filepath.WalkDir(objectsDir, func(path string, d os.DirEntry, err error) error {
+		require.NoError(t, err)
+		if !d.IsDir() {
+			rel, err := filepath.Rel(objectsDir, path)
+			require.NoError(t, err)
+			objectPaths = append(objectPaths, rel)
+		}
+		return nil
+	}))
+	require.Len(t, objectPaths, 1)
+	require.FileExists(t, filepath.Join(remoteStorage, objectPaths[0]))
+}
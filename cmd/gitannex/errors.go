@@ -0,0 +1,108 @@
+package gitannex
+
+import "errors"
+
+// codeError is the [ErrProtocol.Code] of errors that git-annex has not been
+// told about yet. They must be reported with an ERROR message.
+const codeError = "ERROR"
+
+// ErrProtocol is embedded in each category of error that the server's handlers
+// return. Use [errors.As] with a *ErrProtocol to distinguish these errors from
+// others, such as I/O errors while talking to git-annex, and with a pointer to
+// a specific category, e.g. *ErrTransferFailed, to tell the categories apart.
+type ErrProtocol struct {
+	code string
+	err  error
+}
+
+func protocolError(code string, err error) ErrProtocol {
+	return ErrProtocol{code: code, err: err}
+}
+
+func (e *ErrProtocol) Error() string {
+	return e.err.Error()
+}
+
+func (e *ErrProtocol) Unwrap() error {
+	return e.err
+}
+
+// Code returns the prefix of the message that reported the error to
+// git-annex, e.g. "TRANSFER-FAILURE". A code of "ERROR" means that no message
+// has been sent yet.
+func (e *ErrProtocol) Code() string {
+	return e.code
+}
+
+// As lets [errors.As] find the ErrProtocol embedded in each category of error.
+func (e *ErrProtocol) As(target any) bool {
+	if p, ok := target.(**ErrProtocol); ok {
+		*p = e
+		return true
+	}
+	return false
+}
+
+// ErrProtocolParse indicates that a message from git-annex was malformed or
+// unexpected.
+type ErrProtocolParse struct{ ErrProtocol }
+
+// ErrConfigMissing indicates that a config was missing or invalid.
+type ErrConfigMissing struct{ ErrProtocol }
+
+// ErrRemoteNotFound indicates that the rclone remote, or the directory on it
+// where keys are stored, could not be found or used.
+type ErrRemoteNotFound struct{ ErrProtocol }
+
+// ErrTransferFailed indicates that storing, retrieving, checking, or removing
+// a key failed.
+type ErrTransferFailed struct{ ErrProtocol }
+
+// ErrKeyNotFound indicates that a key is not present on the remote. Unlike the
+// other categories, it does not end the session.
+type ErrKeyNotFound struct{ ErrProtocol }
+
+// These constructors let handlers pick the category of an error at runtime.
+
+func newErrConfigMissing(e ErrProtocol) error  { return &ErrConfigMissing{e} }
+func newErrRemoteNotFound(e ErrProtocol) error { return &ErrRemoteNotFound{e} }
+func newErrTransferFailed(e ErrProtocol) error { return &ErrTransferFailed{e} }
+
+// ErrorCode is a machine-readable code that the server includes, in brackets,
+// in the FAILURE and UNKNOWN messages it sends to git-annex, e.g.
+// "TRANSFER-FAILURE STORE SomeKey [E003] failed to copy file: ...". The codes
+// are explained in the "Error codes" section of gitannex.md.
+type ErrorCode string
+
+// Error codes. Once released, a code must keep its meaning.
+const (
+	ErrCodeConfigMissing  ErrorCode = "E001"
+	ErrCodeRemoteNotFound ErrorCode = "E002"
+	ErrCodeTransferFailed ErrorCode = "E003"
+	ErrCodeKeyNotFound    ErrorCode = "E004"
+	ErrCodeProtocolParse  ErrorCode = "E005"
+	ErrCodeKeyExcluded    ErrorCode = "E006"
+	ErrCodeTooLarge       ErrorCode = "E007"
+)
+
+// errorCodeOf returns the [ErrorCode] for the category of `err`.
+func errorCodeOf(err error) ErrorCode {
+	var (
+		configMissing  *ErrConfigMissing
+		remoteNotFound *ErrRemoteNotFound
+		keyNotFound    *ErrKeyNotFound
+		protocolParse  *ErrProtocolParse
+	)
+	switch {
+	case errors.As(err, &configMissing):
+		return ErrCodeConfigMissing
+	case errors.As(err, &remoteNotFound):
+		return ErrCodeRemoteNotFound
+	case errors.As(err, &keyNotFound):
+		return ErrCodeKeyNotFound
+	case errors.As(err, &protocolParse):
+		return ErrCodeProtocolParse
+	default:
+		return ErrCodeTransferFailed
+	}
+}
@@ -0,0 +1,77 @@
+package gitannex
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ExportCapabilities is a set of the export operations that git-annex's export
+// interface defines. A remote that supports exports reports them in reply to
+// "EXPORTSUPPORTED", e.g. "EXPORTSUPPORTED-YES STORE CHECKPRESENT REMOVE".
+type ExportCapabilities uint8
+
+// The export operations, named by the export requests that implement them,
+// e.g. "TRANSFEREXPORT STORE" and "REMOVEEXPORTDIRECTORY".
+const (
+	ExportStore ExportCapabilities = 1 << iota
+	ExportCheckPresent
+	ExportRemove
+	ExportRename
+	ExportRemoveDir
+)
+
+// exportCapabilityNames lists the name of each capability, in the order in
+// which [ExportCapabilities.String] lists them.
+var exportCapabilityNames = []struct {
+	capability ExportCapabilities
+	name       string
+}{
+	{ExportStore, "STORE"},
+	{ExportCheckPresent, "CHECKPRESENT"},
+	{ExportRemove, "REMOVE"},
+	{ExportRename, "RENAME"},
+	{ExportRemoveDir, "REMOVEDIR"},
+}
+
+// implementedExportCapabilities are the export operations that the server has
+// handlers for. Add each capability along with its handler. While it is empty,
+// the server tells git-annex that it does not support exports.
+var implementedExportCapabilities ExportCapabilities
+
+// String returns the names of the capabilities in `c`, separated by spaces,
+// e.g. "STORE CHECKPRESENT".
+func (c ExportCapabilities) String() string {
+	var names []string
+	for _, n := range exportCapabilityNames {
+		if c&n.capability != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, " ")
+}
+
+// parseExportCapabilities parses capability names separated by spaces, as
+// produced by [ExportCapabilities.String].
+func parseExportCapabilities(value string) (ExportCapabilities, error) {
+	var c ExportCapabilities
+fields:
+	for _, field := range strings.Fields(value) {
+		for _, n := range exportCapabilityNames {
+			if field == n.name {
+				c |= n.capability
+				continue fields
+			}
+		}
+		return 0, fmt.Errorf("unknown export capability %q", field)
+	}
+	return c, nil
+}
+
+// exportSupportedReply returns the reply to "EXPORTSUPPORTED" for a server
+// that implements the export operations in `c`.
+func exportSupportedReply(c ExportCapabilities) string {
+	if c == 0 {
+		return "EXPORTSUPPORTED-FAILURE"
+	}
+	return "EXPORTSUPPORTED-YES " + c.String()
+}
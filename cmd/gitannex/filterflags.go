@@ -0,0 +1,61 @@
+package gitannex
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/filter"
+	"github.com/spf13/pflag"
+)
+
+// parseFilterFlags parses the "rclonefilterflags" config, e.g.
+// "--exclude=*.DS_Store --exclude .metadata", into a filter for listings of
+// the prefix directory. Only rclone's filter rule flags are accepted. It
+// returns nil when the config is empty.
+func parseFilterFlags(value string) (*filter.Filter, error) {
+	args := strings.Fields(value)
+	if len(args) == 0 {
+		return nil, nil
+	}
+	// Start from the defaults rather than [filter.Opt], which holds the
+	// filter flags of this command.
+	opt := filter.Options{
+		MinAge:  fs.DurationOff,
+		MaxAge:  fs.DurationOff,
+		MinSize: fs.SizeSuffix(-1),
+		MaxSize: fs.SizeSuffix(-1),
+	}
+	flagSet := pflag.NewFlagSet("rclonefilterflags", pflag.ContinueOnError)
+	// Errors are reported to git-annex, so the usage would only be noise.
+	flagSet.SetOutput(io.Discard)
+	flagSet.StringArrayVarP(&opt.FilterRule, "filter", "f", nil, "")
+	flagSet.StringArrayVar(&opt.FilterFrom, "filter-from", nil, "")
+	flagSet.StringArrayVar(&opt.ExcludeRule, "exclude", nil, "")
+	flagSet.StringArrayVar(&opt.ExcludeFrom, "exclude-from", nil, "")
+	flagSet.StringArrayVar(&opt.IncludeRule, "include", nil, "")
+	flagSet.StringArrayVar(&opt.IncludeFrom, "include-from", nil, "")
+	flagSet.BoolVar(&opt.IgnoreCase, "ignore-case", false, "")
+	if err := flagSet.Parse(args); err != nil {
+		return nil, fmt.Errorf("failed to parse filter flags %q: %w", value, err)
+	}
+	if flagSet.NArg() > 0 {
+		return nil, fmt.Errorf("failed to parse filter flags %q: unexpected argument %q", value, flagSet.Arg(0))
+	}
+	fi, err := filter.NewFilter(&opt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse filter flags %q: %w", value, err)
+	}
+	return fi, nil
+}
+
+// filterExcludesKey reports whether `fi` hides `key`, or the chunk manifest of
+// `key`, from listings, in which case a listing cannot tell whether the key is
+// present and it must be looked up by name.
+func filterExcludesKey(fi *filter.Filter, key string) bool {
+	if fi == nil {
+		return false
+	}
+	return !fi.IncludeRemote(key) || !fi.IncludeRemote(manifestName(key))
+}
@@ -0,0 +1,105 @@
+package gitannex
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fuzzDirPlaceholder is replaced with a temporary directory in each fuzz input.
+// This lets seed corpus entries refer to local files without hardcoding paths.
+const fuzzDirPlaceholder = "$DIR"
+
+// transferPathsAreConfined reports whether every TRANSFER message in `input`
+// names a file inside `dir`. The fuzz target skips other inputs so that it
+// never reads or writes files it does not own.
+func transferPathsAreConfined(input, dir string) bool {
+	for _, line := range strings.Split(input, "\n") {
+		message := messageParser{line}
+		command, err := message.nextSpaceDelimitedParameter()
+		if err != nil || command != "TRANSFER" {
+			continue
+		}
+		if _, err := message.nextSpaceDelimitedParameter(); err != nil {
+			continue
+		}
+		if _, err := message.nextSpaceDelimitedParameter(); err != nil {
+			continue
+		}
+		file := message.finalParameter()
+		if file == "" {
+			continue
+		}
+		rel, found := strings.CutPrefix(file, dir+string(filepath.Separator))
+		if !found || !filepath.IsLocal(rel) {
+			return false
+		}
+	}
+	return true
+}
+
+// FuzzServerRun feeds arbitrary input to the server's message loop and checks
+// that it never panics or writes a malformed line.
+func FuzzServerRun(f *testing.F) {
+	seeds := []string{
+		"INITREMOTE\n",
+		"PREPARE\n",
+		"EXPORTSUPPORTED\n",
+		"TRANSFER STORE SomeKey $DIR/file.txt\n",
+		"TRANSFER STORE SomeKey $DIR/file.txt\nTRANSFER RETRIEVE SomeKey $DIR/retrieved.txt\n",
+		"TRANSFER RETRIEVE KeyThatDoesNotExist $DIR/retrieved.txt\n",
+		"TRANSFER SIDEWAYS SomeKey $DIR/file.txt\n",
+		"CHECKPRESENT SomeKey\n",
+		"TRANSFER STORE SomeKey $DIR/file.txt\nCHECKPRESENT SomeKey\nREMOVE SomeKey\nCHECKPRESENT SomeKey\n",
+		"REMOVE KeyThatDoesNotExist\n",
+		"EXTENSIONS INFO ASYNC GETGITREMOTENAME UNAVAILABLERESPONSE\n",
+		"LISTCONFIGS\n",
+		"GETCOST\n",
+		"GETAVAILABILITY\n",
+		"GETINFO\n",
+		"WHEREIS SomeKey\n",
+		"ERROR something went wrong\n",
+		"UNKNOWN\n",
+		"\n",
+		"PREPARE",
+	}
+	for _, seed := range seeds {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, input []byte) {
+		dir := t.TempDir()
+		inputString := strings.ReplaceAll(string(input), fuzzDirPlaceholder, dir)
+		if !transferPathsAreConfined(inputString, dir) {
+			t.Skip("input transfers files outside of the temporary directory")
+		}
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "file.txt"), []byte("HELLO"), 0600))
+
+		var output bytes.Buffer
+		s := server{
+			reader: bufio.NewReader(strings.NewReader(inputString)),
+			writer: &output,
+		}
+		for _, config := range requiredConfigs {
+			s.mustSetConfigValue(config.id, config.defaultValue)
+		}
+		s.configRcloneRemoteName = ":memory:"
+		s.configPrefix = "fuzz"
+		s.configRcloneLayout = string(layoutModeNodir)
+		s.configsDone = true
+
+		// Errors are expected for most inputs. We only care that the server
+		// returns rather than panicking.
+		_ = s.run()
+
+		require.True(t, strings.HasSuffix(output.String(), "\n"), "output must end with a newline: %q", output.String())
+		for _, line := range strings.SplitAfter(output.String(), "\n") {
+			require.LessOrEqual(t, len(line), maxMessageLength, "line is too long: %q", line)
+		}
+	})
+}
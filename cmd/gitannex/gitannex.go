@@ -26,13 +26,26 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/rclone/rclone/cmd"
 	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/accounting"
 	"github.com/rclone/rclone/fs/cache"
+	"github.com/rclone/rclone/fs/config"
+	"github.com/rclone/rclone/fs/config/configfile"
+	"github.com/rclone/rclone/fs/config/flags"
+	"github.com/rclone/rclone/fs/filter"
+	"github.com/rclone/rclone/fs/hash"
 	"github.com/rclone/rclone/fs/operations"
 	"github.com/spf13/cobra"
 )
@@ -40,26 +53,105 @@ import (
 const subcommandName string = "gitannex"
 const uniqueCommandName string = "git-annex-remote-rclone-builtin"
 
+// Environment variables that add flags when rclone is executed as
+// "git-annex-remote-rclone-builtin". See [maybeTransformArgs].
+const (
+	verboseEnvVar = "RCLONE_GITANNEX_VERBOSE"
+	logFileEnvVar = "RCLONE_GITANNEX_LOG_FILE"
+)
+
 //go:embed gitannex.md
 var gitannexHelp string
 
+// Path of the rclone config file to use instead of the default, as set by the
+// --rclone-config flag.
+var rcloneConfigPath string
+
+// Name of the rclone remote to use regardless of the "rcloneremotename" config,
+// as set by the --remote-override flag. This is a debugging aid.
+var remoteOverride string
+
+// Whether to check that the remote is reachable instead of speaking with
+// git-annex, as set by the --health-check flag.
+var healthCheck bool
+
+// The layout migration to perform instead of speaking with git-annex, e.g.
+// "from=nodir,to=mixed", as set by the --migrate-layout flag.
+var migrateLayoutSpec string
+
+// Whether to print the layout modes instead of speaking with git-annex, as set
+// by the --list-layouts flag.
+var listLayouts bool
+
+// File descriptors over which to speak with git-annex instead of stdin and
+// stdout, as set by the --pipe-in-fd and --pipe-out-fd flags. A negative value
+// means the flag is not set.
+var (
+	pipeInFd  = -1
+	pipeOutFd = -1
+)
+
 func init() {
 	os.Args = maybeTransformArgs(os.Args)
 	cmd.Root.AddCommand(command)
+	cmdFlags := command.Flags()
+	flags.StringVarP(cmdFlags, &rcloneConfigPath, "rclone-config", "", "", "Path to the rclone config file to use instead of the default", "")
+	flags.StringVarP(cmdFlags, &remoteOverride, "remote-override", "", "", "Use this rclone remote instead of the rcloneremotename config (for debugging only)", "")
+	flags.BoolVarP(cmdFlags, &healthCheck, "health-check", "", false, "Check that the remote is reachable, print OK or ERROR, and exit", "")
+	flags.IntVarP(cmdFlags, &pipeInFd, "pipe-in-fd", "", -1, "File descriptor from which to read messages from git-annex instead of stdin", "")
+	flags.IntVarP(cmdFlags, &pipeOutFd, "pipe-out-fd", "", -1, "File descriptor to which to write messages for git-annex instead of stdout", "")
+	flags.StringVarP(cmdFlags, &socketPath, "socket-path", "", "", "Listen on this Unix domain socket and speak with the first client instead of stdin/stdout", "")
+	flags.StringVarP(cmdFlags, &migrateLayoutSpec, "migrate-layout", "", "", "Move the objects in the remote to another layout, e.g. from=nodir,to=mixed, and exit", "")
+	flags.BoolVarP(cmdFlags, &listLayouts, "list-layouts", "", false, "Print the values that the rclonelayout config accepts, and exit", "")
+}
+
+// protocolFiles returns the files over which to speak with git-annex, which
+// are stdin and stdout unless the --pipe-in-fd or --pipe-out-fd flags name
+// other file descriptors.
+func protocolFiles() (in, out *os.File) {
+	in, out = os.Stdin, os.Stdout
+	if pipeInFd >= 0 {
+		in = os.NewFile(uintptr(pipeInFd), "gitannex-in")
+	}
+	if pipeOutFd >= 0 {
+		out = os.NewFile(uintptr(pipeOutFd), "gitannex-out")
+	}
+	return in, out
+}
+
+// useConfigFile makes rclone look up remotes in the config file at `path`, as
+// if it had been given with rclone's global --config flag.
+func useConfigFile(path string) error {
+	if err := config.SetConfigPath(path); err != nil {
+		return fmt.Errorf("failed to set config path: %w", err)
+	}
+	// Discard any config that was already loaded from the default path.
+	configfile.Install()
+	return nil
 }
 
 // maybeTransformArgs returns a modified version of `args` with the "gitannex"
 // subcommand inserted when `args` indicates that the program was executed as
 // "git-annex-remote-rclone-builtin". One way this can happen is when rclone is
 // invoked via symlink. Otherwise, returns `args`.
+//
+// Since git-annex gives no way to pass flags to the program, the transformed
+// args also get "--verbose" when the RCLONE_GITANNEX_VERBOSE environment
+// variable is true, and "--log-file=PATH" when RCLONE_GITANNEX_LOG_FILE is set.
 func maybeTransformArgs(args []string) []string {
 	if len(args) == 0 || filepath.Base(args[0]) != uniqueCommandName {
 		return args
 	}
-	newArgs := make([]string, 0, len(args)+1)
+	newArgs := make([]string, 0, len(args)+3)
 	newArgs = append(newArgs, args[0])
 	newArgs = append(newArgs, subcommandName)
 	newArgs = append(newArgs, args[1:]...)
+	if verbose, _ := strconv.ParseBool(os.Getenv(verboseEnvVar)); verbose {
+		newArgs = append(newArgs, "--verbose")
+	}
+	if logFile := os.Getenv(logFileEnvVar); logFile != "" {
+		newArgs = append(newArgs, "--log-file="+logFile)
+	}
 	return newArgs
 }
 
@@ -107,6 +199,25 @@ func (m *messageParser) finalParameter() string {
 	return param
 }
 
+// AllParameters consumes space-delimited parameters until none remain, or
+// until one fails to parse, and returns those that were parsed.
+func (m *messageParser) AllParameters() []string {
+	var params []string
+	for {
+		param, err := m.nextSpaceDelimitedParameter()
+		if err != nil {
+			return params
+		}
+		params = append(params, param)
+	}
+}
+
+// Remaining returns the unparsed remainder of the line, including any
+// trailing newline, without consuming it.
+func (m *messageParser) Remaining() string {
+	return m.line
+}
+
 // server contains this command's current state.
 type server struct {
 	reader *bufio.Reader
@@ -116,21 +227,244 @@ type server struct {
 	// to stderr.
 	verbose bool
 
+	// When set, this rclone remote is used without asking git-annex for the
+	// "rcloneremotename" config.
+	remoteOverride string
+
+	// ctx is the context of the session, as set by [server.RunWithContext].
+	// Use [server.sessionContext] rather than reading it directly.
+	ctx context.Context
+
 	extensionInfo                bool
 	extensionAsync               bool
 	extensionGetGitRemoteName    bool
 	extensionUnavailableResponse bool
 
-	configsDone            bool
+	configsDone bool
+	// The configs in parsed form; see [server.getSessionConfig].
+	sessionConfig          *sessionConfig
 	configPrefix           string
 	configRcloneRemoteName string
 	configRcloneLayout     string
+	configRcloneBwLimit    string
+	configRcloneChunkSize  string
+
+	configRcloneProtocolTimeout string
+	configRcloneCutoffSize      string
+	configRcloneLogLevel        string
+	configRcloneEncrypt         string
+	configRcloneKeyTypePrefix   string
+	configRcloneSkipConnectTest string
+
+	configRcloneCheckPresentWindow    string
+	configRcloneChecksum              string
+	configRclonePreserveModTime       string
+	configRcloneProxyURL              string
+	configRcloneExcludeKeys           string
+	configRcloneMaxTransferSize       string
+	configRcloneAllowedBackends       string
+	configRcloneProgress              string
+	configRcloneCacheDir              string
+	configRclonePathSeparator         string
+	configRcloneObjectCache           string
+	configRcloneACL                   string
+	configRcloneKMSKey                string
+	configRcloneEncryptionType        string
+	configRcloneDebugHTTP             string
+	configRcloneResumeTransfer        string
+	configRcloneStorageClass          string
+	configRcloneRetrievalStorageClass string
+	configRclonePublicLinks           string
+	configRcloneNamespace             string
+	configRcloneTemporaryPrefix       string
+	configRcloneObjectLocking         string
+	configRcloneObjectLockRetention   string
+	configRcloneCompress              string
+	configRcloneCompressLevel         string
+	configRcloneSnapshotPrefix        string
+	configRcloneBandwidthSchedule     string
+	configRcloneAllowFail             string
+	configRcloneWarmCache             string
+	configRcloneOverwriteExisting     string
+	configRcloneIgnoreCase            string
+	configRcloneRetryDelay            string
+	configRcloneRetryMaxDelay         string
+	configRcloneSHA256Verify          string
+	configRcloneLockFile              string
+	configRclonePiggybackConfig       string
+	configRcloneCheckInterval         string
+	configRcloneObjectPrefix          string
+	configRcloneFilterFlags           string
+	configRcloneCopyFlag              string
+	configRclonePrefixCreateOnPrepare string
+	configRcloneTagging               string
+	configRcloneVerifySize            string
+	configRcloneGzip                  string
+	configRcloneGzipLevel             string
+	configRcloneFailOnAbsent          string
+	configRcloneConnectionsPerServer  string
+	configRcloneCopyBuffer            string
+
+	// Where to render progress when the "rcloneprogress" config is enabled.
+	// If nil, progress goes to stderr.
+	progressOutput io.Writer
+
+	// When the "rcloneprefix" config is unset and git-annex provides the git
+	// remote's name, the default prefix incorporates that name. In that case,
+	// legacyPrefix holds the old default so that objects stored under it can
+	// still be found.
+	legacyPrefix string
+
+	// Keys that were recently stored or retrieved, oldest first, which the
+	// "rclonecheckinterval" integrity checks sample from.
+	recentKeys []recentKey
+	// When the integrity checks are running, stops them.
+	stopIntegrityChecksFunc func()
+	// The number of rounds of integrity checks that have finished.
+	integrityChecks int
+
+	// The "rclonepiggybackconfig" file that has been loaded, if any.
+	piggybackConfigLoaded string
+
+	// When the "rclonewarmcache" config is enabled, the keys that PREPARE
+	// found in the "rcloneprefix" directory.
+	presentKeys *presentKeysCache
+
+	// The prefixes of every snapshot when the "rclonesnapshotprefix" config is
+	// set, as listed by [server.snapshotPrefixes].
+	snapshots []string
+
+	// Whether the "rcloneencrypt" password came from the git-annex branch
+	// rather than from git-annex's creds. INITREMOTE moves it to the creds.
+	encryptPasswordInConfig bool
+
+	// The "rcloneencrypt" password in the obscured form that crypt remotes
+	// expect. It is computed once by fsRemoteAndPrefix.
+	obscuredEncryptPassword string
+
+	// Responses to DIRHASH and DIRHASH-LOWER messages, keyed by message. The
+	// hash of a key never changes, so there is no need to ask twice.
+	dirhashCache map[string]string
+
+	// When true, operations that would modify the remote are skipped. Skipped
+	// stores and removals are reported as failures.
+	dryRun bool
+
+	// When the "rclonefailonabsent" config is enabled, set once a key to
+	// retrieve was missing. Every later transfer then fails.
+	fatalAbsence bool
+
+	// When true, handlePrepare installed a bandwidth limit that must be
+	// removed when the session ends.
+	bwLimitInstalled bool
+
+	// The timetable from the "rclonebandwidthschedule" config, and the limit
+	// that [server.applyBandwidthSchedule] last applied from it.
+	bwSchedule      fs.BwTimetable
+	bwScheduleLimit *fs.BwPair
+
+	// Returns the current time. If nil, [time.Now] is used. Tests set it to
+	// pick a slot of the bandwidth schedule.
+	now func() time.Time
+
+	// Sets the limit of rclone's global token bucket. If nil,
+	// [accounting.TokenBucket.SetBwLimit] is used. Tests set it to record the
+	// limits rather than wait out throttled transfers.
+	setBwLimit func(fs.BwPair)
+
+	// When true, handlePrepare changed rclone's log level, which must be
+	// restored to previousLogLevel when the session ends.
+	logLevelInstalled bool
+	previousLogLevel  fs.LogLevel
+
+	// When true, handlePrepare turned on rclone's HTTP dumps, which must be
+	// restored to previousDump when the session ends.
+	dumpInstalled bool
+	previousDump  fs.DumpFlags
+
+	// When true, handlePrepare changed rclone's cache directory, which must be
+	// restored to previousCacheDir when the session ends.
+	cacheDirInstalled bool
+	previousCacheDir  string
+
+	// Number of bytes successfully transferred during this session. These are
+	// reported in response to GETINFO.
+	bytesStored    int64
+	bytesRetrieved int64
+
+	// Number of operations performed during this session. Stores, retrieves,
+	// and removes are counted when they succeed, and checkpresents are counted
+	// when they find an answer. These are reported at the end of the session.
+	storeCount        int64
+	retrieveCount     int64
+	removeCount       int64
+	checkpresentCount int64
+	// Number of requests whose handler failed, not counting keys that were
+	// not found.
+	errorCount int64
+
+	// When the session started, for [server.Stats].
+	startedAt time.Time
+
+	// How long sendMsg waits for a write to complete before giving up. Zero
+	// means no timeout.
+	sendTimeout time.Duration
+
+	// The Fs most recently returned by [server.getRemoteFs], and its fs
+	// string. Consecutive requests for keys in the same directory, e.g. every
+	// key in the "nodir" layout, reuse it.
+	remoteFs       fs.Fs
+	remoteFsString string
+
+	// How getRemoteFs looks up an Fs. If nil, it uses [cache.Get].
+	getFs func(ctx context.Context, fsString string) (fs.Fs, error)
+
+	// Listings of directories in the "nodir" layout, keyed by fs string, that
+	// answer CHECKPRESENT. See [server.findKeyInListing].
+	checkpresentListings map[string]*dirListing
+
+	// The first error encountered while writing to git-annex. Once set,
+	// sendMsg stops writing and run returns this error.
+	sendErr error
+
+	// Guards the server's state, including the writer, while the integrity
+	// checks run. See [server.startIntegrityChecks].
+	mu sync.Mutex
 }
 
+// ErrPipeClosed is returned by the server when git-annex closes its end of the
+// pipe we write messages to, e.g. because git-annex exited abnormally.
+var ErrPipeClosed = errors.New("git-annex closed the pipe")
+
+// maxMessageLength is the longest line, including the trailing newline, that
+// sendMsg will write. Only free-form error text can realistically exceed it,
+// e.g. when it quotes a very long path, so truncating such lines is harmless.
+const maxMessageLength = 4096
+
+// ErrWriteTimeout is returned by the server when git-annex does not accept a
+// message within the configured timeout, e.g. because it is hung.
+var ErrWriteTimeout = errors.New("timed out sending message to git-annex")
+
+// sendMsg writes `msg` to git-annex. Write errors do not abort the caller;
+// instead, the first one is recorded in `s.sendErr` and later messages are
+// dropped. The run loop checks `s.sendErr` after handling each message.
 func (s *server) sendMsg(msg string) {
+	if s.sendErr != nil {
+		return
+	}
+	// Each message must occupy exactly one line, but error text from a
+	// backend may span several.
+	msg = strings.ReplaceAll(msg, "\n", " ")
+	if len(msg) >= maxMessageLength {
+		msg = msg[:maxMessageLength-1]
+	}
 	msg += "\n"
-	if _, err := io.WriteString(s.writer, msg); err != nil {
-		panic(err)
+	if err := s.write(msg); err != nil {
+		if isBrokenPipe(err) || errors.Is(err, io.ErrClosedPipe) || errors.Is(err, os.ErrClosed) {
+			err = fmt.Errorf("%w: %w", ErrPipeClosed, err)
+		}
+		s.sendErr = fmt.Errorf("failed to send message: %w", err)
+		return
 	}
 	if s.verbose {
 		_, err := os.Stderr.WriteString(fmt.Sprintf("server sent %q\n", msg))
@@ -140,7 +474,63 @@ func (s *server) sendMsg(msg string) {
 	}
 }
 
+// sendInfo sends a message that git-annex may display to the user. When
+// git-annex has not enabled the INFO extension, the message is logged instead.
+func (s *server) sendInfo(msg string) {
+	if !s.extensionInfo {
+		fs.Logf(nil, "%s", msg)
+		return
+	}
+	s.sendMsg("INFO " + msg)
+}
+
+// write writes `msg` to git-annex, giving up after `s.sendTimeout`. Writers
+// that support deadlines get one; for anything else, e.g. a pipe, the write
+// runs in a goroutine that is abandoned if the timer fires first.
+func (s *server) write(msg string) error {
+	if s.sendTimeout <= 0 {
+		_, err := io.WriteString(s.writer, msg)
+		return err
+	}
+
+	if conn, ok := s.writer.(net.Conn); ok {
+		if err := conn.SetWriteDeadline(time.Now().Add(s.sendTimeout)); err != nil {
+			return err
+		}
+		_, err := io.WriteString(conn, msg)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return fmt.Errorf("%w after %v", ErrWriteTimeout, s.sendTimeout)
+		}
+		return err
+	}
+
+	writeErrChan := make(chan error, 1)
+	go func() {
+		_, err := io.WriteString(s.writer, msg)
+		writeErrChan <- err
+	}()
+	timer := time.NewTimer(s.sendTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-writeErrChan:
+		return err
+	case <-timer.C:
+		return fmt.Errorf("%w after %v", ErrWriteTimeout, s.sendTimeout)
+	}
+}
+
 func (s *server) getMsg() (*messageParser, error) {
+	if s.sendErr != nil {
+		// There is no point waiting for a reply to a message that was never
+		// delivered.
+		return nil, s.sendErr
+	}
+	return s.readMsg()
+}
+
+// readMsg reads the next message from git-annex. It returns nil when git-annex
+// has closed stdin.
+func (s *server) readMsg() (*messageParser, error) {
 	msg, err := s.reader.ReadString('\n')
 	if err != nil {
 		if len(msg) == 0 {
@@ -159,12 +549,60 @@ func (s *server) getMsg() (*messageParser, error) {
 	return &messageParser{msg}, nil
 }
 
+// getReply reads git-annex's reply to a message we sent. Unlike getMsg, it
+// treats a closed stdin as an error because a reply was expected.
+func (s *server) getReply() (*messageParser, error) {
+	message, err := s.getMsg()
+	if err == nil && message == nil {
+		err = errors.New("git-annex closed stdin instead of replying")
+	}
+	return message, err
+}
+
+// RunWithContext runs the session like [server.run], with a context that is
+// cancelled when `ctx` is cancelled or when the session ends. Cancelling `ctx`
+// interrupts any backend operation in progress, which the handler reports to
+// git-annex, and ends the session.
+func (s *server) RunWithContext(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s.ctx = ctx
+	return s.run()
+}
+
+// sessionContext returns the context for backend operations in this session.
+func (s *server) sessionContext() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
 func (s *server) run() error {
+	defer s.close()
+
+	s.mu.Lock()
+	if s.startedAt.IsZero() {
+		s.startedAt = time.Now()
+	}
+	s.mu.Unlock()
+
 	// The remote sends the first message.
 	s.sendMsg("VERSION 1")
 
 	for {
-		message, err := s.getMsg()
+		s.mu.Lock()
+		err := s.sendErr
+		s.mu.Unlock()
+		if ctxErr := s.sessionContext().Err(); err == nil && ctxErr != nil {
+			err = fmt.Errorf("session cancelled: %w", ctxErr)
+		}
+		if err != nil {
+			return err
+		}
+
+		// Integrity checks may be running, so read without holding the lock.
+		message, err := s.readMsg()
 		if err != nil {
 			return fmt.Errorf("error receiving message: %w", err)
 		}
@@ -173,61 +611,122 @@ func (s *server) run() error {
 			break
 		}
 
-		command, err := message.nextSpaceDelimitedParameter()
-		if err != nil {
-			return fmt.Errorf("failed to parse command")
-		}
-
-		switch command {
-		//
-		// Git-annex requires that these requests are supported.
-		//
-		case "INITREMOTE":
-			err = s.handleInitRemote()
-		case "PREPARE":
-			err = s.handlePrepare()
-		case "EXPORTSUPPORTED":
-			// Indicate that we do not support exports.
-			s.sendMsg("EXPORTSUPPORTED-FAILURE")
-		case "TRANSFER":
-			err = s.handleTransfer(message)
-		case "CHECKPRESENT":
-			err = s.handleCheckPresent(message)
-		case "REMOVE":
-			err = s.handleRemove(message)
-		case "ERROR":
-			errorMessage := message.finalParameter()
-			err = fmt.Errorf("received error message from git-annex: %s", errorMessage)
-
-		//
-		// These requests are optional.
-		//
-		case "EXTENSIONS":
-			// Git-annex just told us which protocol extensions it supports.
-			// Respond with the list of extensions that we want to use (none).
-			err = s.handleExtensions(message)
-		case "LISTCONFIGS":
-			s.handleListConfigs()
-		case "GETCOST":
-			// Git-annex wants to know the "cost" of using this remote. It
-			// probably depends on the backend we will be using, but let's just
-			// consider this an "expensive remote" per git-annex's
-			// Config/Cost.hs.
-			s.sendMsg("COST 200")
-		case "GETAVAILABILITY":
-			// Indicate that this is a cloud service.
-			s.sendMsg("AVAILABILITY GLOBAL")
-		case "CLAIMURL", "CHECKURL", "WHEREIS", "GETINFO":
-			s.sendMsg("UNSUPPORTED-REQUEST")
-		default:
-			err = fmt.Errorf("received unexpected message from git-annex: %s", message.line)
+		s.mu.Lock()
+		err = s.handleMessage(message)
+		if sendErr := s.sendErr; sendErr != nil {
+			err = sendErr
+		}
+		s.mu.Unlock()
+		// A missing key has been reported to git-annex and is not a reason to
+		// end the session.
+		var keyNotFound *ErrKeyNotFound
+		if errors.As(err, &keyNotFound) {
+			fs.Debugf(nil, "%v", err)
+			continue
 		}
 		if err != nil {
 			return err
 		}
 	}
 
-	return nil
+	s.stopIntegrityChecks()
+	s.sendSessionSummary()
+	return s.sendErr
+}
+
+// handleMessage dispatches a single message from git-annex to its handler.
+func (s *server) handleMessage(message *messageParser) error {
+	command, err := message.nextSpaceDelimitedParameter()
+	if err != nil {
+		return &ErrProtocolParse{protocolError(codeError, errors.New("failed to parse command"))}
+	}
+
+	switch command {
+	//
+	// Git-annex requires that these requests are supported.
+	//
+	case "INITREMOTE":
+		err = s.handleInitRemote()
+	case "PREPARE":
+		err = s.handlePrepare()
+	case "EXPORTSUPPORTED":
+		s.sendMsg(exportSupportedReply(implementedExportCapabilities))
+	case "TRANSFER":
+		err = s.allowFailure(s.handleTransfer(message))
+	case "CHECKPRESENT":
+		err = s.handleCheckPresent(message)
+	case "REMOVE":
+		err = s.handleRemove(message)
+	case "ERROR":
+		errorMessage := message.finalParameter()
+		err = fmt.Errorf("received error message from git-annex: %s", errorMessage)
+
+	//
+	// These requests are optional.
+	//
+	case "EXTENSIONS":
+		// Git-annex just told us which protocol extensions it supports.
+		// Respond with the ones that we use.
+		err = s.handleExtensions(message)
+	case "LISTCONFIGS":
+		s.handleListConfigs()
+	case "GETCOST":
+		// Git-annex wants to know the "cost" of using this remote, which
+		// depends on the backend we will be using.
+		s.sendMsg(fmt.Sprintf("COST %d", s.cost()))
+	case "GETAVAILABILITY":
+		s.sendMsg("AVAILABILITY " + s.availability())
+	case "GETINFO":
+		err = s.handleGetInfo()
+	case "WHEREIS":
+		err = s.handleWhereis(message)
+	case "CLAIMURL":
+		err = s.handleClaimURL(message)
+	case "CHECKURL":
+		s.sendMsg("UNSUPPORTED-REQUEST")
+	default:
+		err = &ErrProtocolParse{protocolError(codeError, fmt.Errorf("received unexpected message from git-annex: %s", message.line))}
+	}
+	s.countError(err)
+	return err
+}
+
+// countError counts `err` in [SessionStats.Errors] unless it is nil or an
+// [ErrKeyNotFound].
+func (s *server) countError(err error) {
+	var keyNotFound *ErrKeyNotFound
+	if err != nil && !errors.As(err, &keyNotFound) {
+		s.errorCount++
+	}
+}
+
+// sessionSummary describes the operations performed during this session.
+func (s *server) sessionSummary() string {
+	count := func(n int64, noun string) string {
+		if n == 1 {
+			return fmt.Sprintf("%d %s", n, noun)
+		}
+		return fmt.Sprintf("%d %ss", n, noun)
+	}
+	return fmt.Sprintf("session: %s (%s), %s (%s), %s, %s",
+		count(s.storeCount, "store"), fs.SizeSuffix(s.bytesStored).ByteUnit(),
+		count(s.retrieveCount, "retrieve"), fs.SizeSuffix(s.bytesRetrieved).ByteUnit(),
+		count(s.removeCount, "remove"),
+		count(s.checkpresentCount, "checkpresent"))
+}
+
+// sendSessionSummary sends the [server.sessionSummary] to git-annex when the
+// INFO extension is in use. Git-annex may have already stopped reading by the
+// time the session ends, so failing to send the summary is not an error.
+func (s *server) sendSessionSummary() {
+	if !s.extensionInfo || s.sendErr != nil {
+		return
+	}
+	s.sendMsg("INFO " + s.sessionSummary())
+	if s.sendErr != nil {
+		fs.Debugf(nil, "Failed to send session summary: %v", s.sendErr)
+		s.sendErr = nil
+	}
 }
 
 // Idempotently handle an incoming INITREMOTE message. This should perform
@@ -242,17 +741,65 @@ func (s *server) handleInitRemote() error {
 		return fmt.Errorf("failed to get configs: %w", err)
 	}
 
+	// failInitRemote reports `err` to git-annex and returns it as an error in
+	// the given category.
+	failInitRemote := func(newCategory func(ErrProtocol) error, err error) error {
+		categoryErr := newCategory(protocolError("INITREMOTE-FAILURE", fmt.Errorf("failed to init remote: %w", err)))
+		s.sendMsg(fmt.Sprintf("INITREMOTE-FAILURE [%s] %s", errorCodeOf(categoryErr), err))
+		return categoryErr
+	}
+
+	// Keep other processes that share the lock file from initializing the
+	// same remote, or transferring to it, at the same time.
+	if s.configRcloneLockFile != "" {
+		unlock, err := lockFile(s.configRcloneLockFile, true)
+		if err != nil {
+			return failInitRemote(newErrConfigMissing, err)
+		}
+		defer unlock()
+	}
+
+	// The remote may be defined in the piggybacked config file.
+	if err := s.installPiggybackConfig(); err != nil {
+		return failInitRemote(newErrConfigMissing, err)
+	}
+
+	// The connection test may need the proxy.
+	if err := s.installProxy(); err != nil {
+		return failInitRemote(newErrConfigMissing, err)
+	}
+
 	if err := validateRemoteName(s.configRcloneRemoteName); err != nil {
-		s.sendMsg(fmt.Sprintf("INITREMOTE-FAILURE %s", err))
-		return fmt.Errorf("failed to init remote: %w", err)
+		return failInitRemote(newErrRemoteNotFound, err)
+	}
+
+	if err := validateAllowedBackend(s.configRcloneRemoteName, s.configRcloneAllowedBackends); err != nil {
+		return failInitRemote(newErrConfigMissing, err)
+	}
+
+	cfg, err := s.getSessionConfig()
+	if err != nil {
+		return failInitRemote(newErrConfigMissing, err)
 	}
 
-	if mode := parseLayoutMode(s.configRcloneLayout); mode == layoutModeUnknown {
-		err := fmt.Errorf("unknown layout mode: %s", s.configRcloneLayout)
-		s.sendMsg(fmt.Sprintf("INITREMOTE-FAILURE %s", err))
-		return fmt.Errorf("failed to init remote: %w", err)
+	if !cfg.skipConnectTest {
+		if err := s.testConnection(s.sessionContext()); err != nil {
+			return failInitRemote(newErrRemoteNotFound, fmt.Errorf("connection test failed: %w", err))
+		}
+	}
+
+	if err := s.checkUUID(s.sessionContext(), true); err != nil {
+		return failInitRemote(newErrRemoteNotFound, err)
 	}
 
+	if s.legacyPrefix != "" {
+		// Persist the prefix derived from the git remote's name. Otherwise,
+		// renaming the git remote would move the prefix.
+		s.sendMsg(fmt.Sprintf("SETCONFIG rcloneprefix %s", s.configPrefix))
+	}
+
+	s.storeEncryptPassword()
+
 	s.sendMsg("INITREMOTE-SUCCESS")
 	return nil
 }
@@ -265,6 +812,118 @@ func (s *server) mustSetConfigValue(id configID, value string) {
 		s.configPrefix = value
 	case configLayout:
 		s.configRcloneLayout = value
+	case configBwLimit:
+		s.configRcloneBwLimit = value
+	case configChunkSize:
+		s.configRcloneChunkSize = value
+	case configProtocolTimeout:
+		s.configRcloneProtocolTimeout = value
+	case configCutoffSize:
+		s.configRcloneCutoffSize = value
+	case configLogLevel:
+		s.configRcloneLogLevel = value
+	case configEncrypt:
+		s.configRcloneEncrypt = value
+	case configKeyTypePrefix:
+		s.configRcloneKeyTypePrefix = value
+	case configSkipConnectTest:
+		s.configRcloneSkipConnectTest = value
+	case configCheckPresentWindow:
+		s.configRcloneCheckPresentWindow = value
+	case configChecksum:
+		s.configRcloneChecksum = value
+	case configPreserveModTime:
+		s.configRclonePreserveModTime = value
+	case configProxyURL:
+		s.configRcloneProxyURL = value
+	case configExcludeKeys:
+		s.configRcloneExcludeKeys = value
+	case configMaxTransferSize:
+		s.configRcloneMaxTransferSize = value
+	case configAllowedBackends:
+		s.configRcloneAllowedBackends = value
+	case configProgress:
+		s.configRcloneProgress = value
+	case configCacheDir:
+		s.configRcloneCacheDir = value
+	case configPathSeparator:
+		s.configRclonePathSeparator = value
+	case configObjectCache:
+		s.configRcloneObjectCache = value
+	case configACL:
+		s.configRcloneACL = value
+	case configKMSKey:
+		s.configRcloneKMSKey = value
+	case configEncryptionType:
+		s.configRcloneEncryptionType = value
+	case configDebugHTTP:
+		s.configRcloneDebugHTTP = value
+	case configResumeTransfer:
+		s.configRcloneResumeTransfer = value
+	case configStorageClass:
+		s.configRcloneStorageClass = value
+	case configRetrievalStorageClass:
+		s.configRcloneRetrievalStorageClass = value
+	case configPublicLinks:
+		s.configRclonePublicLinks = value
+	case configNamespace:
+		s.configRcloneNamespace = value
+	case configTemporaryPrefix:
+		s.configRcloneTemporaryPrefix = value
+	case configObjectLocking:
+		s.configRcloneObjectLocking = value
+	case configObjectLockRetention:
+		s.configRcloneObjectLockRetention = value
+	case configCompress:
+		s.configRcloneCompress = value
+	case configCompressLevel:
+		s.configRcloneCompressLevel = value
+	case configSnapshotPrefix:
+		s.configRcloneSnapshotPrefix = value
+	case configBandwidthSchedule:
+		s.configRcloneBandwidthSchedule = value
+	case configAllowFail:
+		s.configRcloneAllowFail = value
+	case configWarmCache:
+		s.configRcloneWarmCache = value
+	case configOverwriteExisting:
+		s.configRcloneOverwriteExisting = value
+	case configIgnoreCase:
+		s.configRcloneIgnoreCase = value
+	case configRetryDelay:
+		s.configRcloneRetryDelay = value
+	case configRetryMaxDelay:
+		s.configRcloneRetryMaxDelay = value
+	case configSHA256Verify:
+		s.configRcloneSHA256Verify = value
+	case configLockFile:
+		s.configRcloneLockFile = value
+	case configPiggybackConfig:
+		s.configRclonePiggybackConfig = value
+	case configCheckInterval:
+		s.configRcloneCheckInterval = value
+	case configObjectPrefix:
+		s.configRcloneObjectPrefix = value
+	case configFilterFlags:
+		s.configRcloneFilterFlags = value
+	case configCopyFlag:
+		s.configRcloneCopyFlag = value
+	case configPrefixCreateOnPrepare:
+		s.configRclonePrefixCreateOnPrepare = value
+	case configTagging:
+		s.configRcloneTagging = value
+	case configVerifySize:
+		s.configRcloneVerifySize = value
+	case configGzip:
+		s.configRcloneGzip = value
+	case configGzipLevel:
+		s.configRcloneGzipLevel = value
+	case configFailOnAbsent:
+		s.configRcloneFailOnAbsent = value
+	case configConnectionsPerServer:
+		s.configRcloneConnectionsPerServer = value
+	case configCopyBuffer:
+		s.configRcloneCopyBuffer = value
 	default:
 		panic(fmt.Errorf("unhandled configId: %v", id))
 	}
@@ -280,50 +939,392 @@ func (s *server) queryConfigs() error {
 	// "VALUE" response.
 queryNextConfig:
 	for _, config := range requiredConfigs {
+		if config.id == configRemoteName && s.remoteOverride != "" {
+			s.mustSetConfigValue(config.id, s.remoteOverride)
+			continue
+		}
 		// Try each of the config's names in sequence, starting with the
 		// canonical name.
 		for _, configName := range config.names {
-			s.sendMsg(fmt.Sprintf("GETCONFIG %s", configName))
-
-			message, err := s.getMsg()
+			value, err := s.queryConfigWithDefault(configName, "")
+			if errors.Is(err, errEmptyConfigValue) {
+				continue
+			}
 			if err != nil {
 				return err
 			}
-
-			valueKeyword, err := message.nextSpaceDelimitedParameter()
-			if err != nil || valueKeyword != "VALUE" {
-				return fmt.Errorf("failed to parse config value: %s %s", valueKeyword, message.line)
-			}
-
-			if value := message.finalParameter(); value != "" {
+			s.mustSetConfigValue(config.id, value)
+			continue queryNextConfig
+		}
+		if config.envVar != "" {
+			if value := os.Getenv(config.envVar); value != "" {
 				s.mustSetConfigValue(config.id, value)
-				continue queryNextConfig
+				continue
 			}
 		}
-		if config.defaultValue == "" {
-			return fmt.Errorf("did not receive a non-empty config value for %q", config.getCanonicalName())
+		if config.defaultValue == "" && !config.optional {
+			return &ErrConfigMissing{protocolError(codeError, fmt.Errorf("did not receive a non-empty config value for %q", config.getCanonicalName()))}
 		}
 		s.mustSetConfigValue(config.id, config.defaultValue)
+		if config.id == configPrefix && s.extensionGetGitRemoteName {
+			if err := s.useGitRemoteNamePrefix(); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The namespace is part of every path, so an invalid one is useless for
+	// any request.
+	if _, err := parseNamespace(s.configRcloneNamespace); err != nil {
+		return &ErrConfigMissing{protocolError(codeError, err)}
+	}
+
+	// Once INITREMOTE has moved the encryption password to git-annex's
+	// creds, the config only records that there is one.
+	s.encryptPasswordInConfig = s.configRcloneEncrypt != "" && s.configRcloneEncrypt != encryptPasswordInCreds
+	if s.configRcloneEncrypt == encryptPasswordInCreds {
+		password, err := s.queryEncryptPassword()
+		if err != nil {
+			return err
+		}
+		if password == "" {
+			return &ErrConfigMissing{protocolError(codeError, errors.New("the rcloneencrypt password is not in git-annex's creds; pass rcloneencrypt=<password> to git annex enableremote"))}
+		}
+		s.configRcloneEncrypt = password
 	}
 
 	s.configsDone = true
 	return nil
 }
 
+// errEmptyConfigValue is returned by [server.queryConfigWithDefault] when
+// git-annex has no value for a config that has no default.
+var errEmptyConfigValue = errors.New("did not receive a non-empty config value")
+
+// queryConfigWithDefault sends "GETCONFIG <name>" and parses git-annex's
+// "VALUE" response. If the value is empty, it returns `defaultValue`, or
+// [errEmptyConfigValue] when that is empty too.
+func (s *server) queryConfigWithDefault(name, defaultValue string) (string, error) {
+	s.sendMsg(fmt.Sprintf("GETCONFIG %s", name))
+
+	message, err := s.getReply()
+	if err != nil {
+		return "", err
+	}
+
+	valueKeyword, err := message.nextSpaceDelimitedParameter()
+	if err != nil || valueKeyword != "VALUE" {
+		return "", &ErrProtocolParse{protocolError(codeError, fmt.Errorf("failed to parse config value: %s %s", valueKeyword, message.line))}
+	}
+
+	if value := message.finalParameter(); value != "" {
+		return value, nil
+	}
+	if defaultValue == "" {
+		return "", fmt.Errorf("%w for %q", errEmptyConfigValue, name)
+	}
+	return defaultValue, nil
+}
+
+// useGitRemoteNamePrefix replaces the default "rcloneprefix" with one that
+// incorporates the name of the git remote, so that git-annex remotes sharing an
+// rclone remote do not collide. The old default is kept in `s.legacyPrefix`.
+func (s *server) useGitRemoteNamePrefix() error {
+	s.sendMsg("GETGITREMOTENAME")
+	message, err := s.getReply()
+	if err != nil {
+		return err
+	}
+	valueKeyword, err := message.nextSpaceDelimitedParameter()
+	if err != nil || valueKeyword != "VALUE" {
+		return &ErrProtocolParse{protocolError(codeError, fmt.Errorf("failed to parse git remote name: %s %s", valueKeyword, message.line))}
+	}
+	name := message.finalParameter()
+	if name == "" {
+		// The git remote may not have a name yet, e.g. during initremote.
+		return nil
+	}
+	s.legacyPrefix = s.configPrefix
+	s.configPrefix = path.Join(defaultRclonePrefix, sanitizeGitRemoteName(name))
+	return nil
+}
+
 func (s *server) handlePrepare() error {
+	// failPrepare reports `err` to git-annex and returns it as an error in the
+	// given category.
+	failPrepare := func(newCategory func(ErrProtocol) error, err error) error {
+		categoryErr := newCategory(protocolError("PREPARE-FAILURE", err))
+		s.sendMsg(fmt.Sprintf("PREPARE-FAILURE [%s] %s", errorCodeOf(categoryErr), err))
+		return categoryErr
+	}
+
 	if err := s.queryConfigs(); err != nil {
-		s.sendMsg("PREPARE-FAILURE Error getting configs")
-		return fmt.Errorf("error getting configs: %w", err)
+		s.sendMsg(fmt.Sprintf("PREPARE-FAILURE [%s] Error getting configs", ErrCodeConfigMissing))
+		return &ErrConfigMissing{protocolError("PREPARE-FAILURE", fmt.Errorf("error getting configs: %w", err))}
+	}
+	if err := s.installLogLevel(); err != nil {
+		return failPrepare(newErrConfigMissing, err)
+	}
+	if err := s.installDebugHTTP(); err != nil {
+		return failPrepare(newErrConfigMissing, err)
+	}
+	if err := s.installBwLimit(); err != nil {
+		return failPrepare(newErrConfigMissing, err)
+	}
+	if err := s.installBandwidthSchedule(); err != nil {
+		return failPrepare(newErrConfigMissing, err)
+	}
+	if err := s.installProxy(); err != nil {
+		return failPrepare(newErrConfigMissing, err)
+	}
+	if err := s.installPiggybackConfig(); err != nil {
+		return failPrepare(newErrConfigMissing, err)
+	}
+	// Report an invalid config now rather than at the first TRANSFER.
+	cfg, err := s.getSessionConfig()
+	if err != nil {
+		return failPrepare(newErrConfigMissing, err)
+	}
+	// Backends may use the cache directory as soon as they are created, so
+	// this must happen before anything below gets an Fs.
+	if err := s.installCacheDir(); err != nil {
+		return failPrepare(newErrConfigMissing, err)
+	}
+	if err := s.applyProtocolTimeout(); err != nil {
+		return failPrepare(newErrConfigMissing, err)
+	}
+	if cfg.checkInterval > 0 && s.stopIntegrityChecksFunc == nil {
+		s.startIntegrityChecks(cfg.checkInterval)
+	}
+	s.warnUnsupportedConnections()
+	// Rejecting invalid remote names is INITREMOTE's job. Any other handler
+	// that uses such a remote will report the problem.
+	if validateRemoteName(s.configRcloneRemoteName) == nil {
+		if err := s.checkUUID(s.sessionContext(), false); err != nil {
+			return failPrepare(newErrRemoteNotFound, err)
+		}
+		if cfg.createPrefix && !s.dryRun {
+			if err := s.createPrefix(s.sessionContext()); err != nil {
+				return failPrepare(newErrRemoteNotFound, err)
+			}
+		}
+		if cfg.warmCache {
+			// The cache is only an optimization, so go on without it.
+			if prefixFs, err := s.getPrefixFs(s.sessionContext()); err != nil {
+				fs.Debugf(nil, "Not warming cache of present keys: %v", err)
+			} else {
+				s.presentKeys = warmPresentKeysCache(s.sessionContext(), prefixFs, cfg.listFilter)
+			}
+		}
 	}
 	s.sendMsg("PREPARE-SUCCESS")
 	return nil
 }
 
+// installBwLimit applies the "rclonebwlimit" config, if any, to rclone's global
+// token bucket. The limit is removed by [server.close].
+func (s *server) installBwLimit() error {
+	if s.configRcloneBwLimit == "" {
+		return nil
+	}
+	var timetable fs.BwTimetable
+	if err := timetable.Set(s.configRcloneBwLimit); err != nil {
+		return fmt.Errorf("failed to parse bandwidth limit %q: %w", s.configRcloneBwLimit, err)
+	}
+	s.setTokenBucketLimit(timetable.LimitAt(time.Now()).Bandwidth)
+	s.bwLimitInstalled = true
+	return nil
+}
+
+// setTokenBucketLimit sets the limit of rclone's global token bucket, which
+// throttles every transfer.
+func (s *server) setTokenBucketLimit(limit fs.BwPair) {
+	if s.setBwLimit != nil {
+		s.setBwLimit(limit)
+		return
+	}
+	accounting.TokenBucket.SetBwLimit(limit)
+}
+
+// installProxy applies the "rcloneproxyurl" config, if any, by setting the
+// proxy environment variables from which rclone's HTTP transports take their
+// proxy. Git-annex starts a process for each remote, so this only affects the
+// remote of this session. net/http reads the variables once, at the first
+// request of the process, so this must happen before any backend is used.
+func (s *server) installProxy() error {
+	if s.configRcloneProxyURL == "" {
+		return nil
+	}
+	proxyURL, err := url.Parse(s.configRcloneProxyURL)
+	if err != nil {
+		return fmt.Errorf("failed to parse proxy URL %q: %w", s.configRcloneProxyURL, err)
+	}
+	if proxyURL.Scheme == "" || proxyURL.Host == "" {
+		return fmt.Errorf("proxy URL must include a scheme and host, e.g. \"http://proxy.example.com:3128\": %q", s.configRcloneProxyURL)
+	}
+	for _, name := range []string{"HTTPS_PROXY", "HTTP_PROXY"} {
+		if err := os.Setenv(name, proxyURL.String()); err != nil {
+			return fmt.Errorf("failed to set %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// installCacheDir applies the "rclonecachedir" config, if any, to rclone's
+// global config. The previous directory is restored by [server.close], but the
+// contents of the new one are kept, since other sessions may share it.
+func (s *server) installCacheDir() error {
+	if s.configRcloneCacheDir == "" {
+		return nil
+	}
+	previous := config.GetCacheDir()
+	if err := config.SetCacheDir(s.configRcloneCacheDir); err != nil {
+		return fmt.Errorf("failed to set cache dir %q: %w", s.configRcloneCacheDir, err)
+	}
+	if !s.cacheDirInstalled {
+		s.previousCacheDir = previous
+		s.cacheDirInstalled = true
+	}
+	if err := os.MkdirAll(config.GetCacheDir(), 0700); err != nil {
+		return fmt.Errorf("failed to create cache dir: %w", err)
+	}
+	return nil
+}
+
+// installLogLevel applies the "rcloneloglevel" config, if any, to rclone's
+// global config. The previous level is restored by [server.close].
+func (s *server) installLogLevel() error {
+	if s.configRcloneLogLevel == "" {
+		return nil
+	}
+	var level fs.LogLevel
+	if err := level.Set(s.configRcloneLogLevel); err != nil {
+		return fmt.Errorf("failed to parse log level %q: %w", s.configRcloneLogLevel, err)
+	}
+	switch level {
+	case fs.LogLevelDebug, fs.LogLevelInfo, fs.LogLevelNotice, fs.LogLevelError:
+	default:
+		return fmt.Errorf("log level must be one of DEBUG, INFO, NOTICE, or ERROR: %q", s.configRcloneLogLevel)
+	}
+	ci := fs.GetConfig(context.TODO())
+	if !s.logLevelInstalled {
+		s.previousLogLevel = ci.LogLevel
+	}
+	ci.LogLevel = level
+	s.logLevelInstalled = true
+	return nil
+}
+
+// installDebugHTTP applies the "rclonedebughttp" config by turning on rclone's
+// dumps of HTTP headers, which are logged at the DEBUG level, so it raises the
+// log level too. Backends read the dump flags when they are created, so this
+// must happen before anything gets an Fs. Both are restored by
+// [server.close].
+func (s *server) installDebugHTTP() error {
+	debugHTTP, err := parseBoolConfig("debug http", s.configRcloneDebugHTTP)
+	if err != nil || !debugHTTP {
+		return err
+	}
+	ci := fs.GetConfig(context.TODO())
+	if !s.dumpInstalled {
+		s.previousDump = ci.Dump
+	}
+	ci.Dump |= fs.DumpHeaders
+	s.dumpInstalled = true
+	if !s.logLevelInstalled {
+		s.previousLogLevel = ci.LogLevel
+	}
+	ci.LogLevel = fs.LogLevelDebug
+	s.logLevelInstalled = true
+	return nil
+}
+
+// applyProtocolTimeout applies the "rcloneprotocoltimeout" config to sendMsg.
+func (s *server) applyProtocolTimeout() error {
+	if s.configRcloneProtocolTimeout == "" {
+		return nil
+	}
+	timeout, err := fs.ParseDuration(s.configRcloneProtocolTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to parse protocol timeout %q: %w", s.configRcloneProtocolTimeout, err)
+	}
+	if timeout < 0 {
+		return fmt.Errorf("protocol timeout must not be negative: %q", s.configRcloneProtocolTimeout)
+	}
+	s.sendTimeout = timeout
+	return nil
+}
+
+// close releases any global state that was modified during the session. It is
+// called when [server.run] returns.
+func (s *server) close() {
+	s.stopIntegrityChecks()
+	if s.bwLimitInstalled {
+		// Restore whichever limit was configured by rclone's own flags.
+		globalLimit := fs.GetConfig(context.TODO()).BwLimit.LimitAt(time.Now())
+		s.setTokenBucketLimit(globalLimit.Bandwidth)
+		s.bwLimitInstalled = false
+	}
+	if s.logLevelInstalled {
+		fs.GetConfig(context.TODO()).LogLevel = s.previousLogLevel
+		s.logLevelInstalled = false
+	}
+	if s.dumpInstalled {
+		fs.GetConfig(context.TODO()).Dump = s.previousDump
+		s.dumpInstalled = false
+	}
+	if s.cacheDirInstalled {
+		_ = config.SetCacheDir(s.previousCacheDir)
+		s.cacheDirInstalled = false
+	}
+}
+
+// Reset clears the state of the previous session, so that the server can run
+// another session with a new reader and writer, e.g. in tests. The configs are
+// queried again, extensions must be negotiated again, and the session metrics
+// start from zero. It must not be called while a session is running.
+func (s *server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.extensionInfo = false
+	s.extensionAsync = false
+	s.extensionGetGitRemoteName = false
+	s.extensionUnavailableResponse = false
+
+	s.configsDone = false
+	s.sessionConfig = nil
+	for _, config := range requiredConfigs {
+		s.mustSetConfigValue(config.id, "")
+	}
+	s.legacyPrefix = ""
+	s.snapshots = nil
+	s.presentKeys = nil
+	s.recentKeys = nil
+	s.integrityChecks = 0
+	s.bwSchedule, s.bwScheduleLimit = nil, nil
+	s.encryptPasswordInConfig = false
+	s.obscuredEncryptPassword = ""
+	s.dirhashCache = nil
+	s.checkpresentListings = nil
+	s.remoteFs, s.remoteFsString = nil, ""
+
+	s.bytesStored, s.bytesRetrieved = 0, 0
+	s.storeCount, s.retrieveCount, s.removeCount, s.checkpresentCount = 0, 0, 0, 0
+	s.errorCount = 0
+	s.startedAt = time.Time{}
+	s.sendErr = nil
+}
+
 // Git-annex is asking us to return the list of settings that we use. Keep this
 // in sync with `handlePrepare()`.
 func (s *server) handleListConfigs() {
 	for _, config := range requiredConfigs {
-		s.sendMsg(fmt.Sprintf("CONFIG %s %s", config.getCanonicalName(), config.fullDescription()))
+		description := config.fullDescription()
+		if config.envVar != "" {
+			description += fmt.Sprintf(" (env: %s)", config.envVar)
+		}
+		s.sendMsg(fmt.Sprintf("CONFIG %s %s", config.getCanonicalName(), description))
 	}
 	s.sendMsg("CONFIGEND")
 }
@@ -331,129 +1332,627 @@ func (s *server) handleListConfigs() {
 func (s *server) handleTransfer(message *messageParser) error {
 	argMode, err := message.nextSpaceDelimitedParameter()
 	if err != nil {
-		s.sendMsg("TRANSFER-FAILURE failed to parse direction")
-		return fmt.Errorf("malformed arguments for TRANSFER: %w", err)
+		s.sendMsg(fmt.Sprintf("TRANSFER-FAILURE [%s] failed to parse direction", ErrCodeProtocolParse))
+		return &ErrProtocolParse{protocolError("TRANSFER-FAILURE", fmt.Errorf("malformed arguments for TRANSFER: %w", err))}
 	}
 	argKey, err := message.nextSpaceDelimitedParameter()
 	if err != nil {
-		s.sendMsg("TRANSFER-FAILURE failed to parse key")
-		return fmt.Errorf("malformed arguments for TRANSFER: %w", err)
+		s.sendMsg(fmt.Sprintf("TRANSFER-FAILURE [%s] failed to parse key", ErrCodeProtocolParse))
+		return &ErrProtocolParse{protocolError("TRANSFER-FAILURE", fmt.Errorf("malformed arguments for TRANSFER: %w", err))}
 	}
 	argFile := message.finalParameter()
 	if argFile == "" {
-		s.sendMsg("TRANSFER-FAILURE failed to parse file path")
-		return errors.New("failed to parse file path")
+		s.sendMsg(fmt.Sprintf("TRANSFER-FAILURE [%s] failed to parse file path", ErrCodeProtocolParse))
+		return &ErrProtocolParse{protocolError("TRANSFER-FAILURE", errors.New("failed to parse file path"))}
+	}
+	// Git-annex has been told about the missing key, so there is no reason to
+	// end the session.
+	if s.fatalAbsence {
+		s.sendMsg(fmt.Sprintf("TRANSFER-FAILURE %s %s [%s] previous key was missing; aborting", argMode, argKey, ErrCodeTransferFailed))
+		return nil
+	}
+	failTransfer := func(newCategory func(ErrProtocol) error, err error) error {
+		categoryErr := newCategory(protocolError("TRANSFER-FAILURE", err))
+		s.sendMsg(fmt.Sprintf("TRANSFER-FAILURE %s %s [%s] %s", argMode, argKey, errorCodeOf(categoryErr), err))
+		return categoryErr
 	}
 
 	if err := s.queryConfigs(); err != nil {
-		s.sendMsg(fmt.Sprintf("TRANSFER-FAILURE %s %s failed to get configs", argMode, argKey))
-		return fmt.Errorf("error getting configs: %w", err)
+		s.sendMsg(fmt.Sprintf("TRANSFER-FAILURE %s %s [%s] failed to get configs", argMode, argKey, ErrCodeConfigMissing))
+		return &ErrConfigMissing{protocolError("TRANSFER-FAILURE", fmt.Errorf("error getting configs: %w", err))}
 	}
-
-	layout := parseLayoutMode(s.configRcloneLayout)
-	if layout == layoutModeUnknown {
-		s.sendMsg(fmt.Sprintf("TRANSFER-FAILURE %s", argKey))
-		return fmt.Errorf("error parsing layout mode: %q", s.configRcloneLayout)
+	cfg, err := s.getSessionConfig()
+	if err != nil {
+		return failTransfer(newErrConfigMissing, err)
 	}
+	s.applyBandwidthSchedule()
+	// Transfers only wait for an INITREMOTE that holds the lock file, not for
+	// each other.
+	if s.configRcloneLockFile != "" {
+		unlock, err := lockFile(s.configRcloneLockFile, false)
+		if err != nil {
+			return failTransfer(newErrConfigMissing, err)
+		}
+		defer unlock()
+	}
+	layout := cfg.layout
 
-	remoteFsString, err := buildFsString(s.queryDirhash, layout, argKey, s.configRcloneRemoteName, s.configPrefix)
+	remoteFsString, err := s.buildFsString(layout, argKey)
 	if err != nil {
-		s.sendMsg(fmt.Sprintf("TRANSFER-FAILURE %s", argKey))
-		return fmt.Errorf("error building fs string: %w", err)
+		s.sendMsg(fmt.Sprintf("TRANSFER-FAILURE %s %s [%s] failed to build fs string: %s", argMode, argKey, ErrCodeRemoteNotFound, err))
+		return &ErrRemoteNotFound{protocolError("TRANSFER-FAILURE", fmt.Errorf("error building fs string: %w", err))}
 	}
 
-	remoteFs, err := cache.Get(context.TODO(), remoteFsString)
+	remoteFs, err := s.getRemoteFs(s.sessionContext(), remoteFsString)
 	if err != nil {
-		s.sendMsg(fmt.Sprintf("TRANSFER-FAILURE %s %s failed to get remote fs", argMode, argKey))
-		return err
+		s.sendMsg(fmt.Sprintf("TRANSFER-FAILURE %s %s [%s] failed to get remote fs", argMode, argKey, ErrCodeRemoteNotFound))
+		return &ErrRemoteNotFound{protocolError("TRANSFER-FAILURE", err)}
 	}
 
 	localDir := filepath.Dir(argFile)
-	localFs, err := cache.Get(context.TODO(), localDir)
+	localFs, err := cache.Get(s.sessionContext(), localDir)
 	if err != nil {
-		s.sendMsg(fmt.Sprintf("TRANSFER-FAILURE %s %s failed to get local fs", argMode, argKey))
-		return fmt.Errorf("failed to get local fs: %w", err)
+		s.sendMsg(fmt.Sprintf("TRANSFER-FAILURE %s %s [%s] failed to get local fs", argMode, argKey, ErrCodeTransferFailed))
+		return &ErrTransferFailed{protocolError("TRANSFER-FAILURE", fmt.Errorf("failed to get local fs: %w", err))}
 	}
 
 	remoteFileName := argKey
 	localFileName := filepath.Base(argFile)
 
+	// Like rclone's other commands, retry a failed transfer as a whole
+	// --cfg.retries times.
+	attempts := fs.GetConfig(s.sessionContext()).Retries
+	// tooLarge reports whether a file of the given size exceeds the
+	// "rclonemaxtransfersize" config, and if so, tells git-annex. Refusing a
+	// file is not a reason to end the session.
+	tooLarge := func(size int64) bool {
+		if cfg.maxTransferSize == 0 || size <= cfg.maxTransferSize {
+			return false
+		}
+		s.sendMsg(fmt.Sprintf("TRANSFER-FAILURE %s %s [%s] file too large: %s > %s", argMode, argKey, ErrCodeTooLarge,
+			fs.SizeSuffix(size).ByteUnit(), fs.SizeSuffix(cfg.maxTransferSize).ByteUnit()))
+		return true
+	}
+
 	switch argMode {
 	case "STORE":
-		err = operations.CopyFile(context.TODO(), remoteFs, localFs, remoteFileName, localFileName)
+		storeFsString, err := s.buildStoreFsString(layout, argKey)
 		if err != nil {
-			s.sendMsg(fmt.Sprintf("TRANSFER-FAILURE %s %s failed to copy file: %s", argMode, argKey, err))
-			return err
+			s.sendMsg(fmt.Sprintf("TRANSFER-FAILURE %s %s [%s] failed to build fs string: %s", argMode, argKey, ErrCodeRemoteNotFound, err))
+			return &ErrRemoteNotFound{protocolError("TRANSFER-FAILURE", fmt.Errorf("error building fs string: %w", err))}
+		}
+		if storeFsString != remoteFsString {
+			remoteFs, err = s.getRemoteFs(s.sessionContext(), storeFsString)
+			if err != nil {
+				s.sendMsg(fmt.Sprintf("TRANSFER-FAILURE %s %s [%s] failed to get remote fs", argMode, argKey, ErrCodeRemoteNotFound))
+				return &ErrRemoteNotFound{protocolError("TRANSFER-FAILURE", err)}
+			}
+		}
+		// Refusing a key is not a reason to end the session.
+		if keyIsExcluded(argKey, cfg.excludePatterns) {
+			s.sendMsg(fmt.Sprintf("TRANSFER-FAILURE %s %s [%s] excluded by rcloneexcludekeys", argMode, argKey, ErrCodeKeyExcluded))
+			return nil
+		}
+		// Keys are named after their content, so an object stored under the
+		// key already holds it.
+		if !cfg.overwriteExisting {
+			_, err := remoteFs.NewObject(s.sessionContext(), remoteFileName)
+			if err == nil {
+				break
+			}
+			if !errors.Is(err, fs.ErrorObjectNotFound) {
+				s.sendMsg(fmt.Sprintf("TRANSFER-FAILURE %s %s [%s] failed to check for existing object: %s", argMode, argKey, ErrCodeTransferFailed, err))
+				return &ErrTransferFailed{protocolError("TRANSFER-FAILURE", err)}
+			}
+		}
+		hashType, err := selectHashType(remoteFs, localFs, s.configRcloneChecksum)
+		if err != nil {
+			return failTransfer(newErrConfigMissing, err)
 		}
+		info, err := os.Stat(argFile)
+		if err != nil {
+			s.sendMsg(fmt.Sprintf("TRANSFER-FAILURE %s %s [%s] failed to stat file: %s", argMode, argKey, ErrCodeTransferFailed, err))
+			return &ErrTransferFailed{protocolError("TRANSFER-FAILURE", err)}
+		}
+		if tooLarge(info.Size()) {
+			return nil
+		}
+		if s.dryRun {
+			s.refuseDryRunStore(argKey)
+			return nil
+		}
+		s.forgetListing(remoteFsString)
+		ctx, stopProgress, err := s.startProgress(s.sessionContext())
+		if err != nil {
+			return failTransfer(newErrConfigMissing, err)
+		}
+		defer stopProgress()
+		ctx, err = withCopyFlags(ctx, cfg.copyFlags)
+		if err != nil {
+			return failTransfer(newErrConfigMissing, err)
+		}
+		if cfg.objectLockRetention > 0 {
+			ctx = objectLockContext(ctx, cfg.objectLockRetention, time.Now())
+		}
+		if cfg.tagging != "" {
+			ctx = taggingContext(ctx, cfg.tagging)
+		}
+		// The hash that operations.CopyFile compared, if it did the upload.
+		copiedHash := hash.None
+		if cfg.chunkSize > 0 && info.Size() > cfg.chunkSize && cfg.resumeTransfer {
+			_, err = storeResumable(ctx, remoteFs, argKey, argFile, cfg.chunkSize, info.Size())
+			if err != nil {
+				s.sendMsg(fmt.Sprintf("TRANSFER-FAILURE %s %s [%s] failed to store chunks: %s", argMode, argKey, ErrCodeTransferFailed, err))
+				return &ErrTransferFailed{protocolError("TRANSFER-FAILURE", err)}
+			}
+		} else if cfg.chunkSize > 0 && info.Size() > cfg.chunkSize {
+			err = storeChunked(ctx, remoteFs, argKey, argFile, cfg.chunkSize)
+			if err != nil {
+				s.sendMsg(fmt.Sprintf("TRANSFER-FAILURE %s %s [%s] failed to store chunks: %s", argMode, argKey, ErrCodeTransferFailed, err))
+				return &ErrTransferFailed{protocolError("TRANSFER-FAILURE", err)}
+			}
+		} else {
+			upload := func(dst fs.Fs) error {
+				copiedHash = hash.None
+				if cfg.gzip {
+					return storeGzipped(ctx, dst, argKey, argFile, cfg.gzipLevel, cfg.copyBufferSize)
+				}
+				if cfg.cutoffSize > 0 && info.Size() > cfg.cutoffSize && dst.Features().PutStream != nil {
+					if err := storeStreamed(ctx, dst, argKey, argFile); err != nil {
+						return fmt.Errorf("failed to stream file: %w", err)
+					}
+					return nil
+				}
+				if err := operations.CopyFile(ctx, dst, localFs, remoteFileName, localFileName); err != nil {
+					return fmt.Errorf("failed to copy file: %w", err)
+				}
+				copiedHash, _ = operations.CommonHash(ctx, dst, localFs)
+				return nil
+			}
+			if s.configRcloneTemporaryPrefix != "" {
+				temporaryFs, fsErr := s.getTemporaryFs(ctx, argKey)
+				if fsErr != nil {
+					s.sendMsg(fmt.Sprintf("TRANSFER-FAILURE %s %s [%s] failed to get temporary fs", argMode, argKey, ErrCodeRemoteNotFound))
+					return &ErrRemoteNotFound{protocolError("TRANSFER-FAILURE", fsErr)}
+				}
+				err = retryTransfer(ctx, attempts, cfg.retries, func() error {
+					return storeViaTemporary(ctx, remoteFs, temporaryFs, remoteFileName, upload)
+				})
+			} else {
+				err = retryTransfer(ctx, attempts, cfg.retries, func() error {
+					return upload(remoteFs)
+				})
+			}
+			if err != nil {
+				return failTransfer(newErrTransferFailed, err)
+			}
+		}
+		// Chunks are not verified because no single object holds the key, and
+		// gzipped objects differ from the local file by design.
+		if (cfg.chunkSize == 0 || info.Size() <= cfg.chunkSize) && !cfg.gzip {
+			if cfg.verifySize {
+				if err := verifyStoredSize(s.sessionContext(), remoteFs, argKey, info.Size(), cfg.objectLockRetention > 0); err != nil {
+					return failTransfer(newErrTransferFailed, err)
+				}
+			}
+			// There is no need to read both files again for a hash that the
+			// copy already compared.
+			if hashType != copiedHash {
+				if err := verifyStored(s.sessionContext(), remoteFs, argKey, argFile, hashType); err != nil {
+					s.sendMsg(fmt.Sprintf("TRANSFER-FAILURE %s %s [%s] failed to verify file: %s", argMode, argKey, ErrCodeTransferFailed, err))
+					return &ErrTransferFailed{protocolError("TRANSFER-FAILURE", err)}
+				}
+			}
+			// Chunks already carry the local file's modification time.
+			if cfg.preserveModTime {
+				if err := setStoredModTime(s.sessionContext(), remoteFs, argKey, info.ModTime()); err != nil {
+					s.sendMsg(fmt.Sprintf("TRANSFER-FAILURE %s %s [%s] failed to set mtime: %s", argMode, argKey, ErrCodeTransferFailed, err))
+					return &ErrTransferFailed{protocolError("TRANSFER-FAILURE", err)}
+				}
+			}
+		}
+		s.addRecentKey(argKey, storeFsString)
+		s.storeCount++
+		s.bytesStored += info.Size()
 
 	case "RETRIEVE":
-		err = operations.CopyFile(context.TODO(), localFs, remoteFs, localFileName, remoteFileName)
+		retrieveFsString, err := s.buildRetrieveFsString(layout, argKey)
+		if err != nil {
+			s.sendMsg(fmt.Sprintf("TRANSFER-FAILURE %s %s [%s] failed to build fs string: %s", argMode, argKey, ErrCodeConfigMissing, err))
+			return &ErrConfigMissing{protocolError("TRANSFER-FAILURE", fmt.Errorf("error building fs string: %w", err))}
+		}
+		if retrieveFsString != remoteFsString {
+			remoteFs, err = s.getRemoteFs(s.sessionContext(), retrieveFsString)
+			if err != nil {
+				s.sendMsg(fmt.Sprintf("TRANSFER-FAILURE %s %s [%s] failed to get cached remote fs", argMode, argKey, ErrCodeRemoteNotFound))
+				return &ErrRemoteNotFound{protocolError("TRANSFER-FAILURE", err)}
+			}
+		}
+		// Errors finding the key are left for the download to report.
+		if cfg.maxTransferSize > 0 {
+			size, err := storedKeySize(s.sessionContext(), remoteFs, argKey)
+			if err == nil && tooLarge(size) {
+				return nil
+			}
+		}
+		// A failed restore request is left for the download to report, since
+		// the object may not be archived at all.
+		if cfg.restoreTier != "" {
+			if err := requestRestore(s.sessionContext(), remoteFs, remoteFileName, cfg.restoreTier); err != nil {
+				fs.Debugf(remoteFs, "Failed to restore %s: %v", remoteFileName, err)
+			}
+		}
+		ctx, stopProgress, err := s.startProgress(s.sessionContext())
+		if err != nil {
+			return failTransfer(newErrConfigMissing, err)
+		}
+		defer stopProgress()
+		ctx, err = withCopyFlags(ctx, cfg.copyFlags)
+		if err != nil {
+			return failTransfer(newErrConfigMissing, err)
+		}
+		err = retryTransfer(ctx, attempts, cfg.retries, func() error {
+			if cfg.gzip {
+				return retrieveGzipped(ctx, remoteFs, remoteFileName, argFile, cfg.copyBufferSize)
+			}
+			return operations.CopyFile(ctx, localFs, remoteFs, localFileName, remoteFileName)
+		})
+		// When the key is missing, it may have been stored in chunks.
+		if errors.Is(err, fs.ErrorObjectNotFound) {
+			err = retrieveChunked(ctx, remoteFs, argKey, argFile, cfg.copyBufferSize)
+		}
+		// Or it may have been stored under the old default prefix or in a
+		// snapshot.
+		sourceFs := remoteFs
+		if errors.Is(err, fs.ErrorObjectNotFound) {
+			sourceFs, err = s.retrieveFromFallbackPrefixes(s.sessionContext(), layout, argKey, argFile, cfg.copyBufferSize)
+		}
 		// It is non-fatal when retrieval fails because the file is missing on
-		// the remote.
-		if err == fs.ErrorObjectNotFound {
-			s.sendMsg(fmt.Sprintf("TRANSFER-FAILURE %s %s not found", argMode, argKey))
-			return nil
+		// the remote, though "rclonefailonabsent" fails later transfers.
+		if errors.Is(err, fs.ErrorObjectNotFound) {
+			s.fatalAbsence = cfg.failOnAbsent
+			s.sendMsg(fmt.Sprintf("TRANSFER-FAILURE %s %s [%s] not found", argMode, argKey, ErrCodeKeyNotFound))
+			return &ErrKeyNotFound{protocolError("TRANSFER-FAILURE", err)}
 		}
 		if err != nil {
-			s.sendMsg(fmt.Sprintf("TRANSFER-FAILURE %s %s failed to copy file: %s", argMode, argKey, err))
-			return err
+			s.sendMsg(fmt.Sprintf("TRANSFER-FAILURE %s %s [%s] failed to copy file: %s", argMode, argKey, ErrCodeTransferFailed, err))
+			return &ErrTransferFailed{protocolError("TRANSFER-FAILURE", err)}
+		}
+		// Keys of other types do not embed a hash to check against. The
+		// --ignore-checksum copy flag skips this check like rclone's own.
+		if wantSum, ok := sha256FromKey(argKey); ok && cfg.sha256Verify && !fs.GetConfig(ctx).IgnoreChecksum {
+			if err := verifySHA256(argFile, wantSum); err != nil {
+				_ = os.Remove(argFile)
+				return failTransfer(newErrTransferFailed, err)
+			}
+		}
+		if cfg.preserveModTime {
+			err = restoreModTime(s.sessionContext(), sourceFs, argKey, argFile)
+			if err != nil {
+				s.sendMsg(fmt.Sprintf("TRANSFER-FAILURE %s %s [%s] failed to set mtime: %s", argMode, argKey, ErrCodeTransferFailed, err))
+				return &ErrTransferFailed{protocolError("TRANSFER-FAILURE", err)}
+			}
+		}
+		// A key retrieved from a fallback prefix is not where it belongs.
+		if sourceFs == remoteFs {
+			s.addRecentKey(argKey, retrieveFsString)
+		}
+		s.retrieveCount++
+		if info, err := os.Stat(argFile); err == nil {
+			s.bytesRetrieved += info.Size()
 		}
 
 	default:
-		s.sendMsg(fmt.Sprintf("TRANSFER-FAILURE %s %s unrecognized mode", argMode, argKey))
-		return fmt.Errorf("received malformed TRANSFER mode: %v", argMode)
+		s.sendMsg(fmt.Sprintf("TRANSFER-FAILURE %s %s [%s] unrecognized mode", argMode, argKey, ErrCodeProtocolParse))
+		return &ErrProtocolParse{protocolError("TRANSFER-FAILURE", fmt.Errorf("received malformed TRANSFER mode: %v", argMode))}
 	}
 
 	s.sendMsg(fmt.Sprintf("TRANSFER-SUCCESS %s %s", argMode, argKey))
 	return nil
 }
 
+// refuseDryRunStore tells git-annex that storing `key` was skipped in dry-run
+// mode. Git-annex records a successful TRANSFER in its location log, so a
+// skipped one must fail, or the log would claim content the remote lacks.
+// Refusing a store is not a reason to end the session.
+func (s *server) refuseDryRunStore(key string) {
+	s.sendInfo(fmt.Sprintf("[dry-run] skipping store %s", key))
+	s.sendMsg(fmt.Sprintf("TRANSFER-FAILURE STORE %s [%s] [dry-run] store skipped", key, ErrCodeTransferFailed))
+}
+
+// storeStreamed uploads the local file at `localPath` to `remoteFs` with
+// [operations.Rcat]. Unlike [operations.CopyFile], this goes through the
+// backend's PutStream, which lets backends such as S3 switch to a multipart
+// upload for files too large to upload in a single request.
+func storeStreamed(ctx context.Context, remoteFs fs.Fs, key, localPath string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to open local file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to stat local file: %w", err)
+	}
+	// Rcat closes `f`.
+	_, err = operations.Rcat(ctx, remoteFs, key, f, info.ModTime(), nil)
+	return err
+}
+
+// findKey returns nil if `key`, or the chunk manifest of `key`, exists in
+// `remoteFs`. Otherwise, it returns an error such as [fs.ErrorObjectNotFound].
+func findKey(ctx context.Context, remoteFs fs.Fs, key string) error {
+	_, err := findKeyObject(ctx, remoteFs, key)
+	return err
+}
+
+// storedKeySize returns the size of `key` in `remoteFs`, whether it was stored
+// as one object or in chunks.
+func storedKeySize(ctx context.Context, remoteFs fs.Fs, key string) (int64, error) {
+	obj, err := remoteFs.NewObject(ctx, key)
+	if errors.Is(err, fs.ErrorObjectNotFound) {
+		return chunkedSize(ctx, remoteFs, key)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return obj.Size(), nil
+}
+
+// findKeyObject is like [findKey], but returns the object it found.
+func findKeyObject(ctx context.Context, remoteFs fs.Fs, key string) (fs.Object, error) {
+	obj, err := remoteFs.NewObject(ctx, key)
+	if !errors.Is(err, fs.ErrorObjectNotFound) {
+		return obj, err
+	}
+	// When the key is missing, it may have been stored in chunks.
+	obj, err = remoteFs.NewObject(ctx, manifestName(key))
+	if err != nil {
+		return nil, err
+	}
+	inProgress, err := storeInProgress(ctx, remoteFs, key)
+	if err != nil {
+		return nil, err
+	}
+	if inProgress {
+		return nil, fs.ErrorObjectNotFound
+	}
+	return obj, nil
+}
+
+// getRemoteFs returns the Fs for `fsString`. Handlers call it for every key,
+// so it remembers the last Fs rather than asking rclone's cache again when
+// the next key is in the same directory.
+func (s *server) getRemoteFs(ctx context.Context, fsString string) (fs.Fs, error) {
+	if s.remoteFs != nil && s.remoteFsString == fsString {
+		return s.remoteFs, nil
+	}
+	getFs := s.getFs
+	if getFs == nil {
+		getFs = cache.Get
+	}
+	f, err := getFs(ctx, fsString)
+	if err != nil {
+		return nil, err
+	}
+	s.remoteFs, s.remoteFsString = f, fsString
+	return f, nil
+}
+
+// getFallbackFs returns the Fs where `key` would be stored under `prefix`, one
+// of [server.fallbackPrefixes], rather than the "rcloneprefix" config.
+func (s *server) getFallbackFs(ctx context.Context, layout layoutMode, key, prefix string) (fs.Fs, error) {
+	prefixFsString, err := s.buildFsStringWithPrefix(layout, key, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("error building fs string: %w", err)
+	}
+	return s.getRemoteFs(ctx, prefixFsString)
+}
+
+// retrieveFromFallbackPrefixes is like the RETRIEVE branch of handleTransfer,
+// but downloads `key` from under the first of [server.fallbackPrefixes] that
+// holds it. Chunks are copied through a buffer of `bufferSize` bytes. It
+// returns the Fs it downloaded from.
+func (s *server) retrieveFromFallbackPrefixes(ctx context.Context, layout layoutMode, key, localPath string, bufferSize int) (fs.Fs, error) {
+	prefixes, err := s.fallbackPrefixes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	localFs, err := cache.Get(ctx, filepath.Dir(localPath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get local fs: %w", err)
+	}
+	for _, prefix := range prefixes {
+		prefixFs, err := s.getFallbackFs(ctx, layout, key, prefix)
+		if err != nil {
+			return nil, err
+		}
+		err = operations.CopyFile(ctx, localFs, prefixFs, filepath.Base(localPath), key)
+		if errors.Is(err, fs.ErrorObjectNotFound) {
+			err = retrieveChunked(ctx, prefixFs, key, localPath, bufferSize)
+		}
+		if !errors.Is(err, fs.ErrorObjectNotFound) {
+			return prefixFs, err
+		}
+	}
+	return nil, fs.ErrorObjectNotFound
+}
+
 func (s *server) handleCheckPresent(message *messageParser) error {
+	argKey, lookup, err := s.prepareCheckPresent(message)
+	if err != nil {
+		return err
+	}
+	return s.replyCheckPresent(argKey, lookup.find(s.sessionContext()))
+}
+
+// checkPresentLookup looks for a key on behalf of CHECKPRESENT. The Fs values
+// it needs are resolved beforehand by [server.prepareCheckPresent].
+type checkPresentLookup struct {
+	s              *server
+	key            string
+	remoteFs       fs.Fs
+	remoteFsString string
+	// When nonzero, the key is found in a listing of the prefix directory;
+	// see [server.findKeyInListing].
+	window time.Duration
+	// The fs strings where the key would be stored under
+	// [server.fallbackPrefixes], which are only looked up when the key is
+	// missing.
+	fallbackFsStrings []string
+	getFs             func(ctx context.Context, fsString string) (fs.Fs, error)
+	// When not nil, keys that are known to be present without a lookup.
+	presentKeys *presentKeysCache
+	// Whether to accept an object whose name matches the key in all but
+	// case; see [findKeyIgnoringCase].
+	ignoreCase bool
+	// When not nil, the filter from the "rclonefilterflags" config, which
+	// applies to listings of the prefix directory.
+	listFilter *filter.Filter
+}
+
+// find returns nil if the key is present, [fs.ErrorObjectNotFound] if it is
+// not, or another error if presence could not be determined.
+func (l *checkPresentLookup) find(ctx context.Context) error {
+	if l.presentKeys != nil && l.presentKeys.has(l.key) {
+		return nil
+	}
+	var err error
+	if l.window > 0 {
+		err = l.s.findKeyInListing(ctx, l.remoteFsString, l.remoteFs, l.key, l.window, l.listFilter)
+	} else {
+		err = findKey(ctx, l.remoteFs, l.key)
+	}
+	if l.ignoreCase && errors.Is(err, fs.ErrorObjectNotFound) {
+		err = findKeyIgnoringCase(ctx, l.remoteFs, l.key, l.listFilter)
+	}
+	// The key may have been stored under the old default prefix or in a
+	// snapshot.
+	for _, fsString := range l.fallbackFsStrings {
+		if !errors.Is(err, fs.ErrorObjectNotFound) {
+			break
+		}
+		var prefixFs fs.Fs
+		prefixFs, err = l.getFs(ctx, fsString)
+		if err == nil {
+			err = findKey(ctx, prefixFs, l.key)
+		}
+	}
+	return err
+}
+
+// prepareCheckPresent parses a CHECKPRESENT message and resolves everything
+// needed to look for its key. On failure, it replies to git-annex itself.
+func (s *server) prepareCheckPresent(message *messageParser) (string, *checkPresentLookup, error) {
 	argKey := message.finalParameter()
 	if argKey == "" {
-		return errors.New("failed to parse response for CHECKPRESENT")
+		return "", nil, &ErrProtocolParse{protocolError(codeError, errors.New("failed to parse response for CHECKPRESENT"))}
 	}
 
 	if err := s.queryConfigs(); err != nil {
-		s.sendMsg(fmt.Sprintf("CHECKPRESENT-FAILURE %s failed to get configs", argKey))
-		return fmt.Errorf("error getting configs: %s", err)
+		s.sendMsg(fmt.Sprintf("CHECKPRESENT-FAILURE %s [%s] failed to get configs", argKey, ErrCodeConfigMissing))
+		return "", nil, &ErrConfigMissing{protocolError("CHECKPRESENT-FAILURE", fmt.Errorf("error getting configs: %s", err))}
 	}
 
-	layout := parseLayoutMode(s.configRcloneLayout)
-	if layout == layoutModeUnknown {
-		s.sendMsg(fmt.Sprintf("CHECKPRESENT-FAILURE %s", argKey))
-		return fmt.Errorf("error parsing layout mode: %q", s.configRcloneLayout)
+	cfg, err := s.getSessionConfig()
+	if err != nil {
+		s.sendMsg(fmt.Sprintf("CHECKPRESENT-FAILURE %s [%s] %s", argKey, ErrCodeConfigMissing, err))
+		return "", nil, &ErrConfigMissing{protocolError("CHECKPRESENT-FAILURE", err)}
 	}
+	layout := cfg.layout
 
-	remoteFsString, err := buildFsString(s.queryDirhash, layout, argKey, s.configRcloneRemoteName, s.configPrefix)
+	remoteFsString, err := s.buildFsString(layout, argKey)
 	if err != nil {
-		s.sendMsg(fmt.Sprintf("CHECKPRESENT-FAILURE %s", argKey))
-		return fmt.Errorf("error building fs string: %w", err)
+		s.sendMsg(fmt.Sprintf("CHECKPRESENT-FAILURE %s [%s] failed to build fs string: %s", argKey, ErrCodeRemoteNotFound, err))
+		return "", nil, &ErrRemoteNotFound{protocolError("CHECKPRESENT-FAILURE", fmt.Errorf("error building fs string: %w", err))}
 	}
 
-	remoteFs, err := cache.Get(context.TODO(), remoteFsString)
+	remoteFs, err := s.getRemoteFs(s.sessionContext(), remoteFsString)
 	if err != nil {
-		s.sendMsg(fmt.Sprintf("CHECKPRESENT-UNKNOWN %s failed to get remote fs", argKey))
-		return err
+		s.sendMsg(fmt.Sprintf("CHECKPRESENT-UNKNOWN %s [%s] failed to get remote fs", argKey, ErrCodeRemoteNotFound))
+		return "", nil, &ErrRemoteNotFound{protocolError("CHECKPRESENT-UNKNOWN", err)}
 	}
 
-	_, err = remoteFs.NewObject(context.TODO(), argKey)
-	if err == fs.ErrorObjectNotFound {
-		s.sendMsg(fmt.Sprintf("CHECKPRESENT-FAILURE %s", argKey))
-		return nil
+	lookup := &checkPresentLookup{
+		s:              s,
+		key:            argKey,
+		remoteFs:       remoteFs,
+		remoteFsString: remoteFsString,
+		presentKeys:    s.presentKeys,
+		ignoreCase:     cfg.ignoreCase,
+		listFilter:     cfg.listFilter,
 	}
+	if layout == layoutModeNodir {
+		lookup.window = cfg.checkPresentWindow
+	}
+	prefixes, err := s.fallbackPrefixes(s.sessionContext())
 	if err != nil {
-		s.sendMsg(fmt.Sprintf("CHECKPRESENT-UNKNOWN %s error finding file", argKey))
-		return err
+		s.sendMsg(fmt.Sprintf("CHECKPRESENT-UNKNOWN %s [%s] error finding file", argKey, ErrCodeTransferFailed))
+		return "", nil, &ErrTransferFailed{protocolError("CHECKPRESENT-UNKNOWN", err)}
+	}
+	lookup.getFs = s.getFs
+	if lookup.getFs == nil {
+		lookup.getFs = cache.Get
+	}
+	for _, prefix := range prefixes {
+		fsString, err := s.buildFsStringWithPrefix(layout, argKey, prefix)
+		if err != nil {
+			s.sendMsg(fmt.Sprintf("CHECKPRESENT-UNKNOWN %s [%s] error finding file", argKey, ErrCodeTransferFailed))
+			return "", nil, &ErrTransferFailed{protocolError("CHECKPRESENT-UNKNOWN", err)}
+		}
+		lookup.fallbackFsStrings = append(lookup.fallbackFsStrings, fsString)
 	}
+	return argKey, lookup, nil
+}
 
-	s.sendMsg(fmt.Sprintf("CHECKPRESENT-SUCCESS %s", argKey))
+// replyCheckPresent tells git-annex the outcome of looking for `key`, where
+// `err` is the result of [checkPresentLookup.find].
+func (s *server) replyCheckPresent(key string, err error) error {
+	if errors.Is(err, fs.ErrorObjectNotFound) {
+		s.checkpresentCount++
+		s.sendMsg(fmt.Sprintf("CHECKPRESENT-FAILURE %s", key))
+		return &ErrKeyNotFound{protocolError("CHECKPRESENT-FAILURE", err)}
+	}
+	if err != nil {
+		s.sendMsg(fmt.Sprintf("CHECKPRESENT-UNKNOWN %s [%s] error finding file", key, ErrCodeTransferFailed))
+		return &ErrTransferFailed{protocolError("CHECKPRESENT-UNKNOWN", err)}
+	}
+
+	s.checkpresentCount++
+	s.sendMsg(fmt.Sprintf("CHECKPRESENT-SUCCESS %s", key))
 	return nil
 }
 
-func (s *server) queryDirhash(msg string) (string, error) {
+// queryDirhash asks git-annex for the mixed-case hash directories of `key`,
+// e.g. "Xq/3v/".
+func (s *server) queryDirhash(key string) (string, error) {
+	return s.sendDirhashQuery("DIRHASH " + key)
+}
+
+// queryDirhashLower asks git-annex for the lowercase hash directories of `key`,
+// e.g. "f87/4d1/".
+func (s *server) queryDirhashLower(key string) (string, error) {
+	return s.sendDirhashQuery("DIRHASH-LOWER " + key)
+}
+
+// queryDirhashVariant is a [queryDirhashFunc] that dispatches to
+// [server.queryDirhash] or [server.queryDirhashLower].
+func (s *server) queryDirhashVariant(variant dirhashVariant, key string) (string, error) {
+	if variant == dirhashLower {
+		return s.queryDirhashLower(key)
+	}
+	return s.queryDirhash(key)
+}
+
+// sendDirhashQuery sends a DIRHASH or DIRHASH-LOWER message and returns the
+// reply. Replies are cached, since buildFsString may need the same dirhash
+// several times while handling a single key.
+func (s *server) sendDirhashQuery(msg string) (string, error) {
+	if dirhash, ok := s.dirhashCache[msg]; ok {
+		return dirhash, nil
+	}
 	s.sendMsg(msg)
-	parser, err := s.getMsg()
+	parser, err := s.getReply()
 	if err != nil {
 		return "", err
 	}
@@ -468,70 +1967,182 @@ func (s *server) queryDirhash(msg string) (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("failed to parse dirhash: %w", err)
 	}
+	if s.dirhashCache == nil {
+		s.dirhashCache = make(map[string]string)
+	}
+	s.dirhashCache[msg] = dirhash
 	return dirhash, nil
 }
 
 func (s *server) handleRemove(message *messageParser) error {
 	argKey := message.finalParameter()
 	if argKey == "" {
-		return errors.New("failed to parse key for REMOVE")
+		return &ErrProtocolParse{protocolError(codeError, errors.New("failed to parse key for REMOVE"))}
 	}
 
-	layout := parseLayoutMode(s.configRcloneLayout)
-	if layout == layoutModeUnknown {
-		s.sendMsg(fmt.Sprintf("REMOVE-FAILURE %s", argKey))
-		return fmt.Errorf("error parsing layout mode: %q", s.configRcloneLayout)
+	cfg, err := s.getSessionConfig()
+	if err != nil {
+		s.sendMsg(fmt.Sprintf("REMOVE-FAILURE %s [%s] %s", argKey, ErrCodeConfigMissing, err))
+		return &ErrConfigMissing{protocolError("REMOVE-FAILURE", err)}
 	}
+	layout := cfg.layout
 
-	remoteFsString, err := buildFsString(s.queryDirhash, layout, argKey, s.configRcloneRemoteName, s.configPrefix)
+	// Only the "rcloneprefix" directory is touched, since snapshots are
+	// immutable, and so is the old default prefix, from which CHECKPRESENT and
+	// RETRIEVE still find keys. Otherwise, a key dropped from the remote
+	// would still be reported present.
+	remoteFsString, err := s.buildFsString(layout, argKey)
 	if err != nil {
-		s.sendMsg(fmt.Sprintf("REMOVE-FAILURE %s", argKey))
-		return fmt.Errorf("error building fs string: %w", err)
+		s.sendMsg(fmt.Sprintf("REMOVE-FAILURE %s [%s] failed to build fs string: %s", argKey, ErrCodeRemoteNotFound, err))
+		return &ErrRemoteNotFound{protocolError("REMOVE-FAILURE", fmt.Errorf("error building fs string: %w", err))}
+	}
+	remoteFsStrings := []string{remoteFsString}
+	if s.legacyPrefix != "" {
+		legacyFsString, err := s.buildFsStringWithPrefix(layout, argKey, s.legacyPrefix)
+		if err != nil {
+			s.sendMsg(fmt.Sprintf("REMOVE-FAILURE %s [%s] failed to build fs string: %s", argKey, ErrCodeRemoteNotFound, err))
+			return &ErrRemoteNotFound{protocolError("REMOVE-FAILURE", fmt.Errorf("error building fs string: %w", err))}
+		}
+		remoteFsStrings = append(remoteFsStrings, legacyFsString)
 	}
 
-	remoteFs, err := cache.Get(context.TODO(), remoteFsString)
-	if err != nil {
-		s.sendMsg(fmt.Sprintf("REMOVE-FAILURE %s", argKey))
-		return fmt.Errorf("error getting remote fs: %w", err)
+	remoteFss := make([]fs.Fs, 0, len(remoteFsStrings))
+	for _, fsString := range remoteFsStrings {
+		remoteFs, err := s.getRemoteFs(s.sessionContext(), fsString)
+		if err != nil {
+			s.sendMsg(fmt.Sprintf("REMOVE-FAILURE %s [%s] failed to get remote fs: %s", argKey, ErrCodeRemoteNotFound, err))
+			return &ErrRemoteNotFound{protocolError("REMOVE-FAILURE", fmt.Errorf("error getting remote fs: %w", err))}
+		}
+		remoteFss = append(remoteFss, remoteFs)
 	}
 
-	fileObj, err := remoteFs.NewObject(context.TODO(), argKey)
+	// Locked objects cannot be deleted, so do not try. Refusing to remove a
+	// key is not a reason to end the session.
+	if cfg.objectLockRetention > 0 {
+		s.sendMsg(fmt.Sprintf("REMOVE-FAILURE %s [%s] object locking enabled: cannot delete", argKey, ErrCodeTransferFailed))
+		return nil
+	}
+
+	// Git-annex records a successful REMOVE in its location log, so a
+	// skipped one must fail. Refusing it is not a reason to end the session.
+	if s.dryRun {
+		s.sendInfo(fmt.Sprintf("[dry-run] skipping remove %s", argKey))
+		s.sendMsg(fmt.Sprintf("REMOVE-FAILURE %s [%s] [dry-run] remove skipped", argKey, ErrCodeTransferFailed))
+		return nil
+	}
+
+	if s.presentKeys != nil {
+		s.presentKeys.forget(argKey)
+	}
+	s.forgetRecentKey(argKey)
+	for i, remoteFs := range remoteFss {
+		s.forgetListing(remoteFsStrings[i])
+		if err := s.removeKeyFrom(remoteFs, argKey); err != nil {
+			return err
+		}
+	}
+	s.removeCount++
+	s.sendMsg(fmt.Sprintf("REMOVE-SUCCESS %s", argKey))
+	return nil
+}
+
+// removeKeyFrom deletes `key`, and any chunks of it, from `remoteFs` on behalf
+// of REMOVE. It is not an error for the key to be missing. On failure, it
+// tells git-annex and returns the error.
+func (s *server) removeKeyFrom(remoteFs fs.Fs, key string) error {
+	// The key may have been stored in chunks, so remove those too.
+	if _, err := removeChunks(s.sessionContext(), remoteFs, key); err != nil {
+		s.sendMsg(fmt.Sprintf("REMOVE-FAILURE %s [%s] error removing chunks: %s", key, ErrCodeTransferFailed, err))
+		return &ErrTransferFailed{protocolError("REMOVE-FAILURE", fmt.Errorf("error removing chunks: %w", err))}
+	}
+
+	fileObj, err := remoteFs.NewObject(s.sessionContext(), key)
 	// It is non-fatal when removal fails because the file is missing on the
 	// remote.
 	if errors.Is(err, fs.ErrorObjectNotFound) {
-		s.sendMsg(fmt.Sprintf("REMOVE-SUCCESS %s", argKey))
 		return nil
 	}
 	if err != nil {
-		s.sendMsg(fmt.Sprintf("REMOVE-FAILURE %s error getting new fs object: %s", argKey, err))
-		return fmt.Errorf("error getting new fs object: %w", err)
+		s.sendMsg(fmt.Sprintf("REMOVE-FAILURE %s [%s] error getting new fs object: %s", key, ErrCodeTransferFailed, err))
+		return &ErrTransferFailed{protocolError("REMOVE-FAILURE", fmt.Errorf("error getting new fs object: %w", err))}
 	}
-	if err := operations.DeleteFile(context.TODO(), fileObj); err != nil {
-		s.sendMsg(fmt.Sprintf("REMOVE-FAILURE %s error deleting file", argKey))
-		return fmt.Errorf("error deleting file: %q", argKey)
+	if err := operations.DeleteFile(s.sessionContext(), fileObj); err != nil {
+		s.sendMsg(fmt.Sprintf("REMOVE-FAILURE %s [%s] error deleting file", key, ErrCodeTransferFailed))
+		return &ErrTransferFailed{protocolError("REMOVE-FAILURE", fmt.Errorf("error deleting file: %q", key))}
 	}
-	s.sendMsg(fmt.Sprintf("REMOVE-SUCCESS %s", argKey))
 	return nil
 }
 
+// Git-annex is asking for information to display to the user, e.g. in the
+// output of `git annex info`. Respond with a sequence of INFOFIELD/INFOVALUE
+// pairs terminated by INFOEND.
+func (s *server) handleGetInfo() error {
+	if err := s.queryConfigs(); err != nil {
+		return fmt.Errorf("error getting configs: %w", err)
+	}
+
+	fsType, fsRoot := s.describeFs(s.sessionContext())
+	fields := []struct{ name, value string }{
+		{"remote", s.configRcloneRemoteName},
+		{"prefix", s.configPrefix},
+		{"fs-type", fsType},
+		{"fs-root", fsRoot},
+		{"bytes-stored", strconv.FormatInt(s.bytesStored, 10)},
+		{"bytes-retrieved", strconv.FormatInt(s.bytesRetrieved, 10)},
+		{"rclone-version", fs.Version},
+	}
+	for _, field := range fields {
+		s.sendMsg("INFOFIELD " + field.name)
+		s.sendMsg("INFOVALUE " + field.value)
+	}
+	s.sendMsg("INFOEND")
+	return nil
+}
+
+// describeFs returns the type of the remote's backend, e.g. "s3", and the root
+// of the "rcloneprefix" directory within the remote, for GETINFO. Failures are
+// described in the returned values rather than failing GETINFO, which is most
+// useful when something is wrong.
+func (s *server) describeFs(ctx context.Context) (fsType, fsRoot string) {
+	fsInfo, _, _, _, err := fs.ParseRemote(s.configRcloneRemoteName)
+	if err != nil {
+		fsType = fmt.Sprintf("unknown (%v)", err)
+	} else {
+		fsType = fsInfo.Name
+	}
+	prefixFs, err := s.getPrefixFs(ctx)
+	if err != nil {
+		return fsType, fmt.Sprintf("unknown (%v)", err)
+	}
+	return fsType, prefixFs.Root()
+}
+
 func (s *server) handleExtensions(message *messageParser) error {
-	for {
-		extension, err := message.nextSpaceDelimitedParameter()
-		if err != nil {
-			break
-		}
+	// ASYNC and UNAVAILABLERESPONSE are recorded, but not accepted. Accepting
+	// ASYNC would make git-annex prefix every message with a job number,
+	// which the server does not speak, and the server never replies
+	// UNAVAILABLE.
+	var accepted []string
+	for _, extension := range message.AllParameters() {
 		switch extension {
 		case "INFO":
 			s.extensionInfo = true
 		case "ASYNC":
 			s.extensionAsync = true
+			continue
 		case "GETGITREMOTENAME":
 			s.extensionGetGitRemoteName = true
 		case "UNAVAILABLERESPONSE":
 			s.extensionUnavailableResponse = true
+			continue
+		default:
+			continue
+		}
+		if !slices.Contains(accepted, extension) {
+			accepted = append(accepted, extension)
 		}
 	}
-	s.sendMsg("EXTENSIONS")
+	s.sendMsg(strings.TrimSpace("EXTENSIONS " + strings.Join(accepted, " ")))
 	return nil
 }
 
@@ -546,11 +2157,73 @@ var command = &cobra.Command{
 	Run: func(command *cobra.Command, args []string) {
 		cmd.CheckArgs(0, 0, command, args)
 
+		stopHandlingSigpipe := handleSigpipe()
+		defer stopHandlingSigpipe()
+
+		if rcloneConfigPath != "" {
+			if err := useConfigFile(rcloneConfigPath); err != nil {
+				fs.Fatalf(nil, "%v", err)
+			}
+		}
+
+		if listLayouts {
+			printLayouts(os.Stdout)
+			return
+		}
+
+		if healthCheck {
+			os.Exit(runHealthCheck(command.Context(), os.Stdout, standaloneRemote()))
+		}
+
+		if migrateLayoutSpec != "" {
+			os.Exit(runMigrateLayout(command.Context(), os.Stdout, standaloneRemote(), migrateLayoutSpec))
+		}
+
+		var in io.Reader
+		var out io.Writer
+		if socketPath != "" {
+			if pipeInFd >= 0 || pipeOutFd >= 0 {
+				fs.Fatalf(nil, "--socket-path cannot be used with --pipe-in-fd or --pipe-out-fd")
+			}
+			conn, err := listenProtocolSocket(socketPath)
+			if err != nil {
+				fs.Fatalf(nil, "%v", err)
+			}
+			defer func() { _ = conn.Close() }()
+			in, out = conn, conn
+		} else {
+			in, out = protocolFiles()
+		}
 		s := server{
-			reader: bufio.NewReader(os.Stdin),
-			writer: os.Stdout,
+			reader:         bufio.NewReader(in),
+			writer:         out,
+			remoteOverride: remoteOverride,
+		}
+
+		// Rclone's global --dry-run flag would also make operations.CopyFile
+		// skip downloads, which would leave git-annex without the content it
+		// asked for. Handle the flag here instead so that only operations that
+		// modify the remote are skipped.
+		ci := fs.GetConfig(context.Background())
+		s.dryRun, ci.DryRun = ci.DryRun, false
+
+		// Until PREPARE tells us otherwise, use the default protocol timeout.
+		s.configRcloneProtocolTimeout = defaultRcloneProtocolTimeout
+		if err := s.applyProtocolTimeout(); err != nil {
+			panic(err)
+		}
+		err := s.RunWithContext(command.Context())
+		if errors.Is(err, ErrPipeClosed) {
+			// Git-annex is gone, so there is nobody left to send an ERROR
+			// message to and a stack trace would only add noise.
+			fs.Fatalf(nil, "%v", err)
+		}
+		// Errors that were already reported to git-annex, e.g. with a
+		// TRANSFER-FAILURE message, only need to be logged.
+		var protocolErr *ErrProtocol
+		if errors.As(err, &protocolErr) && protocolErr.Code() != codeError {
+			fs.Fatalf(nil, "%v", err)
 		}
-		err := s.run()
 		if err != nil {
 			s.sendMsg(fmt.Sprintf("ERROR %s", err.Error()))
 			panic(err)
@@ -2,23 +2,45 @@ package gitannex
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/md5"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
+	"path"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	// Without this import, the various backends would be unavailable. It looks
 	// unused, but the act of importing runs the package's `init()` function.
 	_ "github.com/rclone/rclone/backend/all"
 
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/cache"
+	"github.com/rclone/rclone/fs/config"
+	"github.com/rclone/rclone/fs/config/configmap"
+	"github.com/rclone/rclone/fs/config/obscure"
+	"github.com/rclone/rclone/fs/fserrors"
 	"github.com/rclone/rclone/fs/fspath"
+	"github.com/rclone/rclone/fs/hash"
+	"github.com/rclone/rclone/fs/operations"
 	"github.com/rclone/rclone/fstest"
+	"github.com/rclone/rclone/lib/random"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -44,6 +66,38 @@ func TestFixArgsForSymlinkCorrectName(t *testing.T) {
 		[]string{"/path/to/git-annex-remote-rclone-builtin", "gitannex"})
 }
 
+func TestFixArgsWithEnvVars(t *testing.T) {
+	t.Setenv(verboseEnvVar, "1")
+	t.Setenv(logFileEnvVar, "/tmp/gitannex.log")
+
+	// Only the invocation as git-annex-remote-rclone-builtin is affected.
+	for _, argList := range [][]string{
+		[]string{},
+		[]string{"foo"},
+		[]string{"rclone", "gitannex"},
+	} {
+		assert.Equal(t, argList, maybeTransformArgs(argList))
+	}
+
+	assert.Equal(t,
+		[]string{"git-annex-remote-rclone-builtin", "gitannex", "--verbose", "--log-file=/tmp/gitannex.log"},
+		maybeTransformArgs([]string{"git-annex-remote-rclone-builtin"}))
+	assert.Equal(t,
+		[]string{"/path/to/git-annex-remote-rclone-builtin", "gitannex", "foo", "--verbose", "--log-file=/tmp/gitannex.log"},
+		maybeTransformArgs([]string{"/path/to/git-annex-remote-rclone-builtin", "foo"}))
+
+	t.Setenv(verboseEnvVar, "0")
+	assert.Equal(t,
+		[]string{"git-annex-remote-rclone-builtin", "gitannex", "--log-file=/tmp/gitannex.log"},
+		maybeTransformArgs([]string{"git-annex-remote-rclone-builtin"}))
+
+	t.Setenv(verboseEnvVar, "true")
+	t.Setenv(logFileEnvVar, "")
+	assert.Equal(t,
+		[]string{"git-annex-remote-rclone-builtin", "gitannex", "--verbose"},
+		maybeTransformArgs([]string{"git-annex-remote-rclone-builtin"}))
+}
+
 type messageParserTestCase struct {
 	label    string
 	testFunc func(*testing.T)
@@ -178,6 +232,45 @@ var messageParserTestCases = []messageParserTestCase{
 			assert.Equal(t, param, "")
 		},
 	},
+	{
+		"AllParameters",
+		func(t *testing.T) {
+			many := make([]string, 100)
+			for i := range many {
+				many[i] = fmt.Sprintf("p%d", i)
+			}
+			for _, tc := range []struct {
+				line string
+				want []string
+			}{
+				{"", nil},
+				{"\n", nil},
+				{"foo\n", []string{"foo"}},
+				{"foo bar baz\n", []string{"foo", "bar", "baz"}},
+				{strings.Join(many, " ") + "\n", many},
+				{"foo bar \n", []string{"foo", "bar"}},
+				{"foo bar   \n", []string{"foo", "bar"}},
+			} {
+				m := messageParser{tc.line}
+				assert.Equal(t, tc.want, m.AllParameters(), "%q", tc.line)
+			}
+		},
+	},
+	{
+		"Remaining",
+		func(t *testing.T) {
+			m := messageParser{"foo bar  baz \n"}
+			assert.Equal(t, "foo bar  baz \n", m.Remaining())
+
+			param, err := m.nextSpaceDelimitedParameter()
+			assert.NoError(t, err)
+			assert.Equal(t, "foo", param)
+			assert.Equal(t, "bar  baz ", m.Remaining())
+			// Remaining does not consume the line.
+			assert.Equal(t, "bar  baz ", m.finalParameter())
+			assert.Equal(t, "", m.Remaining())
+		},
+	},
 }
 
 func TestMessageParser(t *testing.T) {
@@ -234,1226 +327,7305 @@ func TestConfigDefinitionThreeNames(t *testing.T) {
 		configFoo.fullDescription())
 }
 
-type testState struct {
-	t                *testing.T
-	server           *server
-	mockStdinW       *io.PipeWriter
-	mockStdoutReader *bufio.Reader
-	// readLineTimeout is the maximum duration of time to wait for [server] to
-	// write a line to be written to the mock stdout.
-	readLineTimeout time.Duration
+// TestListConfigsDocumentsEveryConfig checks that LISTCONFIGS describes exactly
+// the configs that the server queries.
+func TestListConfigsDocumentsEveryConfig(t *testing.T) {
+	h := makeTestState(t)
 
-	fstestRun    *fstest.Run
-	remoteName   string
-	remotePrefix string
-}
+	serverErrorChan := make(chan error)
+	go func() {
+		serverErrorChan <- h.server.run()
+	}()
 
-func makeTestState(t *testing.T) testState {
-	stdinR, stdinW := io.Pipe()
-	stdoutR, stdoutW := io.Pipe()
+	h.requireReadLineExact("VERSION 1")
+	h.requireWriteLine("LISTCONFIGS")
 
-	return testState{
-		t: t,
-		server: &server{
-			reader: bufio.NewReader(stdinR),
-			writer: stdoutW,
-		},
-		mockStdinW:       stdinW,
-		mockStdoutReader: bufio.NewReader(stdoutR),
+	var listedNames []string
+	for {
+		line := strings.TrimSuffix(h.requireReadLine(), "\n")
+		if line == "CONFIGEND" {
+			break
+		}
+		rest, found := strings.CutPrefix(line, "CONFIG ")
+		require.True(t, found, "expected CONFIG line, got %q", line)
+		name, description, _ := strings.Cut(rest, " ")
+		require.NotEmpty(t, description, "config %q has no description", name)
+		listedNames = append(listedNames, name)
+	}
 
-		// The default readLineTimeout must be large enough to accommodate slow
-		// operations on real remotes. Without a timeout, attempts to read a
-		// line that's never written would block indefinitely.
-		readLineTimeout: time.Second * 30,
+	var canonicalNames []string
+	for _, config := range requiredConfigs {
+		canonicalNames = append(canonicalNames, config.getCanonicalName())
+		require.NotContains(t, config.fullDescription(), "\n", "description of %q spans multiple lines", config.getCanonicalName())
 	}
+	require.ElementsMatch(t, canonicalNames, listedNames)
+
+	require.NoError(t, h.mockStdinW.Close())
+	require.NoError(t, <-serverErrorChan)
 }
 
-func (h *testState) requireRemoteIsEmpty() {
-	h.fstestRun.CheckRemoteItems(h.t)
+func TestQueryConfigWithDefault(t *testing.T) {
+	// query answers "GETCONFIG rclonelayout" with what `reader` yields.
+	query := func(reader io.Reader, defaultValue string) (string, error) {
+		var sent bytes.Buffer
+		s := &server{reader: bufio.NewReader(reader), writer: &sent}
+		value, err := s.queryConfigWithDefault("rclonelayout", defaultValue)
+		require.Equal(t, "GETCONFIG rclonelayout\n", sent.String())
+		return value, err
+	}
+
+	t.Run("Value", func(t *testing.T) {
+		value, err := query(strings.NewReader("VALUE mixed\n"), "nodir")
+		require.NoError(t, err)
+		require.Equal(t, "mixed", value)
+	})
+
+	t.Run("EmptyValueUsesDefault", func(t *testing.T) {
+		value, err := query(strings.NewReader("VALUE\n"), "nodir")
+		require.NoError(t, err)
+		require.Equal(t, "nodir", value)
+	})
+
+	t.Run("EmptyValueWithoutDefault", func(t *testing.T) {
+		_, err := query(strings.NewReader("VALUE\n"), "")
+		require.ErrorIs(t, err, errEmptyConfigValue)
+		require.EqualError(t, err, `did not receive a non-empty config value for "rclonelayout"`)
+	})
+
+	t.Run("ReadError", func(t *testing.T) {
+		_, err := query(iotest.ErrReader(errors.New("read failed")), "nodir")
+		require.EqualError(t, err, "git-annex closed stdin instead of replying")
+	})
+
+	t.Run("NotValue", func(t *testing.T) {
+		_, err := query(strings.NewReader("ERROR oops\n"), "nodir")
+		require.ErrorAs(t, err, new(*ErrProtocolParse))
+	})
 }
 
-// readLineWithTimeout attempts to read a line from the mock stdout. Returns an
-// error if the read operation times out or fails for any reason.
-func (h *testState) readLineWithTimeout() (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), h.readLineTimeout)
-	defer cancel()
+func TestConfigEnvVars(t *testing.T) {
+	envPrefix := "env-" + random.String(8)
+	t.Setenv(standaloneRemoteEnvVar, ":memory:")
+	t.Setenv("RCLONE_GITANNEX_PREFIX", envPrefix)
+	t.Setenv("RCLONE_GITANNEX_LAYOUT", "lower")
+
+	for _, tc := range []struct {
+		label      string
+		values     map[string]string
+		wantPrefix string
+		wantLayout string
+	}{
+		{
+			label:      "EnvOverridesDefault",
+			values:     map[string]string{},
+			wantPrefix: envPrefix,
+			wantLayout: "lower",
+		},
+		{
+			label: "ValueOverridesEnv",
+			values: map[string]string{
+				"rcloneremotename": ":memory:",
+				"rcloneprefix":     "value-" + envPrefix,
+				"rclonelayout":     "nodir",
+			},
+			wantPrefix: "value-" + envPrefix,
+			wantLayout: "nodir",
+		},
+	} {
+		t.Run(tc.label, func(t *testing.T) {
+			h := makeTestState(t)
 
-	lineChan := make(chan string)
-	errChan := make(chan error)
+			serverErrorChan := make(chan error)
+			go func() {
+				serverErrorChan <- h.server.run()
+			}()
 
-	go func() {
-		line, err := h.mockStdoutReader.ReadString('\n')
-		if err != nil {
-			errChan <- err
-		} else {
-			lineChan <- line
-		}
-	}()
+			h.requireReadLineExact("VERSION 1")
+			h.requireWriteLine("INITREMOTE")
+			require.Equal(t, "INITREMOTE-SUCCESS\n", h.answerConfigs(tc.values))
+			require.NoError(t, h.mockStdinW.Close())
+			require.NoError(t, <-serverErrorChan)
 
-	select {
-	case line := <-lineChan:
-		return line, nil
-	case err := <-errChan:
-		return "", err
-	case <-ctx.Done():
-		return "", fmt.Errorf("attempt to read line timed out: %w", ctx.Err())
+			require.Equal(t, ":memory:", h.server.configRcloneRemoteName)
+			require.Equal(t, tc.wantPrefix, h.server.configPrefix)
+			require.Equal(t, tc.wantLayout, h.server.configRcloneLayout)
+		})
 	}
-}
 
-// requireReadLineExact requires that a line matching wantLine can be read from
-// the mock stdout.
-func (h *testState) requireReadLineExact(wantLine string) {
-	receivedLine, err := h.readLineWithTimeout()
-	require.NoError(h.t, err)
-	require.Equal(h.t, wantLine+"\n", receivedLine)
+	h := makeTestState(t)
+	serverErrorChan := make(chan error)
+	go func() {
+		serverErrorChan <- h.server.run()
+	}()
+	h.requireReadLineExact("VERSION 1")
+	h.requireWriteLine("LISTCONFIGS")
+	require.Regexp(t, `^CONFIG rcloneremotename .* \(env: RCLONE_GITANNEX_REMOTE\)\n$`, h.requireReadLine())
+	require.Regexp(t, `^CONFIG rcloneprefix .* \(env: RCLONE_GITANNEX_PREFIX\)\n$`, h.requireReadLine())
+	require.Regexp(t, `^CONFIG rclonelayout .* \(env: RCLONE_GITANNEX_LAYOUT\)\n$`, h.requireReadLine())
+	for line := h.requireReadLine(); line != "CONFIGEND\n"; line = h.requireReadLine() {
+		require.NotContains(t, line, "(env: ")
+	}
+	require.NoError(t, h.mockStdinW.Close())
+	require.NoError(t, <-serverErrorChan)
 }
 
-// requireReadLine requires that a line can be read from the mock stdout and
-// returns the line.
-func (h *testState) requireReadLine() string {
-	receivedLine, err := h.readLineWithTimeout()
-	require.NoError(h.t, err)
-	return receivedLine
-}
+func TestServerReset(t *testing.T) {
+	h := makeTestState(t)
+	// runSession runs a session on h.server that sends INITREMOTE with the
+	// given configs.
+	runSession := func(values map[string]string) {
+		serverErrorChan := make(chan error)
+		go func() {
+			serverErrorChan <- h.server.run()
+		}()
+		h.requireReadLineExact("VERSION 1")
+		h.requireWriteLine("EXTENSIONS GETGITREMOTENAME")
+		h.requireReadLineExact("EXTENSIONS GETGITREMOTENAME")
+		h.requireWriteLine("INITREMOTE")
+		require.Equal(t, "INITREMOTE-SUCCESS\n", h.answerConfigs(values))
+		require.NoError(t, h.mockStdinW.Close())
+		require.NoError(t, <-serverErrorChan)
+	}
 
-// requireWriteLine requires that the given line is successfully written to the
-// mock stdin.
-func (h *testState) requireWriteLine(line string) {
-	_, err := h.mockStdinW.Write([]byte(line + "\n"))
-	require.NoError(h.t, err)
+	firstPrefix := "reset-" + random.String(8)
+	runSession(map[string]string{
+		"rcloneremotename": ":memory:",
+		"rcloneprefix":     firstPrefix,
+		"rclonelayout":     "nodir",
+	})
+	require.Equal(t, firstPrefix, h.server.configPrefix)
+	require.Equal(t, "nodir", h.server.configRcloneLayout)
+	require.True(t, h.server.extensionGetGitRemoteName)
+
+	h.server.Reset()
+	require.False(t, h.server.configsDone)
+	require.False(t, h.server.extensionGetGitRemoteName)
+	require.Empty(t, h.server.configRcloneRemoteName)
+	require.Empty(t, h.server.configPrefix)
+	require.Nil(t, h.server.dirhashCache)
+
+	// Give the server new pipes, as a new git-annex process would.
+	next := makeTestState(t)
+	h.server.reader, h.server.writer = next.server.reader, next.server.writer
+	h.mockStdinW, h.mockStdoutReader = next.mockStdinW, next.mockStdoutReader
+
+	secondPrefix := "reset-" + random.String(8)
+	runSession(map[string]string{
+		"rcloneremotename": ":memory:",
+		"rcloneprefix":     secondPrefix,
+		"rclonelayout":     "lower",
+	})
+	require.Equal(t, secondPrefix, h.server.configPrefix)
+	require.Equal(t, "lower", h.server.configRcloneLayout)
 }
 
-// Preconfigure the handle. This enables the calling test to skip the PREPARE
-// handshake.
-func (h *testState) preconfigureServer() {
-	h.server.configRcloneRemoteName = h.remoteName
-	h.server.configPrefix = h.remotePrefix
-	h.server.configRcloneLayout = string(layoutModeNodir)
-	h.server.configsDone = true
+func TestGetCost(t *testing.T) {
+	require.Equal(t, 100, defaultCostForBackend("local"))
+	require.Equal(t, 110, defaultCostForBackend("sftp"))
+	require.Equal(t, 200, defaultCostForBackend("s3"))
+	require.Equal(t, 300, defaultCostForBackend("ftp"))
+	require.Equal(t, 200, defaultCostForBackend("no-such-backend"))
+
+	for _, tc := range []struct {
+		remoteName   string
+		preconfigure bool
+		wantCost     string
+	}{
+		{":local:", true, "COST 100"},
+		{":s3:", true, "COST 200"},
+		// Before the configs are known, the remote is assumed to be expensive.
+		{":local:", false, "COST 200"},
+	} {
+		h := makeTestState(t)
+		h.remoteName = tc.remoteName
+		if tc.preconfigure {
+			h.preconfigureServer()
+		}
+		serverErrorChan := make(chan error)
+		go func() {
+			serverErrorChan <- h.server.run()
+		}()
+		h.requireReadLineExact("VERSION 1")
+		h.requireWriteLine("GETCOST")
+		h.requireReadLineExact(tc.wantCost)
+		require.NoError(t, h.mockStdinW.Close())
+		require.NoError(t, <-serverErrorChan)
+	}
 }
 
-// Drop-in replacement for `filepath.Rel()` that works around a Windows-specific
-// quirk when one of the paths begins with `\\?\` or `//?/`. It seems that
-// fstest gives us paths with this prefix on Windows, which throws a wrench in
-// the gitannex tests that need to construct relative paths from absolute paths.
-// For a demonstration, see `TestWindowsFilepathRelQuirk` below.
-//
-// The `\\?\` prefix tells Windows APIs to pass strings unmodified to the
-// filesystem without additional parsing [1]. Our workaround is roughly to add
-// the prefix to whichever parameter doesn't have it (when the OS is Windows).
-// I'm not sure this generalizes, but it works for the the kinds of inputs we're
-// throwing at it.
-//
-// [1]: https://learn.microsoft.com/en-us/windows/win32/fileio/naming-a-file?redirectedfrom=MSDN#win32-file-namespaces
-func relativeFilepathWorkaround(basepath, targpath string) (string, error) {
-	if runtime.GOOS != "windows" {
-		return filepath.Rel(basepath, targpath)
+func TestGetAvailability(t *testing.T) {
+	ctx := context.Background()
+	localDir := t.TempDir()
+	for _, tc := range []struct {
+		fsString string
+		want     string
+	}{
+		{":local:" + localDir, "LOCAL"},
+		{fmt.Sprintf(":crypt,remote=%s,password=%s:", quoteConfigValue(":local:"+localDir), obscure.MustObscure("secret")), "LOCAL"},
+		{":memory:" + random.String(8), "GLOBAL"},
+	} {
+		remoteFs, err := cache.Get(ctx, tc.fsString)
+		require.NoError(t, err)
+		require.Equal(t, tc.want, computeAvailability(remoteFs), tc.fsString)
 	}
-	// Canonicalize paths to use backslashes.
-	basepath = filepath.Clean(basepath)
-	targpath = filepath.Clean(targpath)
 
-	const winFilePrefixDisableStringParsing = `\\?\`
-	baseHasPrefix := strings.HasPrefix(basepath, winFilePrefixDisableStringParsing)
-	targHasPrefix := strings.HasPrefix(targpath, winFilePrefixDisableStringParsing)
+	for _, tc := range []struct {
+		remoteName   string
+		remotePrefix string
+		preconfigure bool
+		want         string
+	}{
+		{":local:", localDir, true, "AVAILABILITY LOCAL"},
+		{":memory:", "availability-" + random.String(8), true, "AVAILABILITY GLOBAL"},
+		// Before the configs are known, the remote is assumed to be a cloud
+		// service.
+		{":local:", localDir, false, "AVAILABILITY GLOBAL"},
+	} {
+		h := makeTestState(t)
+		h.remoteName = tc.remoteName
+		h.remotePrefix = tc.remotePrefix
+		if tc.preconfigure {
+			h.preconfigureServer()
+		}
+		serverErrorChan := make(chan error)
+		go func() {
+			serverErrorChan <- h.server.run()
+		}()
+		h.requireReadLineExact("VERSION 1")
+		h.requireWriteLine("GETAVAILABILITY")
+		h.requireReadLineExact(tc.want)
+		require.NoError(t, h.mockStdinW.Close())
+		require.NoError(t, <-serverErrorChan)
+	}
+}
 
-	if baseHasPrefix && !targHasPrefix {
-		targpath = winFilePrefixDisableStringParsing + targpath
+// TestServerFromPipes exercises each handler through [newServerFromPipes].
+func TestServerFromPipes(t *testing.T) {
+	remoteDir := t.TempDir()
+	localDir := t.TempDir()
+	localPath := filepath.Join(localDir, "file.txt")
+	require.NoError(t, os.WriteFile(localPath, []byte("HELLO"), 0600))
+	retrievedPath := filepath.Join(localDir, "retrieved.txt")
+
+	s, pipes := newServerFromPipes(t)
+	pipes.Start()
+	require.Equal(t, []string{"VERSION 1"}, pipes.Lines())
+
+	// send writes `line` to the server as git-annex would.
+	send := func(line string) {
+		_, err := pipes.In.WriteString(line + "\n")
+		require.NoError(t, err)
 	}
-	if !baseHasPrefix && targHasPrefix {
-		basepath = winFilePrefixDisableStringParsing + basepath
+
+	send("EXTENSIONS INFO ASYNC")
+	require.Equal(t, []string{"EXTENSIONS INFO"}, pipes.Lines())
+
+	send("LISTCONFIGS")
+	configLines := pipes.Lines()
+	require.Len(t, configLines, len(requiredConfigs)+1)
+	require.Equal(t, "CONFIGEND", configLines[len(configLines)-1])
+
+	// INITREMOTE asks for each config in turn.
+	values := map[string]string{"rcloneremotename": ":local:", "rcloneprefix": remoteDir}
+	send("INITREMOTE")
+	for {
+		lines := pipes.Lines()
+		require.Len(t, lines, 1)
+		if lines[0] == "GETUUID" {
+			send("VALUE " + testRemoteUUID)
+			continue
+		}
+		name, found := strings.CutPrefix(lines[0], "GETCONFIG ")
+		if !found {
+			require.Equal(t, "INITREMOTE-SUCCESS", lines[0])
+			break
+		}
+		send(strings.TrimRight("VALUE "+values[name], " "))
 	}
-	return filepath.Rel(basepath, targpath)
-}
 
-func TestWindowsFilepathRelQuirk(t *testing.T) {
-	if runtime.GOOS != "windows" {
-		t.Skip()
+	send("PREPARE")
+	require.Equal(t, []string{"GETUUID"}, pipes.Lines())
+	send("VALUE " + testRemoteUUID)
+	require.Equal(t, []string{"PREPARE-SUCCESS"}, pipes.Lines())
+
+	for _, tc := range []struct {
+		message string
+		want    []string
+	}{
+		{"GETCOST", []string{"COST 100"}},
+		{"GETAVAILABILITY", []string{"AVAILABILITY LOCAL"}},
+		{"EXPORTSUPPORTED", []string{"EXPORTSUPPORTED-FAILURE"}},
+		{"CHECKPRESENT SomeKey", []string{"CHECKPRESENT-FAILURE SomeKey"}},
+		{"TRANSFER STORE SomeKey " + localPath, []string{"TRANSFER-SUCCESS STORE SomeKey"}},
+		{"CHECKPRESENT SomeKey", []string{"CHECKPRESENT-SUCCESS SomeKey"}},
+		{"TRANSFER RETRIEVE SomeKey " + retrievedPath, []string{"TRANSFER-SUCCESS RETRIEVE SomeKey"}},
+		{"REMOVE SomeKey", []string{"REMOVE-SUCCESS SomeKey"}},
+		{"CHECKPRESENT SomeKey", []string{"CHECKPRESENT-FAILURE SomeKey"}},
+		{"TRANSFER RETRIEVE SomeKey " + retrievedPath, []string{"TRANSFER-FAILURE RETRIEVE SomeKey [E004] not found"}},
+		{"WHEREIS SomeKey", []string{"UNSUPPORTED-REQUEST"}},
+		{"CLAIMURL https://example.com/file", []string{"CLAIMURL-FAILURE"}},
+		{"CHECKURL https://example.com/file", []string{"UNSUPPORTED-REQUEST"}},
+	} {
+		send(tc.message)
+		require.Equal(t, tc.want, pipes.Lines(), tc.message)
 	}
 
-	t.Run("filepathRelQuirk", func(t *testing.T) {
-		var err error
+	retrieved, err := os.ReadFile(retrievedPath)
+	require.NoError(t, err)
+	require.Equal(t, "HELLO", string(retrieved))
 
-		_, err = filepath.Rel(`C:\foo`, `\\?\C:\foo\bar`)
-		require.Error(t, err)
+	send("GETINFO")
+	infoLines := pipes.Lines()
+	require.Contains(t, infoLines, "INFOFIELD bytes-stored")
+	require.Contains(t, infoLines, "INFOVALUE 5")
+	require.Equal(t, "INFOEND", infoLines[len(infoLines)-1])
 
-		_, err = filepath.Rel(`C:/foo`, `//?/C:/foo/bar`)
-		require.Error(t, err)
+	send("ERROR something went wrong")
+	require.ErrorContains(t, pipes.Close(), "received error message from git-annex: something went wrong")
+	require.Equal(t, int64(5), s.Stats().StoreBytes)
+}
 
-		_, err = filepath.Rel(`\\?\C:\foo`, `C:\foo\bar`)
-		require.Error(t, err)
+// fakeS3 is just enough of an S3 server to store objects. It records
+// the headers of each upload and the body of each restore request. Objects
+// stored with the GLACIER storage class cannot be read until they are
+// restored, which happens at once.
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	headers  map[string]http.Header
+	restores map[string][]byte
+}
 
-		_, err = filepath.Rel(`//?/C:/foo`, `C:/foo/bar`)
-		require.Error(t, err)
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: map[string][]byte{}, headers: map[string]http.Header{}, restores: map[string][]byte{}}
+}
 
-		path, err := filepath.Rel(`\\?\C:\foo`, `\\?\C:\foo\bar`)
-		require.NoError(t, err)
-		require.Equal(t, path, `bar`)
+// storeToFakeS3 stores SomeKey in the "bucket/annex" directory of `s3` via a
+// server with the given configs.
+func storeToFakeS3(t *testing.T, s3 *fakeS3, configure func(s *server)) {
+	localPath := filepath.Join(t.TempDir(), "file.txt")
+	require.NoError(t, os.WriteFile(localPath, []byte("HELLO"), 0600))
+	srv := httptest.NewServer(s3)
+	t.Cleanup(srv.Close)
+
+	h := makeTestState(t)
+	h.remoteName = fmt.Sprintf(":s3,provider=Other,endpoint=%s,force_path_style=true,access_key_id=x,secret_access_key=y,no_check_bucket=true:", quoteConfigValue(srv.URL))
+	h.remotePrefix = "bucket/annex"
+	h.preconfigureServer()
+	configure(h.server)
+
+	serverErrorChan := make(chan error)
+	go func() {
+		serverErrorChan <- h.server.run()
+	}()
 
-		path, err = filepath.Rel(`//?/C:/foo`, `//?/C:/foo/bar`)
-		require.NoError(t, err)
-		require.Equal(t, path, `bar`)
-	})
+	h.requireReadLineExact("VERSION 1")
+	h.requireWriteLine("TRANSFER STORE SomeKey " + localPath)
+	h.requireReadLineExact("TRANSFER-SUCCESS STORE SomeKey")
+	require.NoError(t, h.mockStdinW.Close())
+	require.NoError(t, <-serverErrorChan)
+}
 
-	t.Run("fstestAndTempDirHaveDifferentPrefixes", func(t *testing.T) {
-		r := fstest.NewRun(t)
-		p := r.Flocal.Root()
-		require.True(t, strings.HasPrefix(p, `//?/`))
+// retrieveFromFakeS3 retrieves SomeKey from the "bucket/annex" directory of
+// `s3` via a server with the given configs. It returns the reply to the
+// TRANSFER request and the error with which the server ended.
+func retrieveFromFakeS3(t *testing.T, s3 *fakeS3, configure func(s *server)) (string, error) {
+	localPath := filepath.Join(t.TempDir(), "file.txt")
+	srv := httptest.NewServer(s3)
+	t.Cleanup(srv.Close)
+
+	h := makeTestState(t)
+	h.remoteName = fmt.Sprintf(":s3,provider=Other,endpoint=%s,force_path_style=true,access_key_id=x,secret_access_key=y,no_check_bucket=true:", quoteConfigValue(srv.URL))
+	h.remotePrefix = "bucket/annex"
+	h.preconfigureServer()
+	configure(h.server)
+
+	serverErrorChan := make(chan error)
+	go func() {
+		serverErrorChan <- h.server.run()
+	}()
 
-		tempDir := t.TempDir()
-		require.False(t, strings.HasPrefix(tempDir, `//?/`))
-		require.False(t, strings.HasPrefix(tempDir, `\\?\`))
-	})
+	h.requireReadLineExact("VERSION 1")
+	h.requireWriteLine("TRANSFER RETRIEVE SomeKey " + localPath)
+	reply := h.requireReadLine()
+	require.NoError(t, h.mockStdinW.Close())
+	return reply, <-serverErrorChan
+}
 
-	t.Run("workaroundWorks", func(t *testing.T) {
-		path, err := relativeFilepathWorkaround(`C:\foo`, `\\?\C:\foo\bar`)
-		require.NoError(t, err)
-		require.Equal(t, path, "bar")
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.objects[r.URL.Path] = body
+		f.headers[r.URL.Path] = r.Header.Clone()
+		delete(f.restores, r.URL.Path)
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(body)))
+	case http.MethodPost:
+		if _, ok := r.URL.Query()["restore"]; !ok {
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.restores[r.URL.Path] = body
+	case http.MethodHead, http.MethodGet:
+		body, ok := f.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		storageClass := f.headers[r.URL.Path].Get("X-Amz-Storage-Class")
+		if _, restored := f.restores[r.URL.Path]; r.Method == http.MethodGet && storageClass == "GLACIER" && !restored {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = io.WriteString(w, "<Error><Code>InvalidObjectState</Code><Message>The operation is not valid for the object's storage class</Message></Error>")
+			return
+		}
+		if storageClass != "" {
+			w.Header().Set("X-Amz-Storage-Class", storageClass)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(body)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(body)
+		}
+	case http.MethodDelete:
+		// Like s3, refuse to delete objects under Object Lock.
+		if f.headers[r.URL.Path].Get("X-Amz-Object-Lock-Mode") != "" {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = io.WriteString(w, "<Error><Code>AccessDenied</Code><Message>Access Denied because object protected by object lock</Message></Error>")
+			return
+		}
+		delete(f.objects, r.URL.Path)
+		delete(f.headers, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
 
-		path, err = relativeFilepathWorkaround(`C:/foo`, `//?/C:/foo/bar`)
-		require.NoError(t, err)
-		require.Equal(t, path, "bar")
+func TestACLConfig(t *testing.T) {
+	require.Equal(t, "MyS3,acl='private':", remoteWithOption("MyS3:", "acl", "private"))
+	require.Equal(t, ":s3,provider=AWS,acl='public-read':", remoteWithOption(":s3,provider=AWS:", "acl", "public-read"))
+
+	for _, acl := range []string{"", "private", "public-read"} {
+		t.Run(fmt.Sprintf("acl=%q", acl), func(t *testing.T) {
+			s3 := newFakeS3()
+			storeToFakeS3(t, s3, func(s *server) {
+				s.configRcloneACL = acl
+			})
+
+			s3.mu.Lock()
+			defer s3.mu.Unlock()
+			require.Equal(t, "HELLO", string(s3.objects["/bucket/annex/SomeKey"]))
+			// Without the config, the remote's own setting, which is unset,
+			// applies.
+			require.Equal(t, acl, s3.headers["/bucket/annex/SomeKey"].Get("X-Amz-Acl"))
+		})
+	}
+}
 
-		path, err = relativeFilepathWorkaround(`\\?\C:\foo`, `C:\foo\bar`)
-		require.NoError(t, err)
-		require.Equal(t, path, `bar`)
+func TestStorageClassConfig(t *testing.T) {
+	for _, storageClass := range []string{"", "STANDARD", "GLACIER", "INTELLIGENT_TIERING"} {
+		t.Run(fmt.Sprintf("class=%q", storageClass), func(t *testing.T) {
+			s3 := newFakeS3()
+			storeToFakeS3(t, s3, func(s *server) {
+				s.configRcloneStorageClass = storageClass
+				// The retrieval storage class does not apply to stores.
+				s.configRcloneRetrievalStorageClass = "Bulk"
+			})
+
+			s3.mu.Lock()
+			defer s3.mu.Unlock()
+			require.Equal(t, "HELLO", string(s3.objects["/bucket/annex/SomeKey"]))
+			require.Equal(t, storageClass, s3.headers["/bucket/annex/SomeKey"].Get("X-Amz-Storage-Class"))
+			require.Empty(t, s3.restores)
+		})
+	}
 
-		path, err = relativeFilepathWorkaround(`//?/C:/foo`, `C:/foo/bar`)
+	for _, tc := range []struct {
+		value   string
+		wantErr string
+	}{
+		{value: ""},
+		{value: "Standard"},
+		{value: "Expedited"},
+		{value: "Bulk"},
+		{value: "GLACIER", wantErr: `retrieval storage class must be "Standard", "Expedited", or "Bulk": "GLACIER"`},
+	} {
+		got, err := parseRestoreTier(tc.value)
+		if tc.wantErr != "" {
+			require.EqualError(t, err, tc.wantErr)
+			continue
+		}
 		require.NoError(t, err)
-		require.Equal(t, path, `bar`)
+		require.Equal(t, tc.value, got)
+	}
 
-		path, err = relativeFilepathWorkaround(`\\?\C:\foo`, `\\?\C:\foo\bar`)
-		require.NoError(t, err)
-		require.Equal(t, path, `bar`)
+	t.Run("retrieve", func(t *testing.T) {
+		s3 := newFakeS3()
+		storeToFakeS3(t, s3, func(s *server) {
+			s.configRcloneStorageClass = "GLACIER"
+		})
+
+		// Without a retrieval storage class, the archived object cannot be
+		// read, and the storage class of stores does not matter.
+		reply, err := retrieveFromFakeS3(t, s3, func(s *server) {
+			s.configRcloneStorageClass = "GLACIER"
+		})
+		require.Contains(t, reply, "TRANSFER-FAILURE RETRIEVE SomeKey")
+		require.ErrorContains(t, err, "Object in GLACIER, restore first")
+
+		reply, err = retrieveFromFakeS3(t, s3, func(s *server) {
+			s.configRcloneRetrievalStorageClass = "Expedited"
+		})
+		require.Equal(t, "TRANSFER-SUCCESS RETRIEVE SomeKey\n", reply)
+		require.NoError(t, err)
+
+		s3.mu.Lock()
+		defer s3.mu.Unlock()
+		restore := string(s3.restores["/bucket/annex/SomeKey"])
+		require.Contains(t, restore, "<Tier>Expedited</Tier>")
+		require.Contains(t, restore, "<Days>7</Days>")
+		require.Equal(t, "GLACIER", s3.headers["/bucket/annex/SomeKey"].Get("X-Amz-Storage-Class"))
+	})
+
+	t.Run("initremote", func(t *testing.T) {
+		h := makeTestState(t)
+		serverErrorChan := make(chan error)
+		go func() {
+			serverErrorChan <- h.server.run()
+		}()
+		h.requireReadLineExact("VERSION 1")
+		h.requireWriteLine("INITREMOTE")
+		line := h.answerConfigs(map[string]string{
+			"rcloneremotename":            ":local:",
+			"rcloneprefix":                t.TempDir(),
+			"rcloneretrievalstorageclass": "Fast",
+		})
+		require.NoError(t, h.mockStdinW.Close())
+		require.ErrorAs(t, <-serverErrorChan, new(*ErrConfigMissing))
+		require.Equal(t, `INITREMOTE-FAILURE [E001] retrieval storage class must be "Standard", "Expedited", or "Bulk": "Fast"`+"\n", line)
+	})
+}
+
+func TestObjectLockingConfig(t *testing.T) {
+	for _, tc := range []struct {
+		locking   string
+		retention string
+		want      time.Duration
+		wantErr   string
+	}{
+		{locking: "no", retention: "365d"},
+		{locking: "", retention: "bogus"},
+		{locking: "yes", retention: "365d", want: 365 * 24 * time.Hour},
+		{locking: "true", retention: "1h", want: time.Hour},
+		{locking: "yes", retention: "0s", wantErr: `object lock retention must be positive: "0s"`},
+		{locking: "yes", retention: "bogus", wantErr: `failed to parse object lock retention "bogus"`},
+		{locking: "maybe", retention: "365d", wantErr: `failed to parse object locking "maybe": must be "yes" or "no"`},
+	} {
+		got, err := parseObjectLocking(":s3:", tc.locking, tc.retention)
+		if tc.wantErr != "" {
+			require.ErrorContains(t, err, tc.wantErr)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, tc.want, got)
+	}
+
+	// Other backends would ignore the headers that lock objects.
+	_, err := parseObjectLocking(":local:", "yes", "365d")
+	require.EqualError(t, err, "object locking requires an s3 remote, not local")
+	_, err = parseObjectLocking(":local:", "no", "365d")
+	require.NoError(t, err)
+
+	t.Run("initremote", func(t *testing.T) {
+		h := makeTestState(t)
+		serverErrorChan := make(chan error)
+		go func() {
+			serverErrorChan <- h.server.run()
+		}()
+		h.requireReadLineExact("VERSION 1")
+		h.requireWriteLine("INITREMOTE")
+		line := h.answerConfigs(map[string]string{
+			"rcloneremotename":    ":local:",
+			"rcloneprefix":        t.TempDir(),
+			"rcloneobjectlocking": "yes",
+		})
+		require.NoError(t, h.mockStdinW.Close())
+		require.ErrorAs(t, <-serverErrorChan, new(*ErrConfigMissing))
+		require.Equal(t, "INITREMOTE-FAILURE [E001] object locking requires an s3 remote, not local\n", line)
+	})
+
+	s3 := newFakeS3()
+	before := time.Now()
+	storeToFakeS3(t, s3, func(s *server) {
+		s.configRcloneObjectLocking = "yes"
+		s.configRcloneObjectLockRetention = "30d"
+	})
+	s3.mu.Lock()
+	header := s3.headers["/bucket/annex/SomeKey"]
+	s3.mu.Unlock()
+	require.Equal(t, "COMPLIANCE", header.Get("X-Amz-Object-Lock-Mode"))
+	retainUntil, err := time.Parse(time.RFC3339, header.Get("X-Amz-Object-Lock-Retain-Until-Date"))
+	require.NoError(t, err)
+	require.WithinRange(t, retainUntil, before.Add(30*24*time.Hour-time.Second), time.Now().Add(30*24*time.Hour))
+
+	// remove sends "REMOVE SomeKey" to a server with object locking set to
+	// `locking`, and returns the reply and the server's error.
+	remove := func(locking string) (string, error) {
+		srv := httptest.NewServer(s3)
+		t.Cleanup(srv.Close)
+		h := makeTestState(t)
+		h.remoteName = fmt.Sprintf(":s3,provider=Other,endpoint=%s,force_path_style=true,access_key_id=x,secret_access_key=y,no_check_bucket=true:", quoteConfigValue(srv.URL))
+		h.remotePrefix = "bucket/annex"
+		h.preconfigureServer()
+		h.server.configRcloneObjectLocking = locking
+
+		serverErrorChan := make(chan error)
+		go func() {
+			serverErrorChan <- h.server.run()
+		}()
+
+		h.requireReadLineExact("VERSION 1")
+		h.requireWriteLine("REMOVE SomeKey")
+		reply := h.requireReadLine()
+		require.NoError(t, h.mockStdinW.Close())
+		return reply, <-serverErrorChan
+	}
+
+	// With object locking, REMOVE fails without trying to delete.
+	reply, err := remove("yes")
+	require.NoError(t, err)
+	require.Equal(t, "REMOVE-FAILURE SomeKey [E003] object locking enabled: cannot delete\n", reply)
+
+	// Without it, s3 refuses to delete the locked object.
+	reply, err = remove("no")
+	require.ErrorAs(t, err, new(*ErrTransferFailed))
+	require.Equal(t, "REMOVE-FAILURE SomeKey [E003] error deleting file\n", reply)
+
+	s3.mu.Lock()
+	defer s3.mu.Unlock()
+	require.Equal(t, "HELLO", string(s3.objects["/bucket/annex/SomeKey"]))
+}
+
+func TestTaggingConfig(t *testing.T) {
+	for _, tc := range []struct {
+		value   string
+		want    string
+		wantErr string
+	}{
+		{value: "", want: ""},
+		{value: `{}`, want: ""},
+		{value: `{"project":"annex","env":"prod"}`, want: "env=prod&project=annex"},
+		{value: `{"cost center":"a&b=c"}`, want: "cost+center=a%26b%3Dc"},
+		{value: `{"":"annex"}`, wantErr: "tag keys must not be empty"},
+		{value: `{"project":1}`, wantErr: "failed to parse tagging"},
+		{value: "project=annex", wantErr: "failed to parse tagging"},
+	} {
+		got, err := parseTagging(tc.value)
+		if tc.wantErr != "" {
+			require.ErrorContains(t, err, tc.wantErr, tc.value)
+			continue
+		}
+		require.NoError(t, err, tc.value)
+		require.Equal(t, tc.want, got, tc.value)
+	}
+
+	s3 := newFakeS3()
+	configure := func(s *server) {
+		s.configRcloneTagging = `{"project":"annex","env":"prod"}`
+	}
+	storeToFakeS3(t, s3, configure)
+	s3.mu.Lock()
+	require.Equal(t, "env=prod&project=annex", s3.headers["/bucket/annex/SomeKey"].Get("X-Amz-Tagging"))
+	s3.mu.Unlock()
+
+	// Retrieving the key leaves it as it was stored.
+	reply, err := retrieveFromFakeS3(t, s3, configure)
+	require.NoError(t, err)
+	require.Equal(t, "TRANSFER-SUCCESS RETRIEVE SomeKey\n", reply)
+
+	// Without the config, objects are not tagged.
+	s3 = newFakeS3()
+	storeToFakeS3(t, s3, func(s *server) {})
+	s3.mu.Lock()
+	defer s3.mu.Unlock()
+	require.Empty(t, s3.headers["/bucket/annex/SomeKey"].Get("X-Amz-Tagging"))
+}
+
+func TestKMSKeyConfig(t *testing.T) {
+	for _, tc := range []struct {
+		encryptionType, kmsKey string
+		want                   string
+		wantErr                string
+	}{
+		{want: ""},
+		{kmsKey: "alias/annex", want: "aws:kms"},
+		{encryptionType: "aws:kms", kmsKey: "alias/annex", want: "aws:kms"},
+		{encryptionType: "aws:kms", want: "aws:kms"},
+		{encryptionType: "AES256", want: "AES256"},
+		{encryptionType: "AES256", kmsKey: "alias/annex", wantErr: `encryption type "AES256" cannot use a KMS key`},
+		{encryptionType: "rot13", wantErr: `encryption type must be "aws:kms" or "AES256": "rot13"`},
+	} {
+		got, err := parseServerSideEncryption(tc.encryptionType, tc.kmsKey)
+		if tc.wantErr != "" {
+			require.EqualError(t, err, tc.wantErr)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, tc.want, got)
+	}
+
+	const keyARN = "arn:aws:kms:us-east-1:111122223333:key/1234abcd-12ab-34cd-56ef-1234567890ab"
+	for _, tc := range []struct {
+		label                  string
+		encryptionType, kmsKey string
+		wantEncryption         string
+	}{
+		{label: "Unset"},
+		{label: "KMSKey", kmsKey: keyARN, wantEncryption: "aws:kms"},
+		{label: "AES256", encryptionType: "AES256", wantEncryption: "AES256"},
+	} {
+		t.Run(tc.label, func(t *testing.T) {
+			s3 := newFakeS3()
+			storeToFakeS3(t, s3, func(s *server) {
+				s.configRcloneEncryptionType = tc.encryptionType
+				s.configRcloneKMSKey = tc.kmsKey
+			})
+
+			s3.mu.Lock()
+			defer s3.mu.Unlock()
+			headers := s3.headers["/bucket/annex/SomeKey"]
+			require.NotNil(t, headers)
+			require.Equal(t, tc.wantEncryption, headers.Get("X-Amz-Server-Side-Encryption"))
+			require.Equal(t, tc.kmsKey, headers.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"))
+		})
+	}
+}
+
+func TestRemoteFsLookedUpOnce(t *testing.T) {
+	localDir := t.TempDir()
+	localPath := filepath.Join(localDir, "file.txt")
+	require.NoError(t, os.WriteFile(localPath, []byte("HELLO"), 0600))
+
+	h := makeTestState(t)
+	h.remoteName = ":memory:"
+	h.remotePrefix = "lookups-" + random.String(8)
+	h.preconfigureServer()
+	var lookups []string
+	h.server.getFs = func(ctx context.Context, fsString string) (fs.Fs, error) {
+		lookups = append(lookups, fsString)
+		return cache.Get(ctx, fsString)
+	}
+
+	serverErrorChan := make(chan error)
+	go func() {
+		serverErrorChan <- h.server.run()
+	}()
+
+	h.requireReadLineExact("VERSION 1")
+	h.requireWriteLine("PREPARE")
+	h.requireReadLineExactAfterConfigs("PREPARE-SUCCESS")
+	for i := range 25 {
+		key := fmt.Sprintf("Key%d", i)
+		h.requireWriteLine("TRANSFER STORE " + key + " " + localPath)
+		h.requireReadLineExact("TRANSFER-SUCCESS STORE " + key)
+		h.requireWriteLine("CHECKPRESENT " + key)
+		h.requireReadLineExact("CHECKPRESENT-SUCCESS " + key)
+		h.requireWriteLine("TRANSFER RETRIEVE " + key + " " + filepath.Join(localDir, key))
+		h.requireReadLineExact("TRANSFER-SUCCESS RETRIEVE " + key)
+		h.requireWriteLine("REMOVE " + key)
+		h.requireReadLineExact("REMOVE-SUCCESS " + key)
+	}
+	require.NoError(t, h.mockStdinW.Close())
+	require.NoError(t, <-serverErrorChan)
+
+	// In the "nodir" layout, every key is in the prefix directory, which
+	// PREPARE already looked up.
+	require.Equal(t, []string{":memory:" + h.remotePrefix}, lookups)
+}
+
+func TestBuildFsString(t *testing.T) {
+	dirhashes := map[dirhashVariant]string{
+		dirhashMixed: "Xq/3v/",
+		dirhashLower: "f87/4d1/",
+	}
+	queryDirhash := func(variant dirhashVariant, key string) (string, error) {
+		require.Equal(t, "SomeKey", key)
+		dirhash, ok := dirhashes[variant]
+		require.True(t, ok, "unexpected variant: %v", variant)
+		return dirhash, nil
+	}
+
+	for _, tc := range []struct {
+		mode layoutMode
+		want string
+	}{
+		{layoutModeLower, "remote:prefix/f87/4d1/"},
+		{layoutModeDirectory, "remote:prefix/f87/4d1/SomeKey"},
+		{layoutModeNodir, "remote:prefix"},
+		{layoutModeMixed, "remote:prefix/Xq/3v/"},
+		{layoutModeFrankencase, "remote:prefix/xq/3v/"},
+		{layoutMode4level, "remote:prefix/Xq/3v/f87/4d1/"},
+		{layoutModeAnnexObjects, "remote:prefix/Xq/3v/SomeKey"},
+	} {
+		t.Run(string(tc.mode), func(t *testing.T) {
+			got, err := buildFsString(queryDirhash, tc.mode, "SomeKey", "remote", "prefix")
+			require.NoError(t, err)
+			require.Equal(t, tc.want, got)
+		})
+	}
+}
+
+// TestBuildFsStringKeys specifies where each layout mode stores a variety of
+// keys. The hash directories are those that git-annex computes for each key.
+func TestBuildFsStringKeys(t *testing.T) {
+	const (
+		emptyKey   = "SHA256E-s0--e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+		chunkKey   = "SHA256E-s0-S1048576-C2--e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+		sha256Key  = "SHA256-s5--3733cd977ff8eb18b987357e22ced99f46097f31ecb239e878ae63760e83e4d5"
+		sha256EKey = "SHA256E-s5--3733cd977ff8eb18b987357e22ced99f46097f31ecb239e878ae63760e83e4d5.txt"
+		wormKey    = "WORM-s5-m1700000000--file.txt"
+		urlKey     = "URL--https&c%%example.com%file.txt"
+		oddKey     = "WORM-s0-m0--name with spaces&and;symbols"
+		md5Key     = "MD5-s5--eb61eead90e3b899c6bcbe27ac581660"
+	)
+	dirhashes := map[string]map[dirhashVariant]string{
+		emptyKey:   {dirhashMixed: "pX/ZJ/", dirhashLower: "f87/4d5/"},
+		chunkKey:   {dirhashMixed: "pX/ZJ/", dirhashLower: "f87/4d5/"},
+		sha256Key:  {dirhashMixed: "83/qM/", dirhashLower: "23a/22f/"},
+		sha256EKey: {dirhashMixed: "P6/XM/", dirhashLower: "86a/fe1/"},
+		wormKey:    {dirhashMixed: "Xg/jG/", dirhashLower: "12d/e31/"},
+		urlKey:     {dirhashMixed: "VM/Vf/", dirhashLower: "da4/6ed/"},
+		oddKey:     {dirhashMixed: "22/WF/", dirhashLower: "a2f/8f3/"},
+		md5Key:     {dirhashMixed: "PM/99/", dirhashLower: "ba9/fa4/"},
+	}
+	for key, hashes := range dirhashes {
+		require.Equal(t, hashes[dirhashMixed], mixedDirhash(key), key)
+		require.Equal(t, hashes[dirhashLower], lowerDirhash(key), key)
+	}
+	queryDirhash := func(variant dirhashVariant, key string) (string, error) {
+		dirhash, ok := dirhashes[key][variant]
+		require.True(t, ok, "unexpected query: %v %q", variant, key)
+		return dirhash, nil
+	}
+
+	for _, tc := range []struct {
+		mode   layoutMode
+		key    string
+		prefix string
+		want   string
+	}{
+		{layoutModeNodir, emptyKey, "prefix", "remote:prefix"},
+		{layoutModeNodir, urlKey, "prefix", "remote:prefix"},
+		{layoutModeNodir, emptyKey, "", "remote:"},
+		{layoutModeNodir, emptyKey, "prefix/", "remote:prefix"},
+		{layoutModeMixed, emptyKey, "prefix/", "remote:prefix/pX/ZJ/"},
+		{layoutModeNodir, emptyKey, "a/b", "remote:a/b"},
+		{layoutModeMixed, emptyKey, "prefix", "remote:prefix/pX/ZJ/"},
+		{layoutModeMixed, chunkKey, "prefix", "remote:prefix/pX/ZJ/"},
+		{layoutModeMixed, sha256Key, "prefix", "remote:prefix/83/qM/"},
+		{layoutModeMixed, sha256EKey, "prefix", "remote:prefix/P6/XM/"},
+		{layoutModeMixed, wormKey, "prefix", "remote:prefix/Xg/jG/"},
+		{layoutModeMixed, urlKey, "prefix", "remote:prefix/VM/Vf/"},
+		{layoutModeMixed, oddKey, "prefix", "remote:prefix/22/WF/"},
+		{layoutModeMixed, md5Key, "prefix", "remote:prefix/PM/99/"},
+		{layoutModeMixed, emptyKey, "", "remote:pX/ZJ/"},
+		{layoutModeDirectory, emptyKey, "", "remote:f87/4d5/" + emptyKey},
+		{layoutModeMixed, emptyKey, "a/b", "remote:a/b/pX/ZJ/"},
+		{layoutModeLower, emptyKey, "prefix", "remote:prefix/f87/4d5/"},
+		{layoutModeLower, wormKey, "prefix", "remote:prefix/12d/e31/"},
+		{layoutModeLower, urlKey, "prefix", "remote:prefix/da4/6ed/"},
+		{layoutModeDirectory, emptyKey, "prefix", "remote:prefix/f87/4d5/" + emptyKey},
+		{layoutModeDirectory, oddKey, "prefix", "remote:prefix/a2f/8f3/" + oddKey},
+		{layoutModeFrankencase, emptyKey, "prefix", "remote:prefix/px/zj/"},
+		{layoutModeFrankencase, sha256Key, "prefix", "remote:prefix/83/qm/"},
+		{layoutMode4level, emptyKey, "prefix", "remote:prefix/pX/ZJ/f87/4d5/"},
+		{layoutMode4level, md5Key, "prefix", "remote:prefix/PM/99/ba9/fa4/"},
+		{layoutModeAnnexObjects, emptyKey, "prefix", "remote:prefix/pX/ZJ/" + emptyKey},
+		{layoutModeAnnexObjects, sha256EKey, "prefix", "remote:prefix/P6/XM/" + sha256EKey},
+	} {
+		t.Run(fmt.Sprintf("%s/%s/%q", tc.mode, tc.key, tc.prefix), func(t *testing.T) {
+			got, err := buildFsString(queryDirhash, tc.mode, tc.key, "remote", tc.prefix)
+			require.NoError(t, err)
+			require.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestKeyTypePrefix(t *testing.T) {
+	const (
+		sha256Key = "SHA256E-s5--185f8db32271fe25f561a6fc938b2e264306ec304eda518007d1764826381969.txt"
+		wormKey   = "WORM-s5-m1700000000--file.txt"
+		md5Key    = "MD5-s5--eb61eead90e3b899c6bcbe27ac581660"
+	)
+
+	s := server{
+		configRcloneRemoteName:    "remote:",
+		configPrefix:              "prefix",
+		configRcloneLayout:        "nodir",
+		configRcloneKeyTypePrefix: `{"SHA256":"cold/","WORM":"hot/"}`,
+	}
+	for key, want := range map[string]string{
+		sha256Key: "remote:prefix/cold",
+		wormKey:   "remote:prefix/hot",
+		md5Key:    "remote:prefix",
+		"":        "remote:prefix",
+	} {
+		got, err := s.buildFsString(layoutModeNodir, key)
+		require.NoError(t, err)
+		require.Equal(t, want, got, "key %q", key)
+	}
+
+	for _, value := range []string{`not json`, `["cold/"]`, `{"SHA256":"/cold"}`, `{"SHA256":"../cold"}`} {
+		_, err := parseKeyTypePrefixes(value)
+		require.Error(t, err, "value %q", value)
+	}
+
+	t.Run("Store", func(t *testing.T) {
+		ctx := context.Background()
+		localPath := filepath.Join(t.TempDir(), "file.txt")
+		require.NoError(t, os.WriteFile(localPath, []byte("HELLO"), 0600))
+
+		h := makeTestState(t)
+		h.remoteName = ":memory:"
+		h.remotePrefix = "keytype-" + random.String(8)
+		h.preconfigureServer()
+		h.server.configRcloneKeyTypePrefix = `{"SHA256":"cold/","WORM":"hot/"}`
+
+		serverErrorChan := make(chan error)
+		go func() {
+			serverErrorChan <- h.server.run()
+		}()
+
+		h.requireReadLineExact("VERSION 1")
+		for _, key := range []string{sha256Key, wormKey} {
+			h.requireWriteLine("TRANSFER STORE " + key + " " + localPath)
+			h.requireReadLineExact("TRANSFER-SUCCESS STORE " + key)
+			h.requireWriteLine("CHECKPRESENT " + key)
+			h.requireReadLineExact("CHECKPRESENT-SUCCESS " + key)
+		}
+		require.NoError(t, h.mockStdinW.Close())
+		require.NoError(t, <-serverErrorChan)
+
+		for dir, key := range map[string]string{"cold": sha256Key, "hot": wormKey} {
+			dirFs, err := cache.Get(ctx, ":memory:"+h.remotePrefix+"/"+dir)
+			require.NoError(t, err)
+			_, err = dirFs.NewObject(ctx, key)
+			require.NoError(t, err, "expected %q in %q", key, dir)
+		}
+	})
+}
+
+func TestExcludeKeyPatterns(t *testing.T) {
+	testCases := []struct {
+		label    string
+		value    string
+		key      string
+		excluded bool
+	}{
+		{label: "EmptyList", value: "", key: "SHA1-s5--abcdef", excluded: false},
+		{label: "BlankEntries", value: " , ,", key: "SHA1-s5--abcdef", excluded: false},
+		{label: "WormMatches", value: "*-WORM*", key: "MD5-WORM-s5--abcdef", excluded: true},
+		{label: "WormDoesNotMatch", value: "*-WORM*", key: "SHA256E-s5--abcdef.txt", excluded: false},
+		{label: "Sha1Matches", value: "SHA1-*", key: "SHA1-s5--abcdef", excluded: true},
+		{label: "Sha1DoesNotMatchSha1E", value: "SHA1-*", key: "SHA1E-s5--abcdef.txt", excluded: false},
+		{label: "AnyPatternMatches", value: "SHA1-*, *-WORM*", key: "MD5-WORM-s5--abcdef", excluded: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.label, func(t *testing.T) {
+			patterns, err := parseExcludeKeyPatterns(tc.value)
+			require.NoError(t, err)
+			require.Equal(t, tc.excluded, keyIsExcluded(tc.key, patterns))
+		})
+	}
+
+	_, err := parseExcludeKeyPatterns("SHA1-*,[")
+	require.ErrorContains(t, err, `failed to parse exclude key pattern "["`)
+}
+
+func TestStoreRefusesExcludedKeys(t *testing.T) {
+	localPath := filepath.Join(t.TempDir(), "file.txt")
+	require.NoError(t, os.WriteFile(localPath, []byte("HELLO"), 0600))
+
+	h := makeTestState(t)
+	h.remoteName = ":memory:"
+	h.remotePrefix = "exclude-" + random.String(8)
+	h.preconfigureServer()
+	h.server.configRcloneExcludeKeys = "SHA1-*"
+
+	serverErrorChan := make(chan error)
+	go func() {
+		serverErrorChan <- h.server.run()
+	}()
+
+	h.requireReadLineExact("VERSION 1")
+	h.requireWriteLine("TRANSFER STORE SHA1-s5--abcdef " + localPath)
+	h.requireReadLineExact("TRANSFER-FAILURE STORE SHA1-s5--abcdef [E006] excluded by rcloneexcludekeys")
+	h.requireWriteLine("CHECKPRESENT SHA1-s5--abcdef")
+	h.requireReadLineExact("CHECKPRESENT-FAILURE SHA1-s5--abcdef")
+	// The session continues, and other keys are stored as usual.
+	h.requireWriteLine("TRANSFER STORE SHA256-s5--abcdef " + localPath)
+	h.requireReadLineExact("TRANSFER-SUCCESS STORE SHA256-s5--abcdef")
+	require.NoError(t, h.mockStdinW.Close())
+	require.NoError(t, <-serverErrorChan)
+}
+
+// blockingPutFs wraps an Fs. Its Put closes `started` and then blocks until
+// the context is cancelled.
+type blockingPutFs struct {
+	fs.Fs
+	started chan struct{}
+}
+
+func (f *blockingPutFs) Put(ctx context.Context, in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) (fs.Object, error) {
+	close(f.started)
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestRunWithContextCancelsTransfer(t *testing.T) {
+	localPath := filepath.Join(t.TempDir(), "file.txt")
+	require.NoError(t, os.WriteFile(localPath, []byte("HELLO"), 0600))
+
+	h := makeTestState(t)
+	h.remoteName = ":memory:"
+	h.remotePrefix = "cancel-" + random.String(8)
+	h.preconfigureServer()
+
+	remoteFsString, err := buildFsString(nil, layoutModeNodir, "", h.remoteName, h.remotePrefix)
+	require.NoError(t, err)
+	memoryFs, err := cache.Get(context.Background(), remoteFsString)
+	require.NoError(t, err)
+	blockingFs := &blockingPutFs{Fs: memoryFs, started: make(chan struct{})}
+	cache.Put(remoteFsString, blockingFs)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	serverErrorChan := make(chan error)
+	go func() {
+		serverErrorChan <- h.server.RunWithContext(ctx)
+	}()
+
+	h.requireReadLineExact("VERSION 1")
+	h.requireWriteLine("TRANSFER STORE SomeKey " + localPath)
+	<-blockingFs.started
+	cancel()
+	line, err := h.readLineWithTimeout()
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(line, "TRANSFER-FAILURE STORE SomeKey [E003] failed to copy file: "), line)
+	require.Contains(t, line, "context canceled")
+
+	err = <-serverErrorChan
+	require.ErrorAs(t, err, new(*ErrTransferFailed))
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestProgressConfig(t *testing.T) {
+	localDir := t.TempDir()
+	localPath := filepath.Join(localDir, "file.bin")
+	require.NoError(t, os.WriteFile(localPath, bytes.Repeat([]byte("x"), 4<<20), 0600))
+
+	for _, progress := range []string{"no", "yes"} {
+		t.Run(progress, func(t *testing.T) {
+			var stderr bytes.Buffer
+			h := makeTestState(t)
+			h.remoteName = ":memory:"
+			h.remotePrefix = "progress-" + random.String(8)
+			h.preconfigureServer()
+			h.server.configRcloneProgress = progress
+			h.server.progressOutput = &stderr
+
+			serverErrorChan := make(chan error)
+			go func() {
+				serverErrorChan <- h.server.run()
+			}()
+
+			h.requireReadLineExact("VERSION 1")
+			h.requireWriteLine("TRANSFER STORE SomeKey " + localPath)
+			h.requireReadLineExact("TRANSFER-SUCCESS STORE SomeKey")
+			h.requireWriteLine("TRANSFER RETRIEVE SomeKey " + filepath.Join(localDir, "retrieved-"+progress+".bin"))
+			h.requireReadLineExact("TRANSFER-SUCCESS RETRIEVE SomeKey")
+			require.NoError(t, h.mockStdinW.Close())
+			require.NoError(t, <-serverErrorChan)
+
+			if progress == "no" {
+				require.Empty(t, stderr.String())
+				return
+			}
+			// Each transfer renders at least its final stats, then erases
+			// the line.
+			output := stderr.String()
+			require.GreaterOrEqual(t, strings.Count(output, "4 MiB / 4 MiB, 100%"), 2, output)
+			require.True(t, strings.HasSuffix(output, clearLine), output)
+		})
+	}
+}
+
+func TestAllowedBackends(t *testing.T) {
+	testCases := []struct {
+		remoteName      string
+		allowedBackends string
+		wantErr         string
+	}{
+		{remoteName: ":local:", allowedBackends: ""},
+		{remoteName: ":s3:", allowedBackends: ""},
+		{remoteName: ":local:", allowedBackends: "local"},
+		{remoteName: ":local:", allowedBackends: "s3, local ,sftp"},
+		{remoteName: ":s3:", allowedBackends: "local", wantErr: "backend not in rcloneallowedbackends: s3"},
+		{remoteName: ":s3,provider=AWS:", allowedBackends: "local,sftp", wantErr: "backend not in rcloneallowedbackends: s3"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.remoteName+"/"+tc.allowedBackends, func(t *testing.T) {
+			err := validateAllowedBackend(tc.remoteName, tc.allowedBackends)
+			if tc.wantErr == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, tc.wantErr)
+			}
+		})
+	}
+
+	initRemote := func(t *testing.T, remoteName string) (string, error) {
+		h := makeTestState(t)
+		serverErrorChan := make(chan error)
+		go func() {
+			serverErrorChan <- h.server.run()
+		}()
+
+		h.requireReadLineExact("VERSION 1")
+		h.requireWriteLine("INITREMOTE")
+		line := h.answerConfigs(map[string]string{
+			"rcloneremotename":      remoteName,
+			"rcloneprefix":          t.TempDir(),
+			"rcloneallowedbackends": "local",
+		})
+		require.NoError(t, h.mockStdinW.Close())
+		return line, <-serverErrorChan
+	}
+
+	t.Run("InitRemoteAllowsLocal", func(t *testing.T) {
+		line, err := initRemote(t, ":local:")
+		require.NoError(t, err)
+		require.Equal(t, "INITREMOTE-SUCCESS\n", line)
+	})
+
+	t.Run("InitRemoteRejectsS3", func(t *testing.T) {
+		line, err := initRemote(t, ":s3:")
+		require.ErrorAs(t, err, new(*ErrConfigMissing))
+		require.Equal(t, "INITREMOTE-FAILURE [E001] backend not in rcloneallowedbackends: s3\n", line)
+	})
+}
+
+func TestHealthCheck(t *testing.T) {
+	require.NotNil(t, command.Flags().Lookup("health-check"))
+	ctx := context.Background()
+
+	t.Run("OK", func(t *testing.T) {
+		var out bytes.Buffer
+		require.Equal(t, 0, runHealthCheck(ctx, &out, ":local:"+t.TempDir()))
+		require.Equal(t, "OK\n", out.String())
+	})
+
+	t.Run("MissingDirectory", func(t *testing.T) {
+		var out bytes.Buffer
+		missingDir := filepath.Join(t.TempDir(), "missing")
+		require.Equal(t, 1, runHealthCheck(ctx, &out, ":local:"+missingDir))
+		require.Equal(t, "ERROR: failed to list remote: directory not found\n", out.String())
+	})
+
+	t.Run("NoRemote", func(t *testing.T) {
+		t.Setenv(standaloneRemoteEnvVar, "")
+		var out bytes.Buffer
+		require.Equal(t, 1, runHealthCheck(ctx, &out, standaloneRemote()))
+		require.Equal(t, "ERROR: no remote given: use --remote-override or RCLONE_GITANNEX_REMOTE\n", out.String())
+	})
+
+	t.Run("RemoteFromEnvironment", func(t *testing.T) {
+		dir := t.TempDir()
+		t.Setenv(standaloneRemoteEnvVar, ":local:"+dir)
+		require.Equal(t, ":local:"+dir, standaloneRemote())
+	})
+}
+
+func TestMixedDirhash(t *testing.T) {
+	// Git-annex stores the empty file in .git/annex/objects/pX/ZJ/.
+	const emptyKey = "SHA256E-s0--e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	require.Equal(t, "pX/ZJ/", mixedDirhash(emptyKey))
+	// Every chunk of a key hashes into the key's directory.
+	require.Equal(t, "pX/ZJ/", mixedDirhash("SHA256E-s0-S1048576-C2--e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"))
+	require.Equal(t, "SHA256E-s0--x", nonChunkKey("SHA256E-s0-S10-C1--x"))
+	require.Equal(t, "WORM-s5-m1700000000--a-b--c", nonChunkKey("WORM-s5-m1700000000--a-b--c"))
+}
+
+// lowerDirhash computes the lowercase hash directories of `key`, e.g.
+// "f87/4d1/", as git-annex does in reply to "DIRHASH-LOWER KEY".
+func lowerDirhash(key string) string {
+	sum := fmt.Sprintf("%x", md5.Sum([]byte(nonChunkKey(key))))
+	return sum[0:3] + "/" + sum[3:6] + "/"
+}
+
+// TestDirectoryRemoteInterop checks that the "directory" layout finds and
+// stores objects where git-annex's own "directory" special remote does, i.e.
+// in "<DIRHASH-LOWER>/KEY/KEY", and that the "annexobjects" layout finds the
+// objects that older versions of git-annex stored in "<DIRHASH>/KEY/KEY".
+func TestDirectoryRemoteInterop(t *testing.T) {
+	const emptyKey = "SHA256E-s0--e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	const helloKey = "SHA256E-s5--3733cd977ff8eb18b987357e22ced99f46097f31ecb239e878ae63760e83e4d5"
+	require.Equal(t, "f87/4d5/", lowerDirhash(emptyKey))
+
+	localDir := t.TempDir()
+	localPath := filepath.Join(localDir, "file.txt")
+	require.NoError(t, os.WriteFile(localPath, []byte("HELLO"), 0600))
+
+	// runSession runs `steps` against a server using the given layout for
+	// `remoteDir`. Each step sends a message and expects a reply, answering
+	// DIRHASH queries along the way.
+	runSession := func(remoteDir string, layout layoutMode, steps [][2]string) {
+		h := makeTestState(t)
+		h.remoteName = ":local:"
+		h.remotePrefix = remoteDir
+		h.preconfigureServer()
+		h.server.configRcloneLayout = string(layout)
+
+		serverErrorChan := make(chan error)
+		go func() {
+			serverErrorChan <- h.server.run()
+		}()
+		h.requireReadLineExact("VERSION 1")
+		for _, step := range steps {
+			h.requireWriteLine(step[0])
+			line := h.requireReadLine()
+			if key, found := strings.CutPrefix(strings.TrimSuffix(line, "\n"), "DIRHASH-LOWER "); found {
+				h.requireWriteLine("VALUE " + lowerDirhash(key))
+				line = h.requireReadLine()
+			} else if key, found := strings.CutPrefix(strings.TrimSuffix(line, "\n"), "DIRHASH "); found {
+				h.requireWriteLine("VALUE " + mixedDirhash(key))
+				line = h.requireReadLine()
+			}
+			require.Equal(t, step[1]+"\n", line, step[0])
+		}
+		require.NoError(t, h.mockStdinW.Close())
+		require.NoError(t, <-serverErrorChan)
+	}
+
+	// An object that git-annex's directory special remote stored.
+	remoteDir := t.TempDir()
+	annexPath := filepath.Join(remoteDir, "f87", "4d5", emptyKey, emptyKey)
+	require.NoError(t, os.MkdirAll(filepath.Dir(annexPath), 0700))
+	require.NoError(t, os.WriteFile(annexPath, nil, 0600))
+	retrievedPath := filepath.Join(localDir, "retrieved.txt")
+	runSession(remoteDir, layoutModeDirectory, [][2]string{
+		{"CHECKPRESENT " + emptyKey, "CHECKPRESENT-SUCCESS " + emptyKey},
+		{"TRANSFER RETRIEVE " + emptyKey + " " + retrievedPath, "TRANSFER-SUCCESS RETRIEVE " + emptyKey},
+		{"TRANSFER STORE " + helloKey + " " + localPath, "TRANSFER-SUCCESS STORE " + helloKey},
+	})
+	require.FileExists(t, retrievedPath)
+	require.FileExists(t, filepath.Join(remoteDir, filepath.FromSlash(lowerDirhash(helloKey)), helloKey, helloKey))
+
+	// An object that an older git-annex stored with the mixed-case hash.
+	legacyDir := t.TempDir()
+	legacyPath := filepath.Join(legacyDir, "pX", "ZJ", emptyKey, emptyKey)
+	require.NoError(t, os.MkdirAll(filepath.Dir(legacyPath), 0700))
+	require.NoError(t, os.WriteFile(legacyPath, nil, 0600))
+	runSession(legacyDir, layoutModeAnnexObjects, [][2]string{
+		{"CHECKPRESENT " + emptyKey, "CHECKPRESENT-SUCCESS " + emptyKey},
+		{"REMOVE " + emptyKey, "REMOVE-SUCCESS " + emptyKey},
+	})
+	require.NoFileExists(t, legacyPath)
+}
+
+func TestListLayouts(t *testing.T) {
+	require.NotNil(t, command.Flags().Lookup("list-layouts"))
+
+	var out bytes.Buffer
+	printLayouts(&out)
+	for _, mode := range []string{"nodir", "mixed", "lower"} {
+		require.Contains(t, out.String(), "- `"+mode+"`: ")
+	}
+
+	// New layouts need a description, which the golden file and the docs
+	// should include.
+	golden, err := os.ReadFile(filepath.Join("testdata", "layouts.golden"))
+	require.NoError(t, err)
+	require.Equal(t, string(golden), out.String(), "update testdata/layouts.golden and gitannex.md")
+	require.Contains(t, gitannexHelp, out.String())
+}
+
+func TestParseLayoutMigration(t *testing.T) {
+	m, err := parseLayoutMigration("from=nodir,to=mixed")
+	require.NoError(t, err)
+	require.Equal(t, layoutMigration{from: layoutModeNodir, to: layoutModeMixed}, m)
+
+	for _, spec := range []string{"", "nodir", "from=nodir", "from=mixed,to=nodir", "from=nodir,to=lower", "from=nodir,to=mixed,via=x"} {
+		_, err := parseLayoutMigration(spec)
+		require.Error(t, err, spec)
+	}
+}
+
+func TestMigrateLayout(t *testing.T) {
+	require.NotNil(t, command.Flags().Lookup("migrate-layout"))
+	ctx := context.Background()
+	remoteDir := t.TempDir()
+	keys := []string{
+		"SHA256E-s5--185f8db32271fe25f561a6fc938b2e264306ec304eda518007d1764826381969.txt",
+		"SHA256E-s0--e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		"WORM-s5-m1700000000--notes.txt",
+	}
+	for _, key := range keys {
+		require.NoError(t, os.WriteFile(filepath.Join(remoteDir, key), []byte("HELLO"), 0600))
+	}
+	// A chunked key moves with its chunks, and records are left alone.
+	const chunkedKey = "SHA256E-s4--chunked"
+	require.NoError(t, os.WriteFile(filepath.Join(remoteDir, chunkName(chunkedKey, 0)), []byte("AB"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(remoteDir, chunkName(chunkedKey, 1)), []byte("CD"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(remoteDir, manifestName(chunkedKey)), []byte("2 4\n"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(remoteDir, uuidFileName), []byte("{}"), 0600))
+
+	var out bytes.Buffer
+	require.Equal(t, 0, runMigrateLayout(ctx, &out, ":local:"+remoteDir, "from=nodir,to=mixed"))
+	require.Equal(t, "moved 6 objects\n", out.String())
+
+	queryDirhash := func(variant dirhashVariant, key string) (string, error) {
+		require.Equal(t, dirhashMixed, variant)
+		return mixedDirhash(key), nil
+	}
+	for _, key := range keys {
+		fsString, err := buildFsString(queryDirhash, layoutModeMixed, key, ":local:", remoteDir)
+		require.NoError(t, err)
+		dir := strings.TrimPrefix(fsString, ":local:")
+		require.FileExists(t, filepath.Join(dir, key))
+		require.NoFileExists(t, filepath.Join(remoteDir, key))
+	}
+	for i := range 2 {
+		require.FileExists(t, filepath.Join(remoteDir, mixedDirhash(chunkedKey), chunkName(chunkedKey, i)))
+	}
+	require.FileExists(t, filepath.Join(remoteDir, mixedDirhash(chunkedKey), manifestName(chunkedKey)))
+	require.FileExists(t, filepath.Join(remoteDir, uuidFileName))
+
+	// Running the migration again finds nothing to move.
+	out.Reset()
+	require.Equal(t, 0, runMigrateLayout(ctx, &out, ":local:"+remoteDir, "from=nodir,to=mixed"))
+	require.Equal(t, "moved 0 objects\n", out.String())
+
+	out.Reset()
+	require.Equal(t, 1, runMigrateLayout(ctx, &out, ":local:"+remoteDir, "from=mixed,to=nodir"))
+	require.Contains(t, out.String(), "ERROR: unsupported layout migration")
+}
+
+// TestStoreURLKey checks that a URL key is stored from the file git-annex
+// gives, not fetched again from its URL.
+func TestStoreURLKey(t *testing.T) {
+	ctx := context.Background()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("FROM URL"))
+	}))
+	defer srv.Close()
+
+	localPath := filepath.Join(t.TempDir(), "file.txt")
+	require.NoError(t, os.WriteFile(localPath, []byte("HELLO"), 0600))
+
+	h := makeTestState(t)
+	h.remoteName = ":memory:"
+	h.remotePrefix = "urlkey-" + random.String(8)
+	h.preconfigureServer()
+
+	serverErrorChan := make(chan error)
+	go func() {
+		serverErrorChan <- h.server.run()
+	}()
+
+	key := "URL--" + srv.URL + "/file.txt"
+	h.requireReadLineExact("VERSION 1")
+	h.requireWriteLine("TRANSFER STORE " + key + " " + localPath)
+	h.requireReadLineExact("TRANSFER-SUCCESS STORE " + key)
+	require.NoError(t, h.mockStdinW.Close())
+	require.NoError(t, <-serverErrorChan)
+
+	remoteFsString, err := buildFsString(nil, layoutModeNodir, "", h.remoteName, h.remotePrefix)
+	require.NoError(t, err)
+	remoteFs, err := cache.Get(ctx, remoteFsString)
+	require.NoError(t, err)
+	obj, err := remoteFs.NewObject(ctx, key)
+	require.NoError(t, err)
+	data, err := operations.ReadFile(ctx, obj)
+	require.NoError(t, err)
+	require.Equal(t, "HELLO", string(data))
+}
+
+func TestQueryDirhashVariants(t *testing.T) {
+	const key = "SHA256E-s5--185f8db32271fe25f561a6fc938b2e264306ec304eda518007d1764826381969.txt"
+
+	h := makeTestState(t)
+	type result struct {
+		dirhash string
+		err     error
+	}
+	query := func(variant dirhashVariant, wantMsg, reply string) string {
+		resultChan := make(chan result)
+		go func() {
+			dirhash, err := h.server.queryDirhashVariant(variant, key)
+			resultChan <- result{dirhash, err}
+		}()
+		if wantMsg != "" {
+			h.requireReadLineExact(wantMsg)
+			h.requireWriteLine("VALUE " + reply)
+		}
+		r := <-resultChan
+		require.NoError(t, r.err)
+		return r.dirhash
+	}
+
+	// The replies have the same format as git-annex's, but they are made up.
+	mixed := query(dirhashMixed, "DIRHASH "+key, "pX/Zm/")
+	lower := query(dirhashLower, "DIRHASH-LOWER "+key, "2b8/63f/")
+	require.NotEqual(t, mixed, lower)
+
+	// Each variant is two path components with a trailing slash, and only
+	// DIRHASH-LOWER is restricted to lowercase hex.
+	require.Regexp(t, `^[0-9A-Za-z]{2}/[0-9A-Za-z]{2}/$`, mixed)
+	require.Regexp(t, `^[0-9a-f]{3}/[0-9a-f]{3}/$`, lower)
+
+	// Replies are cached per variant.
+	require.Equal(t, mixed, query(dirhashMixed, "", ""))
+	require.Equal(t, lower, query(dirhashLower, "", ""))
+}
+
+// flatDirhashLayout is an example [LayoutPlugin] that stores each key in a
+// single directory named after its lowercase hash directories, e.g.
+// "prefix/f874d1".
+type flatDirhashLayout struct{}
+
+func (flatDirhashLayout) Name() string {
+	return "flatdirhash"
+}
+
+func (flatDirhashLayout) KeyPath(key, prefix string, queryFn func(string) (string, error)) (string, error) {
+	dirhash, err := queryFn("DIRHASH-LOWER " + key)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(prefix, strings.ReplaceAll(dirhash, "/", "")), nil
+}
+
+func TestLayoutPlugin(t *testing.T) {
+	ctx := context.Background()
+	plugin := flatDirhashLayout{}
+	require.NoError(t, RegisterLayoutPlugin(plugin))
+	t.Cleanup(func() { unregisterLayoutPlugin(plugin.Name()) })
+
+	require.ErrorContains(t, RegisterLayoutPlugin(plugin), "already registered")
+	require.Contains(t, allLayoutModes(), layoutMode("flatdirhash"))
+	require.Equal(t, layoutMode("flatdirhash"), parseLayoutMode("flatdirhash"))
+
+	localDir := t.TempDir()
+	localPath := filepath.Join(localDir, "file.txt")
+	require.NoError(t, os.WriteFile(localPath, []byte("HELLO"), 0600))
+
+	h := makeTestState(t)
+	h.remoteName = ":memory:"
+	h.remotePrefix = "plugin-" + random.String(8)
+	h.preconfigureServer()
+	h.server.configRcloneLayout = plugin.Name()
+
+	serverErrorChan := make(chan error)
+	go func() {
+		serverErrorChan <- h.server.run()
+	}()
+
+	h.requireReadLineExact("VERSION 1")
+	h.requireWriteLine("TRANSFER STORE SomeKey " + localPath)
+	h.requireReadLineExact("DIRHASH-LOWER SomeKey")
+	h.requireWriteLine("VALUE f87/4d1/")
+	h.requireReadLineExact("TRANSFER-SUCCESS STORE SomeKey")
+
+	// The DIRHASH-LOWER reply is cached, so no further queries are sent.
+	h.requireWriteLine("CHECKPRESENT SomeKey")
+	h.requireReadLineExact("CHECKPRESENT-SUCCESS SomeKey")
+	h.requireWriteLine("TRANSFER RETRIEVE SomeKey " + filepath.Join(localDir, "retrieved.txt"))
+	h.requireReadLineExact("TRANSFER-SUCCESS RETRIEVE SomeKey")
+
+	pluginFs, err := cache.Get(ctx, ":memory:"+h.remotePrefix+"/f874d1")
+	require.NoError(t, err)
+	_, err = pluginFs.NewObject(ctx, "SomeKey")
+	require.NoError(t, err)
+
+	h.requireWriteLine("REMOVE SomeKey")
+	h.requireReadLineExact("REMOVE-SUCCESS SomeKey")
+	_, err = pluginFs.NewObject(ctx, "SomeKey")
+	require.ErrorIs(t, err, fs.ErrorObjectNotFound)
+
+	require.NoError(t, h.mockStdinW.Close())
+	require.NoError(t, <-serverErrorChan)
+
+	retrieved, err := os.ReadFile(filepath.Join(localDir, "retrieved.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "HELLO", string(retrieved))
+}
+
+func TestRegisterLayoutPluginRejectsBuiltinNames(t *testing.T) {
+	for _, mode := range []layoutMode{layoutModeNodir, layoutMode4level} {
+		err := RegisterLayoutPlugin(namedLayout(mode))
+		require.ErrorContains(t, err, "collides with built-in layout mode")
+	}
+	require.ErrorContains(t, RegisterLayoutPlugin(namedLayout("")), "must not be empty")
+}
+
+// namedLayout is a [LayoutPlugin] that only has a name.
+type namedLayout string
+
+func (n namedLayout) Name() string {
+	return string(n)
+}
+
+func (n namedLayout) KeyPath(_, prefix string, _ func(string) (string, error)) (string, error) {
+	return prefix, nil
+}
+
+func TestBuildAnnexObjectsPath(t *testing.T) {
+	require.Equal(t, "Xq/3v/SomeKey/SomeKey", buildAnnexObjectsPath("Xq/3v/", "SomeKey"))
+	require.Equal(t,
+		"pX/Zm/SHA256E-s5--185f8db32271fe25f561a6fc938b2e264306ec304eda518007d1764826381969.txt/SHA256E-s5--185f8db32271fe25f561a6fc938b2e264306ec304eda518007d1764826381969.txt",
+		buildAnnexObjectsPath("pX/Zm/", "SHA256E-s5--185f8db32271fe25f561a6fc938b2e264306ec304eda518007d1764826381969.txt"))
+}
+
+func TestAnnexObjectsLayout(t *testing.T) {
+	ctx := context.Background()
+	localDir := t.TempDir()
+	localPath := filepath.Join(localDir, "file.txt")
+	require.NoError(t, os.WriteFile(localPath, []byte("HELLO"), 0600))
+
+	h := makeTestState(t)
+	h.remoteName = ":memory:"
+	h.remotePrefix = "annexobjects-" + random.String(8)
+	h.preconfigureServer()
+	h.server.configRcloneLayout = string(layoutModeAnnexObjects)
+
+	serverErrorChan := make(chan error)
+	go func() {
+		serverErrorChan <- h.server.run()
+	}()
+
+	h.requireReadLineExact("VERSION 1")
+	h.requireWriteLine("TRANSFER STORE SomeKey " + localPath)
+	h.requireReadLineExact("DIRHASH SomeKey")
+	h.requireWriteLine("VALUE Xq/3v/")
+	h.requireReadLineExact("TRANSFER-SUCCESS STORE SomeKey")
+
+	h.requireWriteLine("CHECKPRESENT SomeKey")
+	h.requireReadLineExact("CHECKPRESENT-SUCCESS SomeKey")
+
+	retrievedPath := filepath.Join(localDir, "retrieved.txt")
+	h.requireWriteLine("TRANSFER RETRIEVE SomeKey " + retrievedPath)
+	h.requireReadLineExact("TRANSFER-SUCCESS RETRIEVE SomeKey")
+
+	require.NoError(t, h.mockStdinW.Close())
+	require.NoError(t, <-serverErrorChan)
+
+	retrieved, err := os.ReadFile(retrievedPath)
+	require.NoError(t, err)
+	require.Equal(t, "HELLO", string(retrieved))
+
+	// The object is where git-annex would keep it in .git/annex/objects.
+	objectPath := buildAnnexObjectsPath("Xq/3v/", "SomeKey")
+	objectDirFs, err := cache.Get(ctx, ":memory:"+h.remotePrefix+"/"+path.Dir(objectPath))
+	require.NoError(t, err)
+	_, err = objectDirFs.NewObject(ctx, path.Base(objectPath))
+	require.NoError(t, err)
+}
+
+func TestPathSeparator(t *testing.T) {
+	for _, tc := range []struct {
+		value, want, wantErr string
+	}{
+		{value: "", want: "/"},
+		{value: "/", want: "/"},
+		{value: `\`, want: `\`},
+		{value: ":", wantErr: "path separator must be a single character"},
+		{value: "//", wantErr: "path separator must be a single character"},
+	} {
+		got, err := parsePathSeparator(tc.value)
+		if tc.wantErr != "" {
+			require.ErrorContains(t, err, tc.wantErr)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, tc.want, got)
+	}
+
+	require.Equal(t, `remote:prefix\Xq\3v`, replacePathSeparator("remote:prefix/Xq/3v/", "remote:prefix", `\`))
+	require.Equal(t, `remote:a/b\f87\4d1\SomeKey`, replacePathSeparator("remote:a/b/f87/4d1/SomeKey", "remote:a/b", `\`))
+	require.Equal(t, "remote:prefix", replacePathSeparator("remote:prefix", "remote:prefix", `\`))
+	require.Equal(t, "remote:prefix/Xq/3v/", replacePathSeparator("remote:prefix/Xq/3v/", "remote:prefix", "/"))
+
+	remoteDir := t.TempDir()
+	localPath := filepath.Join(t.TempDir(), "file.txt")
+	require.NoError(t, os.WriteFile(localPath, []byte("HELLO"), 0600))
+
+	h := makeTestState(t)
+	h.remoteName = ":local:"
+	h.remotePrefix = remoteDir
+	h.preconfigureServer()
+	h.server.configRcloneLayout = string(layoutModeMixed)
+	h.server.configRclonePathSeparator = `\`
+
+	serverErrorChan := make(chan error)
+	go func() {
+		serverErrorChan <- h.server.run()
+	}()
+
+	h.requireReadLineExact("VERSION 1")
+	h.requireWriteLine("TRANSFER STORE SomeKey " + localPath)
+	h.requireReadLineExact("DIRHASH SomeKey")
+	h.requireWriteLine("VALUE Xq/3v/")
+	h.requireReadLineExact("TRANSFER-SUCCESS STORE SomeKey")
+	h.requireWriteLine("CHECKPRESENT SomeKey")
+	h.requireReadLineExact("CHECKPRESENT-SUCCESS SomeKey")
+
+	fsString, err := h.server.buildFsString(layoutModeMixed, "SomeKey")
+	require.NoError(t, err)
+	require.Equal(t, ":local:"+remoteDir+`\Xq\3v`, fsString)
+	if runtime.GOOS != "windows" {
+		// Elsewhere, the local backend takes backslashes literally.
+		require.FileExists(t, remoteDir+`\Xq\3v/SomeKey`)
+	}
+
+	h.requireWriteLine("REMOVE SomeKey")
+	h.requireReadLineExact("REMOVE-SUCCESS SomeKey")
+	h.requireWriteLine("CHECKPRESENT SomeKey")
+	h.requireReadLineExact("CHECKPRESENT-FAILURE SomeKey")
+	require.NoError(t, h.mockStdinW.Close())
+	require.NoError(t, <-serverErrorChan)
+}
+
+func TestValidateRemoteNameConnectionStrings(t *testing.T) {
+	for _, testCase := range []struct {
+		value   string
+		wantErr string
+	}{
+		{value: ":local:"},
+		{value: ":local,description=banana:"},
+		{value: ":s3,provider=AWS:"},
+		{value: ":s3,provider=AWS,env_auth=true:"},
+		{value: `:s3,provider=Minio,endpoint="http://127.0.0.1:9000":`},
+		{value: `:s3,provider=Minio,endpoint='http://127.0.0.1:9000',env_auth=true:`},
+		{
+			value:   ":s3,provider=AWS",
+			wantErr: "remote could not be parsed: :s3,provider=AWS",
+		},
+		{
+			value:   ":nonexistentBackend,provider=AWS:",
+			wantErr: "backend does not exist: nonexistentBackend",
+		},
+		{
+			value:   ":s3,provider=Minio,endpoint=http://127.0.0.1:9000:",
+			wantErr: "remote does not exist or incorrectly contains a path:",
+		},
+		{
+			value:   `:s3,provider=AWS:/bucket/path`,
+			wantErr: "remote does not exist or incorrectly contains a path:",
+		},
+		{
+			value:   "s3,provider=AWS:",
+			wantErr: "remote does not exist: s3,provider=AWS:",
+		},
+	} {
+		t.Run(testCase.value, func(t *testing.T) {
+			err := validateRemoteName(testCase.value)
+			if testCase.wantErr == "" {
+				require.NoError(t, err)
+			} else {
+				require.ErrorContains(t, err, testCase.wantErr)
+			}
+		})
+	}
+}
+
+type testState struct {
+	t                *testing.T
+	server           *server
+	mockStdinW       io.WriteCloser
+	mockStdoutReader *bufio.Reader
+	// readLineTimeout is the maximum duration of time to wait for [server] to
+	// write a line to be written to the mock stdout.
+	readLineTimeout time.Duration
+
+	fstestRun    *fstest.Run
+	remoteName   string
+	remotePrefix string
+	// remoteUUID is the UUID that the mock git-annex reports in response to
+	// GETUUID. If empty, testRemoteUUID is used.
+	remoteUUID string
+}
+
+// testRemoteUUID is the default UUID that the mock git-annex reports.
+const testRemoteUUID = "6f3ac1b4-3b57-4c4c-9bc6-f0bd2a4b8e21"
+
+func makeTestState(t *testing.T) testState {
+	stdinR, stdinW := io.Pipe()
+	stdoutR, stdoutW := io.Pipe()
+
+	return testState{
+		t: t,
+		server: &server{
+			reader: bufio.NewReader(stdinR),
+			writer: stdoutW,
+		},
+		mockStdinW:       stdinW,
+		mockStdoutReader: bufio.NewReader(stdoutR),
+
+		// The default readLineTimeout must be large enough to accommodate slow
+		// operations on real remotes. Without a timeout, attempts to read a
+		// line that's never written would block indefinitely.
+		readLineTimeout: time.Second * 30,
+	}
+}
+
+// serverPipes connects a test, acting as git-annex, to a server created by
+// [newServerFromPipes].
+type serverPipes struct {
+	t *testing.T
+	// In carries messages from git-annex to the server.
+	In *os.File
+	// Out carries the server's messages to git-annex.
+	Out *os.File
+
+	server          *server
+	reader          *bufio.Reader
+	serverErrorChan chan error
+}
+
+// newServerFromPipes returns a server that reads and writes a pair of
+// [os.Pipe]s, along with the test's ends of the pipes. The server is not
+// running, so that the test may configure it first. Call [serverPipes.Start]
+// to run it and [serverPipes.Close] to end the session.
+func newServerFromPipes(t *testing.T) (*server, *serverPipes) {
+	stdinR, stdinW, err := os.Pipe()
+	require.NoError(t, err)
+	stdoutR, stdoutW, err := os.Pipe()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		for _, f := range []*os.File{stdinR, stdinW, stdoutR, stdoutW} {
+			_ = f.Close()
+		}
+	})
+
+	s := &server{
+		reader: bufio.NewReader(stdinR),
+		writer: stdoutW,
+	}
+	return s, &serverPipes{
+		t:               t,
+		In:              stdinW,
+		Out:             stdoutR,
+		server:          s,
+		reader:          bufio.NewReader(stdoutR),
+		serverErrorChan: make(chan error, 1),
+	}
+}
+
+// Start runs the server's session in the background.
+func (p *serverPipes) Start() {
+	go func() {
+		p.serverErrorChan <- p.server.run()
+	}()
+}
+
+// Close ends the session as git-annex would, by closing In, and returns the
+// server's error.
+func (p *serverPipes) Close() error {
+	require.NoError(p.t, p.In.Close())
+	select {
+	case err := <-p.serverErrorChan:
+		return err
+	case <-time.After(30 * time.Second):
+		p.t.Fatal("server did not exit after stdin was closed")
+		return nil
+	}
+}
+
+// pipeContinuationPrefixes begin the lines of the server's multi-line replies,
+// and of messages that do not expect a reply, that [serverPipes.Lines] reads
+// past.
+var pipeContinuationPrefixes = []string{"CONFIG ", "INFOFIELD ", "INFOVALUE ", "INFO ", "DEBUG ", "PROGRESS "}
+
+// Lines reads the server's messages, without their newlines, up to and
+// including the first one that ends a reply or asks git-annex a question, e.g.
+// "CONFIGEND", "TRANSFER-SUCCESS STORE SomeKey", or "GETCONFIG rcloneprefix".
+func (p *serverPipes) Lines() []string {
+	var lines []string
+	for {
+		lineChan := make(chan string, 1)
+		errChan := make(chan error, 1)
+		go func() {
+			line, err := p.reader.ReadString('\n')
+			if err != nil {
+				errChan <- err
+				return
+			}
+			lineChan <- strings.TrimSuffix(line, "\n")
+		}()
+		var line string
+		select {
+		case line = <-lineChan:
+		case err := <-errChan:
+			p.t.Fatalf("failed to read from server after %q: %v", lines, err)
+		case <-time.After(30 * time.Second):
+			p.t.Fatalf("timed out reading from server after %q", lines)
+		}
+		lines = append(lines, line)
+		continued := false
+		for _, prefix := range pipeContinuationPrefixes {
+			continued = continued || strings.HasPrefix(line, prefix)
+		}
+		if !continued {
+			return lines
+		}
+	}
+}
+
+func (h *testState) requireRemoteIsEmpty() {
+	h.fstestRun.CheckRemoteItems(h.t)
+}
+
+// readLineWithTimeout attempts to read a line from the mock stdout. Returns an
+// error if the read operation times out or fails for any reason.
+func (h *testState) readLineWithTimeout() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.readLineTimeout)
+	defer cancel()
+
+	lineChan := make(chan string)
+	errChan := make(chan error)
+
+	go func() {
+		line, err := h.mockStdoutReader.ReadString('\n')
+		if err != nil {
+			errChan <- err
+		} else {
+			lineChan <- line
+		}
+	}()
+
+	select {
+	case line := <-lineChan:
+		return line, nil
+	case err := <-errChan:
+		return "", err
+	case <-ctx.Done():
+		return "", fmt.Errorf("attempt to read line timed out: %w", ctx.Err())
+	}
+}
+
+// requireReadLineExact requires that a line matching wantLine can be read from
+// the mock stdout.
+func (h *testState) requireReadLineExact(wantLine string) {
+	receivedLine, err := h.readLineWithTimeout()
+	require.NoError(h.t, err)
+	require.Equal(h.t, wantLine+"\n", receivedLine)
+}
+
+// requireReadLine requires that a line can be read from the mock stdout and
+// returns the line.
+func (h *testState) requireReadLine() string {
+	receivedLine, err := h.readLineWithTimeout()
+	require.NoError(h.t, err)
+	return receivedLine
+}
+
+// requireWriteLine requires that the given line is successfully written to the
+// mock stdin.
+func (h *testState) requireWriteLine(line string) {
+	_, err := h.mockStdinW.Write([]byte(line + "\n"))
+	require.NoError(h.t, err)
+}
+
+// answerConfigs responds to each "GETCONFIG" message sent by the server until
+// the server sends some other line, which is returned. The response to each
+// config is looked up in `values`, and configs that are absent receive an empty
+// "VALUE" response.
+func (h *testState) answerConfigs(values map[string]string) string {
+	for {
+		line := h.requireReadLine()
+		if line == "GETUUID\n" {
+			h.requireWriteLine("VALUE " + h.uuid())
+			continue
+		}
+		configName, found := strings.CutPrefix(strings.TrimSuffix(line, "\n"), "GETCONFIG ")
+		if !found {
+			return line
+		}
+		h.requireWriteLine(strings.TrimRight("VALUE "+values[configName], " "))
+	}
+}
+
+// uuid returns the UUID that the mock git-annex reports for this remote.
+func (h *testState) uuid() string {
+	if h.remoteUUID == "" {
+		return testRemoteUUID
+	}
+	return h.remoteUUID
+}
+
+// requireInitRemote performs the INITREMOTE exchange. It then checks that the
+// server recorded the remote's UUID and deletes the record, which enables tests
+// to reason about the remote's contents in terms of keys alone.
+func (h *testState) requireInitRemote() {
+	h.requireWriteLine("INITREMOTE")
+	h.requireReadLineExactAfterConfigs("INITREMOTE-SUCCESS")
+
+	ctx := context.Background()
+	prefixFs, err := h.server.getPrefixFs(ctx)
+	require.NoError(h.t, err)
+	storedUUID, err := readStoredUUID(ctx, prefixFs)
+	require.NoError(h.t, err)
+	require.Equal(h.t, h.uuid(), storedUUID)
+
+	obj, err := prefixFs.NewObject(ctx, uuidFileName)
+	require.NoError(h.t, err)
+	require.NoError(h.t, obj.Remove(ctx))
+}
+
+// requireReadLineExactAfterConfigs is like requireReadLineExact, but first
+// answers any remaining "GETCONFIG" messages with empty values. It enables tests
+// to focus on the configs they care about.
+func (h *testState) requireReadLineExactAfterConfigs(wantLine string) {
+	require.Equal(h.t, wantLine+"\n", h.answerConfigs(nil))
+}
+
+// requireReadInfo requires that the server sends a GETINFO response, i.e. a
+// sequence of INFOFIELD/INFOVALUE pairs terminated by INFOEND. It returns the
+// fields as a map.
+func (h *testState) requireReadInfo() map[string]string {
+	info := make(map[string]string)
+	for {
+		line := strings.TrimSuffix(h.requireReadLine(), "\n")
+		if line == "INFOEND" {
+			return info
+		}
+		field, found := strings.CutPrefix(line, "INFOFIELD ")
+		require.True(h.t, found, "expected INFOFIELD, but got %q", line)
+		value, found := strings.CutPrefix(strings.TrimSuffix(h.requireReadLine(), "\n"), "INFOVALUE ")
+		require.True(h.t, found, "expected INFOVALUE for field %q", field)
+		info[field] = value
+	}
+}
+
+// Preconfigure the handle. This enables the calling test to skip the PREPARE
+// handshake.
+func (h *testState) preconfigureServer() {
+	for _, config := range requiredConfigs {
+		h.server.mustSetConfigValue(config.id, config.defaultValue)
+	}
+	h.server.configRcloneRemoteName = h.remoteName
+	h.server.configPrefix = h.remotePrefix
+	h.server.configRcloneLayout = string(layoutModeNodir)
+	h.server.configsDone = true
+}
+
+// Drop-in replacement for `filepath.Rel()` that works around a Windows-specific
+// quirk when one of the paths begins with `\\?\` or `//?/`. It seems that
+// fstest gives us paths with this prefix on Windows, which throws a wrench in
+// the gitannex tests that need to construct relative paths from absolute paths.
+// For a demonstration, see `TestWindowsFilepathRelQuirk` below.
+//
+// The `\\?\` prefix tells Windows APIs to pass strings unmodified to the
+// filesystem without additional parsing [1]. Our workaround is roughly to add
+// the prefix to whichever parameter doesn't have it (when the OS is Windows).
+// I'm not sure this generalizes, but it works for the the kinds of inputs we're
+// throwing at it.
+//
+// [1]: https://learn.microsoft.com/en-us/windows/win32/fileio/naming-a-file?redirectedfrom=MSDN#win32-file-namespaces
+func relativeFilepathWorkaround(basepath, targpath string) (string, error) {
+	if runtime.GOOS != "windows" {
+		return filepath.Rel(basepath, targpath)
+	}
+	// Canonicalize paths to use backslashes.
+	basepath = filepath.Clean(basepath)
+	targpath = filepath.Clean(targpath)
+
+	const winFilePrefixDisableStringParsing = `\\?\`
+	baseHasPrefix := strings.HasPrefix(basepath, winFilePrefixDisableStringParsing)
+	targHasPrefix := strings.HasPrefix(targpath, winFilePrefixDisableStringParsing)
+
+	if baseHasPrefix && !targHasPrefix {
+		targpath = winFilePrefixDisableStringParsing + targpath
+	}
+	if !baseHasPrefix && targHasPrefix {
+		basepath = winFilePrefixDisableStringParsing + basepath
+	}
+	return filepath.Rel(basepath, targpath)
+}
+
+func TestWindowsFilepathRelQuirk(t *testing.T) {
+	if runtime.GOOS != "windows" {
+		t.Skip()
+	}
+
+	t.Run("filepathRelQuirk", func(t *testing.T) {
+		var err error
+
+		_, err = filepath.Rel(`C:\foo`, `\\?\C:\foo\bar`)
+		require.Error(t, err)
+
+		_, err = filepath.Rel(`C:/foo`, `//?/C:/foo/bar`)
+		require.Error(t, err)
+
+		_, err = filepath.Rel(`\\?\C:\foo`, `C:\foo\bar`)
+		require.Error(t, err)
+
+		_, err = filepath.Rel(`//?/C:/foo`, `C:/foo/bar`)
+		require.Error(t, err)
+
+		path, err := filepath.Rel(`\\?\C:\foo`, `\\?\C:\foo\bar`)
+		require.NoError(t, err)
+		require.Equal(t, path, `bar`)
+
+		path, err = filepath.Rel(`//?/C:/foo`, `//?/C:/foo/bar`)
+		require.NoError(t, err)
+		require.Equal(t, path, `bar`)
+	})
+
+	t.Run("fstestAndTempDirHaveDifferentPrefixes", func(t *testing.T) {
+		r := fstest.NewRun(t)
+		p := r.Flocal.Root()
+		require.True(t, strings.HasPrefix(p, `//?/`))
+
+		tempDir := t.TempDir()
+		require.False(t, strings.HasPrefix(tempDir, `//?/`))
+		require.False(t, strings.HasPrefix(tempDir, `\\?\`))
+	})
+
+	t.Run("workaroundWorks", func(t *testing.T) {
+		path, err := relativeFilepathWorkaround(`C:\foo`, `\\?\C:\foo\bar`)
+		require.NoError(t, err)
+		require.Equal(t, path, "bar")
+
+		path, err = relativeFilepathWorkaround(`C:/foo`, `//?/C:/foo/bar`)
+		require.NoError(t, err)
+		require.Equal(t, path, "bar")
+
+		path, err = relativeFilepathWorkaround(`\\?\C:\foo`, `C:\foo\bar`)
+		require.NoError(t, err)
+		require.Equal(t, path, `bar`)
+
+		path, err = relativeFilepathWorkaround(`//?/C:/foo`, `C:/foo/bar`)
+		require.NoError(t, err)
+		require.Equal(t, path, `bar`)
+
+		path, err = relativeFilepathWorkaround(`\\?\C:\foo`, `\\?\C:\foo\bar`)
+		require.NoError(t, err)
+		require.Equal(t, path, `bar`)
+	})
+}
+
+type testCase struct {
+	label            string
+	testProtocolFunc func(*testing.T, *testState)
+	expectedError    string
+}
+
+// These test cases run against a backend selected by the `-remote` flag.
+var fstestTestCases = []testCase{
+	{
+		label: "HandlesInit",
+		testProtocolFunc: func(t *testing.T, h *testState) {
+			h.preconfigureServer()
+
+			h.requireReadLineExact("VERSION 1")
+			h.requireInitRemote()
+
+			require.NoError(t, h.mockStdinW.Close())
+		},
+	},
+	{
+		label: "HandlesListConfigs",
+		testProtocolFunc: func(t *testing.T, h *testState) {
+			h.preconfigureServer()
+
+			h.requireReadLineExact("VERSION 1")
+			h.requireInitRemote()
+
+			h.requireWriteLine("LISTCONFIGS")
+
+			require.Regexp(t,
+				regexp.MustCompile(`^CONFIG rcloneremotename \(synonyms: target\) (.|\n)*$`),
+				h.requireReadLine(),
+			)
+			require.Regexp(t,
+				regexp.MustCompile(`^CONFIG rcloneprefix \(synonyms: prefix\) (.|\n)*$`),
+				h.requireReadLine(),
+			)
+			require.Regexp(t,
+				regexp.MustCompile(`^CONFIG rclonelayout \(synonyms: rclone_layout\) (.|\n)*$`),
+				h.requireReadLine(),
+			)
+			// Skip past the optional configs.
+			for line := h.requireReadLine(); line != "CONFIGEND\n"; line = h.requireReadLine() {
+				require.Regexp(t, regexp.MustCompile(`^CONFIG \S+ `), line)
+			}
+
+			require.NoError(t, h.mockStdinW.Close())
+		},
+	},
+	{
+		label: "HandlesPrepare",
+		testProtocolFunc: func(t *testing.T, h *testState) {
+			h.requireReadLineExact("VERSION 1")
+			h.requireWriteLine("EXTENSIONS INFO") // Advertise that we support the INFO extension
+			h.requireReadLineExact("EXTENSIONS INFO")
+
+			require.True(t, h.server.extensionInfo)
+
+			h.requireWriteLine("PREPARE")
+			h.requireReadLineExact("GETCONFIG rcloneremotename")
+			h.requireWriteLine("VALUE " + h.remoteName)
+			h.requireReadLineExact("GETCONFIG rcloneprefix")
+			h.requireWriteLine("VALUE " + h.remotePrefix)
+			h.requireReadLineExact("GETCONFIG rclonelayout")
+			h.requireWriteLine("VALUE frankencase")
+			h.requireReadLineExactAfterConfigs("PREPARE-SUCCESS")
+
+			require.Equal(t, h.server.configRcloneRemoteName, h.remoteName)
+			require.Equal(t, h.server.configPrefix, h.remotePrefix)
+			require.True(t, h.server.configsDone)
+
+			require.NoError(t, h.mockStdinW.Close())
+		},
+	},
+	{
+		label: "PrepareWithMatchingUUID",
+		testProtocolFunc: func(t *testing.T, h *testState) {
+			h.preconfigureServer()
+
+			h.requireReadLineExact("VERSION 1")
+			h.requireWriteLine("INITREMOTE")
+			h.requireReadLineExact("GETUUID")
+			h.requireWriteLine("VALUE " + testRemoteUUID)
+			h.requireReadLineExact("INITREMOTE-SUCCESS")
+
+			h.requireWriteLine("PREPARE")
+			h.requireReadLineExact("GETUUID")
+			h.requireWriteLine("VALUE " + testRemoteUUID)
+			h.requireReadLineExact("PREPARE-SUCCESS")
+
+			require.NoError(t, h.mockStdinW.Close())
+		},
+	},
+	{
+		label: "PrepareWithMismatchedUUID",
+		testProtocolFunc: func(t *testing.T, h *testState) {
+			h.preconfigureServer()
+
+			ctx := context.WithoutCancel(context.Background())
+			h.fstestRun.WriteObject(ctx, uuidFileName, `{"uuid":"some-other-uuid"}`, time.Now())
+
+			h.requireReadLineExact("VERSION 1")
+			h.requireWriteLine("PREPARE")
+			h.requireReadLineExact("GETUUID")
+			h.requireWriteLine("VALUE " + testRemoteUUID)
+			h.requireReadLineExact("GETCONFIG sameas-uuid")
+			h.requireWriteLine("VALUE")
+			h.requireReadLineExact("PREPARE-FAILURE [E002] UUID mismatch: expected some-other-uuid got " + testRemoteUUID)
+
+			require.NoError(t, h.mockStdinW.Close())
+		},
+		expectedError: "UUID mismatch",
+	},
+	{
+		label: "InitRemoteSameAsRecordedUUID",
+		testProtocolFunc: func(t *testing.T, h *testState) {
+			h.preconfigureServer()
+
+			ctx := context.WithoutCancel(context.Background())
+			remoteItem := h.fstestRun.WriteObject(ctx, uuidFileName, `{"uuid":"some-other-uuid"}`, time.Now())
+
+			// A remote initialized with --sameas has a UUID of its own, but
+			// shares the directory of the remote it names.
+			h.requireReadLineExact("VERSION 1")
+			h.requireWriteLine("INITREMOTE")
+			h.requireReadLineExact("GETUUID")
+			h.requireWriteLine("VALUE " + testRemoteUUID)
+			h.requireReadLineExact("GETCONFIG sameas-uuid")
+			h.requireWriteLine("VALUE some-other-uuid")
+			h.requireReadLineExact("INITREMOTE-SUCCESS")
+
+			h.requireWriteLine("PREPARE")
+			h.requireReadLineExact("GETUUID")
+			h.requireWriteLine("VALUE " + testRemoteUUID)
+			h.requireReadLineExact("GETCONFIG sameas-uuid")
+			h.requireWriteLine("VALUE some-other-uuid")
+			h.requireReadLineExact("PREPARE-SUCCESS")
+
+			// The record still names the original remote.
+			h.fstestRun.CheckRemoteItems(t, remoteItem)
+
+			require.NoError(t, h.mockStdinW.Close())
+		},
+	},
+	{
+		label: "InitRemoteWithInvalidKeyTypePrefix",
+		testProtocolFunc: func(t *testing.T, h *testState) {
+			h.requireReadLineExact("VERSION 1")
+			h.requireWriteLine("INITREMOTE")
+			line := h.answerConfigs(map[string]string{
+				"rcloneremotename":    h.remoteName,
+				"rcloneprefix":        h.remotePrefix,
+				"rclonekeytypeprefix": `{"SHA256":"../cold"}`,
+			})
+			require.Equal(t, `INITREMOTE-FAILURE [E001] key type prefix for SHA256 must be a relative path within rcloneprefix: "../cold"`+"\n", line)
+			require.NoError(t, h.mockStdinW.Close())
+		},
+		expectedError: "key type prefix for SHA256 must be a relative path",
+	},
+	{
+		label: "InitRemoteWithMismatchedUUID",
+		testProtocolFunc: func(t *testing.T, h *testState) {
+			h.preconfigureServer()
+
+			ctx := context.WithoutCancel(context.Background())
+			remoteItem := h.fstestRun.WriteObject(ctx, uuidFileName, `{"uuid":"some-other-uuid"}`, time.Now())
+
+			h.requireReadLineExact("VERSION 1")
+			h.requireWriteLine("INITREMOTE")
+			h.requireReadLineExact("GETUUID")
+			h.requireWriteLine("VALUE " + testRemoteUUID)
+			h.requireReadLineExact("GETCONFIG sameas-uuid")
+			h.requireWriteLine("VALUE")
+			h.requireReadLineExact("INITREMOTE-FAILURE [E002] UUID mismatch: expected some-other-uuid got " + testRemoteUUID)
+
+			// The existing record is left alone.
+			h.fstestRun.CheckRemoteItems(t, remoteItem)
+
+			require.NoError(t, h.mockStdinW.Close())
+		},
+		expectedError: "UUID mismatch",
+	},
+	{
+		label: "HandlesPrepareWithUnknownLayout",
+		testProtocolFunc: func(t *testing.T, h *testState) {
+			h.requireReadLineExact("VERSION 1")
+			h.requireWriteLine("EXTENSIONS INFO") // Advertise that we support the INFO extension
+			h.requireReadLineExact("EXTENSIONS INFO")
+
+			require.True(t, h.server.extensionInfo)
+
+			h.requireWriteLine("PREPARE")
+			h.requireReadLineExact("GETCONFIG rcloneremotename")
+			h.requireWriteLine("VALUE " + h.remoteName)
+			h.requireReadLineExact("GETCONFIG rcloneprefix")
+			h.requireWriteLine("VALUE " + h.remotePrefix)
+			h.requireReadLineExact("GETCONFIG rclonelayout")
+			h.requireWriteLine("VALUE nonexistentLayoutMode")
+			// The failure is reported at PREPARE time, not at the first TRANSFER.
+			h.requireReadLineExactAfterConfigs("PREPARE-FAILURE [E001] unknown layout: nonexistentLayoutMode (must be one of [lower directory nodir mixed frankencase 4level annexobjects])")
+
+			require.Equal(t, h.server.configRcloneRemoteName, h.remoteName)
+			require.Equal(t, h.server.configPrefix, h.remotePrefix)
+			require.True(t, h.server.configsDone)
+
+			require.NoError(t, h.mockStdinW.Close())
+		},
+		expectedError: "unknown layout: nonexistentLayoutMode",
+	},
+	{
+		label: "HandlesInitRemoteWithUnknownLayout",
+		testProtocolFunc: func(t *testing.T, h *testState) {
+			h.requireReadLineExact("VERSION 1")
+			h.requireWriteLine("INITREMOTE")
+			line := h.answerConfigs(map[string]string{
+				"rcloneremotename": h.remoteName,
+				"rcloneprefix":     h.remotePrefix,
+				"rclonelayout":     "nonexistentLayoutMode",
+			})
+			require.Equal(t, "INITREMOTE-FAILURE [E001] unknown layout: nonexistentLayoutMode (must be one of [lower directory nodir mixed frankencase 4level annexobjects])\n", line)
+
+			require.NoError(t, h.mockStdinW.Close())
+		},
+		expectedError: "unknown layout: nonexistentLayoutMode",
+	},
+	{
+		label: "HandlesPrepareWithNonexistentRemote",
+		testProtocolFunc: func(t *testing.T, h *testState) {
+			h.requireReadLineExact("VERSION 1")
+			h.requireWriteLine("EXTENSIONS INFO") // Advertise that we support the INFO extension
+			h.requireReadLineExact("EXTENSIONS INFO")
+
+			require.True(t, h.server.extensionInfo)
+
+			h.requireWriteLine("PREPARE")
+			h.requireReadLineExact("GETCONFIG rcloneremotename")
+			h.requireWriteLine("VALUE thisRemoteDoesNotExist")
+			h.requireReadLineExact("GETCONFIG rcloneprefix")
+			h.requireWriteLine("VALUE " + h.remotePrefix)
+			h.requireReadLineExact("GETCONFIG rclonelayout")
+			h.requireWriteLine("VALUE frankencase")
+			h.requireReadLineExactAfterConfigs("PREPARE-SUCCESS")
+
+			require.Equal(t, h.server.configRcloneRemoteName, "thisRemoteDoesNotExist")
+			require.Equal(t, h.server.configPrefix, h.remotePrefix)
+			require.True(t, h.server.configsDone)
+
+			h.requireWriteLine("INITREMOTE")
+			h.requireReadLineExact("INITREMOTE-FAILURE [E002] remote does not exist or incorrectly contains a path: thisRemoteDoesNotExist")
+
+			require.NoError(t, h.mockStdinW.Close())
+		},
+		expectedError: "remote does not exist or incorrectly contains a path: thisRemoteDoesNotExist",
+	},
+	{
+		label: "HandlesPrepareWithPathAsRemote",
+		testProtocolFunc: func(t *testing.T, h *testState) {
+			h.requireReadLineExact("VERSION 1")
+			h.requireWriteLine("EXTENSIONS INFO") // Advertise that we support the INFO extension
+			h.requireReadLineExact("EXTENSIONS INFO")
+
+			require.True(t, h.server.extensionInfo)
+
+			h.requireWriteLine("PREPARE")
+			h.requireReadLineExact("GETCONFIG rcloneremotename")
+			h.requireWriteLine("VALUE " + h.remotePrefix)
+			h.requireReadLineExact("GETCONFIG rcloneprefix")
+			h.requireWriteLine("VALUE /foo")
+			h.requireReadLineExact("GETCONFIG rclonelayout")
+			h.requireWriteLine("VALUE frankencase")
+			h.requireReadLineExactAfterConfigs("PREPARE-SUCCESS")
+
+			require.Equal(t, h.server.configRcloneRemoteName, h.remotePrefix)
+			require.Equal(t, h.server.configPrefix, "/foo")
+			require.True(t, h.server.configsDone)
+
+			h.requireWriteLine("INITREMOTE")
+
+			require.Regexp(t,
+				regexp.MustCompile(`^INITREMOTE-FAILURE \[E002\] remote does not exist or incorrectly contains a path: `),
+				h.requireReadLine(),
+			)
+
+			require.NoError(t, h.mockStdinW.Close())
+		},
+		expectedError: "remote does not exist or incorrectly contains a path:",
+	},
+	{
+		label: "HandlesPrepareWithNonexistentBackendAsRemote",
+		testProtocolFunc: func(t *testing.T, h *testState) {
+			h.requireReadLineExact("VERSION 1")
+			h.requireWriteLine("PREPARE")
+			h.requireReadLineExact("GETCONFIG rcloneremotename")
+			h.requireWriteLine("VALUE :nonexistentBackend:")
+			h.requireReadLineExact("GETCONFIG rcloneprefix")
+			h.requireWriteLine("VALUE /foo")
+			h.requireReadLineExact("GETCONFIG rclonelayout")
+			h.requireWriteLine("VALUE frankencase")
+			h.requireReadLineExactAfterConfigs("PREPARE-SUCCESS")
+
+			require.Equal(t, ":nonexistentBackend:", h.server.configRcloneRemoteName)
+			require.Equal(t, "/foo", h.server.configPrefix)
+			require.True(t, h.server.configsDone)
+
+			h.requireWriteLine("INITREMOTE")
+			h.requireReadLineExact("INITREMOTE-FAILURE [E002] backend does not exist: nonexistentBackend")
+
+			require.NoError(t, h.mockStdinW.Close())
+		},
+		expectedError: "backend does not exist:",
+	},
+	{
+		label: "HandlesPrepareWithBackendAsRemote",
+		testProtocolFunc: func(t *testing.T, h *testState) {
+			h.requireReadLineExact("VERSION 1")
+			h.requireWriteLine("PREPARE")
+			h.requireReadLineExact("GETCONFIG rcloneremotename")
+			h.requireWriteLine("VALUE :local:")
+			h.requireReadLineExact("GETCONFIG rcloneprefix")
+			h.requireWriteLine("VALUE /foo")
+			h.requireReadLineExact("GETCONFIG rclonelayout")
+			h.requireWriteLine("VALUE frankencase")
+			h.requireReadLineExactAfterConfigs("PREPARE-SUCCESS")
+
+			require.Equal(t, ":local:", h.server.configRcloneRemoteName)
+			require.Equal(t, "/foo", h.server.configPrefix)
+			require.True(t, h.server.configsDone)
+
+			h.requireInitRemote()
+
+			require.NoError(t, h.mockStdinW.Close())
+		},
+	},
+	{
+		label: "HandlesPrepareWithBackendMissingTrailingColonAsRemote",
+		testProtocolFunc: func(t *testing.T, h *testState) {
+			h.requireReadLineExact("VERSION 1")
+			h.requireWriteLine("PREPARE")
+			h.requireReadLineExact("GETCONFIG rcloneremotename")
+			h.requireWriteLine("VALUE :local")
+			h.requireReadLineExact("GETCONFIG rcloneprefix")
+			h.requireWriteLine("VALUE /foo")
+			h.requireReadLineExact("GETCONFIG rclonelayout")
+			h.requireWriteLine("VALUE frankencase")
+			h.requireReadLineExactAfterConfigs("PREPARE-SUCCESS")
+
+			require.Equal(t, ":local", h.server.configRcloneRemoteName)
+			require.Equal(t, "/foo", h.server.configPrefix)
+			require.True(t, h.server.configsDone)
+
+			h.requireWriteLine("INITREMOTE")
+			h.requireReadLineExact("INITREMOTE-FAILURE [E002] remote could not be parsed: :local")
+
+			require.NoError(t, h.mockStdinW.Close())
+		},
+		expectedError: "remote could not be parsed:",
+	},
+	{
+		label: "HandlesPrepareWithBackendContainingOptionsAsRemote",
+		testProtocolFunc: func(t *testing.T, h *testState) {
+			h.requireReadLineExact("VERSION 1")
+			h.requireWriteLine("PREPARE")
+			h.requireReadLineExact("GETCONFIG rcloneremotename")
+			h.requireWriteLine("VALUE :local,description=banana:")
+			h.requireReadLineExact("GETCONFIG rcloneprefix")
+			h.requireWriteLine("VALUE /foo")
+			h.requireReadLineExact("GETCONFIG rclonelayout")
+			h.requireWriteLine("VALUE frankencase")
+			h.requireReadLineExactAfterConfigs("PREPARE-SUCCESS")
+
+			require.Equal(t, ":local,description=banana:", h.server.configRcloneRemoteName)
+			require.Equal(t, "/foo", h.server.configPrefix)
+			require.True(t, h.server.configsDone)
+
+			h.requireInitRemote()
+
+			require.NoError(t, h.mockStdinW.Close())
+		},
+	},
+	{
+		label: "HandlesPrepareWithBackendContainingOptionsAndIllegalPathAsRemote",
+		testProtocolFunc: func(t *testing.T, h *testState) {
+			h.requireReadLineExact("VERSION 1")
+			h.requireWriteLine("PREPARE")
+			h.requireReadLineExact("GETCONFIG rcloneremotename")
+			h.requireWriteLine("VALUE :local,description=banana:/bad/path")
+			h.requireReadLineExact("GETCONFIG rcloneprefix")
+			h.requireWriteLine("VALUE /foo")
+			h.requireReadLineExact("GETCONFIG rclonelayout")
+			h.requireWriteLine("VALUE frankencase")
+			h.requireReadLineExactAfterConfigs("PREPARE-SUCCESS")
+
+			require.Equal(t, ":local,description=banana:/bad/path", h.server.configRcloneRemoteName)
+			require.Equal(t, "/foo", h.server.configPrefix)
+			require.True(t, h.server.configsDone)
+
+			h.requireWriteLine("INITREMOTE")
+			h.requireReadLineExact("INITREMOTE-FAILURE [E002] remote does not exist or incorrectly contains a path: :local,description=banana:/bad/path")
+
+			require.NoError(t, h.mockStdinW.Close())
+		},
+		expectedError: "remote does not exist or incorrectly contains a path:",
+	},
+	{
+		label: "HandlesPrepareWithRemoteContainingOptions",
+		testProtocolFunc: func(t *testing.T, h *testState) {
+			const envVar = "RCLONE_CONFIG_FAKE_REMOTE_TYPE"
+			require.NoError(t, os.Setenv(envVar, "memory"))
+			t.Cleanup(func() { require.NoError(t, os.Unsetenv(envVar)) })
+
+			h.requireReadLineExact("VERSION 1")
+			h.requireWriteLine("PREPARE")
+			h.requireReadLineExact("GETCONFIG rcloneremotename")
+			h.requireWriteLine("VALUE fake_remote,banana=yes:")
+			h.requireReadLineExact("GETCONFIG rcloneprefix")
+			h.requireWriteLine("VALUE /foo")
+			h.requireReadLineExact("GETCONFIG rclonelayout")
+			h.requireWriteLine("VALUE frankencase")
+			h.requireReadLineExactAfterConfigs("PREPARE-SUCCESS")
+
+			require.Equal(t, "fake_remote,banana=yes:", h.server.configRcloneRemoteName)
+			require.Equal(t, "/foo", h.server.configPrefix)
+			require.True(t, h.server.configsDone)
+
+			h.requireInitRemote()
+
+			require.NoError(t, h.mockStdinW.Close())
+		},
+	},
+	{
+		label: "HandlesPrepareWithSynonyms",
+		testProtocolFunc: func(t *testing.T, h *testState) {
+			h.requireReadLineExact("VERSION 1")
+			h.requireWriteLine("EXTENSIONS INFO") // Advertise that we support the INFO extension
+			h.requireReadLineExact("EXTENSIONS INFO")
+
+			require.True(t, h.server.extensionInfo)
+
+			h.requireWriteLine("PREPARE")
+			h.requireReadLineExact("GETCONFIG rcloneremotename")
+			// TODO check what git-annex does when asked for a config value it does not have.
+			h.requireWriteLine("VALUE")
+			h.requireReadLineExact("GETCONFIG target")
+			h.requireWriteLine("VALUE " + h.remoteName)
+
+			h.requireReadLineExact("GETCONFIG rcloneprefix")
+			h.requireWriteLine("VALUE " + h.remotePrefix)
+			h.requireReadLineExact("GETCONFIG rclonelayout")
+			h.requireWriteLine("VALUE frankencase")
+			h.requireReadLineExactAfterConfigs("PREPARE-SUCCESS")
+
+			require.Equal(t, h.server.configRcloneRemoteName, h.remoteName)
+			require.Equal(t, h.server.configPrefix, h.remotePrefix)
+			require.True(t, h.server.configsDone)
+
+			require.NoError(t, h.mockStdinW.Close())
+		},
+	},
+	{
+		label: "HandlesPrepareAndDoesNotTrimWhitespaceFromValue",
+		testProtocolFunc: func(t *testing.T, h *testState) {
+			h.requireReadLineExact("VERSION 1")
+			h.requireWriteLine("EXTENSIONS INFO") // Advertise that we support the INFO extension
+			h.requireReadLineExact("EXTENSIONS INFO")
+
+			require.True(t, h.server.extensionInfo)
+
+			h.requireWriteLine("PREPARE")
+			h.requireReadLineExact("GETCONFIG rcloneremotename")
+
+			remoteNameWithSpaces := fmt.Sprintf(" %s ", h.remoteName)
+			prefixWithWhitespace := fmt.Sprintf(" %s\t", h.remotePrefix)
+
+			h.requireWriteLine(fmt.Sprintf("VALUE %s", remoteNameWithSpaces))
+
+			h.requireReadLineExact("GETCONFIG rcloneprefix")
+			h.requireWriteLine(fmt.Sprintf("VALUE %s", prefixWithWhitespace))
+
+			h.requireReadLineExact("GETCONFIG rclonelayout")
+			h.requireWriteLine("VALUE")
+			h.requireReadLineExact("GETCONFIG rclone_layout")
+			h.requireWriteLine("VALUE")
+
+			h.requireReadLineExactAfterConfigs("PREPARE-SUCCESS")
+
+			require.Equal(t, h.server.configRcloneRemoteName, remoteNameWithSpaces)
+			require.Equal(t, h.server.configPrefix, prefixWithWhitespace)
+			require.True(t, h.server.configsDone)
+
+			require.NoError(t, h.mockStdinW.Close())
+		},
+	},
+	{
+		label: "HandlesEarlyError",
+		testProtocolFunc: func(t *testing.T, h *testState) {
+			h.preconfigureServer()
+
+			h.requireReadLineExact("VERSION 1")
+			h.requireWriteLine("ERROR foo")
+
+			require.NoError(t, h.mockStdinW.Close())
+		},
+		expectedError: "received error message from git-annex: foo",
+	},
+	// Test what happens when the git-annex client sends "GETCONFIG", but
+	// doesn't understand git-annex's response.
+	{
+		label: "ConfigFail",
+		testProtocolFunc: func(t *testing.T, h *testState) {
+			h.requireReadLineExact("VERSION 1")
+			h.requireWriteLine("EXTENSIONS INFO") // Advertise that we support the INFO extension
+			h.requireReadLineExact("EXTENSIONS INFO")
+			require.True(t, h.server.extensionInfo)
+
+			h.requireWriteLine("PREPARE")
+			h.requireReadLineExact("GETCONFIG rcloneremotename")
+			h.requireWriteLine("ERROR ineffable error")
+			h.requireReadLineExact("PREPARE-FAILURE [E001] Error getting configs")
+
+			require.NoError(t, h.mockStdinW.Close())
+		},
+		expectedError: "failed to parse config value: ERROR ineffable error",
+	},
+	{
+		label: "TransferStoreEmptyPath",
+		testProtocolFunc: func(t *testing.T, h *testState) {
+			h.preconfigureServer()
+
+			h.requireReadLineExact("VERSION 1")
+			h.requireInitRemote()
+
+			// Note the whitespace following the key.
+			h.requireWriteLine("TRANSFER STORE Key ")
+			h.requireReadLineExact("TRANSFER-FAILURE [E005] failed to parse file path")
+
+			require.NoError(t, h.mockStdinW.Close())
+		},
+		expectedError: "failed to parse file",
+	},
+	// Repeated EXTENSIONS messages add to each other rather than overriding
+	// prior advertised extensions. This behavior is not mandated by the
+	// protocol design.
+	{
+		label: "ExtensionsCompound",
+		testProtocolFunc: func(t *testing.T, h *testState) {
+			h.preconfigureServer()
+
+			h.requireReadLineExact("VERSION 1")
+			h.requireInitRemote()
+
+			h.requireWriteLine("EXTENSIONS")
+			h.requireReadLineExact("EXTENSIONS")
+			require.False(t, h.server.extensionInfo)
+			require.False(t, h.server.extensionAsync)
+			require.False(t, h.server.extensionGetGitRemoteName)
+			require.False(t, h.server.extensionUnavailableResponse)
+
+			h.requireWriteLine("EXTENSIONS INFO")
+			h.requireReadLineExact("EXTENSIONS INFO")
+			require.True(t, h.server.extensionInfo)
+			require.False(t, h.server.extensionAsync)
+			require.False(t, h.server.extensionGetGitRemoteName)
+			require.False(t, h.server.extensionUnavailableResponse)
+
+			h.requireWriteLine("EXTENSIONS ASYNC")
+			h.requireReadLineExact("EXTENSIONS")
+			require.True(t, h.server.extensionInfo)
+			require.True(t, h.server.extensionAsync)
+			require.False(t, h.server.extensionGetGitRemoteName)
+			require.False(t, h.server.extensionUnavailableResponse)
+
+			h.requireWriteLine("EXTENSIONS GETGITREMOTENAME")
+			h.requireReadLineExact("EXTENSIONS GETGITREMOTENAME")
+			require.True(t, h.server.extensionInfo)
+			require.True(t, h.server.extensionAsync)
+			require.True(t, h.server.extensionGetGitRemoteName)
+			require.False(t, h.server.extensionUnavailableResponse)
+
+			h.requireWriteLine("EXTENSIONS UNAVAILABLERESPONSE")
+			h.requireReadLineExact("EXTENSIONS")
+			require.True(t, h.server.extensionInfo)
+			require.True(t, h.server.extensionAsync)
+			require.True(t, h.server.extensionGetGitRemoteName)
+			require.True(t, h.server.extensionUnavailableResponse)
+
+			require.NoError(t, h.mockStdinW.Close())
+		},
+	},
+	{
+		label: "ExtensionsIdempotent",
+		testProtocolFunc: func(t *testing.T, h *testState) {
+			h.preconfigureServer()
+
+			h.requireReadLineExact("VERSION 1")
+			h.requireInitRemote()
+
+			h.requireWriteLine("EXTENSIONS")
+			h.requireReadLineExact("EXTENSIONS")
+			require.False(t, h.server.extensionInfo)
+			require.False(t, h.server.extensionAsync)
+			require.False(t, h.server.extensionGetGitRemoteName)
+			require.False(t, h.server.extensionUnavailableResponse)
+
+			h.requireWriteLine("EXTENSIONS")
+			h.requireReadLineExact("EXTENSIONS")
+			require.False(t, h.server.extensionInfo)
+			require.False(t, h.server.extensionAsync)
+			require.False(t, h.server.extensionGetGitRemoteName)
+			require.False(t, h.server.extensionUnavailableResponse)
+
+			h.requireWriteLine("EXTENSIONS INFO")
+			h.requireReadLineExact("EXTENSIONS INFO")
+			require.True(t, h.server.extensionInfo)
+			require.False(t, h.server.extensionAsync)
+			require.False(t, h.server.extensionGetGitRemoteName)
+			require.False(t, h.server.extensionUnavailableResponse)
+
+			h.requireWriteLine("EXTENSIONS INFO")
+			h.requireReadLineExact("EXTENSIONS INFO")
+			require.True(t, h.server.extensionInfo)
+			require.False(t, h.server.extensionAsync)
+			require.False(t, h.server.extensionGetGitRemoteName)
+			require.False(t, h.server.extensionUnavailableResponse)
+
+			h.requireWriteLine("EXTENSIONS ASYNC ASYNC")
+			h.requireReadLineExact("EXTENSIONS")
+			require.True(t, h.server.extensionInfo)
+			require.True(t, h.server.extensionAsync)
+			require.False(t, h.server.extensionGetGitRemoteName)
+			require.False(t, h.server.extensionUnavailableResponse)
+
+			require.NoError(t, h.mockStdinW.Close())
+		},
+	},
+	{
+		label: "ExtensionsSupportsMultiple",
+		testProtocolFunc: func(t *testing.T, h *testState) {
+			h.preconfigureServer()
+
+			h.requireReadLineExact("VERSION 1")
+			h.requireInitRemote()
+
+			h.requireWriteLine("EXTENSIONS")
+			h.requireReadLineExact("EXTENSIONS")
+			require.False(t, h.server.extensionInfo)
+			require.False(t, h.server.extensionAsync)
+			require.False(t, h.server.extensionGetGitRemoteName)
+			require.False(t, h.server.extensionUnavailableResponse)
+
+			h.requireWriteLine("EXTENSIONS INFO ASYNC")
+			h.requireReadLineExact("EXTENSIONS INFO")
+			require.True(t, h.server.extensionInfo)
+			require.True(t, h.server.extensionAsync)
+			require.False(t, h.server.extensionGetGitRemoteName)
+			require.False(t, h.server.extensionUnavailableResponse)
+
+			require.NoError(t, h.mockStdinW.Close())
+		},
+	},
+	{
+		label: "TransferStoreAbsolute",
+		testProtocolFunc: func(t *testing.T, h *testState) {
+			h.preconfigureServer()
+
+			h.requireReadLineExact("VERSION 1")
+			h.requireInitRemote()
+
+			// Create temp file for transfer with an absolute path.
+			item := h.fstestRun.WriteFile("file.txt", "HELLO", time.Now())
+			absPath := filepath.Join(h.fstestRun.Flocal.Root(), item.Path)
+			require.True(t, filepath.IsAbs(absPath))
+
+			// Specify an absolute path to transfer.
+			h.requireWriteLine("TRANSFER STORE KeyAbsolute " + absPath)
+			h.requireReadLineExact("TRANSFER-SUCCESS STORE KeyAbsolute")
+
+			// Check that the file was transferred.
+			remoteItem := fstest.NewItem("KeyAbsolute", "HELLO", item.ModTime)
+			h.fstestRun.CheckRemoteItems(t, remoteItem)
+
+			// Transfer the same absolute path a second time, but with a different key.
+			h.requireWriteLine("TRANSFER STORE KeyAbsolute2 " + absPath)
+			h.requireReadLineExact("TRANSFER-SUCCESS STORE KeyAbsolute2")
+
+			// Check that the same file was transferred to a new name.
+			remoteItem2 := fstest.NewItem("KeyAbsolute2", "HELLO", item.ModTime)
+			h.fstestRun.CheckRemoteItems(t, remoteItem, remoteItem2)
+
+			h.requireWriteLine("CHECKPRESENT KeyAbsolute2")
+			h.requireReadLineExact("CHECKPRESENT-SUCCESS KeyAbsolute2")
+
+			h.requireWriteLine("CHECKPRESENT KeyThatDoesNotExist")
+			h.requireReadLineExact("CHECKPRESENT-FAILURE KeyThatDoesNotExist")
+
+			require.NoError(t, h.mockStdinW.Close())
+		},
+	},
+	// Test that the TRANSFER command understands simple relative paths
+	// consisting only of a file name.
+	{
+		label: "TransferStoreRelative",
+		testProtocolFunc: func(t *testing.T, h *testState) {
+			// Save the current working directory so we can restore it when this
+			// test ends.
+			cwd, err := os.Getwd()
+			require.NoError(t, err)
+
+			tempDir := t.TempDir()
+
+			require.NoError(t, os.Chdir(tempDir))
+			t.Cleanup(func() { require.NoError(t, os.Chdir(cwd)) })
+
+			h.preconfigureServer()
+
+			h.requireReadLineExact("VERSION 1")
+			h.requireInitRemote()
+
+			item := h.fstestRun.WriteFile("file.txt", "HELLO", time.Now())
+			absPath := filepath.Join(h.fstestRun.Flocal.Root(), item.Path)
+
+			relativePath, err := relativeFilepathWorkaround(tempDir, absPath)
+			require.NoError(t, err)
+			require.False(t, filepath.IsAbs(relativePath))
+			require.FileExists(t, relativePath)
+
+			// Specify a relative path to transfer.
+			h.requireWriteLine("TRANSFER STORE KeyRelative " + relativePath)
+			h.requireReadLineExact("TRANSFER-SUCCESS STORE KeyRelative")
+
+			remoteItem := fstest.NewItem("KeyRelative", "HELLO", item.ModTime)
+			h.fstestRun.CheckRemoteItems(t, remoteItem)
+
+			h.requireWriteLine("CHECKPRESENT KeyRelative")
+			h.requireReadLineExact("CHECKPRESENT-SUCCESS KeyRelative")
+
+			h.requireWriteLine("CHECKPRESENT KeyThatDoesNotExist")
+			h.requireReadLineExact("CHECKPRESENT-FAILURE KeyThatDoesNotExist")
+
+			require.NoError(t, h.mockStdinW.Close())
+		},
+	},
+	{
+		label: "TransferStorePathWithInteriorWhitespace",
+		testProtocolFunc: func(t *testing.T, h *testState) {
+			// Save the current working directory so we can restore it when this
+			// test ends.
+			cwd, err := os.Getwd()
+			require.NoError(t, err)
+
+			tempDir := t.TempDir()
+			require.NoError(t, os.Chdir(tempDir))
+			t.Cleanup(func() { require.NoError(t, os.Chdir(cwd)) })
+
+			h.preconfigureServer()
+
+			h.requireReadLineExact("VERSION 1")
+			h.requireInitRemote()
+
+			// Create temp file for transfer.
+			item := h.fstestRun.WriteFile("filename with spaces.txt", "HELLO", time.Now())
+			absPath := filepath.Join(h.fstestRun.Flocal.Root(), item.Path)
+			relativePath, err := relativeFilepathWorkaround(tempDir, absPath)
+			require.NoError(t, err)
+			require.False(t, filepath.IsAbs(relativePath))
+			require.FileExists(t, relativePath)
+
+			// Specify a relative path to transfer.
+			h.requireWriteLine("TRANSFER STORE KeyRelative " + relativePath)
+			h.requireReadLineExact("TRANSFER-SUCCESS STORE KeyRelative")
+
+			remoteItem := fstest.NewItem("KeyRelative", "HELLO", item.ModTime)
+			h.fstestRun.CheckRemoteItems(t, remoteItem)
+
+			h.requireWriteLine("CHECKPRESENT KeyRelative")
+			h.requireReadLineExact("CHECKPRESENT-SUCCESS KeyRelative")
+
+			h.requireWriteLine("CHECKPRESENT KeyThatDoesNotExist")
+			h.requireReadLineExact("CHECKPRESENT-FAILURE KeyThatDoesNotExist")
+
+			require.NoError(t, h.mockStdinW.Close())
+		},
+	},
+	{
+		label: "CheckPresentAndTransfer",
+		testProtocolFunc: func(t *testing.T, h *testState) {
+			h.preconfigureServer()
+
+			// Create temp file for transfer.
+			item := h.fstestRun.WriteFile("file.txt", "HELLO", time.Now())
+			absPath := filepath.Join(h.fstestRun.Flocal.Root(), item.Path)
+			require.True(t, filepath.IsAbs(absPath))
+
+			h.requireReadLineExact("VERSION 1")
+			h.requireInitRemote()
+
+			h.requireWriteLine("CHECKPRESENT KeyThatDoesNotExist")
+			h.requireReadLineExact("CHECKPRESENT-FAILURE KeyThatDoesNotExist")
+
+			// Specify an absolute path to transfer.
+			h.requireWriteLine("TRANSFER STORE KeyAbsolute " + absPath)
+			h.requireReadLineExact("TRANSFER-SUCCESS STORE KeyAbsolute")
+
+			remoteItem := fstest.NewItem("KeyAbsolute", "HELLO", item.ModTime)
+			h.fstestRun.CheckRemoteItems(t, remoteItem)
+
+			require.NoError(t, h.mockStdinW.Close())
+		},
+	},
+	// Check whether a key is present, transfer a file with that key, then check
+	// again whether it is present.
+	//
+	// This is a regression test for a bug where the second CHECKPRESENT would
+	// generate the following response:
+	//
+	//	CHECKPRESENT-UNKNOWN ${key} failed to read directory entry: readdirent ${filepath}: not a directory
+	//
+	// This message was generated by the local backend's `List()` function. When
+	// checking whether a file exists, we were erroneously listing its contents as
+	// if it were a directory.
+	{
+		label: "CheckpresentTransferCheckpresent",
+		testProtocolFunc: func(t *testing.T, h *testState) {
+			h.preconfigureServer()
+
+			// Create temp file for transfer.
+			item := h.fstestRun.WriteFile("file.txt", "HELLO", time.Now())
+			absPath := filepath.Join(h.fstestRun.Flocal.Root(), item.Path)
+			require.True(t, filepath.IsAbs(absPath))
+
+			h.requireReadLineExact("VERSION 1")
+			h.requireInitRemote()
+
+			h.requireWriteLine("CHECKPRESENT foo")
+			h.requireReadLineExact("CHECKPRESENT-FAILURE foo")
+
+			h.requireWriteLine("TRANSFER STORE foo " + absPath)
+			h.requireReadLineExact("TRANSFER-SUCCESS STORE foo")
+
+			remoteItem := fstest.NewItem("foo", "HELLO", item.ModTime)
+			h.fstestRun.CheckRemoteItems(t, remoteItem)
+
+			h.requireWriteLine("CHECKPRESENT foo")
+			h.requireReadLineExact("CHECKPRESENT-SUCCESS foo")
+
+			require.NoError(t, h.mockStdinW.Close())
+		},
+	},
+	{
+		label: "TransferAndCheckpresentWithRealisticKey",
+		testProtocolFunc: func(t *testing.T, h *testState) {
+			h.preconfigureServer()
+
+			// Create temp file for transfer.
+			item := h.fstestRun.WriteFile("file.txt", "HELLO", time.Now())
+			absPath := filepath.Join(h.fstestRun.Flocal.Root(), item.Path)
+			require.True(t, filepath.IsAbs(absPath))
+
+			h.requireReadLineExact("VERSION 1")
+			h.requireInitRemote()
+
+			realisticKey := "SHA256E-s1048576--7ba87e06b9b7903cfbaf4a38736766c161e3e7b42f06fe57f040aa410a8f0701.this-is-a-test-key"
+
+			// Specify an absolute path to transfer.
+			h.requireWriteLine(fmt.Sprintf("TRANSFER STORE %s %s", realisticKey, absPath))
+			h.requireReadLineExact("TRANSFER-SUCCESS STORE " + realisticKey)
+
+			remoteItem := fstest.NewItem(realisticKey, "HELLO", item.ModTime)
+			h.fstestRun.CheckRemoteItems(t, remoteItem)
+
+			h.requireWriteLine("CHECKPRESENT " + realisticKey)
+			h.requireReadLineExact("CHECKPRESENT-SUCCESS " + realisticKey)
+
+			require.NoError(t, h.mockStdinW.Close())
+		},
+	},
+	{
+		label: "StoreCheckpresentRemoveWith4levelLayout",
+		testProtocolFunc: func(t *testing.T, h *testState) {
+			h.preconfigureServer()
+			h.server.configRcloneLayout = string(layoutMode4level)
+
+			item := h.fstestRun.WriteFile("file.txt", "HELLO", time.Now())
+			absPath := filepath.Join(h.fstestRun.Flocal.Root(), item.Path)
+
+			h.requireReadLineExact("VERSION 1")
+
+			h.requireWriteLine("TRANSFER STORE SomeKey " + absPath)
+			h.requireReadLineExact("DIRHASH SomeKey")
+			h.requireWriteLine("VALUE Xq/3v/")
+			h.requireReadLineExact("DIRHASH-LOWER SomeKey")
+			h.requireWriteLine("VALUE f87/4d1/")
+			h.requireReadLineExact("TRANSFER-SUCCESS STORE SomeKey")
+
+			h.fstestRun.CheckRemoteItems(t, fstest.NewItem("Xq/3v/f87/4d1/SomeKey", "HELLO", item.ModTime))
+
+			// The dirhash responses are cached, so git-annex is not asked again.
+			h.requireWriteLine("CHECKPRESENT SomeKey")
+			h.requireReadLineExact("CHECKPRESENT-SUCCESS SomeKey")
+			h.requireWriteLine("REMOVE SomeKey")
+			h.requireReadLineExact("REMOVE-SUCCESS SomeKey")
+
+			h.requireRemoteIsEmpty()
+
+			require.NoError(t, h.mockStdinW.Close())
+		},
+	},
+	{
+		label: "RetrieveNonexistentFile",
+		testProtocolFunc: func(t *testing.T, h *testState) {
+			h.preconfigureServer()
+
+			h.requireReadLineExact("VERSION 1")
+			h.requireInitRemote()
+
+			h.requireWriteLine("TRANSFER RETRIEVE SomeKey path")
+			h.requireReadLineExact("TRANSFER-FAILURE RETRIEVE SomeKey [E004] not found")
+
+			require.NoError(t, h.mockStdinW.Close())
+		},
+	},
+	{
+		label: "StoreCheckpresentRetrieve",
+		testProtocolFunc: func(t *testing.T, h *testState) {
+			h.preconfigureServer()
+
+			// Create temp file for transfer.
+			item := h.fstestRun.WriteFile("file.txt", "HELLO", time.Now())
+			absPath := filepath.Join(h.fstestRun.Flocal.Root(), item.Path)
+			require.True(t, filepath.IsAbs(absPath))
+
+			h.requireReadLineExact("VERSION 1")
+			h.requireInitRemote()
+
+			// Specify an absolute path to transfer.
+			h.requireWriteLine("TRANSFER STORE SomeKey " + absPath)
+			h.requireReadLineExact("TRANSFER-SUCCESS STORE SomeKey")
+
+			remoteItem := fstest.NewItem("SomeKey", "HELLO", item.ModTime)
+			h.fstestRun.CheckRemoteItems(t, remoteItem)
+
+			h.requireWriteLine("CHECKPRESENT SomeKey")
+			h.requireReadLineExact("CHECKPRESENT-SUCCESS SomeKey")
+
+			h.fstestRun.CheckLocalItems(t,
+				fstest.NewItem("file.txt", "HELLO", item.ModTime),
+			)
+
+			retrievedFilePath := absPath + ".retrieved"
+			h.requireWriteLine("TRANSFER RETRIEVE SomeKey " + retrievedFilePath)
+			h.requireReadLineExact("TRANSFER-SUCCESS RETRIEVE SomeKey")
+
+			h.fstestRun.CheckLocalItems(t,
+				fstest.NewItem("file.txt", "HELLO", item.ModTime),
+				fstest.NewItem("file.txt.retrieved", "HELLO", item.ModTime),
+			)
+
+			require.NoError(t, h.mockStdinW.Close())
+		},
+	},
+	{
+		label: "StoreRetrieveRemoveChunked",
+		testProtocolFunc: func(t *testing.T, h *testState) {
+			h.preconfigureServer()
+			h.server.configRcloneChunkSize = "3M"
+
+			ctx := context.WithoutCancel(context.Background())
+
+			// Create a 10 MiB file, which should be stored in 4 chunks.
+			contents := random.String(10 * 1024 * 1024)
+			item := h.fstestRun.WriteFile("file.txt", contents, time.Now())
+			absPath := filepath.Join(h.fstestRun.Flocal.Root(), item.Path)
+
+			h.requireReadLineExact("VERSION 1")
+			h.requireInitRemote()
+
+			h.requireWriteLine("TRANSFER STORE SomeKey " + absPath)
+			h.requireReadLineExact("TRANSFER-SUCCESS STORE SomeKey")
+
+			_, err := h.fstestRun.Fremote.NewObject(ctx, "SomeKey")
+			require.ErrorIs(t, err, fs.ErrorObjectNotFound)
+			var totalSize int64
+			for i, wantSize := range []int64{3 << 20, 3 << 20, 3 << 20, 1 << 20} {
+				chunk, err := h.fstestRun.Fremote.NewObject(ctx, chunkName("SomeKey", i))
+				require.NoError(t, err)
+				require.Equal(t, wantSize, chunk.Size())
+				totalSize += chunk.Size()
+			}
+			require.Equal(t, int64(len(contents)), totalSize)
+			_, err = h.fstestRun.Fremote.NewObject(ctx, chunkName("SomeKey", 4))
+			require.ErrorIs(t, err, fs.ErrorObjectNotFound)
+
+			h.requireWriteLine("CHECKPRESENT SomeKey")
+			h.requireReadLineExact("CHECKPRESENT-SUCCESS SomeKey")
+
+			retrievedFilePath := absPath + ".retrieved"
+			h.requireWriteLine("TRANSFER RETRIEVE SomeKey " + retrievedFilePath)
+			h.requireReadLineExact("TRANSFER-SUCCESS RETRIEVE SomeKey")
+
+			retrievedContents, err := os.ReadFile(retrievedFilePath)
+			require.NoError(t, err)
+			require.Equal(t, contents, string(retrievedContents))
+
+			// No temporary pieces should be left behind in the local directory.
+			localEntries, err := os.ReadDir(filepath.Dir(absPath))
+			require.NoError(t, err)
+			require.Len(t, localEntries, 2)
+
+			h.requireWriteLine("REMOVE SomeKey")
+			h.requireReadLineExact("REMOVE-SUCCESS SomeKey")
+			h.requireRemoteIsEmpty()
+
+			h.requireWriteLine("CHECKPRESENT SomeKey")
+			h.requireReadLineExact("CHECKPRESENT-FAILURE SomeKey")
+
+			require.NoError(t, h.mockStdinW.Close())
+		},
+	},
+	{
+		label: "StoreSmallFileWithChunkingEnabled",
+		testProtocolFunc: func(t *testing.T, h *testState) {
+			h.preconfigureServer()
+			h.server.configRcloneChunkSize = "3M"
+
+			item := h.fstestRun.WriteFile("file.txt", "HELLO", time.Now())
+			absPath := filepath.Join(h.fstestRun.Flocal.Root(), item.Path)
+
+			h.requireReadLineExact("VERSION 1")
+			h.requireWriteLine("TRANSFER STORE SomeKey " + absPath)
+			h.requireReadLineExact("TRANSFER-SUCCESS STORE SomeKey")
+
+			// Files no larger than the chunk size are stored as usual.
+			h.fstestRun.CheckRemoteItems(t, fstest.NewItem("SomeKey", "HELLO", item.ModTime))
+
+			require.NoError(t, h.mockStdinW.Close())
+		},
+	},
+	{
+		label: "StoreInDryRunMode",
+		testProtocolFunc: func(t *testing.T, h *testState) {
+			h.preconfigureServer()
+			h.server.dryRun = true
+
+			item := h.fstestRun.WriteFile("file.txt", "HELLO", time.Now())
+			absPath := filepath.Join(h.fstestRun.Flocal.Root(), item.Path)
+
+			h.requireReadLineExact("VERSION 1")
+			h.requireWriteLine("EXTENSIONS INFO") // Advertise that we support the INFO extension
+			h.requireReadLineExact("EXTENSIONS INFO")
+
+			h.requireWriteLine("TRANSFER STORE SomeKey " + absPath)
+			h.requireReadLineExact("INFO [dry-run] skipping store SomeKey")
+			h.requireReadLineExact("TRANSFER-FAILURE STORE SomeKey [E003] [dry-run] store skipped")
+
+			h.requireRemoteIsEmpty()
+
+			require.NoError(t, h.mockStdinW.Close())
+		},
+	},
+	{
+		label: "RemoveInDryRunMode",
+		testProtocolFunc: func(t *testing.T, h *testState) {
+			h.preconfigureServer()
+			h.server.dryRun = true
+
+			ctx := context.WithoutCancel(context.Background())
+			remoteItem := h.fstestRun.WriteObject(ctx, "SomeKey", "HELLO", time.Now())
+
+			h.requireReadLineExact("VERSION 1")
+			h.requireWriteLine("EXTENSIONS INFO") // Advertise that we support the INFO extension
+			h.requireReadLineExact("EXTENSIONS INFO")
+
+			h.requireWriteLine("REMOVE SomeKey")
+			h.requireReadLineExact("INFO [dry-run] skipping remove SomeKey")
+			h.requireReadLineExact("REMOVE-FAILURE SomeKey [E003] [dry-run] remove skipped")
+
+			h.fstestRun.CheckRemoteItems(t, remoteItem)
+
+			// Retrieval is not affected by dry-run mode.
+			localPath := filepath.Join(h.fstestRun.Flocal.Root(), "retrieved.txt")
+			h.requireWriteLine("TRANSFER RETRIEVE SomeKey " + localPath)
+			h.requireReadLineExact("TRANSFER-SUCCESS RETRIEVE SomeKey")
+			h.fstestRun.CheckLocalItems(t, fstest.NewItem("retrieved.txt", "HELLO", remoteItem.ModTime))
+
+			require.NoError(t, h.mockStdinW.Close())
+		},
+	},
+	{
+		label: "GetInfoReportsBytesTransferred",
+		testProtocolFunc: func(t *testing.T, h *testState) {
+			h.preconfigureServer()
+
+			item1 := h.fstestRun.WriteFile("file1.txt", "HELLO", time.Now())
+			absPath1 := filepath.Join(h.fstestRun.Flocal.Root(), item1.Path)
+			item2 := h.fstestRun.WriteFile("file2.txt", "GOODBYE", time.Now())
+			absPath2 := filepath.Join(h.fstestRun.Flocal.Root(), item2.Path)
+
+			h.requireReadLineExact("VERSION 1")
+
+			h.requireWriteLine("GETINFO")
+			info := h.requireReadInfo()
+			require.Equal(t, h.remoteName, info["remote"])
+			require.Equal(t, h.remotePrefix, info["prefix"])
+			require.Equal(t, "0", info["bytes-stored"])
+			require.Equal(t, "0", info["bytes-retrieved"])
+			require.Equal(t, h.fstestRun.Fremote.Root(), info["fs-root"])
+			require.Equal(t, fs.Version, info["rclone-version"])
+			require.NotEmpty(t, info["rclone-version"])
+
+			h.requireWriteLine("TRANSFER STORE Key1 " + absPath1)
+			h.requireReadLineExact("TRANSFER-SUCCESS STORE Key1")
+			h.requireWriteLine("TRANSFER STORE Key2 " + absPath2)
+			h.requireReadLineExact("TRANSFER-SUCCESS STORE Key2")
+			h.requireWriteLine("TRANSFER RETRIEVE Key2 " + absPath2 + ".retrieved")
+			h.requireReadLineExact("TRANSFER-SUCCESS RETRIEVE Key2")
+
+			// Failed transfers are not counted.
+			h.requireWriteLine("TRANSFER RETRIEVE KeyThatDoesNotExist " + absPath1 + ".retrieved")
+			h.requireReadLineExact("TRANSFER-FAILURE RETRIEVE KeyThatDoesNotExist [E004] not found")
+
+			h.requireWriteLine("GETINFO")
+			info = h.requireReadInfo()
+			require.Equal(t, "12", info["bytes-stored"])
+			require.Equal(t, "7", info["bytes-retrieved"])
+
+			require.NoError(t, h.mockStdinW.Close())
+		},
+	},
+	{
+		label: "RemovePreexistingFile",
+		testProtocolFunc: func(t *testing.T, h *testState) {
+			h.preconfigureServer()
+
+			ctx := context.WithoutCancel(context.Background())
+
+			// Write a file into the remote without using the git-annex
+			// protocol.
+			remoteItem := h.fstestRun.WriteObject(ctx, "SomeKey", "HELLO", time.Now())
+
+			h.fstestRun.CheckRemoteItems(t, remoteItem)
+
+			h.requireReadLineExact("VERSION 1")
+			h.requireInitRemote()
+
+			h.requireWriteLine("CHECKPRESENT SomeKey")
+			h.requireReadLineExact("CHECKPRESENT-SUCCESS SomeKey")
+
+			h.fstestRun.CheckRemoteItems(t, remoteItem)
+
+			h.requireWriteLine("REMOVE SomeKey")
+			h.requireReadLineExact("REMOVE-SUCCESS SomeKey")
+
+			h.requireRemoteIsEmpty()
+
+			h.requireWriteLine("CHECKPRESENT SomeKey")
+			h.requireReadLineExact("CHECKPRESENT-FAILURE SomeKey")
+
+			h.requireRemoteIsEmpty()
+
+			require.NoError(t, h.mockStdinW.Close())
+		},
+	},
+	{
+		label: "Remove",
+		testProtocolFunc: func(t *testing.T, h *testState) {
+			h.preconfigureServer()
+
+			// Create temp file for transfer.
+			item := h.fstestRun.WriteFile("file.txt", "HELLO", time.Now())
+			absPath := filepath.Join(h.fstestRun.Flocal.Root(), item.Path)
+			require.True(t, filepath.IsAbs(absPath))
+
+			h.requireReadLineExact("VERSION 1")
+			h.requireInitRemote()
+
+			h.requireWriteLine("CHECKPRESENT SomeKey")
+			h.requireReadLineExact("CHECKPRESENT-FAILURE SomeKey")
+
+			// Specify an absolute path to transfer.
+			h.requireWriteLine("TRANSFER STORE SomeKey " + absPath)
+			h.requireReadLineExact("TRANSFER-SUCCESS STORE SomeKey")
+
+			remoteItem := fstest.NewItem("SomeKey", "HELLO", item.ModTime)
+			h.fstestRun.CheckRemoteItems(t, remoteItem)
+
+			h.requireWriteLine("CHECKPRESENT SomeKey")
+			h.requireReadLineExact("CHECKPRESENT-SUCCESS SomeKey")
+
+			h.requireWriteLine("REMOVE SomeKey")
+			h.requireReadLineExact("REMOVE-SUCCESS SomeKey")
+
+			h.requireRemoteIsEmpty()
+
+			h.requireWriteLine("CHECKPRESENT SomeKey")
+			h.requireReadLineExact("CHECKPRESENT-FAILURE SomeKey")
+
+			require.NoError(t, h.mockStdinW.Close())
+		},
+	},
+	{
+		label: "RemoveNonexistentFile",
+		testProtocolFunc: func(t *testing.T, h *testState) {
+			h.preconfigureServer()
+
+			h.requireReadLineExact("VERSION 1")
+			h.requireInitRemote()
+
+			h.requireWriteLine("CHECKPRESENT SomeKey")
+			h.requireReadLineExact("CHECKPRESENT-FAILURE SomeKey")
+
+			h.requireRemoteIsEmpty()
+
+			h.requireWriteLine("REMOVE SomeKey")
+			h.requireReadLineExact("REMOVE-SUCCESS SomeKey")
+
+			h.requireRemoteIsEmpty()
+
+			h.requireWriteLine("CHECKPRESENT SomeKey")
+			h.requireReadLineExact("CHECKPRESENT-FAILURE SomeKey")
+
+			require.NoError(t, h.mockStdinW.Close())
+		},
+	},
+	{
+		label: "ExportNotSupported",
+		testProtocolFunc: func(t *testing.T, h *testState) {
+			h.preconfigureServer()
+
+			h.requireReadLineExact("VERSION 1")
+			h.requireInitRemote()
+
+			h.requireWriteLine("EXPORTSUPPORTED")
+			h.requireReadLineExact("EXPORTSUPPORTED-FAILURE")
+
+			require.NoError(t, h.mockStdinW.Close())
+		},
+	},
+}
+
+func TestExportCapabilities(t *testing.T) {
+	for _, tc := range []struct {
+		capabilities ExportCapabilities
+		want         string
+		wantReply    string
+	}{
+		{0, "", "EXPORTSUPPORTED-FAILURE"},
+		{ExportStore, "STORE", "EXPORTSUPPORTED-YES STORE"},
+		{ExportStore | ExportCheckPresent | ExportRemove, "STORE CHECKPRESENT REMOVE", "EXPORTSUPPORTED-YES STORE CHECKPRESENT REMOVE"},
+		{ExportRemoveDir | ExportStore | ExportCheckPresent | ExportRemove | ExportRename, "STORE CHECKPRESENT REMOVE RENAME REMOVEDIR", "EXPORTSUPPORTED-YES STORE CHECKPRESENT REMOVE RENAME REMOVEDIR"},
+	} {
+		require.Equal(t, tc.want, tc.capabilities.String())
+		require.Equal(t, tc.wantReply, exportSupportedReply(tc.capabilities))
+		parsed, err := parseExportCapabilities(tc.want)
+		require.NoError(t, err)
+		require.Equal(t, tc.capabilities, parsed)
+	}
+
+	_, err := parseExportCapabilities("STORE COPY")
+	require.ErrorContains(t, err, `unknown export capability "COPY"`)
+
+	// The reply follows the handlers as they are added.
+	defer func(saved ExportCapabilities) {
+		implementedExportCapabilities = saved
+	}(implementedExportCapabilities)
+	for _, tc := range []struct {
+		capabilities ExportCapabilities
+		wantReply    string
+	}{
+		{0, "EXPORTSUPPORTED-FAILURE"},
+		{ExportStore | ExportCheckPresent | ExportRemove, "EXPORTSUPPORTED-YES STORE CHECKPRESENT REMOVE"},
+		{ExportStore | ExportCheckPresent | ExportRemove | ExportRename, "EXPORTSUPPORTED-YES STORE CHECKPRESENT REMOVE RENAME"},
+	} {
+		implementedExportCapabilities = tc.capabilities
+		h := makeTestState(t)
+		serverErrorChan := make(chan error)
+		go func() {
+			serverErrorChan <- h.server.run()
+		}()
+		h.requireReadLineExact("VERSION 1")
+		h.requireWriteLine("EXPORTSUPPORTED")
+		h.requireReadLineExact(tc.wantReply)
+		require.NoError(t, h.mockStdinW.Close())
+		require.NoError(t, <-serverErrorChan)
+	}
+}
+
+// TestReadLineHasShortDeadline verifies that [testState.readLineWithTimeout]
+// does not block indefinitely when a line is never written.
+func TestReadLineHasShortDeadline(t *testing.T) {
+	const timeoutForRead = time.Millisecond * 50
+	const timeoutForTest = time.Millisecond * 100
+	const tickDuration = time.Millisecond * 10
+
+	type readLineResult struct {
+		line string
+		err  error
+	}
+
+	resultChan := make(chan readLineResult)
+
+	go func() {
+		defer close(resultChan)
+
+		h := makeTestState(t)
+		h.readLineTimeout = timeoutForRead
+
+		line, err := h.readLineWithTimeout()
+		resultChan <- readLineResult{line, err}
+	}()
+
+	// This closure will be run periodically until time runs out or until all of
+	// its assertions pass.
+	idempotentConditionFunc := func(c *assert.CollectT) {
+		result, ok := <-resultChan
+		require.True(c, ok, "The goroutine should send a result")
+
+		require.Empty(c, result.line, "No line should be read")
+		require.ErrorIs(c, result.err, context.DeadlineExceeded)
+
+		_, ok = <-resultChan
+		require.False(c, ok, "The channel should be closed")
+	}
+
+	require.EventuallyWithT(t, idempotentConditionFunc, timeoutForTest, tickDuration)
+}
+
+// TestBwLimitIsRemovedAtSessionEnd checks that the "rclonebwlimit" config sets
+// the bandwidth limit of transfers and that the limit does not outlive the
+// session that installed it.
+func TestBwLimitIsRemovedAtSessionEnd(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping due to short mode.")
+	}
+
+	localDir := t.TempDir()
+	remoteDir := t.TempDir()
+	localPath := filepath.Join(localDir, "file.txt")
+	require.NoError(t, os.WriteFile(localPath, []byte("0123456789"), 0600))
+
+	// storeWithLimit runs a session that stores the local file with the given
+	// bandwidth limit. It returns the limits set on the token bucket while the
+	// TRANSFER ran, and those set once the session ended. The token bucket is
+	// injected, so no transfer is actually throttled.
+	storeWithLimit := func(key, bwLimit string) (during, after []fs.BwPair) {
+		var limitsMu sync.Mutex
+		var limits []fs.BwPair
+
+		h := makeTestState(t)
+		h.remoteName = ":local:"
+		h.remotePrefix = remoteDir
+		h.preconfigureServer()
+		h.server.configRcloneBwLimit = bwLimit
+		h.server.setBwLimit = func(limit fs.BwPair) {
+			limitsMu.Lock()
+			defer limitsMu.Unlock()
+			limits = append(limits, limit)
+		}
+
+		serverErrorChan := make(chan error)
+		go func() {
+			serverErrorChan <- h.server.run()
+		}()
+
+		h.requireReadLineExact("VERSION 1")
+		h.requireWriteLine("PREPARE")
+		h.requireReadLineExactAfterConfigs("PREPARE-SUCCESS")
+		h.requireWriteLine(fmt.Sprintf("TRANSFER STORE %s %s", key, localPath))
+		h.requireReadLineExact("TRANSFER-SUCCESS STORE " + key)
+
+		limitsMu.Lock()
+		during = slices.Clone(limits)
+		limitsMu.Unlock()
+
+		require.NoError(t, h.mockStdinW.Close())
+		require.NoError(t, <-serverErrorChan)
+
+		limitsMu.Lock()
+		defer limitsMu.Unlock()
+		return during, limits[len(during):]
+	}
+
+	globalLimit := fs.GetConfig(context.Background()).BwLimit.LimitAt(time.Now()).Bandwidth
+	during, after := storeWithLimit("KeyLimited", "1B")
+	require.Equal(t, []fs.BwPair{{Tx: 1, Rx: 1}}, during)
+	require.Equal(t, []fs.BwPair{globalLimit}, after)
+
+	during, after = storeWithLimit("KeyUnlimited", "")
+	require.Empty(t, during)
+	require.Empty(t, after)
+}
+
+// TestBandwidthScheduleConfig checks that the "rclonebandwidthschedule" config
+// limits the bandwidth of transfers only during the slots of the schedule that
+// limit them.
+func TestBandwidthScheduleConfig(t *testing.T) {
+	scheduleDir := t.TempDir()
+	schedulePath := filepath.Join(scheduleDir, "schedule")
+	require.NoError(t, os.WriteFile(schedulePath, []byte("08:00,1B\n20:00,off\n"), 0600))
+	timetable, err := readBandwidthSchedule(schedulePath)
+	require.NoError(t, err)
+	require.Equal(t, fs.SizeSuffix(1), timetable.LimitAt(time.Date(2024, time.January, 1, 10, 0, 0, 0, time.Local)).Bandwidth.Tx)
+	require.Equal(t, fs.SizeSuffix(-1), timetable.LimitAt(time.Date(2024, time.January, 1, 21, 0, 0, 0, time.Local)).Bandwidth.Tx)
+
+	badPath := filepath.Join(scheduleDir, "bad")
+	require.NoError(t, os.WriteFile(badPath, []byte("08:00,fast"), 0600))
+	_, err = readBandwidthSchedule(badPath)
+	require.ErrorContains(t, err, "failed to parse bandwidth schedule")
+	_, err = readBandwidthSchedule(filepath.Join(scheduleDir, "missing"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	t.Run("ConflictsWithBwLimit", func(t *testing.T) {
+		h := makeTestState(t)
+		h.remoteName = ":local:"
+		h.remotePrefix = t.TempDir()
+		h.preconfigureServer()
+		h.server.configRcloneBwLimit = "1M"
+		h.server.configRcloneBandwidthSchedule = schedulePath
+
+		serverErrorChan := make(chan error)
+		go func() {
+			serverErrorChan <- h.server.run()
+		}()
+
+		h.requireReadLineExact("VERSION 1")
+		h.requireWriteLine("PREPARE")
+		h.requireReadLineExactAfterConfigs("PREPARE-FAILURE [E001] rclonebwlimit and rclonebandwidthschedule cannot both be set")
+		require.NoError(t, h.mockStdinW.Close())
+		require.ErrorAs(t, <-serverErrorChan, new(*ErrConfigMissing))
+	})
+
+	if testing.Short() {
+		t.Skip("Skipping due to short mode.")
+	}
+
+	localPath := filepath.Join(t.TempDir(), "file.txt")
+	require.NoError(t, os.WriteFile(localPath, []byte("0123456789"), 0600))
+	remoteDir := t.TempDir()
+
+	// storeAt runs a session that stores the local file at the given time of
+	// day and returns the limits set on the token bucket while the TRANSFER
+	// ran. The token bucket is injected, so no transfer is actually throttled.
+	storeAt := func(key string, hour int) []fs.BwPair {
+		var limitsMu sync.Mutex
+		var limits []fs.BwPair
+
+		h := makeTestState(t)
+		h.remoteName = ":local:"
+		h.remotePrefix = remoteDir
+		h.preconfigureServer()
+		h.server.configRcloneBandwidthSchedule = schedulePath
+		h.server.now = func() time.Time {
+			return time.Date(2024, time.January, 1, hour, 0, 0, 0, time.Local)
+		}
+		h.server.setBwLimit = func(limit fs.BwPair) {
+			limitsMu.Lock()
+			defer limitsMu.Unlock()
+			limits = append(limits, limit)
+		}
+
+		serverErrorChan := make(chan error)
+		go func() {
+			serverErrorChan <- h.server.run()
+		}()
+
+		h.requireReadLineExact("VERSION 1")
+		h.requireWriteLine("PREPARE")
+		h.requireReadLineExactAfterConfigs("PREPARE-SUCCESS")
+		h.requireWriteLine(fmt.Sprintf("TRANSFER STORE %s %s", key, localPath))
+		h.requireReadLineExact("TRANSFER-SUCCESS STORE " + key)
+
+		limitsMu.Lock()
+		during := slices.Clone(limits)
+		limitsMu.Unlock()
+
+		require.NoError(t, h.mockStdinW.Close())
+		require.NoError(t, <-serverErrorChan)
+		return during
+	}
+
+	require.Equal(t, []fs.BwPair{{Tx: 1, Rx: 1}}, storeAt("KeyLimited", 10))
+	require.Equal(t, []fs.BwPair{{Tx: -1, Rx: -1}}, storeAt("KeyUnlimited", 21))
+}
+
+// TestProxyURLConfig checks that the "rcloneproxyurl" config routes backend
+// requests through the proxy.
+func TestProxyURLConfig(t *testing.T) {
+	// net/http reads the proxy from the environment once per process, so the
+	// session runs in a process of its own, as it does under git-annex.
+	if os.Getenv("RCLONE_GITANNEX_TEST_PROXY") == "" {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestProxyURLConfig$")
+		cmd.Env = append(os.Environ(), "RCLONE_GITANNEX_TEST_PROXY=1", "NO_PROXY=", "no_proxy=")
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, "%s", out)
+		return
+	}
+
+	// The fake proxy serves the target's content itself and records the hosts
+	// it was asked to reach.
+	var proxiedHostsMu sync.Mutex
+	var proxiedHosts []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxiedHostsMu.Lock()
+		proxiedHosts = append(proxiedHosts, r.URL.Host)
+		proxiedHostsMu.Unlock()
+		if r.URL.Path != "/annex/SomeKey" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		_, _ = io.WriteString(w, "HELLO")
+	}))
+	t.Cleanup(proxy.Close)
+
+	retrievedPath := filepath.Join(t.TempDir(), "retrieved.txt")
+
+	h := makeTestState(t)
+	// Nothing resolves this host, so the backend can only reach it through the
+	// proxy.
+	h.remoteName = ":http,url='http://files.invalid':"
+	h.remotePrefix = "annex"
+	h.preconfigureServer()
+	h.server.configRcloneProxyURL = proxy.URL
+	// http remotes are read-only.
+	h.server.configRclonePrefixCreateOnPrepare = "no"
+
+	serverErrorChan := make(chan error)
+	go func() {
+		serverErrorChan <- h.server.run()
+	}()
+
+	h.requireReadLineExact("VERSION 1")
+	h.requireWriteLine("PREPARE")
+	h.requireReadLineExactAfterConfigs("PREPARE-SUCCESS")
+	h.requireWriteLine("TRANSFER RETRIEVE SomeKey " + retrievedPath)
+	h.requireReadLineExact("TRANSFER-SUCCESS RETRIEVE SomeKey")
+	require.NoError(t, h.mockStdinW.Close())
+	require.NoError(t, <-serverErrorChan)
+
+	content, err := os.ReadFile(retrievedPath)
+	require.NoError(t, err)
+	require.Equal(t, "HELLO", string(content))
+
+	proxiedHostsMu.Lock()
+	defer proxiedHostsMu.Unlock()
+	require.Contains(t, proxiedHosts, "files.invalid")
+}
+
+func TestCacheDirConfig(t *testing.T) {
+	defaultCacheDir := config.GetCacheDir()
+	cacheDir := filepath.Join(t.TempDir(), "cache")
+	localPath := filepath.Join(t.TempDir(), "file.txt")
+	require.NoError(t, os.WriteFile(localPath, []byte("HELLO"), 0600))
+
+	h := makeTestState(t)
+	// The hasher backend keeps its database in the cache directory.
+	h.remoteName = fmt.Sprintf(":hasher,remote=%s:", quoteConfigValue(t.TempDir()))
+	h.remotePrefix = "cachedir-" + random.String(8)
+	h.preconfigureServer()
+	h.server.configRcloneCacheDir = cacheDir
+
+	serverErrorChan := make(chan error)
+	go func() {
+		serverErrorChan <- h.server.run()
+	}()
+
+	h.requireReadLineExact("VERSION 1")
+	h.requireWriteLine("PREPARE")
+	h.requireReadLineExactAfterConfigs("PREPARE-SUCCESS")
+	require.Equal(t, cacheDir, config.GetCacheDir())
+	h.requireWriteLine("TRANSFER STORE SomeKey " + localPath)
+	h.requireReadLineExact("TRANSFER-SUCCESS STORE SomeKey")
+	h.requireWriteLine("CHECKPRESENT SomeKey")
+	h.requireReadLineExact("CHECKPRESENT-SUCCESS SomeKey")
+	require.NoError(t, h.mockStdinW.Close())
+	require.NoError(t, <-serverErrorChan)
+
+	// The default is restored, but the cache is kept.
+	require.Equal(t, defaultCacheDir, config.GetCacheDir())
+	databases, err := filepath.Glob(filepath.Join(cacheDir, "kv", "*hasher.bolt"))
+	require.NoError(t, err)
+	require.NotEmpty(t, databases)
+	for _, database := range databases {
+		require.NoFileExists(t, filepath.Join(defaultCacheDir, "kv", filepath.Base(database)))
+	}
+}
+
+// offlineFs wraps an Fs whose objects cannot be opened once `offline` is set,
+// as if the remote had become unreachable.
+type offlineFs struct {
+	fs.Fs
+	offline *atomic.Bool
+}
+
+func (o *offlineFs) NewObject(ctx context.Context, remote string) (fs.Object, error) {
+	obj, err := o.Fs.NewObject(ctx, remote)
+	if err != nil {
+		return nil, err
+	}
+	return &offlineObject{Object: obj, offline: o.offline}, nil
+}
+
+type offlineObject struct {
+	fs.Object
+	offline *atomic.Bool
+}
+
+func (o *offlineObject) Open(ctx context.Context, options ...fs.OpenOption) (io.ReadCloser, error) {
+	if o.offline.Load() {
+		return nil, errors.New("remote is offline")
+	}
+	return o.Object.Open(ctx, options...)
+}
+
+func TestObjectCacheConfig(t *testing.T) {
+	ctx := context.Background()
+	for _, useCache := range []bool{false, true} {
+		t.Run(fmt.Sprintf("cache=%v", useCache), func(t *testing.T) {
+			remoteDir := t.TempDir()
+			localDir := t.TempDir()
+			localPath := filepath.Join(localDir, "file.txt")
+			require.NoError(t, os.WriteFile(localPath, []byte("HELLO"), 0600))
+
+			remoteFsString := fspath.JoinRootPath(":local:", remoteDir)
+			remoteFs, err := cache.Get(ctx, remoteFsString)
+			require.NoError(t, err)
+			var offline atomic.Bool
+			cache.Put(remoteFsString, &offlineFs{Fs: remoteFs, offline: &offline})
+
+			h := makeTestState(t)
+			h.remoteName = ":local:"
+			h.remotePrefix = remoteDir
+			h.preconfigureServer()
+			h.server.configRcloneCacheDir = t.TempDir()
+			if useCache {
+				h.server.configRcloneObjectCache = "yes"
+			}
+
+			serverErrorChan := make(chan error)
+			go func() {
+				serverErrorChan <- h.server.run()
+			}()
+
+			h.requireReadLineExact("VERSION 1")
+			h.requireWriteLine("PREPARE")
+			h.requireReadLineExactAfterConfigs("PREPARE-SUCCESS")
+			h.requireWriteLine("TRANSFER STORE SomeKey " + localPath)
+			h.requireReadLineExact("TRANSFER-SUCCESS STORE SomeKey")
+			require.FileExists(t, filepath.Join(remoteDir, "SomeKey"))
+
+			firstPath := filepath.Join(localDir, "first.txt")
+			h.requireWriteLine("TRANSFER RETRIEVE SomeKey " + firstPath)
+			h.requireReadLineExact("TRANSFER-SUCCESS RETRIEVE SomeKey")
+			retrieved, err := os.ReadFile(firstPath)
+			require.NoError(t, err)
+			require.Equal(t, "HELLO", string(retrieved))
+
+			// Once the remote cannot serve the content, only the cache can.
+			offline.Store(true)
+			secondPath := filepath.Join(localDir, "second.txt")
+			h.requireWriteLine("TRANSFER RETRIEVE SomeKey " + secondPath)
+			if useCache {
+				h.requireReadLineExact("TRANSFER-SUCCESS RETRIEVE SomeKey")
+				retrieved, err = os.ReadFile(secondPath)
+				require.NoError(t, err)
+				require.Equal(t, "HELLO", string(retrieved))
+				require.NoError(t, h.mockStdinW.Close())
+				require.NoError(t, <-serverErrorChan)
+			} else {
+				require.True(t, strings.HasPrefix(h.requireReadLine(), "TRANSFER-FAILURE RETRIEVE SomeKey [E003]"))
+				require.NoError(t, h.mockStdinW.Close())
+				require.ErrorContains(t, <-serverErrorChan, "remote is offline")
+			}
+		})
+	}
+}
+
+// TestServerReturnsErrPipeClosed checks that the server exits cleanly with
+// [ErrPipeClosed] when git-annex closes the read end of stdout mid-session.
+func TestServerReturnsErrPipeClosed(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		t.Skip("EPIPE is only reported on Unix")
+	}
+
+	stdinR, stdinW := io.Pipe()
+	stdoutR, stdoutW, err := os.Pipe()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = stdinW.Close()
+		_ = stdoutW.Close()
+	})
+
+	s := server{
+		reader: bufio.NewReader(stdinR),
+		writer: stdoutW,
+	}
+	serverErrorChan := make(chan error)
+	go func() {
+		serverErrorChan <- s.run()
+	}()
+
+	line, err := bufio.NewReader(stdoutR).ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "VERSION 1\n", line)
+
+	require.NoError(t, stdoutR.Close())
+	_, err = io.WriteString(stdinW, "GETCOST\n")
+	require.NoError(t, err)
+
+	select {
+	case err := <-serverErrorChan:
+		require.ErrorIs(t, err, ErrPipeClosed)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not exit after stdout was closed")
+	}
+}
+
+// TestServerReturnsErrWriteTimeout checks that the server gives up when
+// git-annex stops reading its messages.
+func TestServerReturnsErrWriteTimeout(t *testing.T) {
+	const sendTimeout = 500 * time.Millisecond
+
+	stdinR, stdinW := io.Pipe()
+	// Nothing ever reads from stdoutR, so every write to stdoutW blocks.
+	stdoutR, stdoutW := io.Pipe()
+	t.Cleanup(func() {
+		_ = stdinW.Close()
+		_ = stdoutR.Close()
+	})
+
+	s := server{
+		reader:      bufio.NewReader(stdinR),
+		writer:      stdoutW,
+		sendTimeout: sendTimeout,
+	}
+	serverErrorChan := make(chan error)
+	start := time.Now()
+	go func() {
+		serverErrorChan <- s.run()
+	}()
+
+	select {
+	case err := <-serverErrorChan:
+		require.ErrorIs(t, err, ErrWriteTimeout)
+		require.Less(t, time.Since(start), 2*sendTimeout)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not time out")
+	}
+}
+
+// TestServerHandlesStdinClosedWhileAwaitingReply checks that the server returns
+// an error rather than panicking when git-annex closes stdin instead of
+// answering a GETCONFIG message.
+func TestServerHandlesStdinClosedWhileAwaitingReply(t *testing.T) {
+	h := makeTestState(t)
+
+	serverErrorChan := make(chan error)
+	go func() {
+		serverErrorChan <- h.server.run()
+	}()
+
+	h.requireReadLineExact("VERSION 1")
+	h.requireWriteLine("PREPARE")
+	h.requireReadLineExact("GETCONFIG rcloneremotename")
+	require.NoError(t, h.mockStdinW.Close())
+
+	// The server reports PREPARE-FAILURE before returning.
+	h.requireReadLineExact("PREPARE-FAILURE [E001] Error getting configs")
+	require.ErrorContains(t, <-serverErrorChan, "closed stdin")
+}
+
+// TestServerErrorTypes checks the category and code of the errors that end a
+// session.
+// errorCodeRegexp matches the bracketed [ErrorCode] in a FAILURE message.
+var errorCodeRegexp = regexp.MustCompile(`^\S+ .*?\[(E\d{3})\] `)
+
+// parseErrorCode returns the error code from the first line of `output` that
+// starts with `prefix`, e.g. "TRANSFER-FAILURE".
+func parseErrorCode(t *testing.T, output, prefix string) ErrorCode {
+	t.Helper()
+	for _, line := range strings.Split(output, "\n") {
+		if !strings.HasPrefix(line, prefix+" ") {
+			continue
+		}
+		match := errorCodeRegexp.FindStringSubmatch(line)
+		require.NotNil(t, match, "no error code in %q", line)
+		return ErrorCode(match[1])
+	}
+	require.Failf(t, "missing message", "no line starting with %q in output:\n%s", prefix, output)
+	return ""
+}
+
+func TestServerErrorTypes(t *testing.T) {
+	// runServer runs a server on `input` and returns its output and error.
+	runServer := func(t *testing.T, input, remoteName, layout string) (string, error) {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "file.txt"), []byte("HELLO"), 0600))
+
+		var output bytes.Buffer
+		s := server{
+			reader: bufio.NewReader(strings.NewReader(strings.ReplaceAll(input, "$DIR", dir))),
+			writer: &output,
+		}
+		for _, config := range requiredConfigs {
+			s.mustSetConfigValue(config.id, config.defaultValue)
+		}
+		s.configRcloneRemoteName = remoteName
+		s.configPrefix = "errors"
+		s.configRcloneLayout = layout
+		s.configsDone = true
+		err := s.run()
+		return output.String(), err
+	}
+
+	testCases := []struct {
+		label      string
+		input      string
+		remoteName string
+		layout     string
+		wantCode   string
+		wantType   any
+		// wantErrorCode is the bracketed code in the FAILURE message, if
+		// one was sent.
+		wantErrorCode ErrorCode
+	}{{
+		label:      "UnexpectedMessage",
+		input:      "UNKNOWN\n",
+		remoteName: ":memory:",
+		layout:     string(layoutModeNodir),
+		wantCode:   codeError,
+		wantType:   new(*ErrProtocolParse),
+	}, {
+		label:         "MalformedTransferMode",
+		input:         "TRANSFER SIDEWAYS SomeKey $DIR/file.txt\n",
+		remoteName:    ":memory:",
+		layout:        string(layoutModeNodir),
+		wantCode:      "TRANSFER-FAILURE",
+		wantType:      new(*ErrProtocolParse),
+		wantErrorCode: ErrCodeProtocolParse,
+	}, {
+		label:         "UnknownLayout",
+		input:         "CHECKPRESENT SomeKey\n",
+		remoteName:    ":memory:",
+		layout:        "nonexistentLayoutMode",
+		wantCode:      "CHECKPRESENT-FAILURE",
+		wantType:      new(*ErrConfigMissing),
+		wantErrorCode: ErrCodeConfigMissing,
+	}, {
+		label:         "RemoteNotFound",
+		input:         "TRANSFER STORE SomeKey $DIR/file.txt\n",
+		remoteName:    "thisRemoteDoesNotExist:",
+		layout:        string(layoutModeNodir),
+		wantCode:      "TRANSFER-FAILURE",
+		wantType:      new(*ErrRemoteNotFound),
+		wantErrorCode: ErrCodeRemoteNotFound,
+	}, {
+		label:         "TransferFailed",
+		input:         "TRANSFER STORE SomeKey $DIR/missing.txt\n",
+		remoteName:    ":memory:",
+		layout:        string(layoutModeNodir),
+		wantCode:      "TRANSFER-FAILURE",
+		wantType:      new(*ErrTransferFailed),
+		wantErrorCode: ErrCodeTransferFailed,
+	}, {
+		label:         "RemoveUnknownLayout",
+		input:         "REMOVE SomeKey\n",
+		remoteName:    ":memory:",
+		layout:        "nonexistentLayoutMode",
+		wantCode:      "REMOVE-FAILURE",
+		wantType:      new(*ErrConfigMissing),
+		wantErrorCode: ErrCodeConfigMissing,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.label, func(t *testing.T) {
+			output, err := runServer(t, tc.input, tc.remoteName, tc.layout)
+			require.Error(t, err)
+			require.ErrorAs(t, err, tc.wantType)
+
+			var protocolErr *ErrProtocol
+			require.ErrorAs(t, err, &protocolErr)
+			require.Equal(t, tc.wantCode, protocolErr.Code())
+
+			if tc.wantErrorCode != "" {
+				require.Equal(t, tc.wantErrorCode, errorCodeOf(err))
+				require.Equal(t, tc.wantErrorCode, parseErrorCode(t, output, tc.wantCode))
+			}
+		})
+	}
+
+	t.Run("KeyNotFoundContinuesSession", func(t *testing.T) {
+		input := "TRANSFER RETRIEVE SomeKey $DIR/retrieved.txt\nCHECKPRESENT SomeKey\n"
+		output, err := runServer(t, input, ":memory:", string(layoutModeNodir))
+		require.NoError(t, err)
+		require.Contains(t, output, "TRANSFER-FAILURE RETRIEVE SomeKey [E004] not found\n")
+		require.Equal(t, ErrCodeKeyNotFound, parseErrorCode(t, output, "TRANSFER-FAILURE"))
+		require.Contains(t, output, "CHECKPRESENT-FAILURE SomeKey\n")
+	})
+
+	t.Run("UnwrapsCause", func(t *testing.T) {
+		err := &ErrTransferFailed{protocolError("TRANSFER-FAILURE", fs.ErrorObjectNotFound)}
+		require.ErrorIs(t, err, fs.ErrorObjectNotFound)
+		require.Equal(t, fs.ErrorObjectNotFound.Error(), err.Error())
+	})
+}
+
+// faultyFs wraps an Fs whose lookup of `key` fails with `lookupErr`, and whose
+// objects fail to be removed with `removeErr`, when those are set.
+type faultyFs struct {
+	fs.Fs
+	key       string
+	lookupErr error
+	removeErr error
+}
+
+func (f *faultyFs) NewObject(ctx context.Context, remote string) (fs.Object, error) {
+	if remote == f.key && f.lookupErr != nil {
+		return nil, f.lookupErr
+	}
+	obj, err := f.Fs.NewObject(ctx, remote)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyObject{Object: obj, removeErr: f.removeErr}, nil
+}
+
+type faultyObject struct {
+	fs.Object
+	removeErr error
+}
+
+func (o *faultyObject) Remove(ctx context.Context) error {
+	if o.removeErr != nil {
+		return o.removeErr
+	}
+	return o.Object.Remove(ctx)
+}
+
+// runRemove sends "REMOVE SomeKey" to a server whose remote is `f`, and
+// returns the reply and the error with which the server ended.
+func runRemove(t *testing.T, f fs.Fs) (string, error) {
+	h := makeTestState(t)
+	h.remoteName = ":memory:"
+	h.remotePrefix = "remove"
+	h.preconfigureServer()
+	h.server.getFs = func(ctx context.Context, fsString string) (fs.Fs, error) {
+		return f, nil
+	}
+
+	serverErrorChan := make(chan error)
+	go func() {
+		serverErrorChan <- h.server.run()
+	}()
+
+	h.requireReadLineExact("VERSION 1")
+	h.requireWriteLine("REMOVE SomeKey")
+	reply := h.requireReadLine()
+	require.NoError(t, h.mockStdinW.Close())
+	return reply, <-serverErrorChan
+}
+
+// newRemoveFs returns a local Fs for [runRemove], which holds SomeKey when
+// `withKey` is true and is empty otherwise.
+func newRemoveFs(t *testing.T, withKey bool) fs.Fs {
+	ctx := context.Background()
+	f, err := cache.Get(ctx, ":local:"+t.TempDir())
+	require.NoError(t, err)
+	if withKey {
+		in := io.NopCloser(strings.NewReader("HELLO"))
+		_, err := operations.RcatSize(ctx, f, "SomeKey", in, 5, time.Now(), nil)
+		require.NoError(t, err)
+	}
+	return f
+}
+
+func TestHandleRemoveSuccess(t *testing.T) {
+	f := newRemoveFs(t, true)
+	reply, err := runRemove(t, &faultyFs{Fs: f, key: "SomeKey"})
+	require.NoError(t, err)
+	require.Equal(t, "REMOVE-SUCCESS SomeKey\n", reply)
+	_, err = f.NewObject(context.Background(), "SomeKey")
+	require.ErrorIs(t, err, fs.ErrorObjectNotFound)
+}
+
+func TestHandleRemoveKeyNotFound(t *testing.T) {
+	reply, err := runRemove(t, &faultyFs{Fs: newRemoveFs(t, false), key: "SomeKey"})
+	require.NoError(t, err)
+	require.Equal(t, "REMOVE-SUCCESS SomeKey\n", reply)
+}
+
+func TestHandleRemoveLookupError(t *testing.T) {
+	lookupErr := errors.New("permission denied")
+	reply, err := runRemove(t, &faultyFs{Fs: newRemoveFs(t, true), key: "SomeKey", lookupErr: lookupErr})
+	require.Equal(t, "REMOVE-FAILURE SomeKey [E003] error getting new fs object: permission denied\n", reply)
+	require.ErrorAs(t, err, new(*ErrTransferFailed))
+	require.ErrorIs(t, err, lookupErr)
+}
+
+func TestHandleRemoveDeleteError(t *testing.T) {
+	f := newRemoveFs(t, true)
+	reply, err := runRemove(t, &faultyFs{Fs: f, key: "SomeKey", removeErr: errors.New("read-only file system")})
+	require.Equal(t, "REMOVE-FAILURE SomeKey [E003] error deleting file\n", reply)
+	require.ErrorAs(t, err, new(*ErrTransferFailed))
+	require.ErrorContains(t, err, `error deleting file: "SomeKey"`)
+	// The key is still there.
+	_, err = f.NewObject(context.Background(), "SomeKey")
+	require.NoError(t, err)
+}
+
+func TestParseRcloneURL(t *testing.T) {
+	for _, tc := range []struct {
+		rawURL     string
+		remoteName string
+		path       string
+		wantErr    string
+	}{
+		{rawURL: "rclone://myremote/prefix/SomeKey", remoteName: "myremote", path: "prefix/SomeKey"},
+		{rawURL: "rclone://myremote/SomeKey", remoteName: "myremote", path: "SomeKey"},
+		{rawURL: "rclone://myremote/a/b/c/SomeKey", remoteName: "myremote", path: "a/b/c/SomeKey"},
+		{rawURL: "https://myremote/prefix/SomeKey", wantErr: `URL scheme must be "rclone": "https://myremote/prefix/SomeKey"`},
+		{rawURL: "myremote:prefix/SomeKey", wantErr: `URL scheme must be "rclone": "myremote:prefix/SomeKey"`},
+		{rawURL: "rclone:///prefix/SomeKey", wantErr: `URL has no remote name: "rclone:///prefix/SomeKey"`},
+		{rawURL: "rclone://myremote", wantErr: `URL has no valid path: "rclone://myremote"`},
+		{rawURL: "rclone://myremote/../SomeKey", wantErr: `URL has no valid path: "rclone://myremote/../SomeKey"`},
+		{rawURL: "rclone://my remote/SomeKey", wantErr: "failed to parse URL"},
+		{rawURL: "rclone://myremote/%zz", wantErr: "failed to parse URL"},
+	} {
+		remoteName, p, err := parseRcloneURL(tc.rawURL)
+		if tc.wantErr != "" {
+			require.ErrorContains(t, err, tc.wantErr, tc.rawURL)
+			continue
+		}
+		require.NoError(t, err, tc.rawURL)
+		require.Equal(t, tc.remoteName, remoteName, tc.rawURL)
+		require.Equal(t, tc.path, p, tc.rawURL)
+	}
+}
+
+func TestClaimURL(t *testing.T) {
+	h := makeTestState(t)
+	h.remoteName = "myremote:"
+	h.remotePrefix = "prefix/annex"
+	h.preconfigureServer()
+
+	serverErrorChan := make(chan error)
+	go func() {
+		serverErrorChan <- h.server.run()
+	}()
+
+	h.requireReadLineExact("VERSION 1")
+	for _, tc := range []struct {
+		rawURL string
+		want   string
+	}{
+		{"rclone://myremote/prefix/annex/SomeKey", "CLAIMURL-SUCCESS"},
+		{"rclone://myremote/prefix/annex/", "CLAIMURL-FAILURE"},
+		{"rclone://otherremote/prefix/annex/SomeKey", "CLAIMURL-FAILURE"},
+		{"rclone://myremote/prefix/SomeKey", "CLAIMURL-FAILURE"},
+		{"rclone://myremote/prefix/annex/extra/SomeKey", "CLAIMURL-FAILURE"},
+		{"https://myremote/prefix/annex/SomeKey", "CLAIMURL-FAILURE"},
+		{"rclone://myremote/%zz", "CLAIMURL-FAILURE"},
+	} {
+		h.requireWriteLine("CLAIMURL " + tc.rawURL)
+		h.requireReadLineExact(tc.want)
+	}
+	require.NoError(t, h.mockStdinW.Close())
+	require.NoError(t, <-serverErrorChan)
+}
+
+func TestNamespaceConfig(t *testing.T) {
+	for _, tc := range []struct {
+		value   string
+		wantErr bool
+	}{
+		{value: ""},
+		{value: "team-a"},
+		{value: "Team_B-2"},
+		{value: "team/a", wantErr: true},
+		{value: "..", wantErr: true},
+		{value: "team a", wantErr: true},
+		{value: "équipe", wantErr: true},
+	} {
+		_, err := parseNamespace(tc.value)
+		if tc.wantErr {
+			require.EqualError(t, err, fmt.Sprintf(`namespace may only contain letters, digits, "_", and "-": %q`, tc.value))
+		} else {
+			require.NoError(t, err, tc.value)
+		}
+	}
+
+	localPath := filepath.Join(t.TempDir(), "file.txt")
+	require.NoError(t, os.WriteFile(localPath, []byte("HELLO"), 0600))
+	remotePrefix := "namespaces-" + random.String(8)
+
+	// session runs a server in `namespace`, sending each request and
+	// expecting the matching reply.
+	session := func(namespace string, exchanges ...[2]string) error {
+		h := makeTestState(t)
+		h.remoteName = ":memory:"
+		h.remotePrefix = remotePrefix
+		h.preconfigureServer()
+		h.server.configRcloneNamespace = namespace
+
+		serverErrorChan := make(chan error)
+		go func() {
+			serverErrorChan <- h.server.run()
+		}()
+
+		h.requireReadLineExact("VERSION 1")
+		for _, exchange := range exchanges {
+			h.requireWriteLine(exchange[0])
+			h.requireReadLineExact(exchange[1])
+		}
+		require.NoError(t, h.mockStdinW.Close())
+		return <-serverErrorChan
+	}
+
+	require.NoError(t, session("team-a",
+		[2]string{"TRANSFER STORE KeyA " + localPath, "TRANSFER-SUCCESS STORE KeyA"},
+		[2]string{"CHECKPRESENT KeyA", "CHECKPRESENT-SUCCESS KeyA"},
+	))
+	require.NoError(t, session("team-b",
+		[2]string{"CHECKPRESENT KeyA", "CHECKPRESENT-FAILURE KeyA"},
+		[2]string{"TRANSFER STORE KeyB " + localPath, "TRANSFER-SUCCESS STORE KeyB"},
+		[2]string{"CHECKPRESENT KeyB", "CHECKPRESENT-SUCCESS KeyB"},
+	))
+	require.NoError(t, session("team-a",
+		[2]string{"CHECKPRESENT KeyB", "CHECKPRESENT-FAILURE KeyB"},
+	))
+	// Without a namespace, neither key is in the prefix directory.
+	require.NoError(t, session("",
+		[2]string{"CHECKPRESENT KeyA", "CHECKPRESENT-FAILURE KeyA"},
+		[2]string{"CHECKPRESENT KeyB", "CHECKPRESENT-FAILURE KeyB"},
+	))
+
+	ctx := context.Background()
+	for _, want := range []string{"team-a/" + remotePrefix + "/KeyA", "team-b/" + remotePrefix + "/KeyB"} {
+		f, err := cache.Get(ctx, ":memory:"+path.Dir(want))
+		require.NoError(t, err)
+		_, err = f.NewObject(ctx, path.Base(want))
+		require.NoError(t, err, want)
+	}
+
+	t.Run("Invalid", func(t *testing.T) {
+		h := makeTestState(t)
+		serverErrorChan := make(chan error)
+		go func() {
+			serverErrorChan <- h.server.run()
+		}()
+		h.requireReadLineExact("VERSION 1")
+		h.requireWriteLine("PREPARE")
+		require.Equal(t, "PREPARE-FAILURE [E001] Error getting configs\n", h.answerConfigs(map[string]string{
+			"rcloneremotename": ":memory:",
+			"rclonenamespace":  "team/a",
+		}))
+		require.NoError(t, h.mockStdinW.Close())
+		err := <-serverErrorChan
+		require.ErrorAs(t, err, new(*ErrConfigMissing))
+		require.ErrorContains(t, err, "namespace may only contain")
 	})
 }
 
-type testCase struct {
-	label            string
-	testProtocolFunc func(*testing.T, *testState)
-	expectedError    string
+// linkFs wraps an Fs to make canned public links, like a backend with the
+// PublicLink feature.
+type linkFs struct {
+	fs.Fs
+}
+
+func (f *linkFs) Features() *fs.Features {
+	return (&fs.Features{}).Fill(context.Background(), f)
+}
+
+func (f *linkFs) PublicLink(ctx context.Context, remote string, expire fs.Duration, unlink bool) (string, error) {
+	return "https://example.com/share/" + remote, nil
+}
+
+func TestWhereisPublicLinks(t *testing.T) {
+	localPath := filepath.Join(t.TempDir(), "file.txt")
+	require.NoError(t, os.WriteFile(localPath, []byte("HELLO"), 0600))
+
+	for _, tc := range []struct {
+		label       string
+		publicLinks string
+		withLinks   bool
+		key         string
+		want        string
+	}{
+		{label: "Disabled", publicLinks: "no", withLinks: true, key: "SomeKey", want: "UNSUPPORTED-REQUEST"},
+		{label: "Enabled", publicLinks: "yes", withLinks: true, key: "SomeKey", want: "WHEREIS-SUCCESS https://example.com/share/SomeKey"},
+		{label: "MissingKey", publicLinks: "yes", withLinks: true, key: "OtherKey", want: "WHEREIS-FAILURE"},
+		{label: "NoLinkSupport", publicLinks: "yes", withLinks: false, key: "SomeKey", want: "WHEREIS-FAILURE"},
+	} {
+		t.Run(tc.label, func(t *testing.T) {
+			h := makeTestState(t)
+			h.remoteName = ":memory:"
+			h.remotePrefix = "whereis-" + random.String(8)
+			h.preconfigureServer()
+			h.server.configRclonePublicLinks = tc.publicLinks
+			h.server.getFs = func(ctx context.Context, fsString string) (fs.Fs, error) {
+				f, err := cache.Get(ctx, fsString)
+				if err != nil || !tc.withLinks {
+					return f, err
+				}
+				return &linkFs{Fs: f}, nil
+			}
+
+			serverErrorChan := make(chan error)
+			go func() {
+				serverErrorChan <- h.server.run()
+			}()
+
+			h.requireReadLineExact("VERSION 1")
+			h.requireWriteLine("TRANSFER STORE SomeKey " + localPath)
+			h.requireReadLineExact("TRANSFER-SUCCESS STORE SomeKey")
+			h.requireWriteLine("WHEREIS " + tc.key)
+			h.requireReadLineExact(tc.want)
+			require.NoError(t, h.mockStdinW.Close())
+			require.NoError(t, <-serverErrorChan)
+		})
+	}
+}
+
+// TestLogLevelConfig checks that the "rcloneloglevel" config makes rclone log
+// at the requested level for the duration of the session.
+func TestLogLevelConfig(t *testing.T) {
+	ci := fs.GetConfig(context.Background())
+	originalLogLevel := ci.LogLevel
+	require.NotEqual(t, fs.LogLevelDebug, originalLogLevel)
+
+	var mu sync.Mutex
+	var debugLines []string
+	originalLogOutput := fs.LogOutput
+	fs.LogOutput = func(level fs.LogLevel, text string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if level == fs.LogLevelDebug {
+			debugLines = append(debugLines, text)
+		}
+	}
+	t.Cleanup(func() { fs.LogOutput = originalLogOutput })
+
+	localPath := filepath.Join(t.TempDir(), "file.txt")
+	require.NoError(t, os.WriteFile(localPath, []byte("HELLO"), 0600))
+
+	h := makeTestState(t)
+	h.remoteName = ":local:"
+	h.remotePrefix = t.TempDir()
+	h.preconfigureServer()
+	h.server.configRcloneLogLevel = "DEBUG"
+
+	serverErrorChan := make(chan error)
+	go func() {
+		serverErrorChan <- h.server.run()
+	}()
+
+	h.requireReadLineExact("VERSION 1")
+	h.requireWriteLine("PREPARE")
+	h.requireReadLineExactAfterConfigs("PREPARE-SUCCESS")
+	require.Equal(t, fs.LogLevelDebug, ci.LogLevel)
+
+	h.requireWriteLine("TRANSFER STORE SomeKey " + localPath)
+	h.requireReadLineExact("TRANSFER-SUCCESS STORE SomeKey")
+
+	require.NoError(t, h.mockStdinW.Close())
+	require.NoError(t, <-serverErrorChan)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.NotEmpty(t, debugLines, "expected debug output during TRANSFER")
+	require.Equal(t, originalLogLevel, ci.LogLevel, "log level should be restored when the session ends")
+}
+
+// TestDebugHTTPConfig checks that the "rclonedebughttp" config logs HTTP
+// requests without their credentials.
+func TestDebugHTTPConfig(t *testing.T) {
+	ci := fs.GetConfig(context.Background())
+	originalLogLevel, originalDump := ci.LogLevel, ci.Dump
+
+	var mu sync.Mutex
+	var debugLines []string
+	originalLogOutput := fs.LogOutput
+	fs.LogOutput = func(level fs.LogLevel, text string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if level == fs.LogLevelDebug {
+			debugLines = append(debugLines, text)
+		}
+	}
+	t.Cleanup(func() { fs.LogOutput = originalLogOutput })
+
+	localPath := filepath.Join(t.TempDir(), "file.txt")
+	require.NoError(t, os.WriteFile(localPath, []byte("HELLO"), 0600))
+	srv := httptest.NewServer(newFakeS3())
+	t.Cleanup(srv.Close)
+
+	h := makeTestState(t)
+	h.remoteName = fmt.Sprintf(":s3,provider=Other,endpoint=%s,force_path_style=true,access_key_id=x,secret_access_key=y,session_token=TOKEN-SECRET,no_check_bucket=true:", quoteConfigValue(srv.URL))
+	h.remotePrefix = "bucket/annex"
+	h.preconfigureServer()
+	h.server.configRcloneDebugHTTP = "yes"
+
+	serverErrorChan := make(chan error)
+	go func() {
+		serverErrorChan <- h.server.run()
+	}()
+
+	h.requireReadLineExact("VERSION 1")
+	h.requireWriteLine("PREPARE")
+	h.requireReadLineExactAfterConfigs("PREPARE-SUCCESS")
+	require.Equal(t, fs.LogLevelDebug, ci.LogLevel)
+	require.NotZero(t, ci.Dump&fs.DumpHeaders)
+
+	h.requireWriteLine("TRANSFER STORE SomeKey " + localPath)
+	h.requireReadLineExact("TRANSFER-SUCCESS STORE SomeKey")
+	require.NoError(t, h.mockStdinW.Close())
+	require.NoError(t, <-serverErrorChan)
+
+	require.Equal(t, originalLogLevel, ci.LogLevel, "log level should be restored when the session ends")
+	require.Equal(t, originalDump, ci.Dump, "dump flags should be restored when the session ends")
+
+	mu.Lock()
+	defer mu.Unlock()
+	output := strings.Join(debugLines, "\n")
+	require.Contains(t, output, "HTTP REQUEST")
+	require.Contains(t, output, "PUT /bucket/annex/SomeKey")
+	require.Contains(t, output, "Authorization: XXXX")
+	require.Contains(t, output, "X-Amz-Security-Token: XXXX")
+	require.NotContains(t, output, "Credential=x/")
+	require.NotContains(t, output, "X-Amz-Security-Token: TOKEN-SECRET")
 }
 
-// These test cases run against a backend selected by the `-remote` flag.
-var fstestTestCases = []testCase{
-	{
-		label: "HandlesInit",
-		testProtocolFunc: func(t *testing.T, h *testState) {
-			h.preconfigureServer()
+// failNamedPutFs wraps an Fs whose uploads of `remote` fail.
+type failNamedPutFs struct {
+	fs.Fs
+	remote string
+}
 
-			h.requireReadLineExact("VERSION 1")
-			h.requireWriteLine("INITREMOTE")
-			h.requireReadLineExact("INITREMOTE-SUCCESS")
+func (f *failNamedPutFs) Put(ctx context.Context, in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) (fs.Object, error) {
+	if src.Remote() == f.remote {
+		return nil, errors.New("upload failed")
+	}
+	return f.Fs.Put(ctx, in, src, options...)
+}
 
-			require.NoError(t, h.mockStdinW.Close())
-		},
-	},
-	{
-		label: "HandlesListConfigs",
-		testProtocolFunc: func(t *testing.T, h *testState) {
-			h.preconfigureServer()
+// TestChunkManifest checks that a key stored in chunks is only present once
+// its manifest has been written, and that only the chunks the manifest lists
+// make up its content.
+func TestChunkManifest(t *testing.T) {
+	ctx := context.Background()
+	const key = "SHA256E-s8--chunked"
+	dir := t.TempDir()
+	longPath := filepath.Join(dir, "long.txt")
+	require.NoError(t, os.WriteFile(longPath, []byte("01234567"), 0600))
+	shortPath := filepath.Join(dir, "short.txt")
+	require.NoError(t, os.WriteFile(shortPath, []byte("ABCD"), 0600))
+
+	t.Run("ChunksWithoutManifestAreAbsent", func(t *testing.T) {
+		remoteFs, err := cache.Get(ctx, ":memory:manifest-"+random.String(8))
+		require.NoError(t, err)
+		for i := range 2 {
+			_, err := operations.Rcat(ctx, remoteFs, chunkName(key, i), io.NopCloser(strings.NewReader("0123")), time.Now(), nil)
+			require.NoError(t, err)
+		}
+		require.ErrorIs(t, findKey(ctx, remoteFs, key), fs.ErrorObjectNotFound)
+		require.ErrorIs(t, retrieveChunked(ctx, remoteFs, key, filepath.Join(t.TempDir(), "out"), int(minCopyBufferSize)), fs.ErrorObjectNotFound)
+	})
 
-			h.requireReadLineExact("VERSION 1")
-			h.requireWriteLine("INITREMOTE")
-			h.requireReadLineExact("INITREMOTE-SUCCESS")
+	t.Run("FailedStoreRemovesChunks", func(t *testing.T) {
+		memoryFs, err := cache.Get(ctx, ":memory:manifest-"+random.String(8))
+		require.NoError(t, err)
+		remoteFs := &failNamedPutFs{Fs: memoryFs, remote: chunkName(key, 2)}
+		require.ErrorContains(t, storeChunked(ctx, remoteFs, key, longPath, 2), "failed to upload chunk 2")
+		require.ErrorIs(t, findKey(ctx, remoteFs, key), fs.ErrorObjectNotFound)
+		for i := range 2 {
+			_, err := remoteFs.NewObject(ctx, chunkName(key, i))
+			require.ErrorIs(t, err, fs.ErrorObjectNotFound)
+		}
+	})
 
-			h.requireWriteLine("LISTCONFIGS")
+	t.Run("StaleChunksAreRemoved", func(t *testing.T) {
+		remoteFs, err := cache.Get(ctx, ":memory:manifest-"+random.String(8))
+		require.NoError(t, err)
+		require.NoError(t, storeChunked(ctx, remoteFs, key, longPath, 2))
+		require.NoError(t, storeChunked(ctx, remoteFs, key, shortPath, 2))
+		_, err = remoteFs.NewObject(ctx, chunkName(key, 2))
+		require.ErrorIs(t, err, fs.ErrorObjectNotFound)
+		size, err := storedKeySize(ctx, remoteFs, key)
+		require.NoError(t, err)
+		require.Equal(t, int64(4), size)
 
-			require.Regexp(t,
-				regexp.MustCompile(`^CONFIG rcloneremotename \(synonyms: target\) (.|\n)*$`),
-				h.requireReadLine(),
-			)
-			require.Regexp(t,
-				regexp.MustCompile(`^CONFIG rcloneprefix \(synonyms: prefix\) (.|\n)*$`),
-				h.requireReadLine(),
-			)
-			require.Regexp(t,
-				regexp.MustCompile(`^CONFIG rclonelayout \(synonyms: rclone_layout\) (.|\n)*$`),
-				h.requireReadLine(),
-			)
-			h.requireReadLineExact("CONFIGEND")
+		retrievedPath := filepath.Join(t.TempDir(), "retrieved.txt")
+		require.NoError(t, retrieveChunked(ctx, remoteFs, key, retrievedPath, int(minCopyBufferSize)))
+		retrieved, err := os.ReadFile(retrievedPath)
+		require.NoError(t, err)
+		require.Equal(t, "ABCD", string(retrieved))
+	})
+}
 
-			require.NoError(t, h.mockStdinW.Close())
-		},
-	},
-	{
-		label: "HandlesPrepare",
-		testProtocolFunc: func(t *testing.T, h *testState) {
-			h.requireReadLineExact("VERSION 1")
-			h.requireWriteLine("EXTENSIONS INFO") // Advertise that we support the INFO extension
-			h.requireReadLineExact("EXTENSIONS")
+// TestResumeTransferConfig checks that the "rcloneresumetransfer" config makes
+// an interrupted chunked store resume after its last stored chunk.
+func TestResumeTransferConfig(t *testing.T) {
+	ctx := context.Background()
+	const chunkSize = 1024
+	contents := bytes.Repeat([]byte("0123456789"), 350)
+	localPath := filepath.Join(t.TempDir(), "file.txt")
+	require.NoError(t, os.WriteFile(localPath, contents, 0600))
+	const key = "SHA256E-s3500--resumed"
+
+	// A fresh store uploads the whole file and leaves no partial object.
+	freshDir := t.TempDir()
+	freshFs, err := cache.Get(ctx, ":local:"+freshDir)
+	require.NoError(t, err)
+	sent, err := storeResumable(ctx, freshFs, key, localPath, chunkSize, int64(len(contents)))
+	require.NoError(t, err)
+	require.Equal(t, int64(len(contents)), sent)
+	require.NoFileExists(t, filepath.Join(freshDir, partialName(key)))
+
+	// Interrupt a store after its second chunk.
+	remoteDir := t.TempDir()
+	remoteFs, err := cache.Get(ctx, ":local:"+remoteDir)
+	require.NoError(t, err)
+	errInterrupted := errors.New("interrupted")
+	_, err = storeChunkedFrom(ctx, remoteFs, key, localPath, chunkSize, 0, func(offset int64) error {
+		if err := writeResumeOffset(ctx, remoteFs, key, offset); err != nil {
+			return err
+		}
+		if offset == 2*chunkSize {
+			return errInterrupted
+		}
+		return nil
+	})
+	require.ErrorIs(t, err, errInterrupted)
+	require.FileExists(t, filepath.Join(remoteDir, partialName(key)))
+	require.NoFileExists(t, filepath.Join(remoteDir, chunkName(key, 2)))
+
+	// The key stays absent while the partial object exists, even when a
+	// manifest was written before the store was interrupted.
+	require.NoError(t, writeChunkManifest(ctx, remoteFs, key, chunkManifest{count: 2, size: 2 * chunkSize}, time.Now()))
+	require.ErrorIs(t, findKey(ctx, remoteFs, key), fs.ErrorObjectNotFound)
+	require.ErrorIs(t, findKeyIgnoringCase(ctx, remoteFs, key, nil), fs.ErrorObjectNotFound)
+	warmed := warmPresentKeysCache(ctx, remoteFs, nil)
+	<-warmed.done
+	require.False(t, warmed.has(key))
+
+	// The resumed store only uploads the rest.
+	sent, err = storeResumable(ctx, remoteFs, key, localPath, chunkSize, int64(len(contents)))
+	require.NoError(t, err)
+	require.Equal(t, int64(len(contents)-2*chunkSize), sent)
+	require.Less(t, sent, int64(len(contents)))
+	require.NoFileExists(t, filepath.Join(remoteDir, partialName(key)))
+
+	retrievedPath := filepath.Join(t.TempDir(), "retrieved.txt")
+	require.NoError(t, retrieveChunked(ctx, remoteFs, key, retrievedPath, int(defaultCopyBufferSize)))
+	retrieved, err := os.ReadFile(retrievedPath)
+	require.NoError(t, err)
+	require.Equal(t, contents, retrieved)
+
+	// An offset whose last chunk is missing cannot be trusted.
+	require.NoError(t, writeResumeOffset(ctx, remoteFs, "SHA256E-s3500--other", 2*chunkSize))
+	offset, err := readResumeOffset(ctx, remoteFs, "SHA256E-s3500--other", chunkSize, int64(len(contents)))
+	require.NoError(t, err)
+	require.Zero(t, offset)
+
+	// Through the protocol, the config resumes an interrupted store.
+	_, err = storeChunkedFrom(ctx, remoteFs, "SomeKey", localPath, chunkSize, 0, func(offset int64) error {
+		if err := writeResumeOffset(ctx, remoteFs, "SomeKey", offset); err != nil {
+			return err
+		}
+		return errInterrupted
+	})
+	require.ErrorIs(t, err, errInterrupted)
+	// Mark the stored chunk, so that uploading it again would show.
+	marker := bytes.Repeat([]byte("X"), chunkSize)
+	require.NoError(t, os.WriteFile(filepath.Join(remoteDir, chunkName("SomeKey", 0)), marker, 0600))
+
+	h := makeTestState(t)
+	h.remoteName = ":local:"
+	h.remotePrefix = remoteDir
+	h.preconfigureServer()
+	h.server.configRcloneChunkSize = "1K"
+	h.server.configRcloneResumeTransfer = "yes"
+
+	serverErrorChan := make(chan error)
+	go func() {
+		serverErrorChan <- h.server.run()
+	}()
 
-			require.True(t, h.server.extensionInfo)
+	h.requireReadLineExact("VERSION 1")
+	h.requireWriteLine("TRANSFER STORE SomeKey " + localPath)
+	h.requireReadLineExact("TRANSFER-SUCCESS STORE SomeKey")
+	require.NoError(t, h.mockStdinW.Close())
+	require.NoError(t, <-serverErrorChan)
 
-			h.requireWriteLine("PREPARE")
-			h.requireReadLineExact("GETCONFIG rcloneremotename")
-			h.requireWriteLine("VALUE " + h.remoteName)
-			h.requireReadLineExact("GETCONFIG rcloneprefix")
-			h.requireWriteLine("VALUE " + h.remotePrefix)
-			h.requireReadLineExact("GETCONFIG rclonelayout")
-			h.requireWriteLine("VALUE frankencase")
-			h.requireReadLineExact("PREPARE-SUCCESS")
+	require.NoFileExists(t, filepath.Join(remoteDir, partialName("SomeKey")))
+	for i := 0; i < 4; i++ {
+		require.FileExists(t, filepath.Join(remoteDir, chunkName("SomeKey", i)))
+	}
+	firstChunk, err := os.ReadFile(filepath.Join(remoteDir, chunkName("SomeKey", 0)))
+	require.NoError(t, err)
+	require.Equal(t, marker, firstChunk, "first chunk should not be uploaded again")
+}
 
-			require.Equal(t, h.server.configRcloneRemoteName, h.remoteName)
-			require.Equal(t, h.server.configPrefix, h.remotePrefix)
-			require.True(t, h.server.configsDone)
+// TestEncryptConfig checks that the "rcloneencrypt" config encrypts the names
+// and contents of stored objects, which can only be read back with the same
+// password.
+func TestEncryptConfig(t *testing.T) {
+	const contents = "SECRET CONTENTS"
+
+	for _, mode := range []layoutMode{layoutModeNodir, layoutModeMixed} {
+		t.Run(string(mode), func(t *testing.T) {
+			localDir := t.TempDir()
+			localPath := filepath.Join(localDir, "file.txt")
+			require.NoError(t, os.WriteFile(localPath, []byte(contents), 0600))
+			remoteDir := t.TempDir()
+
+			// startSession starts a server that uses `password` and returns a
+			// function that ends the session.
+			startSession := func(password string) (*testState, func()) {
+				h := makeTestState(t)
+				h.remoteName = ":local:"
+				h.remotePrefix = remoteDir
+				h.preconfigureServer()
+				h.server.configRcloneLayout = string(mode)
+				h.server.configRcloneEncrypt = password
+
+				serverErrorChan := make(chan error)
+				go func() {
+					serverErrorChan <- h.server.run()
+				}()
+				h.requireReadLineExact("VERSION 1")
+				return &h, func() {
+					require.NoError(t, h.mockStdinW.Close())
+					require.NoError(t, <-serverErrorChan)
+				}
+			}
+
+			// requireReadLineAfterDirhash answers any DIRHASH query before
+			// requiring `wantLine`.
+			requireReadLineAfterDirhash := func(h *testState, wantLine string) {
+				line := h.requireReadLine()
+				if strings.HasPrefix(line, "DIRHASH ") {
+					h.requireWriteLine("VALUE Xq/3v/")
+					line = h.requireReadLine()
+				}
+				require.Equal(t, wantLine+"\n", line)
+			}
+
+			h, endSession := startSession("correct horse")
+			h.requireWriteLine("TRANSFER STORE SomeKey " + localPath)
+			requireReadLineAfterDirhash(h, "TRANSFER-SUCCESS STORE SomeKey")
+			endSession()
+
+			// Neither the key nor the contents appear in the remote directory.
+			require.Equal(t, 1, countFilesRecursively(t, remoteDir))
+			require.False(t, findFileWithContents(t, remoteDir, []byte(contents)))
+			require.NoError(t, filepath.WalkDir(remoteDir, func(path string, d os.DirEntry, err error) error {
+				require.NoError(t, err)
+				require.NotContains(t, d.Name(), "SomeKey")
+				return nil
+			}))
+
+			// The object cannot be found without the password or with the
+			// wrong one.
+			for _, password := range []string{"", "wrong password"} {
+				h, endSession = startSession(password)
+				h.requireWriteLine("CHECKPRESENT SomeKey")
+				requireReadLineAfterDirhash(h, "CHECKPRESENT-FAILURE SomeKey")
+				endSession()
+			}
+
+			// The right password restores the original bytes.
+			retrievedPath := filepath.Join(localDir, "retrieved.txt")
+			h, endSession = startSession("correct horse")
+			h.requireWriteLine("TRANSFER RETRIEVE SomeKey " + retrievedPath)
+			requireReadLineAfterDirhash(h, "TRANSFER-SUCCESS RETRIEVE SomeKey")
+			endSession()
+
+			retrieved, err := os.ReadFile(retrievedPath)
+			require.NoError(t, err)
+			require.Equal(t, contents, string(retrieved))
+		})
+	}
+}
 
+// TestEncryptPasswordInCreds checks that INITREMOTE moves the "rcloneencrypt"
+// password out of the git-annex branch into git-annex's creds, from which
+// later sessions read it.
+func TestEncryptPasswordInCreds(t *testing.T) {
+	const contents = "SECRET CONTENTS"
+	localPath := filepath.Join(t.TempDir(), "file.txt")
+	require.NoError(t, os.WriteFile(localPath, []byte(contents), 0600))
+	remoteDir := t.TempDir()
+
+	// startSession starts a server and returns a function that ends the
+	// session.
+	startSession := func() (*testState, func() error) {
+		h := makeTestState(t)
+		serverErrorChan := make(chan error)
+		go func() {
+			serverErrorChan <- h.server.run()
+		}()
+		h.requireReadLineExact("VERSION 1")
+		return &h, func() error {
 			require.NoError(t, h.mockStdinW.Close())
-		},
-	},
-	{
-		label: "HandlesPrepareWithUnknownLayout",
-		testProtocolFunc: func(t *testing.T, h *testState) {
-			h.requireReadLineExact("VERSION 1")
-			h.requireWriteLine("EXTENSIONS INFO") // Advertise that we support the INFO extension
-			h.requireReadLineExact("EXTENSIONS")
+			return <-serverErrorChan
+		}
+	}
 
-			require.True(t, h.server.extensionInfo)
+	h, endSession := startSession()
+	h.requireWriteLine("INITREMOTE")
+	line := h.answerConfigs(map[string]string{
+		"rcloneremotename": ":local:",
+		"rcloneprefix":     remoteDir,
+		"rcloneencrypt":    "correct horse",
+	})
+	require.Equal(t, "SETCREDS rcloneencrypt rclone correct horse\n", line)
+	h.requireReadLineExact("SETCONFIG rcloneencrypt creds")
+	h.requireReadLineExact("INITREMOTE-SUCCESS")
+	require.NoError(t, endSession())
+
+	h, endSession = startSession()
+	h.requireWriteLine("PREPARE")
+	line = h.answerConfigs(map[string]string{
+		"rcloneremotename": ":local:",
+		"rcloneprefix":     remoteDir,
+		"rcloneencrypt":    "creds",
+	})
+	require.Equal(t, "GETCREDS rcloneencrypt\n", line)
+	h.requireWriteLine("CREDS rclone correct horse")
+	h.requireReadLineExactAfterConfigs("PREPARE-SUCCESS")
+	require.Equal(t, "correct horse", h.server.configRcloneEncrypt)
+	h.requireWriteLine("TRANSFER STORE SomeKey " + localPath)
+	h.requireReadLineExact("TRANSFER-SUCCESS STORE SomeKey")
+	require.NoError(t, endSession())
+	require.False(t, findFileWithContents(t, remoteDir, []byte(contents)))
+
+	// Without creds, e.g. in a clone that has not enabled the remote with the
+	// password, the session cannot start.
+	h, endSession = startSession()
+	h.requireWriteLine("PREPARE")
+	line = h.answerConfigs(map[string]string{
+		"rcloneremotename": ":local:",
+		"rcloneprefix":     remoteDir,
+		"rcloneencrypt":    "creds",
+	})
+	require.Equal(t, "GETCREDS rcloneencrypt\n", line)
+	h.requireWriteLine("CREDS  ")
+	h.requireReadLineExact("PREPARE-FAILURE [E001] Error getting configs")
+	require.ErrorContains(t, endSession(), "the rcloneencrypt password is not in git-annex's creds")
+}
 
-			h.requireWriteLine("PREPARE")
-			h.requireReadLineExact("GETCONFIG rcloneremotename")
-			h.requireWriteLine("VALUE " + h.remoteName)
-			h.requireReadLineExact("GETCONFIG rcloneprefix")
-			h.requireWriteLine("VALUE " + h.remotePrefix)
-			h.requireReadLineExact("GETCONFIG rclonelayout")
-			h.requireWriteLine("VALUE nonexistentLayoutMode")
-			h.requireReadLineExact("PREPARE-SUCCESS")
+func TestSanitizeGitRemoteName(t *testing.T) {
+	require.Equal(t, "origin", sanitizeGitRemoteName("origin"))
+	require.Equal(t, "My_Remote", sanitizeGitRemoteName("My Remote"))
+	require.Equal(t, "a_b_c_d", sanitizeGitRemoteName("a/b\\c\td"))
+}
 
-			require.Equal(t, h.server.configRcloneRemoteName, h.remoteName)
-			require.Equal(t, h.server.configPrefix, h.remotePrefix)
-			require.True(t, h.server.configsDone)
+func TestDefaultPrefixIncorporatesGitRemoteName(t *testing.T) {
+	suffix := random.String(8)
 
-			h.requireWriteLine("INITREMOTE")
-			h.requireReadLineExact("INITREMOTE-FAILURE unknown layout mode: nonexistentLayoutMode")
+	t.Run("WithGetGitRemoteName", func(t *testing.T) {
+		h := makeTestState(t)
+		serverErrorChan := make(chan error)
+		go func() {
+			serverErrorChan <- h.server.run()
+		}()
+
+		h.requireReadLineExact("VERSION 1")
+		h.requireWriteLine("EXTENSIONS GETGITREMOTENAME")
+		h.requireReadLineExact("EXTENSIONS GETGITREMOTENAME")
+		h.requireWriteLine("INITREMOTE")
+		require.Equal(t, "GETGITREMOTENAME\n", h.answerConfigs(map[string]string{"rcloneremotename": ":memory:"}))
+		h.requireWriteLine("VALUE My Remote/" + suffix)
+
+		wantPrefix := "git-annex-rclone/My_Remote_" + suffix
+		h.requireReadLineExactAfterConfigs("SETCONFIG rcloneprefix " + wantPrefix)
+		h.requireReadLineExact("INITREMOTE-SUCCESS")
+		require.Equal(t, wantPrefix, h.server.configPrefix)
+		require.Equal(t, defaultRclonePrefix, h.server.legacyPrefix)
+
+		require.NoError(t, h.mockStdinW.Close())
+		require.NoError(t, <-serverErrorChan)
+	})
 
-			require.NoError(t, h.mockStdinW.Close())
-		},
-		expectedError: "unknown layout mode: nonexistentLayoutMode",
-	},
-	{
-		label: "HandlesPrepareWithNonexistentRemote",
-		testProtocolFunc: func(t *testing.T, h *testState) {
-			h.requireReadLineExact("VERSION 1")
-			h.requireWriteLine("EXTENSIONS INFO") // Advertise that we support the INFO extension
-			h.requireReadLineExact("EXTENSIONS")
+	t.Run("WithoutGetGitRemoteName", func(t *testing.T) {
+		h := makeTestState(t)
+		serverErrorChan := make(chan error)
+		go func() {
+			serverErrorChan <- h.server.run()
+		}()
+
+		h.requireReadLineExact("VERSION 1")
+		h.requireWriteLine("PREPARE")
+		require.Equal(t, "PREPARE-SUCCESS\n", h.answerConfigs(map[string]string{"rcloneremotename": ":memory:"}))
+		require.Equal(t, defaultRclonePrefix, h.server.configPrefix)
+		require.Empty(t, h.server.legacyPrefix)
+
+		require.NoError(t, h.mockStdinW.Close())
+		require.NoError(t, <-serverErrorChan)
+	})
+}
 
-			require.True(t, h.server.extensionInfo)
+func TestLegacyPrefixFallback(t *testing.T) {
+	ctx := context.Background()
+	const contents = "LEGACY CONTENTS"
+	key := "LegacyKey-" + random.String(8)
+
+	// Store the key under the old default prefix, as an older version would.
+	legacyFsString, err := buildFsString(nil, layoutModeNodir, "", ":memory:", defaultRclonePrefix)
+	require.NoError(t, err)
+	legacyFs, err := cache.Get(ctx, legacyFsString)
+	require.NoError(t, err)
+	in := io.NopCloser(strings.NewReader(contents))
+	_, err = operations.Rcat(ctx, legacyFs, key, in, time.Now(), nil)
+	require.NoError(t, err)
+
+	h := makeTestState(t)
+	serverErrorChan := make(chan error)
+	go func() {
+		serverErrorChan <- h.server.run()
+	}()
 
-			h.requireWriteLine("PREPARE")
-			h.requireReadLineExact("GETCONFIG rcloneremotename")
-			h.requireWriteLine("VALUE thisRemoteDoesNotExist")
-			h.requireReadLineExact("GETCONFIG rcloneprefix")
-			h.requireWriteLine("VALUE " + h.remotePrefix)
-			h.requireReadLineExact("GETCONFIG rclonelayout")
-			h.requireWriteLine("VALUE frankencase")
-			h.requireReadLineExact("PREPARE-SUCCESS")
+	h.requireReadLineExact("VERSION 1")
+	h.requireWriteLine("EXTENSIONS GETGITREMOTENAME")
+	h.requireReadLineExact("EXTENSIONS GETGITREMOTENAME")
+	h.requireWriteLine("PREPARE")
+	require.Equal(t, "GETGITREMOTENAME\n", h.answerConfigs(map[string]string{"rcloneremotename": ":memory:"}))
+	h.requireWriteLine("VALUE origin-" + random.String(8))
+	h.requireReadLineExactAfterConfigs("PREPARE-SUCCESS")
+	require.NotEqual(t, defaultRclonePrefix, h.server.configPrefix)
+
+	h.requireWriteLine("CHECKPRESENT " + key)
+	h.requireReadLineExact("CHECKPRESENT-SUCCESS " + key)
+
+	retrievedPath := filepath.Join(t.TempDir(), "retrieved.txt")
+	h.requireWriteLine("TRANSFER RETRIEVE " + key + " " + retrievedPath)
+	h.requireReadLineExact("TRANSFER-SUCCESS RETRIEVE " + key)
+	retrieved, err := os.ReadFile(retrievedPath)
+	require.NoError(t, err)
+	require.Equal(t, contents, string(retrieved))
+
+	h.requireWriteLine("CHECKPRESENT KeyThatDoesNotExist")
+	h.requireReadLineExact("CHECKPRESENT-FAILURE KeyThatDoesNotExist")
+
+	// Removing the key deletes it from the old default prefix too, so it is
+	// no longer reported present.
+	h.requireWriteLine("REMOVE " + key)
+	h.requireReadLineExact("REMOVE-SUCCESS " + key)
+	h.requireWriteLine("CHECKPRESENT " + key)
+	h.requireReadLineExact("CHECKPRESENT-FAILURE " + key)
+	_, err = legacyFs.NewObject(ctx, key)
+	require.ErrorIs(t, err, fs.ErrorObjectNotFound)
+
+	require.NoError(t, h.mockStdinW.Close())
+	require.NoError(t, <-serverErrorChan)
+}
 
-			require.Equal(t, h.server.configRcloneRemoteName, "thisRemoteDoesNotExist")
-			require.Equal(t, h.server.configPrefix, h.remotePrefix)
-			require.True(t, h.server.configsDone)
+func TestSessionSummary(t *testing.T) {
+	localDir := t.TempDir()
+	smallPath := filepath.Join(localDir, "small.txt")
+	require.NoError(t, os.WriteFile(smallPath, []byte("HELLO"), 0600))
+	largePath := filepath.Join(localDir, "large.txt")
+	require.NoError(t, os.WriteFile(largePath, []byte(random.String(3*1024*1024)), 0600))
 
-			h.requireWriteLine("INITREMOTE")
-			h.requireReadLineExact("INITREMOTE-FAILURE remote does not exist or incorrectly contains a path: thisRemoteDoesNotExist")
+	h := makeTestState(t)
+	h.remoteName = ":memory:"
+	h.remotePrefix = "summary-" + random.String(8)
+	h.preconfigureServer()
 
-			require.NoError(t, h.mockStdinW.Close())
-		},
-		expectedError: "remote does not exist or incorrectly contains a path: thisRemoteDoesNotExist",
-	},
-	{
-		label: "HandlesPrepareWithPathAsRemote",
-		testProtocolFunc: func(t *testing.T, h *testState) {
-			h.requireReadLineExact("VERSION 1")
-			h.requireWriteLine("EXTENSIONS INFO") // Advertise that we support the INFO extension
-			h.requireReadLineExact("EXTENSIONS")
+	serverErrorChan := make(chan error)
+	go func() {
+		serverErrorChan <- h.server.run()
+	}()
 
-			require.True(t, h.server.extensionInfo)
+	h.requireReadLineExact("VERSION 1")
+	h.requireWriteLine("EXTENSIONS INFO")
+	h.requireReadLineExact("EXTENSIONS INFO")
+
+	h.requireWriteLine("TRANSFER STORE SmallKey " + smallPath)
+	h.requireReadLineExact("TRANSFER-SUCCESS STORE SmallKey")
+	h.requireWriteLine("TRANSFER STORE LargeKey " + largePath)
+	h.requireReadLineExact("TRANSFER-SUCCESS STORE LargeKey")
+
+	h.requireWriteLine("TRANSFER RETRIEVE LargeKey " + filepath.Join(localDir, "retrieved.txt"))
+	h.requireReadLineExact("TRANSFER-SUCCESS RETRIEVE LargeKey")
+	// Failed operations are not counted.
+	h.requireWriteLine("TRANSFER RETRIEVE MissingKey " + filepath.Join(localDir, "missing.txt"))
+	h.requireReadLineExact("TRANSFER-FAILURE RETRIEVE MissingKey [E004] not found")
+
+	h.requireWriteLine("CHECKPRESENT SmallKey")
+	h.requireReadLineExact("CHECKPRESENT-SUCCESS SmallKey")
+	h.requireWriteLine("REMOVE SmallKey")
+	h.requireReadLineExact("REMOVE-SUCCESS SmallKey")
+	h.requireWriteLine("CHECKPRESENT SmallKey")
+	h.requireReadLineExact("CHECKPRESENT-FAILURE SmallKey")
+
+	require.NoError(t, h.mockStdinW.Close())
+	line := h.requireReadLine()
+	require.NoError(t, <-serverErrorChan)
+
+	summaryRegexp := regexp.MustCompile(`^INFO session: (\d+) stores? \((.*)\), (\d+) retrieves? \((.*)\), (\d+) removes?, (\d+) checkpresents?\n$`)
+	match := summaryRegexp.FindStringSubmatch(line)
+	require.NotNil(t, match, "unexpected summary: %q", line)
+	assert.Equal(t, "2", match[1])
+	assert.Equal(t, fs.SizeSuffix(5+3*1024*1024).ByteUnit(), match[2])
+	assert.Equal(t, "1", match[3])
+	assert.Equal(t, "3 MiB", match[4])
+	assert.Equal(t, "1", match[5])
+	assert.Equal(t, "2", match[6])
+}
 
-			h.requireWriteLine("PREPARE")
-			h.requireReadLineExact("GETCONFIG rcloneremotename")
-			h.requireWriteLine("VALUE " + h.remotePrefix)
-			h.requireReadLineExact("GETCONFIG rcloneprefix")
-			h.requireWriteLine("VALUE /foo")
-			h.requireReadLineExact("GETCONFIG rclonelayout")
-			h.requireWriteLine("VALUE frankencase")
-			h.requireReadLineExact("PREPARE-SUCCESS")
+func TestStats(t *testing.T) {
+	localDir := t.TempDir()
+	storedPath := filepath.Join(localDir, "stored.txt")
+	require.NoError(t, os.WriteFile(storedPath, []byte("HELLO"), 0600))
 
-			require.Equal(t, h.server.configRcloneRemoteName, h.remotePrefix)
-			require.Equal(t, h.server.configPrefix, "/foo")
-			require.True(t, h.server.configsDone)
+	h := makeTestState(t)
+	h.remoteName = ":memory:"
+	h.remotePrefix = "stats-" + random.String(8)
+	h.preconfigureServer()
+	require.Equal(t, SessionStats{}, h.server.Stats())
 
-			h.requireWriteLine("INITREMOTE")
+	serverErrorChan := make(chan error)
+	go func() {
+		serverErrorChan <- h.server.run()
+	}()
 
-			require.Regexp(t,
-				regexp.MustCompile("^INITREMOTE-FAILURE remote does not exist or incorrectly contains a path: "),
-				h.requireReadLine(),
-			)
+	h.requireReadLineExact("VERSION 1")
+	h.requireWriteLine("TRANSFER STORE SomeKey " + storedPath)
+	h.requireReadLineExact("TRANSFER-SUCCESS STORE SomeKey")
+	h.requireWriteLine("CHECKPRESENT SomeKey")
+	h.requireReadLineExact("CHECKPRESENT-SUCCESS SomeKey")
+	h.requireWriteLine("TRANSFER RETRIEVE SomeKey " + filepath.Join(localDir, "retrieved.txt"))
+	h.requireReadLineExact("TRANSFER-SUCCESS RETRIEVE SomeKey")
+	h.requireWriteLine("REMOVE SomeKey")
+	h.requireReadLineExact("REMOVE-SUCCESS SomeKey")
+	h.requireWriteLine("CHECKPRESENT SomeKey")
+	h.requireReadLineExact("CHECKPRESENT-FAILURE SomeKey")
+	// A missing key is not an error.
+	h.requireWriteLine("TRANSFER RETRIEVE SomeKey " + filepath.Join(localDir, "missing.txt"))
+	h.requireReadLineExact("TRANSFER-FAILURE RETRIEVE SomeKey [E004] not found")
+	h.requireWriteLine("TRANSFER SIDEWAYS SomeKey " + storedPath)
+	h.requireReadLineExact("TRANSFER-FAILURE SIDEWAYS SomeKey [E005] unrecognized mode")
+	require.Error(t, <-serverErrorChan)
+
+	stats := h.server.Stats()
+	require.Positive(t, stats.Uptime)
+	stats.Uptime = 0
+	require.Equal(t, SessionStats{
+		StoreCount:        1,
+		RetrieveCount:     1,
+		RemoveCount:       1,
+		CheckPresentCount: 2,
+		StoreBytes:        5,
+		RetrieveBytes:     5,
+		Errors:            1,
+	}, stats)
+}
+
+func TestGetInfoDescribesFs(t *testing.T) {
+	for _, tc := range []struct {
+		remoteName, wantType, wantRoot string
+	}{
+		{remoteName: ":memory:", wantType: "memory", wantRoot: "getinfo"},
+		// The fields are sent even when the remote is unusable.
+		{remoteName: ":nonexistent:", wantType: `unknown (didn't find backend called "nonexistent")`, wantRoot: "unknown ("},
+	} {
+		t.Run(tc.remoteName, func(t *testing.T) {
+			h := makeTestState(t)
+			h.remoteName = tc.remoteName
+			h.remotePrefix = "getinfo"
+			h.preconfigureServer()
+
+			serverErrorChan := make(chan error)
+			go func() {
+				serverErrorChan <- h.server.run()
+			}()
 
-			require.NoError(t, h.mockStdinW.Close())
-		},
-		expectedError: "remote does not exist or incorrectly contains a path:",
-	},
-	{
-		label: "HandlesPrepareWithNonexistentBackendAsRemote",
-		testProtocolFunc: func(t *testing.T, h *testState) {
 			h.requireReadLineExact("VERSION 1")
-			h.requireWriteLine("PREPARE")
-			h.requireReadLineExact("GETCONFIG rcloneremotename")
-			h.requireWriteLine("VALUE :nonexistentBackend:")
-			h.requireReadLineExact("GETCONFIG rcloneprefix")
-			h.requireWriteLine("VALUE /foo")
-			h.requireReadLineExact("GETCONFIG rclonelayout")
-			h.requireWriteLine("VALUE frankencase")
-			h.requireReadLineExact("PREPARE-SUCCESS")
+			h.requireWriteLine("GETINFO")
+			info := h.requireReadInfo()
+			require.Equal(t, tc.wantType, info["fs-type"])
+			require.True(t, strings.HasPrefix(info["fs-root"], tc.wantRoot), info["fs-root"])
+			require.NotEmpty(t, info["rclone-version"])
+			require.NoError(t, h.mockStdinW.Close())
+			require.NoError(t, <-serverErrorChan)
+		})
+	}
+}
 
-			require.Equal(t, ":nonexistentBackend:", h.server.configRcloneRemoteName)
-			require.Equal(t, "/foo", h.server.configPrefix)
-			require.True(t, h.server.configsDone)
+func TestSessionSummaryRequiresInfoExtension(t *testing.T) {
+	h := makeTestState(t)
+	h.remoteName = ":memory:"
+	h.remotePrefix = "summary-" + random.String(8)
+	h.preconfigureServer()
 
-			h.requireWriteLine("INITREMOTE")
-			h.requireReadLineExact("INITREMOTE-FAILURE backend does not exist: nonexistentBackend")
+	serverErrorChan := make(chan error)
+	go func() {
+		serverErrorChan <- h.server.run()
+	}()
 
-			require.NoError(t, h.mockStdinW.Close())
-		},
-		expectedError: "backend does not exist:",
-	},
-	{
-		label: "HandlesPrepareWithBackendAsRemote",
-		testProtocolFunc: func(t *testing.T, h *testState) {
-			h.requireReadLineExact("VERSION 1")
-			h.requireWriteLine("PREPARE")
-			h.requireReadLineExact("GETCONFIG rcloneremotename")
-			h.requireWriteLine("VALUE :local:")
-			h.requireReadLineExact("GETCONFIG rcloneprefix")
-			h.requireWriteLine("VALUE /foo")
-			h.requireReadLineExact("GETCONFIG rclonelayout")
-			h.requireWriteLine("VALUE frankencase")
-			h.requireReadLineExact("PREPARE-SUCCESS")
+	h.requireReadLineExact("VERSION 1")
+	h.requireWriteLine("CHECKPRESENT SomeKey")
+	h.requireReadLineExact("CHECKPRESENT-FAILURE SomeKey")
+
+	// Without the INFO extension, the server returns without writing anything
+	// else, so this does not block.
+	require.NoError(t, h.mockStdinW.Close())
+	require.NoError(t, <-serverErrorChan)
+	require.Equal(t, int64(1), h.server.checkpresentCount)
+}
+
+func TestRcloneConfigFlag(t *testing.T) {
+	remoteName := "configflagremote" + strings.ToLower(random.String(8))
+	configPath := filepath.Join(t.TempDir(), "rclone.conf")
+	require.NoError(t, os.WriteFile(configPath, []byte("["+remoteName+"]\ntype = memory\n"), 0600))
+
+	// The remote is not defined in the default config.
+	require.Error(t, validateRemoteName(remoteName))
+
+	originalConfigPath := config.GetConfigPath()
+	t.Cleanup(func() {
+		rcloneConfigPath = ""
+		require.NoError(t, useConfigFile(originalConfigPath))
+	})
+	require.NoError(t, command.Flags().Set("rclone-config", configPath))
+	require.NoError(t, useConfigFile(rcloneConfigPath))
+	require.Equal(t, configPath, config.GetConfigPath())
+
+	h := makeTestState(t)
+	serverErrorChan := make(chan error)
+	go func() {
+		serverErrorChan <- h.server.run()
+	}()
 
-			require.Equal(t, ":local:", h.server.configRcloneRemoteName)
-			require.Equal(t, "/foo", h.server.configPrefix)
-			require.True(t, h.server.configsDone)
+	h.requireReadLineExact("VERSION 1")
+	h.requireWriteLine("INITREMOTE")
+	line := h.answerConfigs(map[string]string{
+		"rcloneremotename": remoteName,
+		"rcloneprefix":     "prefix",
+	})
+	require.Equal(t, "INITREMOTE-SUCCESS\n", line)
+	require.NoError(t, h.mockStdinW.Close())
+	require.NoError(t, <-serverErrorChan)
+}
 
-			h.requireWriteLine("INITREMOTE")
-			h.requireReadLineExact("INITREMOTE-SUCCESS")
+// lookupCountingFs wraps an Fs, counts calls to List and NewObject, and delays
+// each call by `latency` to simulate a remote reached over the network.
+type lookupCountingFs struct {
+	fs.Fs
+	latency    time.Duration
+	lists      int
+	newObjects int
+}
 
-			require.NoError(t, h.mockStdinW.Close())
-		},
-	},
-	{
-		label: "HandlesPrepareWithBackendMissingTrailingColonAsRemote",
-		testProtocolFunc: func(t *testing.T, h *testState) {
-			h.requireReadLineExact("VERSION 1")
-			h.requireWriteLine("PREPARE")
-			h.requireReadLineExact("GETCONFIG rcloneremotename")
-			h.requireWriteLine("VALUE :local")
-			h.requireReadLineExact("GETCONFIG rcloneprefix")
-			h.requireWriteLine("VALUE /foo")
-			h.requireReadLineExact("GETCONFIG rclonelayout")
-			h.requireWriteLine("VALUE frankencase")
-			h.requireReadLineExact("PREPARE-SUCCESS")
+func (c *lookupCountingFs) List(ctx context.Context, dir string) (fs.DirEntries, error) {
+	c.lists++
+	time.Sleep(c.latency)
+	return c.Fs.List(ctx, dir)
+}
 
-			require.Equal(t, ":local", h.server.configRcloneRemoteName)
-			require.Equal(t, "/foo", h.server.configPrefix)
-			require.True(t, h.server.configsDone)
+func (c *lookupCountingFs) NewObject(ctx context.Context, remote string) (fs.Object, error) {
+	c.newObjects++
+	time.Sleep(c.latency)
+	return c.Fs.NewObject(ctx, remote)
+}
 
-			h.requireWriteLine("INITREMOTE")
-			h.requireReadLineExact("INITREMOTE-FAILURE remote could not be parsed: :local")
+// newLookupCountingFs installs a [lookupCountingFs] in the cache in place of the
+// Fs for `remoteFsString`.
+func newLookupCountingFs(tb testing.TB, remoteFsString string, latency time.Duration) *lookupCountingFs {
+	remoteFs, err := cache.Get(context.Background(), remoteFsString)
+	require.NoError(tb, err)
+	c := &lookupCountingFs{Fs: remoteFs, latency: latency}
+	cache.Put(remoteFsString, c)
+	return c
+}
 
-			require.NoError(t, h.mockStdinW.Close())
-		},
-		expectedError: "remote could not be parsed:",
-	},
-	{
-		label: "HandlesPrepareWithBackendContainingOptionsAsRemote",
-		testProtocolFunc: func(t *testing.T, h *testState) {
-			h.requireReadLineExact("VERSION 1")
-			h.requireWriteLine("PREPARE")
-			h.requireReadLineExact("GETCONFIG rcloneremotename")
-			h.requireWriteLine("VALUE :local,description=banana:")
-			h.requireReadLineExact("GETCONFIG rcloneprefix")
-			h.requireWriteLine("VALUE /foo")
-			h.requireReadLineExact("GETCONFIG rclonelayout")
-			h.requireWriteLine("VALUE frankencase")
-			h.requireReadLineExact("PREPARE-SUCCESS")
+func TestCheckPresentUsesListing(t *testing.T) {
+	localPath := filepath.Join(t.TempDir(), "file.txt")
+	require.NoError(t, os.WriteFile(localPath, []byte("HELLO"), 0600))
 
-			require.Equal(t, ":local,description=banana:", h.server.configRcloneRemoteName)
-			require.Equal(t, "/foo", h.server.configPrefix)
-			require.True(t, h.server.configsDone)
+	h := makeTestState(t)
+	h.remoteName = ":memory:"
+	h.remotePrefix = "listing-" + random.String(8)
+	h.preconfigureServer()
+	h.server.configRcloneCheckPresentWindow = "1h"
 
-			h.requireWriteLine("INITREMOTE")
-			h.requireReadLineExact("INITREMOTE-SUCCESS")
+	remoteFsString, err := buildFsString(nil, layoutModeNodir, "", h.remoteName, h.remotePrefix)
+	require.NoError(t, err)
+	counter := newLookupCountingFs(t, remoteFsString, 0)
 
-			require.NoError(t, h.mockStdinW.Close())
-		},
-	},
-	{
-		label: "HandlesPrepareWithBackendContainingOptionsAndIllegalPathAsRemote",
-		testProtocolFunc: func(t *testing.T, h *testState) {
-			h.requireReadLineExact("VERSION 1")
-			h.requireWriteLine("PREPARE")
-			h.requireReadLineExact("GETCONFIG rcloneremotename")
-			h.requireWriteLine("VALUE :local,description=banana:/bad/path")
-			h.requireReadLineExact("GETCONFIG rcloneprefix")
-			h.requireWriteLine("VALUE /foo")
-			h.requireReadLineExact("GETCONFIG rclonelayout")
-			h.requireWriteLine("VALUE frankencase")
-			h.requireReadLineExact("PREPARE-SUCCESS")
+	serverErrorChan := make(chan error)
+	go func() {
+		serverErrorChan <- h.server.run()
+	}()
+	h.requireReadLineExact("VERSION 1")
+
+	h.requireWriteLine("TRANSFER STORE KeyA " + localPath)
+	h.requireReadLineExact("TRANSFER-SUCCESS STORE KeyA")
+	counter.lists, counter.newObjects = 0, 0
+
+	// A single listing answers every CHECKPRESENT.
+	h.requireWriteLine("CHECKPRESENT KeyA")
+	h.requireReadLineExact("CHECKPRESENT-SUCCESS KeyA")
+	h.requireWriteLine("CHECKPRESENT KeyB")
+	h.requireReadLineExact("CHECKPRESENT-FAILURE KeyB")
+	h.requireWriteLine("CHECKPRESENT KeyC")
+	h.requireReadLineExact("CHECKPRESENT-FAILURE KeyC")
+	require.Equal(t, 1, counter.lists)
+	require.Equal(t, 0, counter.newObjects)
+
+	// Stores and removes invalidate the listing.
+	h.requireWriteLine("TRANSFER STORE KeyB " + localPath)
+	h.requireReadLineExact("TRANSFER-SUCCESS STORE KeyB")
+	h.requireWriteLine("CHECKPRESENT KeyB")
+	h.requireReadLineExact("CHECKPRESENT-SUCCESS KeyB")
+	h.requireWriteLine("REMOVE KeyA")
+	h.requireReadLineExact("REMOVE-SUCCESS KeyA")
+	h.requireWriteLine("CHECKPRESENT KeyA")
+	h.requireReadLineExact("CHECKPRESENT-FAILURE KeyA")
+	require.Equal(t, 3, counter.lists)
+
+	require.NoError(t, h.mockStdinW.Close())
+	require.NoError(t, <-serverErrorChan)
+}
 
-			require.Equal(t, ":local,description=banana:/bad/path", h.server.configRcloneRemoteName)
-			require.Equal(t, "/foo", h.server.configPrefix)
-			require.True(t, h.server.configsDone)
+// BenchmarkCheckPresent measures a run of 1000 CHECKPRESENT messages, like the
+// ones `git annex fsck --fast` sends, against a remote where each lookup or
+// listing takes 100µs.
+func BenchmarkCheckPresent(b *testing.B) {
+	const numKeys = 1000
+	prefix := "bench-checkpresent-" + random.String(8)
+	remoteFsString, err := buildFsString(nil, layoutModeNodir, "", ":memory:", prefix)
+	require.NoError(b, err)
+	remoteFs, err := cache.Get(context.Background(), remoteFsString)
+	require.NoError(b, err)
+
+	var input strings.Builder
+	for i := range numKeys {
+		key := fmt.Sprintf("SHA256E-s5--%064d", i)
+		// Store every other key, so that half the checks fail.
+		if i%2 == 0 {
+			_, err := operations.Rcat(context.Background(), remoteFs, key, io.NopCloser(strings.NewReader("HELLO")), time.Now(), nil)
+			require.NoError(b, err)
+		}
+		input.WriteString("CHECKPRESENT " + key + "\n")
+	}
+	counter := newLookupCountingFs(b, remoteFsString, 100*time.Microsecond)
+
+	for _, bc := range []struct {
+		name   string
+		window string
+	}{
+		{"Lookups", "0"},
+		{"Listings", defaultRcloneCheckPresentWindow},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			counter.lists, counter.newObjects = 0, 0
+			for range b.N {
+				s := server{
+					reader: bufio.NewReader(strings.NewReader(input.String())),
+					writer: io.Discard,
+				}
+				for _, config := range requiredConfigs {
+					s.mustSetConfigValue(config.id, config.defaultValue)
+				}
+				s.configRcloneRemoteName = ":memory:"
+				s.configPrefix = prefix
+				s.configRcloneCheckPresentWindow = bc.window
+				s.configsDone = true
+				require.NoError(b, s.run())
+			}
+			b.ReportMetric(float64(counter.lists+counter.newObjects)/float64(b.N), "lookups/op")
+		})
+	}
+}
 
-			h.requireWriteLine("INITREMOTE")
-			h.requireReadLineExact("INITREMOTE-FAILURE remote does not exist or incorrectly contains a path: :local,description=banana:/bad/path")
+// BenchmarkWarmCache measures 100 CHECKPRESENT messages, half of them for
+// present keys, with and without the "rclonewarmcache" config. The warm run
+// includes the listing.
+func BenchmarkWarmCache(b *testing.B) {
+	const numKeys = 100
+	var input strings.Builder
+	for i := range numKeys {
+		fmt.Fprintf(&input, "CHECKPRESENT Key%d\n", i)
+	}
+	for _, warm := range []bool{false, true} {
+		b.Run(fmt.Sprintf("warm=%v", warm), func(b *testing.B) {
+			for range b.N {
+				slow := &slowFs{latency: 20 * time.Millisecond}
+				s := newSlowServer(b, slow, numKeys, strings.NewReader(input.String()), io.Discard)
+				if warm {
+					s.presentKeys = warmPresentKeysCache(context.Background(), slow, nil)
+					<-s.presentKeys.done
+				}
+				require.NoError(b, s.run())
+			}
+		})
+	}
+}
 
-			require.NoError(t, h.mockStdinW.Close())
-		},
-		expectedError: "remote does not exist or incorrectly contains a path:",
-	},
-	{
-		label: "HandlesPrepareWithRemoteContainingOptions",
-		testProtocolFunc: func(t *testing.T, h *testState) {
-			const envVar = "RCLONE_CONFIG_fake_remote_TYPE"
-			require.NoError(t, os.Setenv(envVar, "memory"))
-			t.Cleanup(func() { require.NoError(t, os.Unsetenv(envVar)) })
+// benchmarkLayout measures a run of 10 000 CHECKPRESENT messages against a
+// `:local:` remote holding 10 000 keys in the given layout. Each iteration is a
+// full session with a mock git-annex, so in the "mixed" layout it includes the
+// DIRHASH round trip for each key.
+func benchmarkLayout(b *testing.B, mode layoutMode) {
+	const numKeys = 10000
+	remoteDir := b.TempDir()
+	queryDirhash := func(_ dirhashVariant, key string) (string, error) {
+		return mixedDirhash(key), nil
+	}
+	keys := make([]string, numKeys)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("SHA256E-s5--%064d", i)
+		fsString, err := buildFsString(queryDirhash, mode, keys[i], ":local:", remoteDir)
+		require.NoError(b, err)
+		dir := strings.TrimPrefix(fsString, ":local:")
+		require.NoError(b, os.MkdirAll(dir, 0700))
+		require.NoError(b, os.WriteFile(filepath.Join(dir, keys[i]), []byte("HELLO"), 0600))
+	}
 
-			h.requireReadLineExact("VERSION 1")
-			h.requireWriteLine("PREPARE")
-			h.requireReadLineExact("GETCONFIG rcloneremotename")
-			h.requireWriteLine("VALUE fake_remote,banana=yes:")
-			h.requireReadLineExact("GETCONFIG rcloneprefix")
-			h.requireWriteLine("VALUE /foo")
-			h.requireReadLineExact("GETCONFIG rclonelayout")
-			h.requireWriteLine("VALUE frankencase")
-			h.requireReadLineExact("PREPARE-SUCCESS")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		stdinR, stdinW := io.Pipe()
+		stdoutR, stdoutW := io.Pipe()
+		s := server{
+			reader: bufio.NewReader(stdinR),
+			writer: stdoutW,
+		}
+		for _, config := range requiredConfigs {
+			s.mustSetConfigValue(config.id, config.defaultValue)
+		}
+		s.configRcloneRemoteName = ":local:"
+		s.configPrefix = remoteDir
+		s.configRcloneLayout = string(mode)
+		s.configsDone = true
+		serverErrorChan := make(chan error, 1)
+		go func() {
+			serverErrorChan <- s.run()
+			_ = stdoutW.Close()
+		}()
+
+		// Play git-annex: answer each DIRHASH and send the next CHECKPRESENT
+		// once the previous one has been answered.
+		stdout := bufio.NewReader(stdoutR)
+		next := 0
+		for {
+			line, err := stdout.ReadString('\n')
+			if err != nil {
+				break
+			}
+			switch {
+			case strings.HasPrefix(line, "DIRHASH "):
+				_, err = io.WriteString(stdinW, "VALUE "+mixedDirhash(strings.TrimSpace(strings.TrimPrefix(line, "DIRHASH ")))+"\n")
+			case strings.HasPrefix(line, "CHECKPRESENT-FAILURE"), strings.HasPrefix(line, "CHECKPRESENT-UNKNOWN"):
+				b.Fatalf("unexpected reply: %q", line)
+			case next < numKeys:
+				_, err = io.WriteString(stdinW, "CHECKPRESENT "+keys[next]+"\n")
+				next++
+			default:
+				err = stdinW.Close()
+			}
+			require.NoError(b, err)
+		}
+		require.NoError(b, <-serverErrorChan)
+	}
+}
 
-			require.Equal(t, "fake_remote,banana=yes:", h.server.configRcloneRemoteName)
-			require.Equal(t, "/foo", h.server.configPrefix)
-			require.True(t, h.server.configsDone)
+// BenchmarkLayoutNoDir and BenchmarkLayoutMixed compare the cost of checking
+// many keys in the "nodir" and "mixed" layouts. In the "nodir" layout, the
+// default rclonecheckpresentwindow answers most checks from one listing. The
+// "mixed" layout needs a DIRHASH round trip and a lookup per key. See the
+// "Layout performance" section of gitannex.md for results.
+func BenchmarkLayoutNoDir(b *testing.B) {
+	benchmarkLayout(b, layoutModeNodir)
+}
 
-			h.requireWriteLine("INITREMOTE")
-			h.requireReadLineExact("INITREMOTE-SUCCESS")
+func BenchmarkLayoutMixed(b *testing.B) {
+	benchmarkLayout(b, layoutModeMixed)
+}
 
-			require.NoError(t, h.mockStdinW.Close())
-		},
-	},
-	{
-		label: "HandlesPrepareWithSynonyms",
-		testProtocolFunc: func(t *testing.T, h *testState) {
-			h.requireReadLineExact("VERSION 1")
-			h.requireWriteLine("EXTENSIONS INFO") // Advertise that we support the INFO extension
-			h.requireReadLineExact("EXTENSIONS")
+// rejectPutFs wraps an Fs and rejects uploads of objects named `rejected`.
+type rejectPutFs struct {
+	fs.Fs
+	rejected string
+}
 
-			require.True(t, h.server.extensionInfo)
+func (r *rejectPutFs) Put(ctx context.Context, in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) (fs.Object, error) {
+	if src.Remote() == r.rejected {
+		return nil, fmt.Errorf("permission denied: %s", src.Remote())
+	}
+	return r.Fs.Put(ctx, in, src, options...)
+}
 
-			h.requireWriteLine("PREPARE")
-			h.requireReadLineExact("GETCONFIG rcloneremotename")
-			// TODO check what git-annex does when asked for a config value it does not have.
-			h.requireWriteLine("VALUE")
-			h.requireReadLineExact("GETCONFIG target")
-			h.requireWriteLine("VALUE " + h.remoteName)
+func TestInitRemoteConnectTest(t *testing.T) {
+	ctx := context.Background()
 
-			h.requireReadLineExact("GETCONFIG rcloneprefix")
-			h.requireWriteLine("VALUE " + h.remotePrefix)
-			h.requireReadLineExact("GETCONFIG rclonelayout")
-			h.requireWriteLine("VALUE frankencase")
-			h.requireReadLineExact("PREPARE-SUCCESS")
+	// initRemote runs a session that sends INITREMOTE with the given configs
+	// and returns the server's reply and error. When `rejectConnectTest` is
+	// true, the remote rejects the connection test's upload.
+	initRemote := func(configs map[string]string, rejectConnectTest bool) (string, fs.Fs, error) {
+		h := makeTestState(t)
+		prefix := "connect-" + random.String(8)
+		prefixFsString, err := buildFsString(nil, layoutModeNodir, "", ":memory:", prefix)
+		require.NoError(t, err)
+		prefixFs, err := cache.Get(ctx, prefixFsString)
+		require.NoError(t, err)
+		if rejectConnectTest {
+			cache.Put(prefixFsString, &rejectPutFs{Fs: prefixFs, rejected: connectTestFileName})
+		}
 
-			require.Equal(t, h.server.configRcloneRemoteName, h.remoteName)
-			require.Equal(t, h.server.configPrefix, h.remotePrefix)
-			require.True(t, h.server.configsDone)
+		serverErrorChan := make(chan error)
+		go func() {
+			serverErrorChan <- h.server.run()
+		}()
 
-			require.NoError(t, h.mockStdinW.Close())
-		},
-	},
-	{
-		label: "HandlesPrepareAndDoesNotTrimWhitespaceFromValue",
-		testProtocolFunc: func(t *testing.T, h *testState) {
-			h.requireReadLineExact("VERSION 1")
-			h.requireWriteLine("EXTENSIONS INFO") // Advertise that we support the INFO extension
-			h.requireReadLineExact("EXTENSIONS")
+		h.requireReadLineExact("VERSION 1")
+		h.requireWriteLine("INITREMOTE")
+		values := map[string]string{"rcloneremotename": ":memory:", "rcloneprefix": prefix}
+		for name, value := range configs {
+			values[name] = value
+		}
+		line := h.answerConfigs(values)
+		require.NoError(t, h.mockStdinW.Close())
+		return line, prefixFs, <-serverErrorChan
+	}
 
-			require.True(t, h.server.extensionInfo)
+	t.Run("Passes", func(t *testing.T) {
+		line, prefixFs, err := initRemote(nil, false)
+		require.NoError(t, err)
+		require.Equal(t, "INITREMOTE-SUCCESS\n", line)
+		_, err = prefixFs.NewObject(ctx, connectTestFileName)
+		require.ErrorIs(t, err, fs.ErrorObjectNotFound)
+	})
 
-			h.requireWriteLine("PREPARE")
-			h.requireReadLineExact("GETCONFIG rcloneremotename")
+	t.Run("Fails", func(t *testing.T) {
+		line, _, err := initRemote(nil, true)
+		require.ErrorContains(t, err, "connection test failed")
+		require.Equal(t, "INITREMOTE-FAILURE [E002] connection test failed: failed to upload .rclone-gitannex-init: permission denied: .rclone-gitannex-init\n", line)
+	})
 
-			remoteNameWithSpaces := fmt.Sprintf(" %s ", h.remoteName)
-			prefixWithWhitespace := fmt.Sprintf(" %s\t", h.remotePrefix)
+	t.Run("Skipped", func(t *testing.T) {
+		line, _, err := initRemote(map[string]string{"rcloneskipconnecttest": "yes"}, true)
+		require.NoError(t, err)
+		require.Equal(t, "INITREMOTE-SUCCESS\n", line)
+	})
 
-			h.requireWriteLine(fmt.Sprintf("VALUE %s", remoteNameWithSpaces))
+	t.Run("InvalidSkipValue", func(t *testing.T) {
+		line, _, err := initRemote(map[string]string{"rcloneskipconnecttest": "maybe"}, false)
+		require.Error(t, err)
+		require.Equal(t, "INITREMOTE-FAILURE [E001] failed to parse skip connect test \"maybe\": must be \"yes\" or \"no\"\n", line)
+	})
+}
 
-			h.requireReadLineExact("GETCONFIG rcloneprefix")
-			h.requireWriteLine(fmt.Sprintf("VALUE %s", prefixWithWhitespace))
+// singlePartLimitFs wraps an Fs and, like S3, rejects single-request uploads
+// larger than maxPutSize. Streaming uploads are passed through to the wrapped
+// Fs and counted.
+type singlePartLimitFs struct {
+	fs.Fs
+	maxPutSize int64
+	features   *fs.Features
+	streamed   int
+}
 
-			h.requireReadLineExact("GETCONFIG rclonelayout")
-			h.requireWriteLine("VALUE")
-			h.requireReadLineExact("GETCONFIG rclone_layout")
-			h.requireWriteLine("VALUE")
+func newSinglePartLimitFs(ctx context.Context, f fs.Fs, maxPutSize int64) *singlePartLimitFs {
+	l := &singlePartLimitFs{Fs: f, maxPutSize: maxPutSize}
+	l.features = (&fs.Features{}).Fill(ctx, l)
+	return l
+}
 
-			h.requireReadLineExact("PREPARE-SUCCESS")
+func (l *singlePartLimitFs) Features() *fs.Features {
+	return l.features
+}
 
-			require.Equal(t, h.server.configRcloneRemoteName, remoteNameWithSpaces)
-			require.Equal(t, h.server.configPrefix, prefixWithWhitespace)
-			require.True(t, h.server.configsDone)
+func (l *singlePartLimitFs) Put(ctx context.Context, in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) (fs.Object, error) {
+	if src.Size() > l.maxPutSize {
+		return nil, fmt.Errorf("single-part upload of %d bytes exceeds limit of %d bytes", src.Size(), l.maxPutSize)
+	}
+	return l.Fs.Put(ctx, in, src, options...)
+}
 
-			require.NoError(t, h.mockStdinW.Close())
-		},
-	},
-	{
-		label: "HandlesEarlyError",
-		testProtocolFunc: func(t *testing.T, h *testState) {
-			h.preconfigureServer()
+func (l *singlePartLimitFs) PutStream(ctx context.Context, in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) (fs.Object, error) {
+	l.streamed++
+	return l.Fs.Features().PutStream(ctx, in, src, options...)
+}
 
-			h.requireReadLineExact("VERSION 1")
-			h.requireWriteLine("ERROR foo")
+// TestStoreStreamsFilesLargerThanCutoff checks that files larger than the
+// "rclonecutoffsize" config are uploaded with PutStream, which lets backends
+// like S3 use multipart uploads.
+func TestStoreStreamsFilesLargerThanCutoff(t *testing.T) {
+	ctx := context.Background()
+
+	// The file must be larger than --streaming-upload-cutoff, otherwise
+	// operations.Rcat uploads it with Put.
+	const fileSize = 256 * 1024
+	localPath := filepath.Join(t.TempDir(), "file.bin")
+	require.NoError(t, os.WriteFile(localPath, []byte(random.String(fileSize)), 0600))
+
+	// storeWithCutoff runs a session that stores the local file with the given
+	// cutoff size and returns the fake remote and the server's error.
+	storeWithCutoff := func(cutoffSize, wantLine string) (*singlePartLimitFs, error) {
+		h := makeTestState(t)
+		h.remoteName = ":memory:"
+		h.remotePrefix = "cutoff-" + random.String(8)
+		h.preconfigureServer()
+		h.server.configRcloneCutoffSize = cutoffSize
 
-			require.NoError(t, h.mockStdinW.Close())
-		},
-		expectedError: "received error message from git-annex: foo",
-	},
-	// Test what happens when the git-annex client sends "GETCONFIG", but
-	// doesn't understand git-annex's response.
-	{
-		label: "ConfigFail",
-		testProtocolFunc: func(t *testing.T, h *testState) {
-			h.requireReadLineExact("VERSION 1")
-			h.requireWriteLine("EXTENSIONS INFO") // Advertise that we support the INFO extension
-			h.requireReadLineExact("EXTENSIONS")
-			require.True(t, h.server.extensionInfo)
+		remoteFsString, err := buildFsString(nil, layoutModeNodir, "", h.remoteName, h.remotePrefix)
+		require.NoError(t, err)
+		memoryFs, err := cache.Get(ctx, remoteFsString)
+		require.NoError(t, err)
+		remoteFs := newSinglePartLimitFs(ctx, memoryFs, 128*1024)
+		cache.Put(remoteFsString, remoteFs)
+
+		serverErrorChan := make(chan error)
+		go func() {
+			serverErrorChan <- h.server.run()
+		}()
+
+		h.requireReadLineExact("VERSION 1")
+		h.requireWriteLine("TRANSFER STORE SomeKey " + localPath)
+		h.requireReadLineExact(wantLine)
+		require.NoError(t, h.mockStdinW.Close())
+		return remoteFs, <-serverErrorChan
+	}
 
-			h.requireWriteLine("PREPARE")
-			h.requireReadLineExact("GETCONFIG rcloneremotename")
-			h.requireWriteLine("ERROR ineffable error")
-			h.requireReadLineExact("PREPARE-FAILURE Error getting configs")
+	t.Run("Enabled", func(t *testing.T) {
+		remoteFs, err := storeWithCutoff("128K", "TRANSFER-SUCCESS STORE SomeKey")
+		require.NoError(t, err)
+		require.Equal(t, 1, remoteFs.streamed)
 
-			require.NoError(t, h.mockStdinW.Close())
-		},
-		expectedError: "failed to parse config value: ERROR ineffable error",
-	},
-	{
-		label: "TransferStoreEmptyPath",
-		testProtocolFunc: func(t *testing.T, h *testState) {
-			h.preconfigureServer()
+		obj, err := remoteFs.NewObject(ctx, "SomeKey")
+		require.NoError(t, err)
+		require.Equal(t, int64(fileSize), obj.Size())
+	})
 
-			h.requireReadLineExact("VERSION 1")
-			h.requireWriteLine("INITREMOTE")
-			h.requireReadLineExact("INITREMOTE-SUCCESS")
+	t.Run("Disabled", func(t *testing.T) {
+		remoteFs, err := storeWithCutoff("0", "TRANSFER-FAILURE STORE SomeKey [E003] failed to copy file: single-part upload of 262144 bytes exceeds limit of 131072 bytes")
+		require.Error(t, err)
+		require.Equal(t, 0, remoteFs.streamed)
+	})
+}
 
-			// Note the whitespace following the key.
-			h.requireWriteLine("TRANSFER STORE Key ")
-			h.requireReadLineExact("TRANSFER-FAILURE failed to parse file path")
+// noHashFs wraps an Fs and claims to support no hashes.
+type noHashFs struct {
+	fs.Fs
+}
+
+func (f *noHashFs) Hashes() hash.Set {
+	return hash.Set(hash.None)
+}
+
+// badHashFs wraps an Fs and reports a wrong checksum for every object.
+type badHashFs struct {
+	fs.Fs
+}
+
+func (f *badHashFs) NewObject(ctx context.Context, remote string) (fs.Object, error) {
+	obj, err := f.Fs.NewObject(ctx, remote)
+	if err != nil {
+		return nil, err
+	}
+	return &badHashObject{Object: obj}, nil
+}
+
+type badHashObject struct {
+	fs.Object
+}
+
+func (o *badHashObject) Hash(_ context.Context, _ hash.Type) (string, error) {
+	return "0123456789abcdef0123456789abcdef", nil
+}
+
+func TestSelectHashType(t *testing.T) {
+	memoryFs, err := cache.Get(context.Background(), ":memory:checksum")
+	require.NoError(t, err)
+	require.True(t, memoryFs.Hashes().Contains(hash.MD5))
+	require.False(t, memoryFs.Hashes().Contains(hash.SHA256))
+	localFs, err := cache.Get(context.Background(), t.TempDir())
+	require.NoError(t, err)
+
+	testCases := []struct {
+		label      string
+		remoteFs   fs.Fs
+		preference string
+		want       hash.Type
+		wantErr    string
+	}{
+		{label: "Auto", remoteFs: memoryFs, preference: "auto", want: hash.MD5},
+		{label: "Empty", remoteFs: memoryFs, preference: "", want: hash.MD5},
+		{label: "None", remoteFs: memoryFs, preference: "none", want: hash.None},
+		{label: "Specific", remoteFs: memoryFs, preference: "md5", want: hash.MD5},
+		{label: "Unsupported", remoteFs: memoryFs, preference: "sha256", wantErr: `checksum "sha256" is not supported by the remote`},
+		{label: "Unknown", remoteFs: memoryFs, preference: "bogus", wantErr: `failed to parse checksum "bogus"`},
+		{label: "AutoWithoutHashes", remoteFs: &noHashFs{memoryFs}, preference: "auto", want: hash.None},
+		{label: "AutoPrefersCommonHash", remoteFs: localFs, preference: "auto", want: localFs.Hashes().GetOne()},
+		{label: "NoneWithoutHashes", remoteFs: &noHashFs{memoryFs}, preference: "none", want: hash.None},
+		{label: "SpecificWithoutHashes", remoteFs: &noHashFs{memoryFs}, preference: "md5", wantErr: `checksum "md5" is not supported by the remote`},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.label, func(t *testing.T) {
+			got, err := selectHashType(tc.remoteFs, localFs, tc.preference)
+			if tc.wantErr != "" {
+				require.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.want, got)
+		})
+	}
+}
 
-			require.NoError(t, h.mockStdinW.Close())
-		},
-		expectedError: "failed to parse file",
-	},
-	// Repeated EXTENSIONS messages add to each other rather than overriding
-	// prior advertised extensions. This behavior is not mandated by the
-	// protocol design.
-	{
-		label: "ExtensionsCompound",
-		testProtocolFunc: func(t *testing.T, h *testState) {
-			h.preconfigureServer()
+func TestStoreVerifiesChecksum(t *testing.T) {
+	ctx := context.Background()
+	localPath := filepath.Join(t.TempDir(), "file.txt")
+	require.NoError(t, os.WriteFile(localPath, []byte("HELLO"), 0600))
 
-			h.requireReadLineExact("VERSION 1")
-			h.requireWriteLine("INITREMOTE")
-			h.requireReadLineExact("INITREMOTE-SUCCESS")
+	// store runs a session that stores the local file with the given checksum
+	// and copy flag configs on a remote that reports wrong checksums once the
+	// upload is over, and requires that the server replies with `wantLine`.
+	store := func(checksum, copyFlag, wantLine string) {
+		h := makeTestState(t)
+		h.remoteName = ":memory:"
+		h.remotePrefix = "checksum-" + random.String(8)
+		h.preconfigureServer()
+		h.server.configRcloneChecksum = checksum
+		h.server.configRcloneCopyFlag = copyFlag
 
-			h.requireWriteLine("EXTENSIONS")
-			h.requireReadLineExact("EXTENSIONS")
-			require.False(t, h.server.extensionInfo)
-			require.False(t, h.server.extensionAsync)
-			require.False(t, h.server.extensionGetGitRemoteName)
-			require.False(t, h.server.extensionUnavailableResponse)
+		remoteFsString, err := buildFsString(nil, layoutModeNodir, "", h.remoteName, h.remotePrefix)
+		require.NoError(t, err)
+		memoryFs, err := cache.Get(ctx, remoteFsString)
+		require.NoError(t, err)
+		cache.Put(remoteFsString, &badHashFs{memoryFs})
+
+		serverErrorChan := make(chan error)
+		go func() {
+			serverErrorChan <- h.server.run()
+		}()
+
+		h.requireReadLineExact("VERSION 1")
+		h.requireWriteLine("TRANSFER STORE SomeKey " + localPath)
+		h.requireReadLineExact(wantLine)
+		require.NoError(t, h.mockStdinW.Close())
+		<-serverErrorChan
+	}
 
-			h.requireWriteLine("EXTENSIONS INFO")
-			h.requireReadLineExact("EXTENSIONS")
-			require.True(t, h.server.extensionInfo)
-			require.False(t, h.server.extensionAsync)
-			require.False(t, h.server.extensionGetGitRemoteName)
-			require.False(t, h.server.extensionUnavailableResponse)
+	t.Run("Auto", func(t *testing.T) {
+		store("auto", "--ignore-checksum", "TRANSFER-FAILURE STORE SomeKey [E003] failed to verify file: md5 differ: local eb61eead90e3b899c6bcbe27ac581660, remote 0123456789abcdef0123456789abcdef")
+	})
 
-			h.requireWriteLine("EXTENSIONS ASYNC")
-			h.requireReadLineExact("EXTENSIONS")
-			require.True(t, h.server.extensionInfo)
-			require.True(t, h.server.extensionAsync)
-			require.False(t, h.server.extensionGetGitRemoteName)
-			require.False(t, h.server.extensionUnavailableResponse)
+	// The copy already compared md5 against the uploaded object, so the stored
+	// object is not read again.
+	t.Run("AlreadyComparedByCopy", func(t *testing.T) {
+		store("auto", "", "TRANSFER-SUCCESS STORE SomeKey")
+	})
 
-			h.requireWriteLine("EXTENSIONS GETGITREMOTENAME")
-			h.requireReadLineExact("EXTENSIONS")
-			require.True(t, h.server.extensionInfo)
-			require.True(t, h.server.extensionAsync)
-			require.True(t, h.server.extensionGetGitRemoteName)
-			require.False(t, h.server.extensionUnavailableResponse)
+	t.Run("None", func(t *testing.T) {
+		store("none", "--ignore-checksum", "TRANSFER-SUCCESS STORE SomeKey")
+	})
+}
 
-			h.requireWriteLine("EXTENSIONS UNAVAILABLERESPONSE")
-			h.requireReadLineExact("EXTENSIONS")
-			require.True(t, h.server.extensionInfo)
-			require.True(t, h.server.extensionAsync)
-			require.True(t, h.server.extensionGetGitRemoteName)
-			require.True(t, h.server.extensionUnavailableResponse)
+func TestPreserveModTime(t *testing.T) {
+	dir := t.TempDir()
+	storedPath := filepath.Join(dir, "stored.txt")
+	retrievedPath := filepath.Join(dir, "retrieved.txt")
+	require.NoError(t, os.WriteFile(storedPath, []byte("HELLO"), 0600))
+	modTime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	require.NoError(t, os.Chtimes(storedPath, modTime, modTime))
+
+	h := makeTestState(t)
+	h.remoteName = ":memory:"
+	h.remotePrefix = "mtime-" + random.String(8)
+	h.preconfigureServer()
+	h.server.configRclonePreserveModTime = "yes"
+
+	serverErrorChan := make(chan error)
+	go func() {
+		serverErrorChan <- h.server.run()
+	}()
 
-			require.NoError(t, h.mockStdinW.Close())
-		},
-	},
-	{
-		label: "ExtensionsIdempotent",
-		testProtocolFunc: func(t *testing.T, h *testState) {
-			h.preconfigureServer()
+	h.requireReadLineExact("VERSION 1")
+	h.requireWriteLine("TRANSFER STORE SomeKey " + storedPath)
+	h.requireReadLineExact("TRANSFER-SUCCESS STORE SomeKey")
+	h.requireWriteLine("TRANSFER RETRIEVE SomeKey " + retrievedPath)
+	h.requireReadLineExact("TRANSFER-SUCCESS RETRIEVE SomeKey")
+	require.NoError(t, h.mockStdinW.Close())
+	require.NoError(t, <-serverErrorChan)
+
+	info, err := os.Stat(retrievedPath)
+	require.NoError(t, err)
+	require.WithinDuration(t, modTime, info.ModTime(), time.Second)
+}
 
-			h.requireReadLineExact("VERSION 1")
-			h.requireWriteLine("INITREMOTE")
-			h.requireReadLineExact("INITREMOTE-SUCCESS")
+// TestAsyncIsNotAccepted checks that the server does not accept the ASYNC
+// extension, so git-annex keeps sending requests without job numbers.
+func TestAsyncIsNotAccepted(t *testing.T) {
+	h := makeTestState(t)
+	h.remoteName = ":memory:"
+	h.remotePrefix = "async-" + random.String(8)
+	h.preconfigureServer()
 
-			h.requireWriteLine("EXTENSIONS")
-			h.requireReadLineExact("EXTENSIONS")
-			require.False(t, h.server.extensionInfo)
-			require.False(t, h.server.extensionAsync)
-			require.False(t, h.server.extensionGetGitRemoteName)
-			require.False(t, h.server.extensionUnavailableResponse)
+	serverErrorChan := make(chan error)
+	go func() {
+		serverErrorChan <- h.server.run()
+	}()
 
-			h.requireWriteLine("EXTENSIONS")
-			h.requireReadLineExact("EXTENSIONS")
-			require.False(t, h.server.extensionInfo)
-			require.False(t, h.server.extensionAsync)
-			require.False(t, h.server.extensionGetGitRemoteName)
-			require.False(t, h.server.extensionUnavailableResponse)
+	h.requireReadLineExact("VERSION 1")
+	h.requireWriteLine("EXTENSIONS ASYNC")
+	h.requireReadLineExact("EXTENSIONS")
+	h.requireWriteLine("CHECKPRESENT SomeKey")
+	h.requireReadLineExact("CHECKPRESENT-FAILURE SomeKey")
+	h.requireWriteLine("J 1 CHECKPRESENT SomeKey")
+	require.NoError(t, h.mockStdinW.Close())
+	require.ErrorContains(t, <-serverErrorChan, "received unexpected message from git-annex")
+}
 
-			h.requireWriteLine("EXTENSIONS INFO")
-			h.requireReadLineExact("EXTENSIONS")
-			require.True(t, h.server.extensionInfo)
-			require.False(t, h.server.extensionAsync)
-			require.False(t, h.server.extensionGetGitRemoteName)
-			require.False(t, h.server.extensionUnavailableResponse)
+// slowFs wraps an Fs whose lookups take `latency`, and counts them.
+type slowFs struct {
+	fs.Fs
+	latency time.Duration
+	lookups atomic.Int32
+}
 
-			h.requireWriteLine("EXTENSIONS INFO")
-			h.requireReadLineExact("EXTENSIONS")
-			require.True(t, h.server.extensionInfo)
-			require.False(t, h.server.extensionAsync)
-			require.False(t, h.server.extensionGetGitRemoteName)
-			require.False(t, h.server.extensionUnavailableResponse)
+func (f *slowFs) NewObject(ctx context.Context, remote string) (fs.Object, error) {
+	f.lookups.Add(1)
+	time.Sleep(f.latency)
+	return f.Fs.NewObject(ctx, remote)
+}
 
-			h.requireWriteLine("EXTENSIONS ASYNC ASYNC")
-			h.requireReadLineExact("EXTENSIONS")
-			require.True(t, h.server.extensionInfo)
-			require.True(t, h.server.extensionAsync)
-			require.False(t, h.server.extensionGetGitRemoteName)
-			require.False(t, h.server.extensionUnavailableResponse)
+// newSlowServer returns a server whose remote, a fresh :memory: prefix holding
+// the keys "Key0", "Key2", ..., below `numKeys`, is wrapped in `slow`.
+func newSlowServer(tb testing.TB, slow *slowFs, numKeys int, reader io.Reader, writer io.Writer) *server {
+	ctx := context.Background()
+	prefix := "slow-" + random.String(8)
+	remoteFs, err := cache.Get(ctx, ":memory:"+prefix)
+	require.NoError(tb, err)
+	for i := 0; i < numKeys; i += 2 {
+		_, err := operations.Rcat(ctx, remoteFs, fmt.Sprintf("Key%d", i), io.NopCloser(strings.NewReader("HELLO")), time.Now(), nil)
+		require.NoError(tb, err)
+	}
+	slow.Fs = remoteFs
 
-			require.NoError(t, h.mockStdinW.Close())
+	s := &server{
+		reader: bufio.NewReader(reader),
+		writer: writer,
+		getFs: func(ctx context.Context, fsString string) (fs.Fs, error) {
+			return slow, nil
 		},
-	},
-	{
-		label: "ExtensionsSupportsMultiple",
-		testProtocolFunc: func(t *testing.T, h *testState) {
-			h.preconfigureServer()
+	}
+	for _, config := range requiredConfigs {
+		s.mustSetConfigValue(config.id, config.defaultValue)
+	}
+	s.configRcloneRemoteName = ":memory:"
+	s.configPrefix = prefix
+	s.configRcloneLayout = string(layoutModeNodir)
+	// Listings answer every key at once, which would hide the lookups.
+	s.configRcloneCheckPresentWindow = "0"
+	s.configsDone = true
+	return s
+}
 
-			h.requireReadLineExact("VERSION 1")
-			h.requireWriteLine("INITREMOTE")
-			h.requireReadLineExact("INITREMOTE-SUCCESS")
+// TestExtensionsNegotiation checks which extensions the server activates by
+// listing them in its EXTENSIONS reply. It is a checklist: when an extension is
+// fully implemented and the server starts listing it, flip its entry here.
+func TestExtensionsNegotiation(t *testing.T) {
+	activated := map[string]bool{
+		"INFO":                true,
+		"ASYNC":               false,
+		"GETGITREMOTENAME":    true,
+		"UNAVAILABLERESPONSE": false,
+	}
+	offered := make([]string, 0, len(activated))
+	for extension := range activated {
+		offered = append(offered, extension)
+	}
 
-			h.requireWriteLine("EXTENSIONS")
-			h.requireReadLineExact("EXTENSIONS")
-			require.False(t, h.server.extensionInfo)
-			require.False(t, h.server.extensionAsync)
-			require.False(t, h.server.extensionGetGitRemoteName)
-			require.False(t, h.server.extensionUnavailableResponse)
+	h := makeTestState(t)
+	serverErrorChan := make(chan error)
+	go func() {
+		serverErrorChan <- h.server.run()
+	}()
 
-			h.requireWriteLine("EXTENSIONS INFO ASYNC")
-			h.requireReadLineExact("EXTENSIONS")
-			require.True(t, h.server.extensionInfo)
-			require.True(t, h.server.extensionAsync)
-			require.False(t, h.server.extensionGetGitRemoteName)
-			require.False(t, h.server.extensionUnavailableResponse)
+	h.requireReadLineExact("VERSION 1")
+	h.requireWriteLine("EXTENSIONS " + strings.Join(offered, " "))
+	reply := messageParser{h.requireReadLine()}
+	command, err := reply.nextSpaceDelimitedParameter()
+	require.NoError(t, err)
+	require.Equal(t, "EXTENSIONS", command)
+	replied := reply.AllParameters()
+	// With INFO offered, the server sends a session summary at the end.
+	go func() {
+		_, _ = io.Copy(io.Discard, h.mockStdoutReader)
+	}()
+	require.NoError(t, h.mockStdinW.Close())
+	require.NoError(t, <-serverErrorChan)
 
-			require.NoError(t, h.mockStdinW.Close())
-		},
-	},
-	{
-		label: "TransferStoreAbsolute",
-		testProtocolFunc: func(t *testing.T, h *testState) {
-			h.preconfigureServer()
+	for extension, wantActivated := range activated {
+		t.Run(extension, func(t *testing.T) {
+			if wantActivated {
+				require.Contains(t, replied, extension)
+			} else {
+				require.NotContains(t, replied, extension)
+			}
+		})
+	}
+	// The server must not activate extensions that git-annex did not offer.
+	for _, extension := range replied {
+		require.Contains(t, activated, extension)
+	}
+}
+
+func TestExtensionsRecorded(t *testing.T) {
+	type extensions struct {
+		info, async, getGitRemoteName, unavailableResponse bool
+	}
+	for _, tc := range []struct {
+		offered string
+		want    extensions
+	}{
+		{"", extensions{}},
+		{"INFO", extensions{info: true}},
+		{"ASYNC", extensions{async: true}},
+		{"GETGITREMOTENAME", extensions{getGitRemoteName: true}},
+		{"UNAVAILABLERESPONSE", extensions{unavailableResponse: true}},
+		{"INFO ASYNC", extensions{info: true, async: true}},
+		{"GETGITREMOTENAME UNAVAILABLERESPONSE", extensions{getGitRemoteName: true, unavailableResponse: true}},
+		{"INFO ASYNC GETGITREMOTENAME UNAVAILABLERESPONSE", extensions{true, true, true, true}},
+		// Unknown names are ignored, and so are names that differ in case.
+		{"FOO", extensions{}},
+		{"FOO ASYNC BAR-BAZ info", extensions{async: true}},
+	} {
+		t.Run(fmt.Sprintf("%q", tc.offered), func(t *testing.T) {
+			h := makeTestState(t)
+			serverErrorChan := make(chan error)
+			go func() {
+				serverErrorChan <- h.server.run()
+			}()
 
 			h.requireReadLineExact("VERSION 1")
-			h.requireWriteLine("INITREMOTE")
-			h.requireReadLineExact("INITREMOTE-SUCCESS")
+			h.requireWriteLine(strings.TrimRight("EXTENSIONS "+tc.offered, " "))
+			reply := messageParser{h.requireReadLine()}
+			command, err := reply.nextSpaceDelimitedParameter()
+			require.NoError(t, err)
+			require.Equal(t, "EXTENSIONS", command)
+			for _, extension := range reply.AllParameters() {
+				require.Contains(t, []string{"INFO", "ASYNC", "GETGITREMOTENAME", "UNAVAILABLERESPONSE"}, extension)
+				require.Contains(t, strings.Fields(tc.offered), extension)
+			}
+			// With INFO offered, the server sends a session summary at the end.
+			go func() {
+				_, _ = io.Copy(io.Discard, h.mockStdoutReader)
+			}()
+			require.NoError(t, h.mockStdinW.Close())
+			require.NoError(t, <-serverErrorChan)
+
+			require.Equal(t, tc.want, extensions{
+				info:                h.server.extensionInfo,
+				async:               h.server.extensionAsync,
+				getGitRemoteName:    h.server.extensionGetGitRemoteName,
+				unavailableResponse: h.server.extensionUnavailableResponse,
+			})
+		})
+	}
+}
 
-			// Create temp file for transfer with an absolute path.
-			item := h.fstestRun.WriteFile("file.txt", "HELLO", time.Now())
-			absPath := filepath.Join(h.fstestRun.Flocal.Root(), item.Path)
-			require.True(t, filepath.IsAbs(absPath))
+func TestMaxTransferSize(t *testing.T) {
+	ctx := context.Background()
+	localDir := t.TempDir()
+	emptyPath := filepath.Join(localDir, "empty.txt")
+	require.NoError(t, os.WriteFile(emptyPath, nil, 0600))
+	twoBytePath := filepath.Join(localDir, "two.txt")
+	require.NoError(t, os.WriteFile(twoBytePath, []byte("AB"), 0600))
+
+	h := makeTestState(t)
+	h.remoteName = ":memory:"
+	h.remotePrefix = "maxsize-" + random.String(8)
+	h.preconfigureServer()
+	h.server.configRcloneMaxTransferSize = "1B"
+
+	// Store a key that is too large for the limit behind the server's back.
+	remoteFsString, err := buildFsString(nil, layoutModeNodir, "", h.remoteName, h.remotePrefix)
+	require.NoError(t, err)
+	remoteFs, err := cache.Get(ctx, remoteFsString)
+	require.NoError(t, err)
+	in := io.NopCloser(strings.NewReader("AB"))
+	_, err = operations.RcatSize(ctx, remoteFs, "LargeKey", in, 2, time.Now(), nil)
+	require.NoError(t, err)
+
+	serverErrorChan := make(chan error)
+	go func() {
+		serverErrorChan <- h.server.run()
+	}()
 
-			// Specify an absolute path to transfer.
-			h.requireWriteLine("TRANSFER STORE KeyAbsolute " + absPath)
-			h.requireReadLineExact("TRANSFER-SUCCESS STORE KeyAbsolute")
+	h.requireReadLineExact("VERSION 1")
+	h.requireWriteLine("TRANSFER STORE EmptyKey " + emptyPath)
+	h.requireReadLineExact("TRANSFER-SUCCESS STORE EmptyKey")
+	h.requireWriteLine("TRANSFER STORE TwoByteKey " + twoBytePath)
+	h.requireReadLineExact("TRANSFER-FAILURE STORE TwoByteKey [E007] file too large: 2 B > 1 B")
+	h.requireWriteLine("TRANSFER RETRIEVE LargeKey " + filepath.Join(localDir, "retrieved.txt"))
+	h.requireReadLineExact("TRANSFER-FAILURE RETRIEVE LargeKey [E007] file too large: 2 B > 1 B")
+	require.NoError(t, h.mockStdinW.Close())
+	require.NoError(t, <-serverErrorChan)
+
+	_, err = remoteFs.NewObject(ctx, "TwoByteKey")
+	require.ErrorIs(t, err, fs.ErrorObjectNotFound)
+	require.NoFileExists(t, filepath.Join(localDir, "retrieved.txt"))
+}
 
-			// Check that the file was transferred.
-			remoteItem := fstest.NewItem("KeyAbsolute", "HELLO", item.ModTime)
-			h.fstestRun.CheckRemoteItems(t, remoteItem)
+func TestRemoteOverride(t *testing.T) {
+	require.NotNil(t, command.Flags().Lookup("remote-override"))
 
-			// Transfer the same absolute path a second time, but with a different key.
-			h.requireWriteLine("TRANSFER STORE KeyAbsolute2 " + absPath)
-			h.requireReadLineExact("TRANSFER-SUCCESS STORE KeyAbsolute2")
+	remoteDir := t.TempDir()
+	localPath := filepath.Join(t.TempDir(), "file.txt")
+	require.NoError(t, os.WriteFile(localPath, []byte("HELLO"), 0600))
 
-			// Check that the same file was transferred to a new name.
-			remoteItem2 := fstest.NewItem("KeyAbsolute2", "HELLO", item.ModTime)
-			h.fstestRun.CheckRemoteItems(t, remoteItem, remoteItem2)
+	h := makeTestState(t)
+	h.server.remoteOverride = ":local:"
 
-			h.requireWriteLine("CHECKPRESENT KeyAbsolute2")
-			h.requireReadLineExact("CHECKPRESENT-SUCCESS KeyAbsolute2")
+	serverErrorChan := make(chan error)
+	go func() {
+		serverErrorChan <- h.server.run()
+	}()
 
-			h.requireWriteLine("CHECKPRESENT KeyThatDoesNotExist")
-			h.requireReadLineExact("CHECKPRESENT-FAILURE KeyThatDoesNotExist")
+	h.requireReadLineExact("VERSION 1")
+	h.requireWriteLine("INITREMOTE")
+	// Git-annex is not asked for "rcloneremotename", so an empty answer would
+	// end the session.
+	require.Equal(t, "INITREMOTE-SUCCESS\n", h.answerConfigs(map[string]string{"rcloneprefix": remoteDir}))
+	h.requireWriteLine("PREPARE")
+	h.requireReadLineExactAfterConfigs("PREPARE-SUCCESS")
+
+	h.requireWriteLine("TRANSFER STORE SomeKey " + localPath)
+	h.requireReadLineExact("TRANSFER-SUCCESS STORE SomeKey")
+	content, err := os.ReadFile(filepath.Join(remoteDir, "SomeKey"))
+	require.NoError(t, err)
+	require.Equal(t, "HELLO", string(content))
+
+	h.requireWriteLine("REMOVE SomeKey")
+	h.requireReadLineExact("REMOVE-SUCCESS SomeKey")
+	require.NoFileExists(t, filepath.Join(remoteDir, "SomeKey"))
+
+	require.NoError(t, h.mockStdinW.Close())
+	require.NoError(t, <-serverErrorChan)
+	require.Equal(t, ":local:", h.server.configRcloneRemoteName)
+}
 
-			require.NoError(t, h.mockStdinW.Close())
-		},
-	},
-	// Test that the TRANSFER command understands simple relative paths
-	// consisting only of a file name.
-	{
-		label: "TransferStoreRelative",
-		testProtocolFunc: func(t *testing.T, h *testState) {
-			// Save the current working directory so we can restore it when this
-			// test ends.
-			cwd, err := os.Getwd()
-			require.NoError(t, err)
+// TestMain drives the tests
+func TestMain(m *testing.M) {
+	fstest.TestMain(m)
+}
 
-			tempDir := t.TempDir()
+// Run fstest-compatible test cases with backend selected by `-remote`.
+func TestGitAnnexFstestBackendCases(t *testing.T) {
 
-			require.NoError(t, os.Chdir(tempDir))
-			t.Cleanup(func() { require.NoError(t, os.Chdir(cwd)) })
+	for _, testCase := range fstestTestCases {
+		t.Run(testCase.label, func(t *testing.T) {
+			r := fstest.NewRun(t)
+			t.Cleanup(func() { r.Finalise() })
 
-			h.preconfigureServer()
+			// Parse the fstest-provided remote string. It might have a path!
+			remoteName, remotePath, err := fspath.SplitFs(r.FremoteName)
+			require.NoError(t, err)
 
-			h.requireReadLineExact("VERSION 1")
-			h.requireWriteLine("INITREMOTE")
-			h.requireReadLineExact("INITREMOTE-SUCCESS")
+			// The gitannex command requires the `rcloneremotename` is the name
+			// of a remote or a colon-prefixed backend name like ":local:", so
+			// the empty string will not suffice.
+			if remoteName == "" {
+				require.True(t, r.Fremote.Features().IsLocal)
+				remoteName = ":local:"
+			}
 
-			item := h.fstestRun.WriteFile("file.txt", "HELLO", time.Now())
-			absPath := filepath.Join(h.fstestRun.Flocal.Root(), item.Path)
+			handle := makeTestState(t)
+			handle.fstestRun = r
+			handle.remoteName = remoteName
+			handle.remotePrefix = remotePath
 
-			relativePath, err := relativeFilepathWorkaround(tempDir, absPath)
-			require.NoError(t, err)
-			require.False(t, filepath.IsAbs(relativePath))
-			require.FileExists(t, relativePath)
+			serverErrorChan := make(chan error)
 
-			// Specify a relative path to transfer.
-			h.requireWriteLine("TRANSFER STORE KeyRelative " + relativePath)
-			h.requireReadLineExact("TRANSFER-SUCCESS STORE KeyRelative")
+			go func() {
+				// Run the gitannex server and send the result back to the
+				// goroutine associated with `t`. We can't use `require` here
+				// because it could call `t.FailNow()`, which says it must be
+				// called on the goroutine associated with the test.
+				serverErrorChan <- handle.server.run()
+			}()
 
-			remoteItem := fstest.NewItem("KeyRelative", "HELLO", item.ModTime)
-			h.fstestRun.CheckRemoteItems(t, remoteItem)
+			testCase.testProtocolFunc(t, &handle)
+
+			// The server may send a session summary after the test case
+			// closes stdin. Discard any output the test case did not read so
+			// that the server can return.
+			go func() {
+				_, _ = io.Copy(io.Discard, handle.mockStdoutReader)
+			}()
 
-			h.requireWriteLine("CHECKPRESENT KeyRelative")
-			h.requireReadLineExact("CHECKPRESENT-SUCCESS KeyRelative")
+			serverError, ok := <-serverErrorChan
+			require.True(t, ok, "Should receive one error/nil from server")
+			require.Empty(t, serverErrorChan)
 
-			h.requireWriteLine("CHECKPRESENT KeyThatDoesNotExist")
-			h.requireReadLineExact("CHECKPRESENT-FAILURE KeyThatDoesNotExist")
+			if testCase.expectedError == "" {
+				require.NoError(t, serverError)
+			} else {
+				require.ErrorContains(t, serverError, testCase.expectedError)
+			}
+		})
+	}
+}
 
-			require.NoError(t, h.mockStdinW.Close())
-		},
-	},
-	{
-		label: "TransferStorePathWithInteriorWhitespace",
-		testProtocolFunc: func(t *testing.T, h *testState) {
-			// Save the current working directory so we can restore it when this
-			// test ends.
-			cwd, err := os.Getwd()
-			require.NoError(t, err)
+// failMoveFs wraps an Fs whose server-side moves fail with `moveErr`.
+type failMoveFs struct {
+	fs.Fs
+	moveErr error
+}
 
-			tempDir := t.TempDir()
-			require.NoError(t, os.Chdir(tempDir))
-			t.Cleanup(func() { require.NoError(t, os.Chdir(cwd)) })
+func (f *failMoveFs) Features() *fs.Features {
+	features := *f.Fs.Features()
+	features.Move = func(ctx context.Context, src fs.Object, remote string) (fs.Object, error) {
+		return nil, f.moveErr
+	}
+	return &features
+}
 
-			h.preconfigureServer()
+func TestTemporaryPrefixConfig(t *testing.T) {
+	require.NoError(t, validateTemporaryPrefix("", "git-annex-rclone"))
+	require.NoError(t, validateTemporaryPrefix("git-annex-tmp", "git-annex-rclone"))
+	require.EqualError(t, validateTemporaryPrefix("git-annex-rclone/", "git-annex-rclone"),
+		`temporary prefix must differ from prefix: "git-annex-rclone/"`)
 
-			h.requireReadLineExact("VERSION 1")
-			h.requireWriteLine("INITREMOTE")
-			h.requireReadLineExact("INITREMOTE-SUCCESS")
+	localPath := filepath.Join(t.TempDir(), "file.txt")
+	require.NoError(t, os.WriteFile(localPath, []byte("HELLO"), 0600))
 
-			// Create temp file for transfer.
-			item := h.fstestRun.WriteFile("filename with spaces.txt", "HELLO", time.Now())
-			absPath := filepath.Join(h.fstestRun.Flocal.Root(), item.Path)
-			relativePath, err := relativeFilepathWorkaround(tempDir, absPath)
-			require.NoError(t, err)
-			require.False(t, filepath.IsAbs(relativePath))
-			require.FileExists(t, relativePath)
+	// store runs a session that stores SomeKey via a temporary prefix and
+	// returns the reply, the prefix and temporary directories, and the
+	// server's error. When `moveErr` is set, moving into the prefix fails.
+	store := func(moveErr error) (reply, remoteDir, temporaryDir string, err error) {
+		h := makeTestState(t)
+		remoteDir, temporaryDir = t.TempDir(), t.TempDir()
+		h.remoteName = ":local:"
+		h.remotePrefix = remoteDir
+		h.preconfigureServer()
+		h.server.configRcloneTemporaryPrefix = temporaryDir
+		h.server.getFs = func(ctx context.Context, fsString string) (fs.Fs, error) {
+			f, err := cache.Get(ctx, fsString)
+			if err == nil && moveErr != nil && strings.Contains(fsString, remoteDir) {
+				f = &failMoveFs{Fs: f, moveErr: moveErr}
+			}
+			return f, err
+		}
 
-			// Specify a relative path to transfer.
-			h.requireWriteLine("TRANSFER STORE KeyRelative " + relativePath)
-			h.requireReadLineExact("TRANSFER-SUCCESS STORE KeyRelative")
+		serverErrorChan := make(chan error)
+		go func() {
+			serverErrorChan <- h.server.run()
+		}()
 
-			remoteItem := fstest.NewItem("KeyRelative", "HELLO", item.ModTime)
-			h.fstestRun.CheckRemoteItems(t, remoteItem)
+		h.requireReadLineExact("VERSION 1")
+		h.requireWriteLine("TRANSFER STORE SomeKey " + localPath)
+		reply = h.requireReadLine()
+		require.NoError(t, h.mockStdinW.Close())
+		return reply, remoteDir, temporaryDir, <-serverErrorChan
+	}
 
-			h.requireWriteLine("CHECKPRESENT KeyRelative")
-			h.requireReadLineExact("CHECKPRESENT-SUCCESS KeyRelative")
+	t.Run("Moves", func(t *testing.T) {
+		reply, remoteDir, temporaryDir, err := store(nil)
+		require.NoError(t, err)
+		require.Equal(t, "TRANSFER-SUCCESS STORE SomeKey\n", reply)
+		require.FileExists(t, filepath.Join(remoteDir, "SomeKey"))
+		require.NoFileExists(t, filepath.Join(temporaryDir, "SomeKey"))
+	})
 
-			h.requireWriteLine("CHECKPRESENT KeyThatDoesNotExist")
-			h.requireReadLineExact("CHECKPRESENT-FAILURE KeyThatDoesNotExist")
+	t.Run("CleansUpFailedMove", func(t *testing.T) {
+		moveErr := errors.New("permission denied")
+		reply, remoteDir, temporaryDir, err := store(moveErr)
+		require.Equal(t, "TRANSFER-FAILURE STORE SomeKey [E003] failed to move from temporary prefix: permission denied\n", reply)
+		require.ErrorAs(t, err, new(*ErrTransferFailed))
+		require.ErrorIs(t, err, moveErr)
+		require.NoFileExists(t, filepath.Join(remoteDir, "SomeKey"))
+		require.NoFileExists(t, filepath.Join(temporaryDir, "SomeKey"))
+	})
+}
 
-			require.NoError(t, h.mockStdinW.Close())
-		},
-	},
-	{
-		label: "CheckPresentAndTransfer",
-		testProtocolFunc: func(t *testing.T, h *testState) {
+func TestCompressConfig(t *testing.T) {
+	for _, tc := range []struct {
+		compress    string
+		level       string
+		wantEnabled bool
+		wantLevel   int
+		wantErr     string
+	}{
+		{compress: "no", level: "6"},
+		{compress: "", level: "bogus"},
+		{compress: "yes", level: "6", wantEnabled: true, wantLevel: 6},
+		{compress: "yes", level: "", wantEnabled: true, wantLevel: 6},
+		{compress: "true", level: "-2", wantEnabled: true, wantLevel: -2},
+		{compress: "yes", level: "10", wantErr: `compress level must be an integer from -2 to 9: "10"`},
+		{compress: "yes", level: "max", wantErr: `compress level must be an integer from -2 to 9: "max"`},
+	} {
+		enabled, level, err := parseCompression(tc.compress, tc.level)
+		if tc.wantErr != "" {
+			require.EqualError(t, err, tc.wantErr)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, tc.wantEnabled, enabled)
+		require.Equal(t, tc.wantLevel, level)
+	}
+
+	for _, encrypt := range []string{"", "secret"} {
+		t.Run(fmt.Sprintf("encrypt=%q", encrypt), func(t *testing.T) {
+			content := []byte(strings.Repeat("All work and no play makes Jack a dull boy.\n", 1000))
+			localPath := filepath.Join(t.TempDir(), "file.txt")
+			require.NoError(t, os.WriteFile(localPath, content, 0600))
+			retrievedPath := filepath.Join(t.TempDir(), "retrieved.txt")
+			remoteDir := t.TempDir()
+
+			h := makeTestState(t)
+			h.remoteName = ":local:"
+			h.remotePrefix = remoteDir
 			h.preconfigureServer()
+			h.server.configRcloneCompress = "yes"
+			h.server.configRcloneCompressLevel = "9"
+			h.server.configRcloneEncrypt = encrypt
 
-			// Create temp file for transfer.
-			item := h.fstestRun.WriteFile("file.txt", "HELLO", time.Now())
-			absPath := filepath.Join(h.fstestRun.Flocal.Root(), item.Path)
-			require.True(t, filepath.IsAbs(absPath))
+			serverErrorChan := make(chan error)
+			go func() {
+				serverErrorChan <- h.server.run()
+			}()
 
 			h.requireReadLineExact("VERSION 1")
-			h.requireWriteLine("INITREMOTE")
-			h.requireReadLineExact("INITREMOTE-SUCCESS")
+			h.requireWriteLine("TRANSFER STORE SomeKey " + localPath)
+			h.requireReadLineExact("TRANSFER-SUCCESS STORE SomeKey")
+			h.requireWriteLine("CHECKPRESENT SomeKey")
+			h.requireReadLineExact("CHECKPRESENT-SUCCESS SomeKey")
+			h.requireWriteLine("TRANSFER RETRIEVE SomeKey " + retrievedPath)
+			h.requireReadLineExact("TRANSFER-SUCCESS RETRIEVE SomeKey")
+			require.NoError(t, h.mockStdinW.Close())
+			require.NoError(t, <-serverErrorChan)
 
-			h.requireWriteLine("CHECKPRESENT KeyThatDoesNotExist")
-			h.requireReadLineExact("CHECKPRESENT-FAILURE KeyThatDoesNotExist")
+			retrieved, err := os.ReadFile(retrievedPath)
+			require.NoError(t, err)
+			require.Equal(t, content, retrieved)
+
+			// The compress backend stores the object under another name,
+			// next to a small metadata file.
+			require.NoFileExists(t, filepath.Join(remoteDir, "SomeKey"))
+			var storedSize int64
+			require.NoError(t, filepath.Walk(remoteDir, func(path string, info os.FileInfo, err error) error {
+				if err == nil && info.Mode().IsRegular() {
+					storedSize += info.Size()
+				}
+				return err
+			}))
+			require.Positive(t, storedSize)
+			require.Less(t, storedSize, int64(len(content))/10)
+		})
+	}
+}
 
-			// Specify an absolute path to transfer.
-			h.requireWriteLine("TRANSFER STORE KeyAbsolute " + absPath)
-			h.requireReadLineExact("TRANSFER-SUCCESS STORE KeyAbsolute")
+func TestSnapshotPrefixConfig(t *testing.T) {
+	for _, tc := range []struct {
+		value   string
+		want    string
+		wantErr string
+	}{
+		{value: "", want: ""},
+		{value: "snap/2024-01-01", want: "snap/2024-01-01"},
+		{value: "/snap/2024-01-01/", want: "snap/2024-01-01"},
+		{value: "snap", wantErr: `snapshot prefix must lie within a directory of snapshots, e.g. "snap/2024-01-01": "snap"`},
+		{value: "annex/snap", wantErr: `snapshot prefix must not lie within prefix: "annex/snap"`},
+	} {
+		got, err := parseSnapshotPrefix(tc.value, "annex")
+		if tc.wantErr != "" {
+			require.EqualError(t, err, tc.wantErr)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, tc.want, got)
+	}
 
-			remoteItem := fstest.NewItem("KeyAbsolute", "HELLO", item.ModTime)
-			h.fstestRun.CheckRemoteItems(t, remoteItem)
+	ctx := context.Background()
+	root := "snapshots-" + random.String(8)
+	snapFs, err := cache.Get(ctx, ":memory:"+root+"/snap")
+	require.NoError(t, err)
+	names, err := listSnapshotPrefixes(ctx, snapFs)
+	require.NoError(t, err)
+	require.Empty(t, names)
+
+	localPath := filepath.Join(t.TempDir(), "file.txt")
+	require.NoError(t, os.WriteFile(localPath, []byte("HELLO"), 0600))
+	retrievedPath := filepath.Join(t.TempDir(), "retrieved.txt")
+
+	// session runs a server that stores to `snapshotPrefix`, sending each
+	// request and expecting the matching reply.
+	session := func(snapshotPrefix string, exchanges ...[2]string) {
+		h := makeTestState(t)
+		h.remoteName = ":memory:"
+		h.remotePrefix = root + "/annex"
+		h.preconfigureServer()
+		h.server.configRcloneSnapshotPrefix = snapshotPrefix
+
+		serverErrorChan := make(chan error)
+		go func() {
+			serverErrorChan <- h.server.run()
+		}()
+
+		h.requireReadLineExact("VERSION 1")
+		for _, exchange := range exchanges {
+			h.requireWriteLine(exchange[0])
+			h.requireReadLineExact(exchange[1])
+		}
+		require.NoError(t, h.mockStdinW.Close())
+		require.NoError(t, <-serverErrorChan)
+	}
 
-			require.NoError(t, h.mockStdinW.Close())
-		},
-	},
-	// Check whether a key is present, transfer a file with that key, then check
-	// again whether it is present.
-	//
-	// This is a regression test for a bug where the second CHECKPRESENT would
-	// generate the following response:
-	//
-	//	CHECKPRESENT-UNKNOWN ${key} failed to read directory entry: readdirent ${filepath}: not a directory
-	//
-	// This message was generated by the local backend's `List()` function. When
-	// checking whether a file exists, we were erroneously listing its contents as
-	// if it were a directory.
-	{
-		label: "CheckpresentTransferCheckpresent",
-		testProtocolFunc: func(t *testing.T, h *testState) {
-			h.preconfigureServer()
+	session("",
+		[2]string{"TRANSFER STORE KeyMain " + localPath, "TRANSFER-SUCCESS STORE KeyMain"},
+	)
+	session(root+"/snap/2024-01-01",
+		[2]string{"TRANSFER STORE KeyA " + localPath, "TRANSFER-SUCCESS STORE KeyA"},
+		// Keys are found in either prefix.
+		[2]string{"CHECKPRESENT KeyA", "CHECKPRESENT-SUCCESS KeyA"},
+		[2]string{"CHECKPRESENT KeyMain", "CHECKPRESENT-SUCCESS KeyMain"},
+		// Only the copy in rcloneprefix is removed.
+		[2]string{"REMOVE KeyA", "REMOVE-SUCCESS KeyA"},
+		[2]string{"CHECKPRESENT KeyA", "CHECKPRESENT-SUCCESS KeyA"},
+		[2]string{"REMOVE KeyMain", "REMOVE-SUCCESS KeyMain"},
+		[2]string{"CHECKPRESENT KeyMain", "CHECKPRESENT-FAILURE KeyMain"},
+	)
+	// Keys in older snapshots are still found.
+	session(root+"/snap/2024-02-01",
+		[2]string{"TRANSFER STORE KeyB " + localPath, "TRANSFER-SUCCESS STORE KeyB"},
+		[2]string{"CHECKPRESENT KeyA", "CHECKPRESENT-SUCCESS KeyA"},
+		[2]string{"TRANSFER RETRIEVE KeyA " + retrievedPath, "TRANSFER-SUCCESS RETRIEVE KeyA"},
+	)
+	retrieved, err := os.ReadFile(retrievedPath)
+	require.NoError(t, err)
+	require.Equal(t, "HELLO", string(retrieved))
+	// Without a snapshot prefix, snapshots are not searched.
+	session("",
+		[2]string{"CHECKPRESENT KeyA", "CHECKPRESENT-FAILURE KeyA"},
+	)
+
+	names, err = listSnapshotPrefixes(ctx, snapFs)
+	require.NoError(t, err)
+	require.Equal(t, []string{"2024-02-01", "2024-01-01"}, names)
+	for _, remote := range []string{"2024-01-01/KeyA", "2024-02-01/KeyB"} {
+		_, err := snapFs.NewObject(ctx, remote)
+		require.NoError(t, err, remote)
+	}
+}
 
-			// Create temp file for transfer.
-			item := h.fstestRun.WriteFile("file.txt", "HELLO", time.Now())
-			absPath := filepath.Join(h.fstestRun.Flocal.Root(), item.Path)
-			require.True(t, filepath.IsAbs(absPath))
+// failPutFs wraps an Fs whose uploads fail with `err`.
+type failPutFs struct {
+	fs.Fs
+	err error
+}
 
-			h.requireReadLineExact("VERSION 1")
-			h.requireWriteLine("INITREMOTE")
-			h.requireReadLineExact("INITREMOTE-SUCCESS")
+func (f *failPutFs) Put(ctx context.Context, in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) (fs.Object, error) {
+	return nil, f.err
+}
 
-			h.requireWriteLine("CHECKPRESENT foo")
-			h.requireReadLineExact("CHECKPRESENT-FAILURE foo")
+func TestAllowFailConfig(t *testing.T) {
+	require.True(t, isTransientError(fserrors.RetryErrorf("connection reset")))
+	require.True(t, isTransientError(&ErrTransferFailed{protocolError("TRANSFER-FAILURE", io.ErrUnexpectedEOF)}))
+	require.False(t, isTransientError(errors.New("permission denied")))
+	require.False(t, isTransientError(nil))
 
-			h.requireWriteLine("TRANSFER STORE foo " + absPath)
-			h.requireReadLineExact("TRANSFER-SUCCESS STORE foo")
+	localPath := filepath.Join(t.TempDir(), "file.txt")
+	require.NoError(t, os.WriteFile(localPath, []byte("HELLO"), 0600))
 
-			remoteItem := fstest.NewItem("foo", "HELLO", item.ModTime)
-			h.fstestRun.CheckRemoteItems(t, remoteItem)
+	// store runs a session with the INFO extension that stores KeyA to a
+	// remote whose uploads fail with `putErr`, then asks whether KeyA is
+	// present. It expects the server to send `want` and returns its error.
+	store := func(t *testing.T, allowFail, chunkSize string, putErr error, want ...string) error {
+		h := makeTestState(t)
+		h.remoteName = ":local:"
+		h.remotePrefix = t.TempDir()
+		h.preconfigureServer()
+		h.server.configRcloneAllowFail = allowFail
+		h.server.configRcloneChunkSize = chunkSize
+		// Transient errors are retried, which need not take long here.
+		h.server.configRcloneRetryDelay = "1ms"
+		h.server.getFs = func(ctx context.Context, fsString string) (fs.Fs, error) {
+			f, err := cache.Get(ctx, fsString)
+			if err != nil {
+				return nil, err
+			}
+			return &failPutFs{Fs: f, err: putErr}, nil
+		}
 
-			h.requireWriteLine("CHECKPRESENT foo")
-			h.requireReadLineExact("CHECKPRESENT-SUCCESS foo")
+		serverErrorChan := make(chan error)
+		go func() {
+			serverErrorChan <- h.server.run()
+		}()
+
+		h.requireReadLineExact("VERSION 1")
+		h.requireWriteLine("EXTENSIONS INFO")
+		h.requireReadLineExact("EXTENSIONS INFO")
+		h.requireWriteLine("TRANSFER STORE KeyA " + localPath)
+		// When the session goes on, the server reads CHECKPRESENT. Otherwise,
+		// nothing reads it, so it is written in the background.
+		go func() {
+			_, _ = io.WriteString(h.mockStdinW, "CHECKPRESENT KeyA\n")
+			_ = h.mockStdinW.Close()
+		}()
+		for _, line := range want {
+			require.Equal(t, line+"\n", h.requireReadLine())
+		}
+		return <-serverErrorChan
+	}
 
-			require.NoError(t, h.mockStdinW.Close())
-		},
-	},
-	{
-		label: "TransferAndCheckpresentWithRealisticKey",
-		testProtocolFunc: func(t *testing.T, h *testState) {
-			h.preconfigureServer()
+	t.Run("SwallowsTransientError", func(t *testing.T) {
+		err := store(t, "yes", "0", fserrors.RetryErrorf("connection reset"),
+			"TRANSFER-FAILURE STORE KeyA [E003] failed to copy file: connection reset",
+			"INFO allow-fail: swallowed transient error: failed to copy file: connection reset",
+			"CHECKPRESENT-FAILURE KeyA",
+			"INFO session: 0 stores (0 B), 0 retrieves (0 B), 0 removes, 1 checkpresent",
+		)
+		require.NoError(t, err)
+	})
 
-			// Create temp file for transfer.
-			item := h.fstestRun.WriteFile("file.txt", "HELLO", time.Now())
-			absPath := filepath.Join(h.fstestRun.Flocal.Root(), item.Path)
-			require.True(t, filepath.IsAbs(absPath))
+	t.Run("DisabledEndsSession", func(t *testing.T) {
+		err := store(t, "no", "0", fserrors.RetryErrorf("connection reset"),
+			"TRANSFER-FAILURE STORE KeyA [E003] failed to copy file: connection reset",
+		)
+		require.ErrorAs(t, err, new(*ErrTransferFailed))
+	})
 
-			h.requireReadLineExact("VERSION 1")
-			h.requireWriteLine("INITREMOTE")
-			h.requireReadLineExact("INITREMOTE-SUCCESS")
+	t.Run("PermanentErrorEndsSession", func(t *testing.T) {
+		err := store(t, "yes", "0", errors.New("permission denied"),
+			"TRANSFER-FAILURE STORE KeyA [E003] failed to copy file: permission denied",
+		)
+		require.ErrorAs(t, err, new(*ErrTransferFailed))
+	})
 
-			realisticKey := "SHA256E-s1048576--7ba87e06b9b7903cfbaf4a38736766c161e3e7b42f06fe57f040aa410a8f0701.this-is-a-test-key"
+	t.Run("ConfigErrorEndsSession", func(t *testing.T) {
+		err := store(t, "yes", "bogus", fserrors.RetryErrorf("connection reset"),
+			`TRANSFER-FAILURE STORE KeyA [E001] failed to parse chunk size "bogus": bad suffix 's'`,
+		)
+		require.ErrorAs(t, err, new(*ErrConfigMissing))
+	})
+}
 
-			// Specify an absolute path to transfer.
-			h.requireWriteLine(fmt.Sprintf("TRANSFER STORE %s %s", realisticKey, absPath))
-			h.requireReadLineExact("TRANSFER-SUCCESS STORE " + realisticKey)
+func TestWarmCacheConfig(t *testing.T) {
+	stdinR, stdinW := io.Pipe()
+	stdoutR, stdoutW := io.Pipe()
+	slow := &slowFs{}
+	s := newSlowServer(t, slow, 4, stdinR, stdoutW)
+	s.configRcloneWarmCache = "yes"
+	h := testState{
+		t:                t,
+		server:           s,
+		mockStdinW:       stdinW,
+		mockStdoutReader: bufio.NewReader(stdoutR),
+		readLineTimeout:  30 * time.Second,
+	}
+	serverErrorChan := make(chan error)
+	go func() {
+		serverErrorChan <- s.run()
+	}()
 
-			remoteItem := fstest.NewItem(realisticKey, "HELLO", item.ModTime)
-			h.fstestRun.CheckRemoteItems(t, remoteItem)
+	h.requireReadLineExact("VERSION 1")
+	h.requireWriteLine("PREPARE")
+	h.requireReadLineExact("GETUUID")
+	h.requireWriteLine("VALUE " + testRemoteUUID)
+	h.requireReadLineExact("PREPARE-SUCCESS")
+	require.NotNil(t, s.presentKeys)
+	<-s.presentKeys.done
+
+	// A key found by the listing needs no lookup.
+	lookups := slow.lookups.Load()
+	h.requireWriteLine("CHECKPRESENT Key0")
+	h.requireReadLineExact("CHECKPRESENT-SUCCESS Key0")
+	require.Equal(t, lookups, slow.lookups.Load())
+
+	// Any other key is still looked up.
+	h.requireWriteLine("CHECKPRESENT Key1")
+	h.requireReadLineExact("CHECKPRESENT-FAILURE Key1")
+	require.Greater(t, slow.lookups.Load(), lookups)
+
+	// A removed key is no longer reported present.
+	h.requireWriteLine("REMOVE Key2")
+	h.requireReadLineExact("REMOVE-SUCCESS Key2")
+	h.requireWriteLine("CHECKPRESENT Key2")
+	h.requireReadLineExact("CHECKPRESENT-FAILURE Key2")
+
+	require.NoError(t, stdinW.Close())
+	require.NoError(t, <-serverErrorChan)
+}
 
-			h.requireWriteLine("CHECKPRESENT " + realisticKey)
-			h.requireReadLineExact("CHECKPRESENT-SUCCESS " + realisticKey)
+func TestOverwriteExistingConfig(t *testing.T) {
+	localPath := filepath.Join(t.TempDir(), "file.txt")
+	require.NoError(t, os.WriteFile(localPath, []byte("HELLO"), 0600))
 
-			require.NoError(t, h.mockStdinW.Close())
-		},
-	},
-	{
-		label: "RetrieveNonexistentFile",
-		testProtocolFunc: func(t *testing.T, h *testState) {
-			h.preconfigureServer()
+	// store runs a session that stores SomeKey over an existing object
+	// holding "OLD" and returns the reply and the object's content
+	// afterwards.
+	store := func(t *testing.T, overwriteExisting string) (reply, content string) {
+		h := makeTestState(t)
+		remoteDir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(remoteDir, "SomeKey"), []byte("OLD"), 0600))
+		h.remoteName = ":local:"
+		h.remotePrefix = remoteDir
+		h.preconfigureServer()
+		h.server.configRcloneOverwriteExisting = overwriteExisting
+
+		serverErrorChan := make(chan error)
+		go func() {
+			serverErrorChan <- h.server.run()
+		}()
+
+		h.requireReadLineExact("VERSION 1")
+		h.requireWriteLine("TRANSFER STORE SomeKey " + localPath)
+		reply = h.requireReadLine()
+		require.NoError(t, h.mockStdinW.Close())
+		require.NoError(t, <-serverErrorChan)
+		data, err := os.ReadFile(filepath.Join(remoteDir, "SomeKey"))
+		require.NoError(t, err)
+		return reply, string(data)
+	}
 
-			h.requireReadLineExact("VERSION 1")
-			h.requireWriteLine("INITREMOTE")
-			h.requireReadLineExact("INITREMOTE-SUCCESS")
+	t.Run("Overwrites", func(t *testing.T) {
+		reply, content := store(t, "yes")
+		require.Equal(t, "TRANSFER-SUCCESS STORE SomeKey\n", reply)
+		require.Equal(t, "HELLO", content)
+	})
 
-			h.requireWriteLine("TRANSFER RETRIEVE SomeKey path")
-			h.requireReadLineExact("TRANSFER-FAILURE RETRIEVE SomeKey not found")
+	t.Run("KeepsExisting", func(t *testing.T) {
+		reply, content := store(t, "no")
+		require.Equal(t, "TRANSFER-SUCCESS STORE SomeKey\n", reply)
+		require.Equal(t, "OLD", content)
+	})
+}
 
-			require.NoError(t, h.mockStdinW.Close())
-		},
-	},
-	{
-		label: "StoreCheckpresentRetrieve",
-		testProtocolFunc: func(t *testing.T, h *testState) {
-			h.preconfigureServer()
+func TestIgnoreCaseConfig(t *testing.T) {
+	ctx := context.Background()
+	remoteFs, err := cache.Get(ctx, ":memory:ignorecase-"+random.String(8))
+	require.NoError(t, err)
+	for _, name := range []string{"sha256e-s5--abc", "sha256e-s5--chunked.chunks", "SHA256E-s5--Other"} {
+		_, err := operations.Rcat(ctx, remoteFs, name, io.NopCloser(strings.NewReader("HELLO")), time.Now(), nil)
+		require.NoError(t, err)
+	}
+	require.NoError(t, findKeyIgnoringCase(ctx, remoteFs, "SHA256E-s5--abc", nil))
+	require.NoError(t, findKeyIgnoringCase(ctx, remoteFs, "SHA256E-s5--ABC", nil))
+	require.NoError(t, findKeyIgnoringCase(ctx, remoteFs, "SHA256E-s5--CHUNKED", nil))
+	require.ErrorIs(t, findKeyIgnoringCase(ctx, remoteFs, "SHA256E-s5--ab", nil), fs.ErrorObjectNotFound)
+	require.ErrorIs(t, findKeyIgnoringCase(ctx, remoteFs, "SHA256E-s5--abcd", nil), fs.ErrorObjectNotFound)
+
+	missingFs, err := cache.Get(ctx, ":memory:ignorecase-missing-"+random.String(8))
+	require.NoError(t, err)
+	require.ErrorIs(t, findKeyIgnoringCase(ctx, missingFs, "SHA256E-s5--abc", nil), fs.ErrorObjectNotFound)
+
+	// checkPresent runs a session that checks the presence of
+	// "SHA256E-s5--abc", stored as "sha256e-s5--abc", and returns the reply.
+	checkPresent := func(t *testing.T, ignoreCase string) string {
+		h := makeTestState(t)
+		remoteDir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(remoteDir, "sha256e-s5--abc"), []byte("HELLO"), 0600))
+		h.remoteName = ":local:"
+		h.remotePrefix = remoteDir
+		h.preconfigureServer()
+		h.server.configRcloneIgnoreCase = ignoreCase
+
+		serverErrorChan := make(chan error)
+		go func() {
+			serverErrorChan <- h.server.run()
+		}()
+
+		h.requireReadLineExact("VERSION 1")
+		h.requireWriteLine("CHECKPRESENT SHA256E-s5--abc")
+		reply := h.requireReadLine()
+		require.NoError(t, h.mockStdinW.Close())
+		require.NoError(t, <-serverErrorChan)
+		return reply
+	}
 
-			// Create temp file for transfer.
-			item := h.fstestRun.WriteFile("file.txt", "HELLO", time.Now())
-			absPath := filepath.Join(h.fstestRun.Flocal.Root(), item.Path)
-			require.True(t, filepath.IsAbs(absPath))
+	t.Run("Enabled", func(t *testing.T) {
+		require.Equal(t, "CHECKPRESENT-SUCCESS SHA256E-s5--abc\n", checkPresent(t, "yes"))
+	})
 
-			h.requireReadLineExact("VERSION 1")
-			h.requireWriteLine("INITREMOTE")
-			h.requireReadLineExact("INITREMOTE-SUCCESS")
+	t.Run("Disabled", func(t *testing.T) {
+		require.Equal(t, "CHECKPRESENT-FAILURE SHA256E-s5--abc\n", checkPresent(t, "no"))
+	})
+}
 
-			// Specify an absolute path to transfer.
-			h.requireWriteLine("TRANSFER STORE SomeKey " + absPath)
-			h.requireReadLineExact("TRANSFER-SUCCESS STORE SomeKey")
+func TestRetryDelayConfig(t *testing.T) {
+	r, err := parseRetrySchedule("", "")
+	require.NoError(t, err)
+	require.Equal(t, retrySchedule{delay: 2 * time.Second, maxDelay: time.Minute}, r)
+	_, err = parseRetrySchedule("bogus", "")
+	require.ErrorContains(t, err, `failed to parse retry delay "bogus"`)
+	_, err = parseRetrySchedule("-1s", "")
+	require.EqualError(t, err, `retry delay must not be negative: "-1s"`)
+	_, err = parseRetrySchedule("10s", "5s")
+	require.EqualError(t, err, "retry max delay 5s must not be less than retry delay 10s")
+
+	// The wait doubles after each attempt, up to the maximum, give or take
+	// 10%.
+	r = retrySchedule{delay: time.Second, maxDelay: 5 * time.Second}
+	for attempt, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		wait := r.wait(attempt)
+		require.GreaterOrEqual(t, wait, want*9/10, "attempt %d", attempt)
+		require.LessOrEqual(t, wait, want*11/10, "attempt %d", attempt)
+	}
 
-			remoteItem := fstest.NewItem("SomeKey", "HELLO", item.ModTime)
-			h.fstestRun.CheckRemoteItems(t, remoteItem)
+	ctx := context.Background()
+	r, err = parseRetrySchedule("1ms", "")
+	require.NoError(t, err)
+
+	t.Run("RetriesTransientErrors", func(t *testing.T) {
+		calls := 0
+		start := time.Now()
+		err := retryTransfer(ctx, 4, r, func() error {
+			calls++
+			if calls <= 3 {
+				return fserrors.RetryErrorf("connection reset")
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, 4, calls)
+		require.Less(t, time.Since(start), 50*time.Millisecond)
+	})
 
-			h.requireWriteLine("CHECKPRESENT SomeKey")
-			h.requireReadLineExact("CHECKPRESENT-SUCCESS SomeKey")
+	t.Run("GivesUp", func(t *testing.T) {
+		calls := 0
+		err := retryTransfer(ctx, 3, r, func() error {
+			calls++
+			return fserrors.RetryErrorf("connection reset")
+		})
+		require.EqualError(t, err, "connection reset")
+		require.Equal(t, 3, calls)
+	})
 
-			h.fstestRun.CheckLocalItems(t,
-				fstest.NewItem("file.txt", "HELLO", item.ModTime),
-			)
+	t.Run("PermanentError", func(t *testing.T) {
+		calls := 0
+		err := retryTransfer(ctx, 3, r, func() error {
+			calls++
+			return errors.New("permission denied")
+		})
+		require.EqualError(t, err, "permission denied")
+		require.Equal(t, 1, calls)
+	})
+}
 
-			retrievedFilePath := absPath + ".retrieved"
-			h.requireWriteLine("TRANSFER RETRIEVE SomeKey " + retrievedFilePath)
-			h.requireReadLineExact("TRANSFER-SUCCESS RETRIEVE SomeKey")
+func TestSHA256VerifyConfig(t *testing.T) {
+	const helloSum = "3733cd977ff8eb18b987357e22ced99f46097f31ecb239e878ae63760e83e4d5"
+	for _, tc := range []struct {
+		key  string
+		want string
+		ok   bool
+	}{
+		{key: "SHA256E-s5--" + helloSum + ".txt", want: helloSum, ok: true},
+		{key: "SHA256E-s5--" + helloSum, want: helloSum, ok: true},
+		{key: "SHA256-s5--" + helloSum, want: helloSum, ok: true},
+		{key: "SHA256-s5--" + helloSum + ".txt"},
+		{key: "SHA256E-s5--" + helloSum[:63] + ".txt"},
+		{key: "SHA256E-s5--" + strings.Repeat("z", 64)},
+		{key: "SHA256E-s5-S2-C1--" + helloSum},
+		{key: "SHA512E-s5--" + helloSum},
+		{key: "WORM-s5-m1--file.txt"},
+	} {
+		got, ok := sha256FromKey(tc.key)
+		require.Equal(t, tc.ok, ok, tc.key)
+		require.Equal(t, tc.want, got, tc.key)
+	}
 
-			h.fstestRun.CheckLocalItems(t,
-				fstest.NewItem("file.txt", "HELLO", item.ModTime),
-				fstest.NewItem("file.txt.retrieved", "HELLO", item.ModTime),
-			)
+	// retrieve runs a session that retrieves `key`, stored with `content`,
+	// and returns the reply and whether the local file exists afterwards.
+	retrieve := func(t *testing.T, key, content string) (reply string, exists bool) {
+		h := makeTestState(t)
+		remoteDir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(remoteDir, key), []byte(content), 0600))
+		h.remoteName = ":local:"
+		h.remotePrefix = remoteDir
+		h.preconfigureServer()
+		h.server.configRcloneSHA256Verify = "yes"
+
+		serverErrorChan := make(chan error)
+		go func() {
+			serverErrorChan <- h.server.run()
+		}()
+
+		localPath := filepath.Join(t.TempDir(), "file.txt")
+		h.requireReadLineExact("VERSION 1")
+		h.requireWriteLine("TRANSFER RETRIEVE " + key + " " + localPath)
+		reply = h.requireReadLine()
+		require.NoError(t, h.mockStdinW.Close())
+		<-serverErrorChan
+		_, err := os.Stat(localPath)
+		return reply, err == nil
+	}
+
+	t.Run("Matches", func(t *testing.T) {
+		key := "SHA256E-s5--" + helloSum + ".txt"
+		reply, exists := retrieve(t, key, "HELLO")
+		require.Equal(t, "TRANSFER-SUCCESS RETRIEVE "+key+"\n", reply)
+		require.True(t, exists)
+	})
+
+	t.Run("Mismatch", func(t *testing.T) {
+		key := "SHA256E-s5--" + helloSum + ".txt"
+		reply, exists := retrieve(t, key, "HELLp")
+		require.True(t, strings.HasPrefix(reply, "TRANSFER-FAILURE RETRIEVE "+key+" [E003] hash mismatch: expected "+helloSum), reply)
+		require.False(t, exists)
+	})
+
+	t.Run("OtherKeyType", func(t *testing.T) {
+		reply, exists := retrieve(t, "WORM-s5-m1--file.txt", "HELLp")
+		require.Equal(t, "TRANSFER-SUCCESS RETRIEVE WORM-s5-m1--file.txt\n", reply)
+		require.True(t, exists)
+	})
+}
 
-			require.NoError(t, h.mockStdinW.Close())
-		},
-	},
-	{
-		label: "RemovePreexistingFile",
-		testProtocolFunc: func(t *testing.T, h *testState) {
-			h.preconfigureServer()
+func TestPiggybackConfig(t *testing.T) {
+	aliasDir := t.TempDir()
+	configPath := filepath.Join(t.TempDir(), "piggyback.conf")
+	require.NoError(t, os.WriteFile(configPath, []byte("[PiggyRemote]\ntype = alias\nremote = "+aliasDir+"\n"), 0600))
+	// The remote is defined with environment variables, which t.Setenv
+	// removes again after the test.
+	t.Setenv(fs.ConfigToEnv("PiggyRemote", "type"), "")
+	t.Setenv(fs.ConfigToEnv("PiggyRemote", "remote"), "")
 
-			ctx := context.WithoutCancel(context.Background())
+	_, err := loadPiggybackConfig(filepath.Join(t.TempDir(), "missing.conf"))
+	require.ErrorContains(t, err, "failed to load piggyback config")
 
-			// Write a file into the remote without using the git-annex
-			// protocol.
-			remoteItem := h.fstestRun.WriteObject(ctx, "SomeKey", "HELLO", time.Now())
+	t.Run("StoresToPiggybackedRemote", func(t *testing.T) {
+		localPath := filepath.Join(t.TempDir(), "file.txt")
+		require.NoError(t, os.WriteFile(localPath, []byte("HELLO"), 0600))
 
-			h.fstestRun.CheckRemoteItems(t, remoteItem)
+		h := makeTestState(t)
+		serverErrorChan := make(chan error)
+		go func() {
+			serverErrorChan <- h.server.run()
+		}()
+		configs := map[string]string{
+			"rcloneremotename":      "PiggyRemote",
+			"rcloneprefix":          "annex",
+			"rclonelayout":          "nodir",
+			"rclonepiggybackconfig": configPath,
+		}
 
-			h.requireReadLineExact("VERSION 1")
-			h.requireWriteLine("INITREMOTE")
-			h.requireReadLineExact("INITREMOTE-SUCCESS")
+		h.requireReadLineExact("VERSION 1")
+		h.requireWriteLine("INITREMOTE")
+		require.Equal(t, "INITREMOTE-SUCCESS\n", h.answerConfigs(configs))
+		h.requireWriteLine("PREPARE")
+		require.Equal(t, "PREPARE-SUCCESS\n", h.answerConfigs(configs))
+		h.requireWriteLine("TRANSFER STORE SomeKey " + localPath)
+		h.requireReadLineExact("TRANSFER-SUCCESS STORE SomeKey")
+		require.FileExists(t, filepath.Join(aliasDir, "annex", "SomeKey"))
+
+		require.NoError(t, h.mockStdinW.Close())
+		require.NoError(t, <-serverErrorChan)
+	})
 
-			h.requireWriteLine("CHECKPRESENT SomeKey")
-			h.requireReadLineExact("CHECKPRESENT-SUCCESS SomeKey")
+	t.Run("ReportsOverride", func(t *testing.T) {
+		// The previous load defined the remote.
+		overridden, err := loadPiggybackConfig(configPath)
+		require.NoError(t, err)
+		require.Equal(t, []string{"PiggyRemote"}, overridden)
+	})
+}
 
-			h.fstestRun.CheckRemoteItems(t, remoteItem)
+func TestCheckIntervalConfig(t *testing.T) {
+	for _, tc := range []struct {
+		value   string
+		want    time.Duration
+		wantErr string
+	}{
+		{value: "", want: 0},
+		{value: "0", want: 0},
+		{value: "90s", want: 90 * time.Second},
+		{value: "1h", want: time.Hour},
+		{value: "-1s", wantErr: `check interval must not be negative: "-1s"`},
+		{value: "often", wantErr: `failed to parse check interval "often"`},
+	} {
+		got, err := parseCheckInterval(tc.value)
+		if tc.wantErr != "" {
+			require.ErrorContains(t, err, tc.wantErr)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, tc.want, got)
+	}
 
-			h.requireWriteLine("REMOVE SomeKey")
-			h.requireReadLineExact("REMOVE-SUCCESS SomeKey")
+	s := &server{}
+	for i := range maxRecentKeys + 10 {
+		s.addRecentKey(fmt.Sprintf("Key%d", i), "remote:")
+	}
+	require.Len(t, s.recentKeys, maxRecentKeys)
+	require.Equal(t, "Key10", s.recentKeys[0].key)
+	require.Len(t, s.sampleRecentKeys(), maxRecentKeys/100)
+	s.forgetRecentKey("Key10")
+	require.Equal(t, "Key11", s.recentKeys[0].key)
+
+	localPath := filepath.Join(t.TempDir(), "file.txt")
+	require.NoError(t, os.WriteFile(localPath, []byte("HELLO"), 0600))
+
+	h := makeTestState(t)
+	remoteDir := t.TempDir()
+	h.remoteName = ":local:"
+	h.remotePrefix = remoteDir
+	h.preconfigureServer()
+	h.server.configRcloneCheckInterval = "10ms"
+	serverErrorChan := make(chan error)
+	go func() {
+		serverErrorChan <- h.server.run()
+	}()
 
-			h.requireRemoteIsEmpty()
+	h.requireReadLineExact("VERSION 1")
+	h.requireWriteLine("EXTENSIONS INFO")
+	h.requireReadLineExact("EXTENSIONS INFO")
+	h.requireWriteLine("PREPARE")
+	h.requireReadLineExactAfterConfigs("PREPARE-SUCCESS")
+	h.requireWriteLine("TRANSFER STORE SomeKey " + localPath)
+	h.requireReadLineExact("TRANSFER-SUCCESS STORE SomeKey")
+
+	// While the key is present, the checks run without a word.
+	require.Eventually(t, func() bool {
+		h.server.mu.Lock()
+		defer h.server.mu.Unlock()
+		return h.server.integrityChecks > 0
+	}, 10*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, os.Remove(filepath.Join(remoteDir, "SomeKey")))
+	h.requireReadLineExact("INFO integrity-check: key SomeKey missing, was present")
+
+	// The checks may report the key again before the session ends.
+	go func() {
+		_, _ = io.Copy(io.Discard, h.mockStdoutReader)
+	}()
+	require.NoError(t, h.mockStdinW.Close())
+	require.NoError(t, <-serverErrorChan)
+	require.Nil(t, h.server.stopIntegrityChecksFunc)
+}
 
-			h.requireWriteLine("CHECKPRESENT SomeKey")
-			h.requireReadLineExact("CHECKPRESENT-FAILURE SomeKey")
+func TestObjectPrefixConfig(t *testing.T) {
+	for _, tc := range []struct {
+		value, want, wantErr string
+	}{
+		{value: "", want: ""},
+		{value: "objects", want: "objects"},
+		{value: "objects/", want: "objects"},
+		{value: "annex/objects", want: "annex/objects"},
+		{value: "/objects", wantErr: `object prefix must not start with "/"`},
+		{value: "../objects", wantErr: `object prefix must not contain ".."`},
+		{value: "objects/../..", wantErr: `object prefix must not contain ".."`},
+	} {
+		got, err := parseObjectPrefix(tc.value)
+		if tc.wantErr != "" {
+			require.ErrorContains(t, err, tc.wantErr)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, tc.want, got)
+	}
 
-			h.requireRemoteIsEmpty()
+	require.Equal(t, "remote:objects", joinObjectPrefix("remote:", "objects"))
+	require.Equal(t, "remote:prefix/objects", joinObjectPrefix("remote:prefix", "objects"))
+	require.Equal(t, "remote:prefix/f87/4d1/objects", joinObjectPrefix("remote:prefix/f87/4d1/", "objects"))
+	require.Equal(t, "remote:prefix", joinObjectPrefix("remote:prefix", ""))
 
-			require.NoError(t, h.mockStdinW.Close())
-		},
-	},
-	{
-		label: "Remove",
-		testProtocolFunc: func(t *testing.T, h *testState) {
-			h.preconfigureServer()
+	remoteDir := t.TempDir()
+	localPath := filepath.Join(t.TempDir(), "file.txt")
+	require.NoError(t, os.WriteFile(localPath, []byte("HELLO"), 0600))
 
-			// Create temp file for transfer.
-			item := h.fstestRun.WriteFile("file.txt", "HELLO", time.Now())
-			absPath := filepath.Join(h.fstestRun.Flocal.Root(), item.Path)
-			require.True(t, filepath.IsAbs(absPath))
+	h := makeTestState(t)
+	h.remoteName = ":local:"
+	h.remotePrefix = remoteDir
+	h.preconfigureServer()
+	h.server.configRcloneLayout = string(layoutModeLower)
+	h.server.configRcloneObjectPrefix = "objects"
 
-			h.requireReadLineExact("VERSION 1")
-			h.requireWriteLine("INITREMOTE")
-			h.requireReadLineExact("INITREMOTE-SUCCESS")
+	serverErrorChan := make(chan error)
+	go func() {
+		serverErrorChan <- h.server.run()
+	}()
 
-			h.requireWriteLine("CHECKPRESENT SomeKey")
-			h.requireReadLineExact("CHECKPRESENT-FAILURE SomeKey")
+	h.requireReadLineExact("VERSION 1")
+	h.requireWriteLine("TRANSFER STORE SomeKey " + localPath)
+	h.requireReadLineExact("DIRHASH-LOWER SomeKey")
+	h.requireWriteLine("VALUE f87/4d1/")
+	h.requireReadLineExact("TRANSFER-SUCCESS STORE SomeKey")
+	require.FileExists(t, filepath.Join(remoteDir, "f87", "4d1", "objects", "SomeKey"))
+	h.requireWriteLine("CHECKPRESENT SomeKey")
+	h.requireReadLineExact("CHECKPRESENT-SUCCESS SomeKey")
+
+	require.NoError(t, h.mockStdinW.Close())
+	require.NoError(t, <-serverErrorChan)
+
+	// The prefix directory itself is not affected.
+	prefixFs, err := h.server.getPrefixFs(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, filepath.ToSlash(remoteDir), filepath.ToSlash(prefixFs.Root()))
+}
 
-			// Specify an absolute path to transfer.
-			h.requireWriteLine("TRANSFER STORE SomeKey " + absPath)
-			h.requireReadLineExact("TRANSFER-SUCCESS STORE SomeKey")
+func TestFilterFlagsConfig(t *testing.T) {
+	fi, err := parseFilterFlags("")
+	require.NoError(t, err)
+	require.Nil(t, fi)
+	fi, err = parseFilterFlags("--exclude=*.DS_Store --exclude .metadata")
+	require.NoError(t, err)
+	require.False(t, fi.IncludeRemote("photos.DS_Store"))
+	require.False(t, fi.IncludeRemote(".metadata"))
+	require.True(t, fi.IncludeRemote("SHA256E-s5--abc"))
+	require.True(t, filterExcludesKey(fi, "SomeKey.DS_Store"))
+	require.False(t, filterExcludesKey(fi, "SomeKey"))
+	require.False(t, filterExcludesKey(nil, "SomeKey"))
+	_, err = parseFilterFlags("--dry-run")
+	require.ErrorContains(t, err, "unknown flag: --dry-run")
+	_, err = parseFilterFlags("--exclude *.tmp *.bak")
+	require.EqualError(t, err, `failed to parse filter flags "--exclude *.tmp *.bak": unexpected argument "*.bak"`)
+
+	t.Run("Listing", func(t *testing.T) {
+		h := makeTestState(t)
+		h.remoteName = ":memory:"
+		h.remotePrefix = "filterflags-" + random.String(8)
+		h.preconfigureServer()
+		h.server.configRcloneCheckPresentWindow = "1h"
+		h.server.configRcloneFilterFlags = "--exclude=Hidden*"
 
-			remoteItem := fstest.NewItem("SomeKey", "HELLO", item.ModTime)
-			h.fstestRun.CheckRemoteItems(t, remoteItem)
+		remoteFsString, err := buildFsString(nil, layoutModeNodir, "", h.remoteName, h.remotePrefix)
+		require.NoError(t, err)
+		counter := newLookupCountingFs(t, remoteFsString, 0)
+		for _, name := range []string{"HiddenKey", "VisibleKey"} {
+			_, err := operations.Rcat(context.Background(), counter.Fs, name, io.NopCloser(strings.NewReader("HELLO")), time.Now(), nil)
+			require.NoError(t, err)
+		}
 
-			h.requireWriteLine("CHECKPRESENT SomeKey")
-			h.requireReadLineExact("CHECKPRESENT-SUCCESS SomeKey")
+		serverErrorChan := make(chan error)
+		go func() {
+			serverErrorChan <- h.server.run()
+		}()
+		h.requireReadLineExact("VERSION 1")
+
+		// The listing answers for keys that the filter lets through.
+		h.requireWriteLine("CHECKPRESENT VisibleKey")
+		h.requireReadLineExact("CHECKPRESENT-SUCCESS VisibleKey")
+		h.requireWriteLine("CHECKPRESENT OtherKey")
+		h.requireReadLineExact("CHECKPRESENT-FAILURE OtherKey")
+		require.Equal(t, 1, counter.lists)
+		require.Equal(t, 0, counter.newObjects)
+
+		// A key that the filter hides is still found by name.
+		h.requireWriteLine("CHECKPRESENT HiddenKey")
+		h.requireReadLineExact("CHECKPRESENT-SUCCESS HiddenKey")
+		h.requireWriteLine("CHECKPRESENT HiddenMissingKey")
+		h.requireReadLineExact("CHECKPRESENT-FAILURE HiddenMissingKey")
+		require.Equal(t, 1, counter.lists)
+		// The missing key is looked up as a whole and as a first chunk.
+		require.Equal(t, 3, counter.newObjects)
+
+		require.NoError(t, h.mockStdinW.Close())
+		require.NoError(t, <-serverErrorChan)
+	})
 
-			h.requireWriteLine("REMOVE SomeKey")
-			h.requireReadLineExact("REMOVE-SUCCESS SomeKey")
+	t.Run("IgnoreCase", func(t *testing.T) {
+		// Only the listing ignores case, and the filter hides the object
+		// from it.
+		h := makeTestState(t)
+		remoteDir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(remoteDir, "sha256e-s5--abc"), []byte("HELLO"), 0600))
+		h.remoteName = ":local:"
+		h.remotePrefix = remoteDir
+		h.preconfigureServer()
+		h.server.configRcloneIgnoreCase = "yes"
+		h.server.configRcloneFilterFlags = "--exclude sha256e-*"
+
+		serverErrorChan := make(chan error)
+		go func() {
+			serverErrorChan <- h.server.run()
+		}()
+		h.requireReadLineExact("VERSION 1")
+		h.requireWriteLine("CHECKPRESENT SHA256E-s5--abc")
+		h.requireReadLineExact("CHECKPRESENT-FAILURE SHA256E-s5--abc")
+		require.NoError(t, h.mockStdinW.Close())
+		require.NoError(t, <-serverErrorChan)
+	})
 
-			h.requireRemoteIsEmpty()
+	t.Run("Invalid", func(t *testing.T) {
+		h := makeTestState(t)
+		h.remoteName = ":local:"
+		h.remotePrefix = t.TempDir()
+		h.preconfigureServer()
+		h.server.configRcloneFilterFlags = "--bogus"
+
+		serverErrorChan := make(chan error)
+		go func() {
+			serverErrorChan <- h.server.run()
+		}()
+		h.requireReadLineExact("VERSION 1")
+		h.requireWriteLine("PREPARE")
+		h.requireReadLineExactAfterConfigs(`PREPARE-FAILURE [E001] failed to parse filter flags "--bogus": unknown flag: --bogus`)
+		require.NoError(t, h.mockStdinW.Close())
+		require.ErrorAs(t, <-serverErrorChan, new(*ErrConfigMissing))
+	})
+}
 
-			h.requireWriteLine("CHECKPRESENT SomeKey")
-			h.requireReadLineExact("CHECKPRESENT-FAILURE SomeKey")
+func TestCopyFlagConfig(t *testing.T) {
+	flags, err := parseCopyFlags("")
+	require.NoError(t, err)
+	require.Empty(t, flags)
+	flags, err = parseCopyFlags("--ignore-checksum --multi-thread-streams 0 --retries=1")
+	require.NoError(t, err)
+	require.Equal(t, configmap.Simple{
+		"ignore_checksum":      "true",
+		"multi_thread_streams": "0",
+		"retries":              "1",
+	}, flags)
+	ctx, err := withCopyFlags(context.Background(), flags)
+	require.NoError(t, err)
+	require.True(t, fs.GetConfig(ctx).IgnoreChecksum)
+	require.Equal(t, 0, fs.GetConfig(ctx).MultiThreadStreams)
+	require.False(t, fs.GetConfig(context.Background()).IgnoreChecksum)
+
+	for value, wantErr := range map[string]string{
+		"ignore-checksum":     `copy flag must start with "--": "ignore-checksum"`,
+		"--bogus":             "unknown copy flag: --bogus",
+		"--dry-run":           "copy flag is not allowed: --dry-run",
+		"--interactive=true":  "copy flag is not allowed: --interactive",
+		"--transfers":         "copy flag needs a value: --transfers",
+		"--transfers=several": `couldn't parse config item "transfers"`,
+	} {
+		_, err := parseCopyFlags(value)
+		require.ErrorContains(t, err, wantErr, value)
+	}
 
-			require.NoError(t, h.mockStdinW.Close())
-		},
-	},
-	{
-		label: "RemoveNonexistentFile",
-		testProtocolFunc: func(t *testing.T, h *testState) {
-			h.preconfigureServer()
+	// retrieve runs a session that retrieves a key whose content does not
+	// match its hash, and returns the reply.
+	retrieve := func(t *testing.T, copyFlag string) string {
+		const helloSum = "3733cd977ff8eb18b987357e22ced99f46097f31ecb239e878ae63760e83e4d5"
+		key := "SHA256E-s5--" + helloSum + ".txt"
+		h := makeTestState(t)
+		remoteDir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(remoteDir, key), []byte("HELLp"), 0600))
+		h.remoteName = ":local:"
+		h.remotePrefix = remoteDir
+		h.preconfigureServer()
+		h.server.configRcloneSHA256Verify = "yes"
+		h.server.configRcloneCopyFlag = copyFlag
+
+		serverErrorChan := make(chan error)
+		go func() {
+			serverErrorChan <- h.server.run()
+		}()
+
+		localPath := filepath.Join(t.TempDir(), "file.txt")
+		h.requireReadLineExact("VERSION 1")
+		h.requireWriteLine("TRANSFER RETRIEVE " + key + " " + localPath)
+		reply := strings.TrimPrefix(h.requireReadLine(), "TRANSFER-")
+		require.NoError(t, h.mockStdinW.Close())
+		<-serverErrorChan
+		return strings.Fields(reply)[0]
+	}
 
-			h.requireReadLineExact("VERSION 1")
-			h.requireWriteLine("INITREMOTE")
-			h.requireReadLineExact("INITREMOTE-SUCCESS")
+	t.Run("IgnoreChecksum", func(t *testing.T) {
+		require.Equal(t, "SUCCESS", retrieve(t, "--ignore-checksum"))
+	})
 
-			h.requireWriteLine("CHECKPRESENT SomeKey")
-			h.requireReadLineExact("CHECKPRESENT-FAILURE SomeKey")
+	t.Run("Default", func(t *testing.T) {
+		require.Equal(t, "FAILURE", retrieve(t, ""))
+	})
 
-			h.requireRemoteIsEmpty()
+	t.Run("Invalid", func(t *testing.T) {
+		require.Equal(t, "FAILURE", retrieve(t, "--dry-run"))
+	})
+}
 
-			h.requireWriteLine("REMOVE SomeKey")
-			h.requireReadLineExact("REMOVE-SUCCESS SomeKey")
+// mkdirCountingFs wraps an Fs and counts calls to Mkdir.
+type mkdirCountingFs struct {
+	fs.Fs
+	mkdirs atomic.Int32
+}
 
-			h.requireRemoteIsEmpty()
+func (c *mkdirCountingFs) Mkdir(ctx context.Context, dir string) error {
+	c.mkdirs.Add(1)
+	return c.Fs.Mkdir(ctx, dir)
+}
 
-			h.requireWriteLine("CHECKPRESENT SomeKey")
-			h.requireReadLineExact("CHECKPRESENT-FAILURE SomeKey")
+func TestPrefixCreateOnPrepareConfig(t *testing.T) {
+	// prepare runs a session that prepares a remote whose prefix directory
+	// does not exist yet, then stores a key. It returns the Mkdir calls during
+	// PREPARE.
+	prepare := func(t *testing.T, createOnPrepare string) int32 {
+		localPath := filepath.Join(t.TempDir(), "file.txt")
+		require.NoError(t, os.WriteFile(localPath, []byte("HELLO"), 0600))
 
-			require.NoError(t, h.mockStdinW.Close())
-		},
-	},
-	{
-		label: "ExportNotSupported",
-		testProtocolFunc: func(t *testing.T, h *testState) {
-			h.preconfigureServer()
+		h := makeTestState(t)
+		remoteDir := filepath.Join(t.TempDir(), "prefix")
+		h.remoteName = ":local:"
+		h.remotePrefix = remoteDir
+		h.preconfigureServer()
+		h.server.configRclonePrefixCreateOnPrepare = createOnPrepare
 
-			h.requireReadLineExact("VERSION 1")
-			h.requireWriteLine("INITREMOTE")
-			h.requireReadLineExact("INITREMOTE-SUCCESS")
+		prefixFsString, err := h.server.buildFsString(layoutModeNodir, "")
+		require.NoError(t, err)
+		prefixFs, err := cache.Get(context.Background(), prefixFsString)
+		require.NoError(t, err)
+		counter := &mkdirCountingFs{Fs: prefixFs}
+		cache.Put(prefixFsString, counter)
+
+		serverErrorChan := make(chan error)
+		go func() {
+			serverErrorChan <- h.server.run()
+		}()
+
+		h.requireReadLineExact("VERSION 1")
+		h.requireWriteLine("PREPARE")
+		h.requireReadLineExact("GETUUID")
+		h.requireWriteLine("VALUE " + testRemoteUUID)
+		h.requireReadLineExact("PREPARE-SUCCESS")
+		mkdirs := counter.mkdirs.Load()
+		h.requireWriteLine("TRANSFER STORE SomeKey " + localPath)
+		h.requireReadLineExact("TRANSFER-SUCCESS STORE SomeKey")
+		require.NoError(t, h.mockStdinW.Close())
+		require.NoError(t, <-serverErrorChan)
+		require.FileExists(t, filepath.Join(remoteDir, "SomeKey"))
+		return mkdirs
+	}
 
-			h.requireWriteLine("EXPORTSUPPORTED")
-			h.requireReadLineExact("EXPORTSUPPORTED-FAILURE")
+	t.Run("Enabled", func(t *testing.T) {
+		require.Equal(t, int32(1), prepare(t, "yes"))
+	})
 
-			require.NoError(t, h.mockStdinW.Close())
-		},
-	},
+	t.Run("Disabled", func(t *testing.T) {
+		require.Zero(t, prepare(t, "no"))
+	})
 }
 
-// TestReadLineHasShortDeadline verifies that [testState.readLineWithTimeout]
-// does not block indefinitely when a line is never written.
-func TestReadLineHasShortDeadline(t *testing.T) {
-	const timeoutForRead = time.Millisecond * 50
-	const timeoutForTest = time.Millisecond * 100
-	const tickDuration = time.Millisecond * 10
+// truncatingFs wraps an Fs, and reports objects that it finds as one byte
+// shorter than they are, as if their upload had been truncated.
+type truncatingFs struct {
+	fs.Fs
+}
 
-	type readLineResult struct {
-		line string
-		err  error
+func (t *truncatingFs) NewObject(ctx context.Context, remote string) (fs.Object, error) {
+	obj, err := t.Fs.NewObject(ctx, remote)
+	if err != nil {
+		return nil, err
 	}
+	return &truncatedObject{obj}, nil
+}
 
-	resultChan := make(chan readLineResult)
+// truncatedObject is an Object that is one byte shorter than it says.
+type truncatedObject struct {
+	fs.Object
+}
 
-	go func() {
-		defer close(resultChan)
+func (o *truncatedObject) Size() int64 {
+	return o.Object.Size() - 1
+}
+
+func TestVerifySizeConfig(t *testing.T) {
+	// store stores a key to a remote that reports objects as truncated. It
+	// returns the reply, the directory, and the server's error.
+	store := func(t *testing.T, verifySize string) (reply, remoteDir string, serverErr error) {
+		localPath := filepath.Join(t.TempDir(), "file.txt")
+		require.NoError(t, os.WriteFile(localPath, []byte("HELLO"), 0600))
 
 		h := makeTestState(t)
-		h.readLineTimeout = timeoutForRead
+		remoteDir = t.TempDir()
+		h.remoteName = ":local:"
+		h.remotePrefix = remoteDir
+		h.preconfigureServer()
+		h.server.configRcloneVerifySize = verifySize
+		// The truncated object's checksum would differ too.
+		h.server.configRcloneChecksum = checksumNone
+
+		remoteFsString, err := h.server.buildFsString(layoutModeNodir, "SomeKey")
+		require.NoError(t, err)
+		remoteFs, err := cache.Get(context.Background(), remoteFsString)
+		require.NoError(t, err)
+		cache.Put(remoteFsString, &truncatingFs{remoteFs})
+
+		serverErrorChan := make(chan error)
+		go func() {
+			serverErrorChan <- h.server.run()
+		}()
+
+		h.requireReadLineExact("VERSION 1")
+		h.requireWriteLine("TRANSFER STORE SomeKey " + localPath)
+		reply = h.requireReadLine()
+		require.NoError(t, h.mockStdinW.Close())
+		return reply, remoteDir, <-serverErrorChan
+	}
 
-		line, err := h.readLineWithTimeout()
-		resultChan <- readLineResult{line, err}
-	}()
+	t.Run("Enabled", func(t *testing.T) {
+		reply, remoteDir, err := store(t, "yes")
+		require.ErrorIs(t, err, errSizeMismatch)
+		require.Equal(t, "TRANSFER-FAILURE STORE SomeKey [E003] size mismatch: uploaded 4 expected 5\n", reply)
+		require.NoFileExists(t, filepath.Join(remoteDir, "SomeKey"))
+	})
 
-	// This closure will be run periodically until time runs out or until all of
-	// its assertions pass.
-	idempotentConditionFunc := func(c *assert.CollectT) {
-		result, ok := <-resultChan
-		require.True(c, ok, "The goroutine should send a result")
+	t.Run("Locked", func(t *testing.T) {
+		ctx := context.Background()
+		remoteDir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(remoteDir, "SomeKey"), []byte("HELLO"), 0600))
+		remoteFs, err := cache.Get(ctx, ":local:"+remoteDir)
+		require.NoError(t, err)
 
-		require.Empty(c, result.line, "No line should be read")
-		require.ErrorIs(c, result.err, context.DeadlineExceeded)
+		// A locked object cannot be deleted, so it is reported instead.
+		err = verifyStoredSize(ctx, &truncatingFs{remoteFs}, "SomeKey", 5, true)
+		require.ErrorIs(t, err, errSizeMismatch)
+		require.ErrorContains(t, err, "the object is locked, so it was left in place")
+		require.FileExists(t, filepath.Join(remoteDir, "SomeKey"))
+	})
 
-		_, ok = <-resultChan
-		require.False(c, ok, "The channel should be closed")
+	t.Run("Disabled", func(t *testing.T) {
+		reply, remoteDir, err := store(t, "no")
+		require.NoError(t, err)
+		require.Equal(t, "TRANSFER-SUCCESS STORE SomeKey\n", reply)
+		require.FileExists(t, filepath.Join(remoteDir, "SomeKey"))
+	})
+}
+
+func TestGzipConfig(t *testing.T) {
+	for _, tc := range []struct {
+		enabled, level string
+		wantEnabled    bool
+		wantLevel      int
+		wantErr        string
+	}{
+		{enabled: "no", level: "bogus"},
+		{enabled: "yes", level: "", wantEnabled: true, wantLevel: 6},
+		{enabled: "yes", level: "1", wantEnabled: true, wantLevel: 1},
+		{enabled: "true", level: "9", wantEnabled: true, wantLevel: 9},
+		{enabled: "yes", level: "0", wantErr: `gzip level must be an integer from 1 to 9: "0"`},
+		{enabled: "yes", level: "10", wantErr: `gzip level must be an integer from 1 to 9: "10"`},
+		{enabled: "yes", level: "bogus", wantErr: `gzip level must be an integer from 1 to 9: "bogus"`},
+		{enabled: "maybe", level: "6", wantErr: `failed to parse gzip "maybe"`},
+	} {
+		gotEnabled, gotLevel, err := parseGzip(tc.enabled, tc.level)
+		if tc.wantErr != "" {
+			require.ErrorContains(t, err, tc.wantErr)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, tc.wantEnabled, gotEnabled)
+		require.Equal(t, tc.wantLevel, gotLevel)
 	}
 
-	require.EventuallyWithT(t, idempotentConditionFunc, timeoutForTest, tickDuration)
+	content := []byte(strings.Repeat("HELLO gzip ", 1000))
+	localDir := t.TempDir()
+	localPath := filepath.Join(localDir, "file.txt")
+	require.NoError(t, os.WriteFile(localPath, content, 0600))
+
+	h := makeTestState(t)
+	remoteDir := t.TempDir()
+	h.remoteName = ":local:"
+	h.remotePrefix = remoteDir
+	h.preconfigureServer()
+	h.server.configRcloneGzip = "yes"
+	h.server.configRcloneGzipLevel = "9"
+
+	serverErrorChan := make(chan error)
+	go func() {
+		serverErrorChan <- h.server.run()
+	}()
+
+	h.requireReadLineExact("VERSION 1")
+	h.requireWriteLine("TRANSFER STORE SomeKey " + localPath)
+	h.requireReadLineExact("TRANSFER-SUCCESS STORE SomeKey")
+
+	// The stored object is smaller than the file, and gunzips to it.
+	stored, err := os.ReadFile(filepath.Join(remoteDir, "SomeKey"))
+	require.NoError(t, err)
+	require.Less(t, len(stored), len(content))
+	zr, err := gzip.NewReader(bytes.NewReader(stored))
+	require.NoError(t, err)
+	gunzipped, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	require.Equal(t, content, gunzipped)
+
+	retrievedPath := filepath.Join(localDir, "retrieved.txt")
+	h.requireWriteLine("TRANSFER RETRIEVE SomeKey " + retrievedPath)
+	h.requireReadLineExact("TRANSFER-SUCCESS RETRIEVE SomeKey")
+	retrieved, err := os.ReadFile(retrievedPath)
+	require.NoError(t, err)
+	require.Equal(t, content, retrieved)
+
+	// A missing key is reported as such.
+	h.requireWriteLine("TRANSFER RETRIEVE OtherKey " + filepath.Join(localDir, "other.txt"))
+	h.requireReadLineExact("TRANSFER-FAILURE RETRIEVE OtherKey [E004] not found")
+	require.NoFileExists(t, filepath.Join(localDir, "other.txt"))
+
+	require.NoError(t, h.mockStdinW.Close())
+	require.NoError(t, <-serverErrorChan)
 }
 
-// TestMain drives the tests
-func TestMain(m *testing.M) {
-	fstest.TestMain(m)
+func TestFailOnAbsentConfig(t *testing.T) {
+	// run retrieves a missing key, then stores and retrieves another key. It
+	// returns the replies to the last two transfers.
+	run := func(t *testing.T, failOnAbsent string) (storeReply, retrieveReply string) {
+		localDir := t.TempDir()
+		localPath := filepath.Join(localDir, "file.txt")
+		require.NoError(t, os.WriteFile(localPath, []byte("HELLO"), 0600))
+
+		h := makeTestState(t)
+		h.remoteName = ":local:"
+		h.remotePrefix = t.TempDir()
+		h.preconfigureServer()
+		h.server.configRcloneFailOnAbsent = failOnAbsent
+
+		serverErrorChan := make(chan error)
+		go func() {
+			serverErrorChan <- h.server.run()
+		}()
+
+		h.requireReadLineExact("VERSION 1")
+		h.requireWriteLine("TRANSFER RETRIEVE MissingKey " + filepath.Join(localDir, "missing.txt"))
+		h.requireReadLineExact("TRANSFER-FAILURE RETRIEVE MissingKey [E004] not found")
+		require.Equal(t, failOnAbsent == "yes", h.server.fatalAbsence)
+		h.requireWriteLine("TRANSFER STORE SomeKey " + localPath)
+		storeReply = h.requireReadLine()
+		h.requireWriteLine("TRANSFER RETRIEVE SomeKey " + filepath.Join(localDir, "retrieved.txt"))
+		retrieveReply = h.requireReadLine()
+		require.NoError(t, h.mockStdinW.Close())
+		require.NoError(t, <-serverErrorChan)
+		return storeReply, retrieveReply
+	}
+
+	t.Run("Enabled", func(t *testing.T) {
+		storeReply, retrieveReply := run(t, "yes")
+		require.Equal(t, "TRANSFER-FAILURE STORE SomeKey [E003] previous key was missing; aborting\n", storeReply)
+		require.Equal(t, "TRANSFER-FAILURE RETRIEVE SomeKey [E003] previous key was missing; aborting\n", retrieveReply)
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		storeReply, retrieveReply := run(t, "no")
+		require.Equal(t, "TRANSFER-SUCCESS STORE SomeKey\n", storeReply)
+		require.Equal(t, "TRANSFER-SUCCESS RETRIEVE SomeKey\n", retrieveReply)
+	})
 }
 
-// Run fstest-compatible test cases with backend selected by `-remote`.
-func TestGitAnnexFstestBackendCases(t *testing.T) {
+func TestConnectionsPerServerConfig(t *testing.T) {
+	for _, tc := range []struct {
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{value: "", want: 0},
+		{value: "1", want: 1},
+		{value: "8", want: 8},
+		{value: "0", wantErr: true},
+		{value: "-1", wantErr: true},
+		{value: "many", wantErr: true},
+	} {
+		got, err := parseConnectionsPerServer(tc.value)
+		if tc.wantErr {
+			require.ErrorContains(t, err, "connections per server must be a positive integer", tc.value)
+			continue
+		}
+		require.NoError(t, err, tc.value)
+		require.Equal(t, tc.want, got, tc.value)
+	}
 
-	for _, testCase := range fstestTestCases {
-		t.Run(testCase.label, func(t *testing.T) {
-			r := fstest.NewRun(t)
-			t.Cleanup(func() { r.Finalise() })
+	for _, tc := range []struct {
+		remoteName  string
+		connections string
+		want        string
+	}{
+		{":sftp,host=example.com:", "3", ":sftp,host=example.com,connections='3':prefix"},
+		{":ftp,host=example.com:", "3", ":ftp,host=example.com,concurrency='3':prefix"},
+		{":sftp,host=example.com:", "", ":sftp,host=example.com:prefix"},
+		{":local:", "3", ":local:prefix"},
+	} {
+		s := server{
+			configRcloneRemoteName:           tc.remoteName,
+			configPrefix:                     "prefix",
+			configRcloneLayout:               "nodir",
+			configRcloneConnectionsPerServer: tc.connections,
+		}
+		got, err := s.buildFsString(layoutModeNodir, "SomeKey")
+		require.NoError(t, err)
+		require.Equal(t, tc.want, got)
+	}
 
-			// Parse the fstest-provided remote string. It might have a path!
-			remoteName, remotePath, err := fspath.SplitFs(r.FremoteName)
-			require.NoError(t, err)
+	// Backends that cannot limit their connections get a warning.
+	h := makeTestState(t)
+	h.remoteName = ":local:"
+	h.remotePrefix = t.TempDir()
+	h.preconfigureServer()
+	h.server.configRcloneConnectionsPerServer = "3"
 
-			// The gitannex command requires the `rcloneremotename` is the name
-			// of a remote or a colon-prefixed backend name like ":local:", so
-			// the empty string will not suffice.
-			if remoteName == "" {
-				require.True(t, r.Fremote.Features().IsLocal)
-				remoteName = ":local:"
-			}
+	serverErrorChan := make(chan error)
+	go func() {
+		serverErrorChan <- h.server.run()
+	}()
 
-			handle := makeTestState(t)
-			handle.fstestRun = r
-			handle.remoteName = remoteName
-			handle.remotePrefix = remotePath
+	h.requireReadLineExact("VERSION 1")
+	h.requireWriteLine("EXTENSIONS INFO")
+	h.requireReadLineExact("EXTENSIONS INFO")
+	h.requireWriteLine("PREPARE")
+	h.requireReadLineExact("INFO rcloneconnectionsperserver is not supported by the local backend; ignoring it")
+	h.requireReadLineExact("GETUUID")
+	h.requireWriteLine("VALUE " + testRemoteUUID)
+	h.requireReadLineExact("PREPARE-SUCCESS")
+	// With INFO offered, the server sends a session summary at the end.
+	go func() {
+		_, _ = io.Copy(io.Discard, h.mockStdoutReader)
+	}()
+	require.NoError(t, h.mockStdinW.Close())
+	require.NoError(t, <-serverErrorChan)
+}
 
-			serverErrorChan := make(chan error)
+func TestCopyBufferConfig(t *testing.T) {
+	for _, tc := range []struct {
+		value   string
+		want    int
+		wantErr string
+	}{
+		{value: "", want: 16 << 20},
+		{value: "4K", want: 4 << 10},
+		{value: "16M", want: 16 << 20},
+		{value: "1G", want: 1 << 30},
+		{value: "3K", wantErr: `copy buffer must be from 4Ki to 1Gi: "3K"`},
+		{value: "2G", wantErr: `copy buffer must be from 4Ki to 1Gi: "2G"`},
+		{value: "bogus", wantErr: `failed to parse copy buffer "bogus"`},
+	} {
+		got, err := parseCopyBufferSize(tc.value)
+		if tc.wantErr != "" {
+			require.ErrorContains(t, err, tc.wantErr)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, tc.want, got)
+	}
 
-			go func() {
-				// Run the gitannex server and send the result back to the
-				// goroutine associated with `t`. We can't use `require` here
-				// because it could call `t.FailNow()`, which says it must be
-				// called on the goroutine associated with the test.
-				serverErrorChan <- handle.server.run()
-			}()
+	// Copies into a file read through the whole buffer, rather than 32 KiB
+	// at a time.
+	src := &readSizeRecorder{Reader: bytes.NewReader(make([]byte, 1<<20))}
+	out, err := os.Create(filepath.Join(t.TempDir(), "out"))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, out.Close()) }()
+	n, err := copyWithBuffer(out, src, make([]byte, 256<<10))
+	require.NoError(t, err)
+	require.Equal(t, int64(1<<20), n)
+	require.Equal(t, 256<<10, src.maxRead)
+}
 
-			testCase.testProtocolFunc(t, &handle)
+// readSizeRecorder wraps a Reader and records the largest read asked of it.
+type readSizeRecorder struct {
+	io.Reader
+	maxRead int
+}
 
-			serverError, ok := <-serverErrorChan
-			require.True(t, ok, "Should receive one error/nil from server")
-			require.Empty(t, serverErrorChan)
+func (r *readSizeRecorder) Read(p []byte) (int, error) {
+	r.maxRead = max(r.maxRead, len(p))
+	return r.Reader.Read(p)
+}
 
-			if testCase.expectedError == "" {
-				require.NoError(t, serverError)
-			} else {
-				require.ErrorContains(t, serverError, testCase.expectedError)
-			}
-		})
+// latencyReader wraps a Reader and waits `latency` before each read, like a
+// backend that makes a request for each read.
+type latencyReader struct {
+	io.Reader
+	latency time.Duration
+}
+
+func (r *latencyReader) Read(p []byte) (int, error) {
+	time.Sleep(r.latency)
+	return r.Reader.Read(p)
+}
+
+// BenchmarkCopyBuffer measures copying an 8 MiB object to a local file through
+// buffers of various sizes, from a local backend and from one that adds 10ms
+// of latency to each read.
+func BenchmarkCopyBuffer(b *testing.B) {
+	const size = 8 << 20
+	ctx := context.Background()
+	remoteDir := b.TempDir()
+	require.NoError(b, os.WriteFile(filepath.Join(remoteDir, "SomeKey"), make([]byte, size), 0600))
+	remoteFs, err := cache.Get(ctx, remoteDir)
+	require.NoError(b, err)
+	obj, err := remoteFs.NewObject(ctx, "SomeKey")
+	require.NoError(b, err)
+	localPath := filepath.Join(b.TempDir(), "file.bin")
+
+	for _, backend := range []struct {
+		name    string
+		latency time.Duration
+	}{
+		{"Local", 0},
+		{"Latency10ms", 10 * time.Millisecond},
+	} {
+		for _, bufferSize := range []fs.SizeSuffix{32 * fs.Kibi, fs.Mebi, 16 * fs.Mebi, 128 * fs.Mebi} {
+			b.Run(fmt.Sprintf("%s/%v", backend.name, bufferSize), func(b *testing.B) {
+				b.SetBytes(size)
+				for range b.N {
+					in, err := obj.Open(ctx)
+					require.NoError(b, err)
+					out, err := os.Create(localPath)
+					require.NoError(b, err)
+					src := &latencyReader{Reader: in, latency: backend.latency}
+					_, err = copyWithBuffer(out, src, make([]byte, bufferSize))
+					require.NoError(b, err)
+					require.NoError(b, out.Close())
+					require.NoError(b, in.Close())
+				}
+			})
+		}
 	}
 }
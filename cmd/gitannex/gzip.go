@@ -0,0 +1,102 @@
+package gitannex
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/operations"
+)
+
+// parseGzip parses the "rclonegzip" and "rclonegziplevel" configs. It returns
+// whether stored objects are gzipped, and if so, at which level.
+func parseGzip(enabled, level string) (bool, int, error) {
+	gzipEnabled, err := parseBoolConfig("gzip", enabled)
+	if err != nil || !gzipEnabled {
+		return false, 0, err
+	}
+	if level == "" {
+		return true, 6, nil
+	}
+	gzipLevel, err := strconv.Atoi(level)
+	if err != nil || gzipLevel < gzip.BestSpeed || gzipLevel > gzip.BestCompression {
+		return false, 0, fmt.Errorf("gzip level must be an integer from %d to %d: %q", gzip.BestSpeed, gzip.BestCompression, level)
+	}
+	return true, gzipLevel, nil
+}
+
+// storeGzipped uploads the local file at `localPath` to `remoteFs` as `key`,
+// gzipped at `level` on the way, reading through a buffer of `bufferSize`
+// bytes. The compressed size is unknown until the upload ends, so the object
+// is streamed with [operations.Rcat].
+func storeGzipped(ctx context.Context, remoteFs fs.Fs, key, localPath string, level, bufferSize int) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to open local file: %w", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat local file: %w", err)
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		zw, err := gzip.NewWriterLevel(pw, level)
+		if err != nil {
+			_ = pw.CloseWithError(err)
+			return
+		}
+		if _, err := copyWithBuffer(zw, f, make([]byte, bufferSize)); err != nil {
+			_ = pw.CloseWithError(fmt.Errorf("failed to read local file: %w", err))
+			return
+		}
+		_ = pw.CloseWithError(zw.Close())
+	}()
+	// Rcat closes `pr`, which ends the goroutine if the upload fails early.
+	if _, err := operations.Rcat(ctx, remoteFs, key, pr, info.ModTime(), nil); err != nil {
+		return fmt.Errorf("failed to upload gzipped file: %w", err)
+	}
+	return nil
+}
+
+// retrieveGzipped downloads the gzipped object `key` from `remoteFs` and
+// writes it, decompressed, to `localPath` through a buffer of `bufferSize`
+// bytes. When the object is missing, it returns [fs.ErrorObjectNotFound] and
+// leaves `localPath` alone.
+func retrieveGzipped(ctx context.Context, remoteFs fs.Fs, key, localPath string, bufferSize int) (err error) {
+	obj, err := remoteFs.NewObject(ctx, key)
+	if err != nil {
+		return err
+	}
+	in, err := operations.Open(ctx, obj)
+	if err != nil {
+		return fmt.Errorf("failed to open object: %w", err)
+	}
+	defer fs.CheckClose(in, &err)
+	zr, err := gzip.NewReader(in)
+	if err != nil {
+		return fmt.Errorf("failed to read gzip header: %w", err)
+	}
+	defer fs.CheckClose(zr, &err)
+
+	out, err := os.Create(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to create local file: %w", err)
+	}
+	defer func() {
+		fs.CheckClose(out, &err)
+		if err != nil {
+			_ = os.Remove(localPath)
+		}
+	}()
+	if _, err := copyWithBuffer(out, zr, make([]byte, bufferSize)); err != nil {
+		return fmt.Errorf("failed to decompress object: %w", err)
+	}
+	return nil
+}
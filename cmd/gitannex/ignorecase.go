@@ -0,0 +1,51 @@
+package gitannex
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/filter"
+	"github.com/rclone/rclone/fs/list"
+)
+
+// findKeyIgnoringCase is like [findKey], but also accepts an object whose name
+// differs from `key` only in case, as case-insensitive remotes may report. It
+// lists the directory of `remoteFs`, so it is only worth calling once
+// [findKey] has failed. When `fi` is not nil, objects that it excludes are
+// not considered.
+func findKeyIgnoringCase(ctx context.Context, remoteFs fs.Fs, key string, fi *filter.Filter) error {
+	includeAll := fi == nil
+	if fi != nil {
+		ctx = filter.ReplaceConfig(ctx, fi)
+	}
+	entries, err := list.DirSorted(ctx, remoteFs, includeAll, "")
+	if errors.Is(err, fs.ErrorDirNotFound) {
+		return fs.ErrorObjectNotFound
+	}
+	if err != nil {
+		return err
+	}
+	manifest := manifestName(key)
+	for _, entry := range entries {
+		if _, isObject := entry.(fs.Object); !isObject {
+			continue
+		}
+		if strings.EqualFold(entry.Remote(), key) {
+			return nil
+		}
+		if strings.EqualFold(entry.Remote(), manifest) {
+			// The key is absent while a resumable store of it is in progress.
+			stored := strings.TrimSuffix(entry.Remote(), manifestName(""))
+			inProgress, err := storeInProgress(ctx, remoteFs, stored)
+			if err != nil {
+				return err
+			}
+			if !inProgress {
+				return nil
+			}
+		}
+	}
+	return fs.ErrorObjectNotFound
+}
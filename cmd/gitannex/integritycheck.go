@@ -0,0 +1,146 @@
+package gitannex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"slices"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/cache"
+)
+
+// maxRecentKeys is the number of recently transferred keys that the
+// "rclonecheckinterval" integrity checks sample from.
+const maxRecentKeys = 1000
+
+// recentKey is a key that was recently stored or retrieved, and the fs string
+// of the directory where it was found.
+type recentKey struct {
+	key      string
+	fsString string
+}
+
+// parseCheckInterval parses the "rclonecheckinterval" config. An empty value
+// or zero disables the integrity checks.
+func parseCheckInterval(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	interval, err := fs.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse check interval %q: %w", value, err)
+	}
+	if interval < 0 {
+		return 0, fmt.Errorf("check interval must not be negative: %q", value)
+	}
+	return interval, nil
+}
+
+// addRecentKey records that `key` is present in the directory `fsString`,
+// dropping the oldest record once there are [maxRecentKeys]. The caller must
+// hold `s.mu`.
+func (s *server) addRecentKey(key, fsString string) {
+	s.forgetRecentKey(key)
+	if len(s.recentKeys) == maxRecentKeys {
+		s.recentKeys = s.recentKeys[1:]
+	}
+	s.recentKeys = append(s.recentKeys, recentKey{key: key, fsString: fsString})
+}
+
+// forgetRecentKey drops `key` from the recently transferred keys, e.g. because
+// git-annex removed it. The caller must hold `s.mu`.
+func (s *server) forgetRecentKey(key string) {
+	s.recentKeys = slices.DeleteFunc(s.recentKeys, func(recent recentKey) bool {
+		return recent.key == key
+	})
+}
+
+// sampleRecentKeys returns 1% of the recently transferred keys, and at least
+// one if there are any, chosen at random. The caller must hold `s.mu`.
+func (s *server) sampleRecentKeys() []recentKey {
+	if len(s.recentKeys) == 0 {
+		return nil
+	}
+	n := max(1, len(s.recentKeys)/100)
+	sample := make([]recentKey, 0, n)
+	for _, i := range rand.Perm(len(s.recentKeys))[:n] {
+		sample = append(sample, s.recentKeys[i])
+	}
+	return sample
+}
+
+// startIntegrityChecks checks a sample of the recently transferred keys every
+// `interval` in the background, until [server.stopIntegrityChecks] is called
+// or the session ends. A key that has gone missing is reported to git-annex
+// with an INFO message.
+func (s *server) startIntegrityChecks(interval time.Duration) {
+	ctx, cancel := context.WithCancel(s.sessionContext())
+	done := make(chan struct{})
+	s.stopIntegrityChecksFunc = func() {
+		cancel()
+		<-done
+	}
+	getFs := s.getFs
+	if getFs == nil {
+		getFs = cache.Get
+	}
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			s.mu.Lock()
+			sample := s.sampleRecentKeys()
+			s.mu.Unlock()
+			for _, recent := range sample {
+				s.checkRecentKey(ctx, getFs, recent)
+			}
+			s.mu.Lock()
+			s.integrityChecks++
+			s.mu.Unlock()
+		}
+	}()
+}
+
+// checkRecentKey looks up a recently transferred key and reports it if it has
+// gone missing. Errors other than a missing key are only logged, since the
+// next transfer will report a remote that is unreachable.
+func (s *server) checkRecentKey(ctx context.Context, getFs func(context.Context, string) (fs.Fs, error), recent recentKey) {
+	f, err := getFs(ctx, recent.fsString)
+	if err == nil {
+		err = findKey(ctx, f, recent.key)
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	if !errors.Is(err, fs.ErrorObjectNotFound) {
+		if err != nil {
+			fs.Debugf(nil, "Integrity check of %s failed: %v", recent.key, err)
+		}
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// The key may have been removed by git-annex in the meantime.
+	if slices.Contains(s.recentKeys, recent) {
+		s.sendInfo(fmt.Sprintf("integrity-check: key %s missing, was present", recent.key))
+	}
+}
+
+// stopIntegrityChecks stops the checks started by
+// [server.startIntegrityChecks], if any, and waits for them to finish. The
+// caller must not hold `s.mu`.
+func (s *server) stopIntegrityChecks() {
+	if s.stopIntegrityChecksFunc != nil {
+		s.stopIntegrityChecksFunc()
+		s.stopIntegrityChecksFunc = nil
+	}
+}
@@ -0,0 +1,116 @@
+package gitannex
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// keyType returns the type of an annex key, i.e. the name of the backend that
+// generated it. For instance, the type of "SHA256E-s1024--0123abcd.txt" is
+// "SHA256E".
+func keyType(key string) string {
+	typ, _, _ := strings.Cut(key, "-")
+	return typ
+}
+
+// sha256FromKey returns the hex SHA-256 hash of the content of a key of type
+// "SHA256" or "SHA256E", such as "SHA256E-s5--185f8db3...9969.txt". It
+// reports false for other keys, and for keys of a chunk, whose content is only
+// part of what the hash covers.
+func sha256FromKey(key string) (string, bool) {
+	typ := keyType(key)
+	if (typ != "SHA256" && typ != "SHA256E") || nonChunkKey(key) != key {
+		return "", false
+	}
+	_, name, ok := strings.Cut(key, "--")
+	if !ok || len(name) < sha256.Size*2 {
+		return "", false
+	}
+	sum := name[:sha256.Size*2]
+	// Only "SHA256E" keys may have an extension after the hash.
+	if typ == "SHA256" && len(name) != len(sum) {
+		return "", false
+	}
+	if _, err := hex.DecodeString(sum); err != nil {
+		return "", false
+	}
+	return strings.ToLower(sum), true
+}
+
+// parseKeyTypePrefixes parses the "rclonekeytypeprefix" config, a JSON object
+// mapping key types to directories, e.g. {"SHA256":"cold/","WORM":"hot/"}. An
+// empty value yields an empty map.
+func parseKeyTypePrefixes(value string) (map[string]string, error) {
+	prefixes := make(map[string]string)
+	if value == "" {
+		return prefixes, nil
+	}
+	if err := json.Unmarshal([]byte(value), &prefixes); err != nil {
+		return nil, fmt.Errorf("failed to parse key type prefixes %q: %w", value, err)
+	}
+	for typ, prefix := range prefixes {
+		if path.IsAbs(prefix) || !isLocalPath(prefix) {
+			return nil, fmt.Errorf("key type prefix for %s must be a relative path within rcloneprefix: %q", typ, prefix)
+		}
+	}
+	return prefixes, nil
+}
+
+// isLocalPath reports whether the slash-separated path `p` stays within the
+// directory it is relative to.
+func isLocalPath(p string) bool {
+	cleaned := path.Clean(p)
+	return cleaned != ".." && !strings.HasPrefix(cleaned, "../")
+}
+
+// prefixForKey returns the directory, relative to the remote, under which `key`
+// is stored. When the "rclonekeytypeprefix" config maps the key's type to a
+// directory, that directory is joined to the "rcloneprefix" config. Keys whose
+// type ends in "E", such as "SHA256E", also match the type without it, since
+// the two differ only in whether the key preserves the file extension.
+func (s *server) prefixForKey(key string) (string, error) {
+	cfg, err := s.getSessionConfig()
+	if err != nil {
+		return "", err
+	}
+	typ := keyType(key)
+	prefix, ok := cfg.keyTypePrefixes[typ]
+	if !ok {
+		prefix, ok = cfg.keyTypePrefixes[strings.TrimSuffix(typ, "E")]
+	}
+	if !ok || typ == "" {
+		return s.configPrefix, nil
+	}
+	return path.Join(s.configPrefix, prefix), nil
+}
+
+// parseExcludeKeyPatterns parses the "rcloneexcludekeys" config, a
+// comma-separated list of [path.Match] patterns. Blank entries are ignored.
+func parseExcludeKeyPatterns(value string) ([]string, error) {
+	var patterns []string
+	for _, pattern := range strings.Split(value, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("failed to parse exclude key pattern %q: %w", pattern, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// keyIsExcluded reports whether `key` matches any of `patterns`.
+func keyIsExcluded(key string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, key); matched {
+			return true
+		}
+	}
+	return false
+}
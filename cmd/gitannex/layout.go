@@ -1,25 +1,41 @@
 package gitannex
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"path"
+	"slices"
 	"strings"
+	"sync"
 
 	"github.com/rclone/rclone/fs/fspath"
 )
 
 type layoutMode string
 
-// All layout modes from git-annex-remote-rclone are supported.
+// The layout modes of git-annex-remote-rclone are supported, so that remotes it
+// set up can be used as they are. The "4level" and "annexobjects" modes are
+// specific to this command, and git-annex-remote-rclone cannot read remotes
+// that use them.
 const (
 	layoutModeLower       layoutMode = "lower"
 	layoutModeDirectory   layoutMode = "directory"
 	layoutModeNodir       layoutMode = "nodir"
 	layoutModeMixed       layoutMode = "mixed"
 	layoutModeFrankencase layoutMode = "frankencase"
-	layoutModeUnknown     layoutMode = ""
+	// The "4level" mode matches none of git-annex's own layouts either, so
+	// only this command can read remotes that use it.
+	layoutMode4level layoutMode = "4level"
+	// The "annexobjects" mode mirrors the .git/annex/objects directory of a
+	// git-annex repository, so that a mounted remote can be used as one.
+	layoutModeAnnexObjects layoutMode = "annexobjects"
+	layoutModeUnknown      layoutMode = ""
 )
 
-func allLayoutModes() []layoutMode {
+// compatLayoutModes returns the layout modes that git-annex-remote-rclone also
+// understands.
+func compatLayoutModes() []layoutMode {
 	return []layoutMode{
 		layoutModeLower,
 		layoutModeDirectory,
@@ -29,6 +45,29 @@ func allLayoutModes() []layoutMode {
 	}
 }
 
+// builtinOnlyLayoutModes returns the built-in layout modes that
+// git-annex-remote-rclone does not understand.
+func builtinOnlyLayoutModes() []layoutMode {
+	return []layoutMode{layoutMode4level, layoutModeAnnexObjects}
+}
+
+// allLayoutModes returns the built-in layout modes followed by the names of
+// registered layout plugins in sorted order.
+func allLayoutModes() []layoutMode {
+	modes := append(compatLayoutModes(), builtinOnlyLayoutModes()...)
+	layoutPluginsMu.RLock()
+	defer layoutPluginsMu.RUnlock()
+	names := make([]string, 0, len(layoutPlugins))
+	for name := range layoutPlugins {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		modes = append(modes, layoutMode(name))
+	}
+	return modes
+}
+
 func parseLayoutMode(mode string) layoutMode {
 	for _, knownMode := range allLayoutModes() {
 		if mode == string(knownMode) {
@@ -38,8 +77,139 @@ func parseLayoutMode(mode string) layoutMode {
 	return layoutModeUnknown
 }
 
-type queryDirhashFunc func(msg string) (string, error)
+// LayoutPlugin defines a custom layout mode, which users select by setting the
+// "rclonelayout" config to the plugin's name.
+type LayoutPlugin interface {
+	// Name returns the name of the layout mode. It must not collide with a
+	// built-in mode or another plugin.
+	Name() string
+	// KeyPath returns the directory, relative to the root of the rclone
+	// remote, where the object named `key` is stored. The directory should be
+	// within `prefix`, the "rcloneprefix" config. `queryFn` sends a message to
+	// git-annex, either "DIRHASH KEY" or "DIRHASH-LOWER KEY", and returns the
+	// value of the reply, e.g. "Xq/3v/".
+	KeyPath(key, prefix string, queryFn func(string) (string, error)) (string, error)
+}
+
+var (
+	layoutPluginsMu sync.RWMutex
+	layoutPlugins   = make(map[string]LayoutPlugin)
+)
+
+// RegisterLayoutPlugin adds `p` to the set of layout modes. It returns an error
+// if the plugin's name is empty or is already taken.
+func RegisterLayoutPlugin(p LayoutPlugin) error {
+	name := p.Name()
+	if name == "" {
+		return errors.New("layout plugin name must not be empty")
+	}
+	if slices.Contains(append(compatLayoutModes(), builtinOnlyLayoutModes()...), layoutMode(name)) {
+		return fmt.Errorf("layout plugin name collides with built-in layout mode: %s", name)
+	}
+	layoutPluginsMu.Lock()
+	defer layoutPluginsMu.Unlock()
+	if _, found := layoutPlugins[name]; found {
+		return fmt.Errorf("layout plugin is already registered: %s", name)
+	}
+	layoutPlugins[name] = p
+	return nil
+}
+
+// unregisterLayoutPlugin removes the plugin registered under `name`, if any.
+func unregisterLayoutPlugin(name string) {
+	layoutPluginsMu.Lock()
+	defer layoutPluginsMu.Unlock()
+	delete(layoutPlugins, name)
+}
+
+// getLayoutPlugin returns the plugin registered for `mode`, or nil.
+func getLayoutPlugin(mode layoutMode) LayoutPlugin {
+	layoutPluginsMu.RLock()
+	defer layoutPluginsMu.RUnlock()
+	return layoutPlugins[string(mode)]
+}
+
+// buildAnnexObjectsPath returns the path of `key` relative to the
+// .git/annex/objects directory of a git-annex repository, e.g.
+// "Xq/3v/KEY/KEY". The `dirhash` is git-annex's reply to "DIRHASH KEY", which
+// is the same mixed-case hash that git-annex uses for its own object store.
+// Git-annex nests each object in a directory named after its key so that it
+// can lock down the object's permissions separately from its siblings.
+func buildAnnexObjectsPath(dirhash, key string) string {
+	return path.Join(dirhash, key, key)
+}
+
+// layoutDescriptions describe where each built-in layout mode stores a key, for
+// the --list-layouts flag.
+var layoutDescriptions = map[layoutMode]string{
+	layoutModeLower:        "Lowercase hash directories from DIRHASH-LOWER, e.g. `f87/4d5/KEY`.",
+	layoutModeDirectory:    "Like `lower`, plus a directory named after the key, e.g. `f87/4d5/KEY/KEY`, as in git-annex's directory special remote.",
+	layoutModeNodir:        "Every key directly in the prefix directory, e.g. `KEY`.",
+	layoutModeMixed:        "Mixed-case hash directories from DIRHASH, e.g. `pX/ZJ/KEY`.",
+	layoutModeFrankencase:  "Like `mixed`, but lowercased, e.g. `px/zj/KEY`.",
+	layoutMode4level:       "Mixed-case hash directories above lowercase ones, e.g. `pX/ZJ/f87/4d5/KEY`. Only rclone can read it; neither git-annex nor git-annex-remote-rclone uses this layout.",
+	layoutModeAnnexObjects: "Like `mixed`, plus a directory named after the key, e.g. `pX/ZJ/KEY/KEY`, as in .git/annex/objects.",
+}
+
+// printLayouts writes a Markdown list of the layout modes and their
+// descriptions to `out`, for the --list-layouts flag.
+func printLayouts(out io.Writer) {
+	for _, mode := range allLayoutModes() {
+		description, ok := layoutDescriptions[mode]
+		if !ok {
+			description = "Provided by a layout plugin."
+		}
+		_, _ = fmt.Fprintf(out, "- `%s`: %s\n", mode, description)
+	}
+}
+
+// validateLayoutMode returns nil iff `mode` names a known layout mode.
+// Otherwise, it returns an error listing the valid modes that is suitable for
+// sending back to git-annex.
+func validateLayoutMode(mode string) error {
+	if parseLayoutMode(mode) == layoutModeUnknown {
+		return fmt.Errorf("unknown layout: %s (must be one of %v)", mode, allLayoutModes())
+	}
+	return nil
+}
+
+// dirhashVariant selects which of git-annex's hash directory schemes to query.
+type dirhashVariant int
+
+const (
+	// dirhashMixed is the mixed-case scheme that git-annex uses for its own
+	// object store, e.g. "Xq/3v/". It is queried with DIRHASH.
+	dirhashMixed dirhashVariant = iota
+	// dirhashLower is the lowercase hex scheme that git-annex uses where paths
+	// may be case-insensitive, e.g. "f87/4d1/". It is queried with
+	// DIRHASH-LOWER.
+	dirhashLower
+)
+
+type queryDirhashFunc func(variant dirhashVariant, key string) (string, error)
+
+// dirhashVariants returns the hash directories, outermost first, under which
+// `mode` nests each key.
+func (mode layoutMode) dirhashVariants() []dirhashVariant {
+	switch mode {
+	case layoutModeLower, layoutModeDirectory:
+		return []dirhashVariant{dirhashLower}
+	case layoutModeMixed, layoutModeFrankencase, layoutModeAnnexObjects:
+		return []dirhashVariant{dirhashMixed}
+	case layoutMode4level:
+		return []dirhashVariant{dirhashMixed, dirhashLower}
+	default:
+		return nil
+	}
+}
 
+// buildFsString returns the fs string of the directory where `key` is stored
+// in the given layout `mode`. The "4level" mode nests the two-level mixed-case
+// hash that git-annex uses for its object store (DIRHASH) above the two-level
+// lowercase hash (DIRHASH-LOWER), e.g. "prefix/Xq/3v/f87/4d1/".
+//
+// Since every key costs one or two round trips to git-annex, `queryDirhash`
+// should cache its responses; see [server.queryDirhashVariant].
 func buildFsString(queryDirhash queryDirhashFunc, mode layoutMode, key, remoteName, prefix string) (string, error) {
 	remoteName = strings.TrimSuffix(remoteName, ":") + ":"
 	remoteString := fspath.JoinRootPath(remoteName, prefix)
@@ -48,30 +218,128 @@ func buildFsString(queryDirhash queryDirhashFunc, mode layoutMode, key, remoteNa
 		return remoteString, nil
 	}
 
-	var dirhash string
-	var err error
-	switch mode {
-	case layoutModeLower, layoutModeDirectory:
-		dirhash, err = queryDirhash("DIRHASH-LOWER " + key)
-	case layoutModeMixed, layoutModeFrankencase:
-		dirhash, err = queryDirhash("DIRHASH " + key)
-	default:
+	if plugin := getLayoutPlugin(mode); plugin != nil {
+		keyPath, err := plugin.KeyPath(key, prefix, func(msg string) (string, error) {
+			command, msgKey, _ := strings.Cut(msg, " ")
+			switch command {
+			case "DIRHASH":
+				return queryDirhash(dirhashMixed, msgKey)
+			case "DIRHASH-LOWER":
+				return queryDirhash(dirhashLower, msgKey)
+			default:
+				return "", fmt.Errorf("layout plugins may not send %q", msg)
+			}
+		})
+		if err != nil {
+			return "", fmt.Errorf("layout plugin %s failed: %w", mode, err)
+		}
+		return fspath.JoinRootPath(remoteName, keyPath), nil
+	}
+
+	variants := mode.dirhashVariants()
+	if variants == nil {
 		panic("unreachable")
 	}
-	if err != nil {
-		return "", fmt.Errorf("buildFsString failed to query dirhash: %w", err)
+	var dirhash string
+	for _, variant := range variants {
+		hashDirs, err := queryDirhash(variant, key)
+		if err != nil {
+			return "", fmt.Errorf("buildFsString failed to query dirhash: %w", err)
+		}
+		dirhash += hashDirs
 	}
 
+	// Without a prefix, a leading slash would make the path absolute.
+	separator := "/"
+	if strings.HasSuffix(remoteString, ":") {
+		separator = ""
+	}
 	switch mode {
-	case layoutModeLower:
-		return fmt.Sprintf("%s/%s", remoteString, dirhash), nil
 	case layoutModeDirectory:
-		return fmt.Sprintf("%s/%s%s", remoteString, dirhash, key), nil
-	case layoutModeMixed:
-		return fmt.Sprintf("%s/%s", remoteString, dirhash), nil
+		return fmt.Sprintf("%s%s%s%s", remoteString, separator, dirhash, key), nil
+	case layoutModeAnnexObjects:
+		return fmt.Sprintf("%s%s%s", remoteString, separator, path.Dir(buildAnnexObjectsPath(dirhash, key))), nil
 	case layoutModeFrankencase:
-		return fmt.Sprintf("%s/%s", remoteString, strings.ToLower(dirhash)), nil
+		return fmt.Sprintf("%s%s%s", remoteString, separator, strings.ToLower(dirhash)), nil
 	default:
-		panic("unreachable")
+		return fmt.Sprintf("%s%s%s", remoteString, separator, dirhash), nil
+	}
+}
+
+// buildFsString is like the [buildFsString] function, but takes the remote
+// name and prefix from the server's configs. The prefix may depend on the type
+// of `key`; see [server.prefixForKey].
+func (s *server) buildFsString(mode layoutMode, key string) (string, error) {
+	prefix, err := s.prefixForKey(key)
+	if err != nil {
+		return "", err
+	}
+	return s.buildFsStringWithPrefix(mode, key, prefix)
+}
+
+// buildFsStringWithPrefix is like [server.buildFsString], but uses `prefix`
+// in place of the "rcloneprefix" config.
+func (s *server) buildFsStringWithPrefix(mode layoutMode, key, prefix string) (string, error) {
+	remoteName, prefix, err := s.fsRemoteAndPrefix(prefix)
+	if err != nil {
+		return "", err
+	}
+	return s.buildFsStringWithRemote(mode, key, remoteName, prefix)
+}
+
+// buildFsStringWithRemote is like [server.buildFsStringWithPrefix], but uses
+// `remoteName` and `prefix` as given, without wrapping them for encryption.
+// The directory of a key ends with the "rcloneobjectprefix" config, if any.
+func (s *server) buildFsStringWithRemote(mode layoutMode, key, remoteName, prefix string) (string, error) {
+	fsString, err := buildFsString(s.queryDirhashVariant, mode, key, remoteName, prefix)
+	if err != nil {
+		return "", err
+	}
+	cfg, err := s.getSessionConfig()
+	if err != nil {
+		return "", err
+	}
+	fsString = replacePathSeparator(fsString, fspath.JoinRootPath(strings.TrimSuffix(remoteName, ":")+":", prefix), cfg.pathSeparator)
+	// The prefix directory itself, e.g. for the UUID record, has no key.
+	if key == "" {
+		return fsString, nil
+	}
+	return joinObjectPrefix(fsString, cfg.objectPrefix), nil
+}
+
+// parseObjectPrefix parses the "rcloneobjectprefix" config, a relative path
+// such as "objects" that is inserted between the directories of the layout
+// and the key. Trailing slashes are dropped.
+func parseObjectPrefix(value string) (string, error) {
+	if strings.HasPrefix(value, "/") {
+		return "", fmt.Errorf("object prefix must not start with \"/\": %q", value)
+	}
+	if strings.Contains(value, "..") {
+		return "", fmt.Errorf("object prefix must not contain \"..\": %q", value)
+	}
+	return strings.TrimRight(value, "/"), nil
+}
+
+// joinObjectPrefix appends `objectPrefix` to the directory `fsString`.
+func joinObjectPrefix(fsString, objectPrefix string) string {
+	if objectPrefix == "" {
+		return fsString
+	}
+	if strings.HasSuffix(fsString, ":") || strings.HasSuffix(fsString, "/") {
+		return fsString + objectPrefix
+	}
+	return fsString + "/" + objectPrefix
+}
+
+// replacePathSeparator replaces the slashes in the part of `fsString` that
+// follows `prefixFsString`, i.e. in the directories that the layout created
+// within the prefix, with `separator`.
+func replacePathSeparator(fsString, prefixFsString, separator string) string {
+	layoutPath, found := strings.CutPrefix(fsString, prefixFsString)
+	if !found || separator == "/" {
+		return fsString
 	}
+	// Rclone ignores a trailing slash, but not a trailing backslash.
+	layoutPath = strings.TrimSuffix(layoutPath, "/")
+	return prefixFsString + strings.ReplaceAll(layoutPath, "/", separator)
 }
@@ -0,0 +1,9 @@
+//go:build windows || plan9
+
+package gitannex
+
+// lockFile is a no-op on this platform, which has no flock(2). The
+// "rclonelockfile" config is ignored.
+func lockFile(path string, exclusive bool) (unlock func(), err error) {
+	return func() {}, nil
+}
@@ -0,0 +1,39 @@
+//go:build !windows && !plan9
+
+package gitannex
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockFile takes an flock(2) lock on the file at `path`, creating it if
+// needed, and waits until the lock is granted. The lock is exclusive if
+// `exclusive` is set and shared otherwise. Locks are advisory, so they only
+// keep out other processes that use the same "rclonelockfile" config.
+func lockFile(path string, exclusive bool) (unlock func(), err error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+	how := unix.LOCK_SH
+	if exclusive {
+		how = unix.LOCK_EX
+	}
+	for {
+		err = unix.Flock(int(f.Fd()), how)
+		if err != unix.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+	return func() {
+		// Closing the file releases the lock.
+		_ = f.Close()
+	}, nil
+}
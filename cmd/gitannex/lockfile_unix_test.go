@@ -0,0 +1,74 @@
+//go:build !windows && !plan9
+
+package gitannex
+
+import (
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gitannex.lock")
+
+	t.Run("Exclusive", func(t *testing.T) {
+		var holders, maxHolders atomic.Int32
+		var wg sync.WaitGroup
+		for range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				unlock, err := lockFile(path, true)
+				if !assert.NoError(t, err) {
+					return
+				}
+				defer unlock()
+				n := holders.Add(1)
+				for {
+					m := maxHolders.Load()
+					if n <= m || maxHolders.CompareAndSwap(m, n) {
+						break
+					}
+				}
+				time.Sleep(5 * time.Millisecond)
+				holders.Add(-1)
+			}()
+		}
+		wg.Wait()
+		require.Equal(t, int32(1), maxHolders.Load())
+	})
+
+	t.Run("SharedWaitsForExclusive", func(t *testing.T) {
+		unlockExclusive, err := lockFile(path, true)
+		require.NoError(t, err)
+		locked := make(chan struct{})
+		go func() {
+			unlock, err := lockFile(path, false)
+			if assert.NoError(t, err) {
+				defer unlock()
+			}
+			close(locked)
+		}()
+		select {
+		case <-locked:
+			t.Fatal("shared lock granted while an exclusive lock was held")
+		case <-time.After(50 * time.Millisecond):
+		}
+		unlockExclusive()
+		<-locked
+	})
+
+	t.Run("SharedLocksOverlap", func(t *testing.T) {
+		unlock1, err := lockFile(path, false)
+		require.NoError(t, err)
+		defer unlock1()
+		unlock2, err := lockFile(path, false)
+		require.NoError(t, err)
+		unlock2()
+	})
+}
@@ -0,0 +1,174 @@
+package gitannex
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/cache"
+	"github.com/rclone/rclone/fs/operations"
+)
+
+// layoutMigration is a layout migration requested with the --migrate-layout
+// flag, e.g. "from=nodir,to=mixed".
+type layoutMigration struct {
+	from layoutMode
+	to   layoutMode
+}
+
+// parseLayoutMigration parses the value of the --migrate-layout flag. Only
+// migrations from "nodir" to "mixed" are supported.
+func parseLayoutMigration(value string) (layoutMigration, error) {
+	var m layoutMigration
+	for _, field := range strings.Split(value, ",") {
+		name, mode, found := strings.Cut(strings.TrimSpace(field), "=")
+		if !found {
+			return m, fmt.Errorf("failed to parse layout migration %q: expected from=LAYOUT,to=LAYOUT", value)
+		}
+		switch name {
+		case "from":
+			m.from = parseLayoutMode(mode)
+		case "to":
+			m.to = parseLayoutMode(mode)
+		default:
+			return m, fmt.Errorf("failed to parse layout migration %q: unknown field %q", value, name)
+		}
+	}
+	if m.from != layoutModeNodir || m.to != layoutModeMixed {
+		return m, fmt.Errorf("unsupported layout migration %q: only from=nodir,to=mixed is supported", value)
+	}
+	return m, nil
+}
+
+// mixedDirhashChars are the characters with which git-annex encodes the
+// mixed-case hash directories. Git-annex picked letters that rarely appear in
+// words.
+const mixedDirhashChars = "0123456789zqjxkmvwgpfZQJXKMVWGPF"
+
+// mixedDirhash computes the mixed-case hash directories of `key`, e.g.
+// "Xq/3v/", exactly as git-annex does in reply to "DIRHASH KEY". It lets the
+// layout migration run without git-annex.
+func mixedDirhash(key string) string {
+	sum := md5.Sum([]byte(nonChunkKey(key)))
+	var encoded []byte
+	for i := 0; i < len(sum); i += 4 {
+		w := binary.LittleEndian.Uint32(sum[i : i+4])
+		var chars [8]byte
+		for x := range chars {
+			chars[x] = mixedDirhashChars[(w>>(6*x))&31]
+		}
+		// Git-annex swaps each pair of characters and drops the last two,
+		// which are always "0".
+		for x := 0; x < 6; x += 2 {
+			encoded = append(encoded, chars[x+1], chars[x])
+		}
+	}
+	return fmt.Sprintf("%s/%s/", encoded[0:2], encoded[2:4])
+}
+
+// nonChunkKey strips the chunk size ("-S") and chunk number ("-C") fields from
+// a key, since git-annex hashes all chunks of a key into the same directory.
+func nonChunkKey(key string) string {
+	fieldsPart, name, found := strings.Cut(key, "--")
+	if !found {
+		return key
+	}
+	fields := strings.Split(fieldsPart, "-")
+	kept := fields[:1]
+	for _, field := range fields[1:] {
+		if !strings.HasPrefix(field, "S") && !strings.HasPrefix(field, "C") {
+			kept = append(kept, field)
+		}
+	}
+	return strings.Join(kept, "-") + "--" + name
+}
+
+// chunkSuffixRegexp matches the suffix that [chunkName] appends to a key.
+var chunkSuffixRegexp = regexp.MustCompile(`\.\d{3}$`)
+
+// migrationKey returns the key whose directory `name`, an object in the
+// "nodir" prefix directory, belongs in. Chunks and chunk manifests belong with
+// their key, which is recognized by the presence of its first chunk in
+// `names`.
+func migrationKey(name string, names map[string]struct{}) string {
+	if key, ok := strings.CutSuffix(name, manifestName("")); ok {
+		if _, ok := names[chunkName(key, 0)]; ok {
+			return key
+		}
+	}
+	if loc := chunkSuffixRegexp.FindStringIndex(name); loc != nil {
+		key := name[:loc[0]]
+		if _, ok := names[chunkName(key, 0)]; ok {
+			return key
+		}
+	}
+	return name
+}
+
+// migrateLayout moves every object stored directly in `prefixFs`, the
+// "rcloneprefix" directory of a "nodir" remote, into the directory that the
+// "mixed" layout would use. Objects in subdirectories have already been
+// migrated, and files beginning with "." are this command's own records, so
+// both are left alone. That makes the migration idempotent, and an interrupted
+// migration can be resumed by running it again. It returns the number of
+// objects moved.
+func migrateLayout(ctx context.Context, prefixFs fs.Fs, m layoutMigration) (moved int, err error) {
+	entries, err := prefixFs.List(ctx, "")
+	if err != nil {
+		return 0, fmt.Errorf("failed to list prefix directory: %w", err)
+	}
+	names := make(map[string]struct{}, len(entries))
+	for _, entry := range entries {
+		if _, isObject := entry.(fs.Object); isObject {
+			names[entry.Remote()] = struct{}{}
+		}
+	}
+	for _, entry := range entries {
+		obj, isObject := entry.(fs.Object)
+		if !isObject || strings.HasPrefix(obj.Remote(), ".") {
+			continue
+		}
+		dst := mixedDirhash(migrationKey(obj.Remote(), names)) + obj.Remote()
+		if err := operations.MoveFile(ctx, prefixFs, prefixFs, dst, obj.Remote()); err != nil {
+			return moved, fmt.Errorf("failed to move %s to %s: %w", obj.Remote(), dst, err)
+		}
+		moved++
+	}
+	return moved, nil
+}
+
+// runMigrateLayout migrates the objects in `remote`, the "rcloneprefix"
+// directory of a git-annex remote, as requested by `spec`, the value of the
+// --migrate-layout flag, without talking to git-annex. It prints a summary or
+// "ERROR: <reason>" to `out` and returns the exit code for the process.
+func runMigrateLayout(ctx context.Context, out io.Writer, remote, spec string) (exitCode int) {
+	moved, err := migrateRemoteLayout(ctx, remote, spec)
+	if err != nil {
+		_, _ = fmt.Fprintf(out, "ERROR: %v\n", err)
+		return 1
+	}
+	_, _ = fmt.Fprintf(out, "moved %d objects\n", moved)
+	return 0
+}
+
+// migrateRemoteLayout is like [migrateLayout], but parses its arguments.
+func migrateRemoteLayout(ctx context.Context, remote, spec string) (int, error) {
+	m, err := parseLayoutMigration(spec)
+	if err != nil {
+		return 0, err
+	}
+	if remote == "" {
+		return 0, errors.New("no remote given: use --remote-override or " + standaloneRemoteEnvVar)
+	}
+	prefixFs, err := cache.Get(ctx, remote)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get remote fs: %w", err)
+	}
+	return migrateLayout(ctx, prefixFs, m)
+}
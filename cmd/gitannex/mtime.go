@@ -0,0 +1,38 @@
+package gitannex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// setStoredModTime sets the modification time of the object named `key` in
+// `remoteFs` to `modTime`. Backends that cannot set modification times are
+// left alone.
+func setStoredModTime(ctx context.Context, remoteFs fs.Fs, key string, modTime time.Time) error {
+	obj, err := remoteFs.NewObject(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to find stored object: %w", err)
+	}
+	err = obj.SetModTime(ctx, modTime)
+	if errors.Is(err, fs.ErrorCantSetModTime) || errors.Is(err, fs.ErrorCantSetModTimeWithoutDelete) {
+		fs.Debugf(obj, "not preserving modification time: %v", err)
+		return nil
+	}
+	return err
+}
+
+// restoreModTime sets the modification time of the local file at `localPath`
+// to that of the object, or chunk manifest, holding `key` in `remoteFs`.
+func restoreModTime(ctx context.Context, remoteFs fs.Fs, key, localPath string) error {
+	obj, err := findKeyObject(ctx, remoteFs, key)
+	if err != nil {
+		return err
+	}
+	modTime := obj.ModTime(ctx)
+	return os.Chtimes(localPath, modTime, modTime)
+}
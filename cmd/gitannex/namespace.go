@@ -0,0 +1,16 @@
+package gitannex
+
+import (
+	"path"
+)
+
+// namespacedPrefix returns `prefix` within the directory named by the
+// "rclonenamespace" config, e.g. "team-a/git-annex-rclone", so that git-annex
+// remotes sharing an rclone remote store their keys apart. Without a
+// namespace, `prefix` is returned as is.
+func (s *server) namespacedPrefix(prefix string) string {
+	if s.configRcloneNamespace == "" {
+		return prefix
+	}
+	return path.Join(s.configRcloneNamespace, prefix)
+}
@@ -0,0 +1,51 @@
+package gitannex
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/rclone/rclone/fs/config"
+	"github.com/rclone/rclone/fs/fspath"
+)
+
+// objectCacheDir is the directory, within rclone's cache directory, where the
+// "rcloneobjectcache" config keeps its database and chunks.
+const objectCacheDir = "gitannex-objectcache"
+
+// objectCacheRemote wraps `remote`, an fs string such as "remote:prefix", in a
+// connection string for rclone's cache backend. The cache backend's own
+// defaults for its paths are fixed when rclone starts, so they are passed
+// explicitly to honor the "rclonecachedir" config.
+func objectCacheRemote(remote string) string {
+	dir := filepath.Join(config.GetCacheDir(), objectCacheDir)
+	return fmt.Sprintf(":cache,remote=%s,db_path=%s,chunk_path=%s:",
+		quoteConfigValue(remote),
+		quoteConfigValue(filepath.Join(dir, "db")),
+		quoteConfigValue(filepath.Join(dir, "chunks")))
+}
+
+// buildRetrieveFsString is like [server.buildFsString], but when the
+// "rcloneobjectcache" config is enabled, the returned fs string reads through
+// rclone's cache backend, so that keys retrieved again are served from local
+// disk. Stores go directly to the remote, which avoids caching everything that
+// is uploaded.
+func (s *server) buildRetrieveFsString(mode layoutMode, key string) (string, error) {
+	cfg, err := s.getSessionConfig()
+	if err != nil {
+		return "", err
+	}
+	if !cfg.objectCache {
+		return s.buildFsString(mode, key)
+	}
+	prefix, err := s.prefixForKey(key)
+	if err != nil {
+		return "", err
+	}
+	remoteName, prefix, err := s.fsRemoteAndPrefix(prefix)
+	if err != nil {
+		return "", err
+	}
+	cachedRemote := objectCacheRemote(fspath.JoinRootPath(strings.TrimSuffix(remoteName, ":")+":", prefix))
+	return s.buildFsStringWithRemote(mode, key, cachedRemote, "")
+}
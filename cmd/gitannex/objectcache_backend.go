@@ -0,0 +1,8 @@
+//go:build !plan9 && !js
+
+package gitannex
+
+// The "rcloneobjectcache" config wraps the remote in a cache remote, so the
+// cache backend must be registered even if no other code imports it. The cache
+// backend is not available on every platform.
+import _ "github.com/rclone/rclone/backend/cache"
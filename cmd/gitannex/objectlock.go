@@ -0,0 +1,52 @@
+package gitannex
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// objectLockMode is the S3 Object Lock mode of stored keys. In COMPLIANCE
+// mode, no user can delete a locked object or shorten its retention.
+const objectLockMode = "COMPLIANCE"
+
+// parseObjectLocking parses the "rcloneobjectlocking" and
+// "rcloneobjectlockretention" configs. It returns how long stored keys are
+// locked for, or 0 when object locking is disabled. Only s3 understands the
+// headers that lock objects, so object locking requires `remoteName` to be an
+// s3 remote.
+func parseObjectLocking(remoteName, locking, retention string) (time.Duration, error) {
+	enabled, err := parseBoolConfig("object locking", locking)
+	if err != nil || !enabled {
+		return 0, err
+	}
+	fsInfo, _, _, _, err := fs.ParseRemote(remoteName)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find backend of %s: %w", remoteName, err)
+	}
+	if fsInfo.Name != "s3" {
+		return 0, fmt.Errorf("object locking requires an s3 remote, not %s", fsInfo.Name)
+	}
+	d, err := fs.ParseDuration(retention)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse object lock retention %q: %w", retention, err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("object lock retention must be positive: %q", retention)
+	}
+	return d, nil
+}
+
+// objectLockContext returns `ctx` with upload headers that ask s3 to lock
+// each uploaded object in [objectLockMode] until `retention` after `now`.
+func objectLockContext(ctx context.Context, retention time.Duration, now time.Time) context.Context {
+	ctx, ci := fs.AddConfig(ctx)
+	ci.UploadHeaders = append(slices.Clone(ci.UploadHeaders),
+		&fs.HTTPOption{Key: "X-Amz-Object-Lock-Mode", Value: objectLockMode},
+		&fs.HTTPOption{Key: "X-Amz-Object-Lock-Retain-Until-Date", Value: now.Add(retention).UTC().Format(time.RFC3339)},
+	)
+	return ctx
+}
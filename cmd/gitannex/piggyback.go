@@ -0,0 +1,63 @@
+package gitannex
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/config"
+	"github.com/unknwon/goconfig" //nolint:misspell // Don't include misspell when running golangci-lint
+)
+
+// loadPiggybackConfig makes the remotes defined in the rclone config file at
+// `path` available to this process, in addition to those in rclone's own
+// config file. It returns the names of the remotes that it overrides.
+//
+// The remotes are defined with RCLONE_CONFIG_* environment variables rather
+// than added to rclone's config storage. Rclone may save its config storage,
+// e.g. when a backend refreshes an OAuth token, and the piggybacked remotes
+// must not end up in the user's own config file.
+func loadPiggybackConfig(path string) (overridden []string, err error) {
+	gc, err := goconfig.LoadConfigFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load piggyback config: %w", err)
+	}
+	for _, section := range gc.GetSectionList() {
+		keys := gc.GetKeyList(section)
+		if len(keys) == 0 {
+			continue
+		}
+		if config.LoadedData().HasSection(section) || os.Getenv(fs.ConfigToEnv(section, "type")) != "" {
+			overridden = append(overridden, section)
+		}
+		for _, key := range keys {
+			value, err := gc.GetValue(section, key)
+			if err != nil {
+				return overridden, fmt.Errorf("failed to read %s in section %q of piggyback config: %w", key, section, err)
+			}
+			if err := os.Setenv(fs.ConfigToEnv(section, key), value); err != nil {
+				return overridden, fmt.Errorf("failed to set %s of remote %q: %w", key, section, err)
+			}
+		}
+	}
+	return overridden, nil
+}
+
+// installPiggybackConfig applies the "rclonepiggybackconfig" config, if any,
+// and tells git-annex about each remote that it overrides.
+func (s *server) installPiggybackConfig() error {
+	// INITREMOTE and PREPARE may both load the file, and the second load
+	// would report the first one's remotes as overridden.
+	if s.configRclonePiggybackConfig == "" || s.configRclonePiggybackConfig == s.piggybackConfigLoaded {
+		return nil
+	}
+	overridden, err := loadPiggybackConfig(s.configRclonePiggybackConfig)
+	if err != nil {
+		return err
+	}
+	s.piggybackConfigLoaded = s.configRclonePiggybackConfig
+	for _, name := range overridden {
+		s.sendInfo(fmt.Sprintf("piggyback config: overriding remote %q", name))
+	}
+	return nil
+}
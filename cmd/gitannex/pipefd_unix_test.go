@@ -0,0 +1,87 @@
+//go:build unix
+
+package gitannex
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// dupFd returns a duplicate of the file descriptor of `f`, which the caller
+// owns.
+func dupFd(t *testing.T, f *os.File) int {
+	fd, err := syscall.Dup(int(f.Fd()))
+	require.NoError(t, err)
+	return fd
+}
+
+func TestPipeFdFlags(t *testing.T) {
+	stdinR, stdinW, err := os.Pipe()
+	require.NoError(t, err)
+	stdoutR, stdoutW, err := os.Pipe()
+	require.NoError(t, err)
+	// The server gets its own copies of the descriptors, as it would from a
+	// parent process.
+	inFd, outFd := dupFd(t, stdinR), dupFd(t, stdoutW)
+	require.NoError(t, stdinR.Close())
+	require.NoError(t, stdoutW.Close())
+
+	flagSet := command.Flags()
+	require.NoError(t, flagSet.Set("pipe-in-fd", strconv.Itoa(inFd)))
+	require.NoError(t, flagSet.Set("pipe-out-fd", strconv.Itoa(outFd)))
+	t.Cleanup(func() {
+		pipeInFd, pipeOutFd = -1, -1
+	})
+	in, out := protocolFiles()
+	require.Equal(t, uintptr(inFd), in.Fd())
+	require.Equal(t, uintptr(outFd), out.Fd())
+
+	remoteDir := t.TempDir()
+	localPath := filepath.Join(t.TempDir(), "file.txt")
+	require.NoError(t, os.WriteFile(localPath, []byte("HELLO"), 0600))
+
+	h := testState{
+		t: t,
+		server: &server{
+			reader: bufio.NewReader(in),
+			writer: out,
+		},
+		mockStdinW:       stdinW,
+		mockStdoutReader: bufio.NewReader(stdoutR),
+		readLineTimeout:  30 * time.Second,
+	}
+	serverErrorChan := make(chan error)
+	go func() {
+		err := h.server.run()
+		// Closing the server's end of stdout lets the test see EOF.
+		_ = out.Close()
+		_ = in.Close()
+		serverErrorChan <- err
+	}()
+
+	h.requireReadLineExact("VERSION 1")
+	h.requireWriteLine("INITREMOTE")
+	require.Equal(t, "INITREMOTE-SUCCESS\n", h.answerConfigs(map[string]string{
+		"rcloneremotename": ":local:",
+		"rcloneprefix":     remoteDir,
+	}))
+	h.requireWriteLine("PREPARE")
+	h.requireReadLineExactAfterConfigs("PREPARE-SUCCESS")
+	h.requireWriteLine("TRANSFER STORE SomeKey " + localPath)
+	h.requireReadLineExact("TRANSFER-SUCCESS STORE SomeKey")
+	require.FileExists(t, filepath.Join(remoteDir, "SomeKey"))
+	h.requireWriteLine("REMOVE SomeKey")
+	h.requireReadLineExact("REMOVE-SUCCESS SomeKey")
+	require.NoFileExists(t, filepath.Join(remoteDir, "SomeKey"))
+
+	require.NoError(t, stdinW.Close())
+	require.NoError(t, <-serverErrorChan)
+	require.NoError(t, stdoutR.Close())
+}
@@ -0,0 +1,76 @@
+package gitannex
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/accounting"
+)
+
+// progressStatsGroup is the rclone stats group that counts transfers while the
+// "rcloneprogress" config is enabled. Reusing one group for the whole session
+// keeps rclone from accumulating a group per transfer.
+const progressStatsGroup = "gitannex-progress"
+
+// progressInterval is how often the progress line is redrawn.
+const progressInterval = 500 * time.Millisecond
+
+// clearLine moves the cursor to the start of the line and erases the line.
+const clearLine = "\r\x1b[K"
+
+// startProgress renders rclone's one-line transfer stats to stderr, or to
+// s.progressOutput if set, until the returned function is called. The returned
+// context must be used for the transfer so that it is counted. The progress
+// line is erased when rendering stops, leaving stderr as it was.
+//
+// Progress is only rendered when the "rcloneprogress" config is enabled.
+// Otherwise, `ctx` is returned unchanged.
+func (s *server) startProgress(ctx context.Context) (context.Context, func(), error) {
+	cfg, err := s.getSessionConfig()
+	if err != nil || !cfg.progress {
+		return ctx, func() {}, err
+	}
+	out := s.progressOutput
+	if out == nil {
+		out = os.Stderr
+	}
+
+	ctx, ci := fs.AddConfig(ctx)
+	ci.StatsOneLine = true
+	ctx = accounting.WithStatsGroup(ctx, progressStatsGroup)
+	stats := accounting.Stats(ctx)
+	stats.ResetCounters()
+
+	render := func() {
+		_, _ = io.WriteString(out, clearLine+strings.TrimSpace(stats.String()))
+	}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				render()
+			case <-stop:
+				// Show the final numbers before erasing the line, so that
+				// even short transfers produce at least one update.
+				render()
+				_, _ = io.WriteString(out, clearLine)
+				return
+			}
+		}
+	}()
+	return ctx, func() {
+		close(stop)
+		wg.Wait()
+	}, nil
+}
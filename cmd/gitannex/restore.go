@@ -0,0 +1,67 @@
+package gitannex
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/filter"
+)
+
+// restoreLifetimeDays is how long s3 keeps the copy of an archived object
+// that [requestRestore] asks for. It leaves git-annex time to retry the
+// retrieval once the restore is done.
+const restoreLifetimeDays = "7"
+
+// requestRestore asks the backend of `remoteFs` to restore the object `remote`
+// from an archive storage class like GLACIER with the priority `tier`, via the
+// backend's "restore" command. Restores take time, so the object may not be
+// readable yet when this returns. Backends without a "restore" command, and
+// objects that are not archived, are left alone.
+func requestRestore(ctx context.Context, remoteFs fs.Fs, remote, tier string) error {
+	command := remoteFs.Features().Command
+	if command == nil {
+		return nil
+	}
+	// Restore just this object, found without listing its directory.
+	fi, err := filter.NewFilter(nil)
+	if err != nil {
+		return err
+	}
+	if err := fi.AddFile(remote); err != nil {
+		return err
+	}
+	ctx = filter.ReplaceConfig(ctx, fi)
+	ctx, ci := fs.AddConfig(ctx)
+	ci.NoTraverse = true
+
+	out, err := command(ctx, "restore", nil, map[string]string{
+		"priority": tier,
+		"lifetime": restoreLifetimeDays,
+	})
+	if errors.Is(err, fs.ErrorCommandNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to request restore: %w", err)
+	}
+	// The command reports a status for each object, which is not an error
+	// when the object is not archived.
+	encoded, err := json.Marshal(out)
+	if err != nil {
+		return err
+	}
+	var statuses []struct {
+		Status string
+		Remote string
+	}
+	if err := json.Unmarshal(encoded, &statuses); err != nil {
+		return err
+	}
+	for _, status := range statuses {
+		fs.Debugf(remoteFs, "Restore of %s: %s", status.Remote, status.Status)
+	}
+	return nil
+}
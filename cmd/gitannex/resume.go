@@ -0,0 +1,117 @@
+package gitannex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/operations"
+)
+
+// partialName returns the name of the object in which a resumable store of
+// `key` records how many bytes it has stored, e.g. "KEY.partial".
+func partialName(key string) string {
+	return key + ".partial"
+}
+
+// storeInProgress reports whether a resumable store of `key` has recorded its
+// progress and not yet finished, in which case the key is absent, whatever
+// else `remoteFs` holds.
+func storeInProgress(ctx context.Context, remoteFs fs.Fs, key string) (bool, error) {
+	_, err := remoteFs.NewObject(ctx, partialName(key))
+	if errors.Is(err, fs.ErrorObjectNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to find partial object: %w", err)
+	}
+	return true, nil
+}
+
+// removePartial deletes the partial object of `key`, if any.
+func removePartial(ctx context.Context, remoteFs fs.Fs, key string) error {
+	obj, err := remoteFs.NewObject(ctx, partialName(key))
+	if errors.Is(err, fs.ErrorObjectNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to find partial object: %w", err)
+	}
+	if err := operations.DeleteFile(ctx, obj); err != nil {
+		return fmt.Errorf("failed to delete partial object: %w", err)
+	}
+	return nil
+}
+
+// readResumeOffset returns the offset recorded in the partial object of `key`,
+// or 0 when there is none. Offsets that cannot be trusted, e.g. ones that are
+// not at a chunk boundary or whose last chunk is missing, are ignored, so the
+// store starts over.
+func readResumeOffset(ctx context.Context, remoteFs fs.Fs, key string, chunkSize, size int64) (int64, error) {
+	obj, err := remoteFs.NewObject(ctx, partialName(key))
+	if errors.Is(err, fs.ErrorObjectNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to find partial object: %w", err)
+	}
+	in, err := operations.Open(ctx, obj)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open partial object: %w", err)
+	}
+	contents, err := io.ReadAll(in)
+	_ = in.Close()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read partial object: %w", err)
+	}
+	offset, err := strconv.ParseInt(strings.TrimSpace(string(contents)), 10, 64)
+	if err != nil || offset <= 0 || offset > size || offset%chunkSize != 0 {
+		fs.Debugf(obj, "Ignoring invalid resume offset %q", contents)
+		return 0, nil
+	}
+	lastChunk, err := remoteFs.NewObject(ctx, chunkName(key, int(offset/chunkSize)-1))
+	if err != nil || lastChunk.Size() != chunkSize {
+		fs.Debugf(obj, "Ignoring resume offset %d: last stored chunk is missing or incomplete", offset)
+		return 0, nil
+	}
+	return offset, nil
+}
+
+// writeResumeOffset records `offset` in the partial object of `key`.
+func writeResumeOffset(ctx context.Context, remoteFs fs.Fs, key string, offset int64) error {
+	contents := strconv.FormatInt(offset, 10)
+	in := io.NopCloser(strings.NewReader(contents))
+	if _, err := operations.RcatSize(ctx, remoteFs, partialName(key), in, int64(len(contents)), time.Now(), nil); err != nil {
+		return fmt.Errorf("failed to record resume offset: %w", err)
+	}
+	return nil
+}
+
+// storeResumable is like [storeChunked], but records its progress in the
+// partial object of `key` after each chunk. When a previous store of `key` was
+// interrupted, it resumes after the last chunk that was recorded rather than
+// uploading the whole file again. The key is absent until the partial object
+// is deleted, which happens once the manifest follows the last chunk. It
+// returns the number of bytes uploaded.
+func storeResumable(ctx context.Context, remoteFs fs.Fs, key, localPath string, chunkSize, size int64) (int64, error) {
+	offset, err := readResumeOffset(ctx, remoteFs, key, chunkSize, size)
+	if err != nil {
+		return 0, err
+	}
+	if offset > 0 {
+		fs.Infof(nil, "Resuming store of %s at offset %d", key, offset)
+	}
+	progress := func(offset int64) error {
+		return writeResumeOffset(ctx, remoteFs, key, offset)
+	}
+	sent, err := storeChunkedFrom(ctx, remoteFs, key, localPath, chunkSize, offset, progress)
+	if err != nil {
+		return sent, err
+	}
+	return sent, removePartial(ctx, remoteFs, key)
+}
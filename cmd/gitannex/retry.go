@@ -0,0 +1,85 @@
+package gitannex
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// The defaults of the "rcloneretrydelay" and "rcloneretrymaxdelay" configs.
+const (
+	defaultRetryDelay    = "2s"
+	defaultRetryMaxDelay = "60s"
+)
+
+// retrySchedule is the backoff between attempts of [retryTransfer], from the
+// "rcloneretrydelay" and "rcloneretrymaxdelay" configs.
+type retrySchedule struct {
+	delay    time.Duration
+	maxDelay time.Duration
+}
+
+// parseRetrySchedule parses the "rcloneretrydelay" and "rcloneretrymaxdelay"
+// configs. An empty value means the default.
+func parseRetrySchedule(delay, maxDelay string) (retrySchedule, error) {
+	parse := func(name, value, defaultValue string) (time.Duration, error) {
+		if value == "" {
+			value = defaultValue
+		}
+		d, err := fs.ParseDuration(value)
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse %s %q: %w", name, value, err)
+		}
+		if d < 0 {
+			return 0, fmt.Errorf("%s must not be negative: %q", name, value)
+		}
+		return d, nil
+	}
+	var r retrySchedule
+	var err error
+	if r.delay, err = parse("retry delay", delay, defaultRetryDelay); err != nil {
+		return r, err
+	}
+	if r.maxDelay, err = parse("retry max delay", maxDelay, defaultRetryMaxDelay); err != nil {
+		return r, err
+	}
+	if r.maxDelay < r.delay {
+		return r, fmt.Errorf("retry max delay %v must not be less than retry delay %v", r.maxDelay, r.delay)
+	}
+	return r, nil
+}
+
+// wait returns how long to wait after the given failed attempt, counting from
+// zero: the delay, doubled for each earlier attempt and capped at the maximum,
+// give or take 10% so that many clients do not retry in lockstep.
+func (r retrySchedule) wait(attempt int) time.Duration {
+	d := r.delay
+	for i := 0; i < attempt && d < r.maxDelay; i++ {
+		d *= 2
+	}
+	d = min(d, r.maxDelay)
+	jitter := time.Duration((rand.Float64()*0.2 - 0.1) * float64(d))
+	return d + jitter
+}
+
+// retryTransfer calls `transfer` up to `attempts` times, waiting between
+// attempts according to `schedule`. Only transient errors, as decided by
+// [isTransientError], are retried. It returns the last error.
+func retryTransfer(ctx context.Context, attempts int, schedule retrySchedule, transfer func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := transfer()
+		if err == nil || attempt+1 >= attempts || !isTransientError(err) {
+			return err
+		}
+		wait := schedule.wait(attempt)
+		fs.Debugf(nil, "Retrying transfer in %v after attempt %d/%d failed: %v", wait, attempt+1, attempts, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package gitannex
+
+import (
+	"time"
+
+	"github.com/rclone/rclone/fs/config/configmap"
+	"github.com/rclone/rclone/fs/filter"
+)
+
+// sessionConfig holds the configs of a session in parsed form. It is built
+// once per session by [server.getSessionConfig], so that handlers neither
+// parse configs again nor each report the same invalid config.
+type sessionConfig struct {
+	layout               layoutMode
+	keyTypePrefixes      map[string]string
+	excludePatterns      []string
+	pathSeparator        string
+	serverSideEncryption string
+	restoreTier          string
+	objectLockRetention  time.Duration
+	tagging              string
+	compress             bool
+	compressLevel        int
+	snapshotPrefix       string
+	allowFail            bool
+	warmCache            bool
+	overwriteExisting    bool
+	ignoreCase           bool
+	retries              retrySchedule
+	sha256Verify         bool
+	verifySize           bool
+	gzip                 bool
+	gzipLevel            int
+	failOnAbsent         bool
+	connectionsPerServer int
+	copyBufferSize       int
+	checkInterval        time.Duration
+	objectPrefix         string
+	listFilter           *filter.Filter
+	copyFlags            configmap.Simple
+	createPrefix         bool
+	skipConnectTest      bool
+	preserveModTime      bool
+	maxTransferSize      int64
+	chunkSize            int64
+	cutoffSize           int64
+	resumeTransfer       bool
+	checkPresentWindow   time.Duration
+	objectCache          bool
+	progress             bool
+	publicLinks          bool
+}
+
+// getSessionConfig returns the configs of this session, parsing and
+// validating them the first time it is called once git-annex has sent them.
+// It returns the first invalid config as an error.
+func (s *server) getSessionConfig() (*sessionConfig, error) {
+	if s.sessionConfig != nil {
+		return s.sessionConfig, nil
+	}
+	c, err := s.parseSessionConfig()
+	if err != nil {
+		return nil, err
+	}
+	// Until git-annex has sent the configs, they may still change.
+	if s.configsDone {
+		s.sessionConfig = c
+	}
+	return c, nil
+}
+
+// parseSessionConfig parses and validates every config that the handlers use.
+func (s *server) parseSessionConfig() (*sessionConfig, error) {
+	c := &sessionConfig{}
+	var err error
+	if err = validateLayoutMode(s.configRcloneLayout); err != nil {
+		return nil, err
+	}
+	c.layout = parseLayoutMode(s.configRcloneLayout)
+	if c.keyTypePrefixes, err = parseKeyTypePrefixes(s.configRcloneKeyTypePrefix); err != nil {
+		return nil, err
+	}
+	if c.excludePatterns, err = parseExcludeKeyPatterns(s.configRcloneExcludeKeys); err != nil {
+		return nil, err
+	}
+	if c.pathSeparator, err = parsePathSeparator(s.configRclonePathSeparator); err != nil {
+		return nil, err
+	}
+	if c.serverSideEncryption, err = parseServerSideEncryption(s.configRcloneEncryptionType, s.configRcloneKMSKey); err != nil {
+		return nil, err
+	}
+	if c.restoreTier, err = parseRestoreTier(s.configRcloneRetrievalStorageClass); err != nil {
+		return nil, err
+	}
+	if err = validateTemporaryPrefix(s.configRcloneTemporaryPrefix, s.configPrefix); err != nil {
+		return nil, err
+	}
+	if c.objectLockRetention, err = parseObjectLocking(s.configRcloneRemoteName, s.configRcloneObjectLocking, s.configRcloneObjectLockRetention); err != nil {
+		return nil, err
+	}
+	if c.tagging, err = parseTagging(s.configRcloneTagging); err != nil {
+		return nil, err
+	}
+	if c.compress, c.compressLevel, err = parseCompression(s.configRcloneCompress, s.configRcloneCompressLevel); err != nil {
+		return nil, err
+	}
+	if c.snapshotPrefix, err = parseSnapshotPrefix(s.configRcloneSnapshotPrefix, s.configPrefix); err != nil {
+		return nil, err
+	}
+	if c.allowFail, err = parseBoolConfig("allow fail", s.configRcloneAllowFail); err != nil {
+		return nil, err
+	}
+	if c.warmCache, err = parseBoolConfig("warm cache", s.configRcloneWarmCache); err != nil {
+		return nil, err
+	}
+	if c.overwriteExisting, err = parseBoolConfig("overwrite existing", s.configRcloneOverwriteExisting); err != nil {
+		return nil, err
+	}
+	if c.ignoreCase, err = parseBoolConfig("ignore case", s.configRcloneIgnoreCase); err != nil {
+		return nil, err
+	}
+	if c.retries, err = parseRetrySchedule(s.configRcloneRetryDelay, s.configRcloneRetryMaxDelay); err != nil {
+		return nil, err
+	}
+	if c.sha256Verify, err = parseBoolConfig("sha256 verify", s.configRcloneSHA256Verify); err != nil {
+		return nil, err
+	}
+	if c.verifySize, err = parseBoolConfig("verify size", s.configRcloneVerifySize); err != nil {
+		return nil, err
+	}
+	if c.gzip, c.gzipLevel, err = parseGzip(s.configRcloneGzip, s.configRcloneGzipLevel); err != nil {
+		return nil, err
+	}
+	if c.failOnAbsent, err = parseBoolConfig("fail on absent", s.configRcloneFailOnAbsent); err != nil {
+		return nil, err
+	}
+	if c.connectionsPerServer, err = parseConnectionsPerServer(s.configRcloneConnectionsPerServer); err != nil {
+		return nil, err
+	}
+	if c.copyBufferSize, err = parseCopyBufferSize(s.configRcloneCopyBuffer); err != nil {
+		return nil, err
+	}
+	if c.checkInterval, err = parseCheckInterval(s.configRcloneCheckInterval); err != nil {
+		return nil, err
+	}
+	if c.objectPrefix, err = parseObjectPrefix(s.configRcloneObjectPrefix); err != nil {
+		return nil, err
+	}
+	if c.listFilter, err = parseFilterFlags(s.configRcloneFilterFlags); err != nil {
+		return nil, err
+	}
+	if c.copyFlags, err = parseCopyFlags(s.configRcloneCopyFlag); err != nil {
+		return nil, err
+	}
+	if c.createPrefix, err = parseBoolConfig("prefix create on prepare", s.configRclonePrefixCreateOnPrepare); err != nil {
+		return nil, err
+	}
+	if c.skipConnectTest, err = parseBoolConfig("skip connect test", s.configRcloneSkipConnectTest); err != nil {
+		return nil, err
+	}
+	if c.preserveModTime, err = parseBoolConfig("preserve mtime", s.configRclonePreserveModTime); err != nil {
+		return nil, err
+	}
+	if c.maxTransferSize, err = parseSizeConfig("max transfer size", s.configRcloneMaxTransferSize); err != nil {
+		return nil, err
+	}
+	if c.chunkSize, err = parseSizeConfig("chunk size", s.configRcloneChunkSize); err != nil {
+		return nil, err
+	}
+	if c.cutoffSize, err = parseSizeConfig("cutoff size", s.configRcloneCutoffSize); err != nil {
+		return nil, err
+	}
+	if c.resumeTransfer, err = parseBoolConfig("resume transfer", s.configRcloneResumeTransfer); err != nil {
+		return nil, err
+	}
+	if c.checkPresentWindow, err = parseCheckPresentWindow(s.configRcloneCheckPresentWindow); err != nil {
+		return nil, err
+	}
+	if c.objectCache, err = parseBoolConfig("object cache", s.configRcloneObjectCache); err != nil {
+		return nil, err
+	}
+	if c.progress, err = parseBoolConfig("progress", s.configRcloneProgress); err != nil {
+		return nil, err
+	}
+	if c.publicLinks, err = parseBoolConfig("public links", s.configRclonePublicLinks); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
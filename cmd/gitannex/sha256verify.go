@@ -0,0 +1,32 @@
+package gitannex
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// errHashMismatch is returned by [verifySHA256] when a file's content does not
+// match the hash in its key.
+var errHashMismatch = errors.New("hash mismatch")
+
+// verifySHA256 checks that the SHA-256 hash of the file at `localPath` is
+// `want`, in hex.
+func verifySHA256(localPath, want string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to open local file: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("failed to hash local file: %w", err)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		return fmt.Errorf("%w: expected %s got %s", errHashMismatch, want, got)
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build windows || plan9
+
+package gitannex
+
+// handleSigpipe is a no-op on this platform, which has no SIGPIPE.
+func handleSigpipe() (stop func()) {
+	return func() {}
+}
+
+// isBrokenPipe always returns false on this platform. Closed pipes are still
+// detected through [io.ErrClosedPipe] and [os.ErrClosed].
+func isBrokenPipe(err error) bool {
+	return false
+}
@@ -0,0 +1,29 @@
+//go:build !windows && !plan9
+
+package gitannex
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// handleSigpipe stops SIGPIPE from killing the process when git-annex closes
+// stdout. By default, the Go runtime exits when a write to stdout fails with
+// EPIPE. Once SIGPIPE is routed to a channel, the write returns EPIPE instead,
+// which sendMsg converts to [ErrPipeClosed]. The returned function undoes the
+// registration.
+func handleSigpipe() (stop func()) {
+	sigpipe := make(chan os.Signal, 1)
+	signal.Notify(sigpipe, syscall.SIGPIPE)
+	return func() {
+		signal.Stop(sigpipe)
+	}
+}
+
+// isBrokenPipe reports whether `err` is the result of writing to a pipe whose
+// read end has been closed.
+func isBrokenPipe(err error) bool {
+	return errors.Is(err, syscall.EPIPE)
+}
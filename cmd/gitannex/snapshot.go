@@ -0,0 +1,106 @@
+package gitannex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/cache"
+)
+
+// parseSnapshotPrefix validates the "rclonesnapshotprefix" config. The other
+// snapshots are the directories next to it, e.g. "snap/2024-01-01" is next to
+// "snap/2023-12-01", so it must lie within a parent directory. It returns the
+// cleaned prefix, or "" when snapshots are disabled.
+func parseSnapshotPrefix(snapshotPrefix, prefix string) (string, error) {
+	if snapshotPrefix == "" {
+		return "", nil
+	}
+	cleaned := strings.Trim(path.Clean("/"+snapshotPrefix), "/")
+	if !strings.Contains(cleaned, "/") {
+		return "", fmt.Errorf("snapshot prefix must lie within a directory of snapshots, e.g. \"snap/2024-01-01\": %q", snapshotPrefix)
+	}
+	if cleanedPrefix := strings.Trim(path.Clean("/"+prefix), "/"); cleaned == cleanedPrefix || strings.HasPrefix(cleaned, cleanedPrefix+"/") {
+		return "", fmt.Errorf("snapshot prefix must not lie within prefix: %q", snapshotPrefix)
+	}
+	return cleaned, nil
+}
+
+// listSnapshotPrefixes returns the names of the snapshot directories in
+// `remoteFs`, the directory that holds them, newest first assuming they are
+// named by date.
+func listSnapshotPrefixes(ctx context.Context, remoteFs fs.Fs) ([]string, error) {
+	entries, err := remoteFs.List(ctx, "")
+	if errors.Is(err, fs.ErrorDirNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if _, isDir := entry.(fs.Directory); isDir {
+			names = append(names, entry.Remote())
+		}
+	}
+	slices.Sort(names)
+	slices.Reverse(names)
+	return names, nil
+}
+
+// snapshotPrefixes returns the prefixes of every snapshot, starting with the
+// "rclonesnapshotprefix" config, or nil when snapshots are disabled. The
+// snapshots are listed once per session.
+func (s *server) snapshotPrefixes(ctx context.Context) ([]string, error) {
+	cfg, err := s.getSessionConfig()
+	if err != nil || cfg.snapshotPrefix == "" {
+		return nil, err
+	}
+	current := cfg.snapshotPrefix
+	if s.snapshots != nil {
+		return s.snapshots, nil
+	}
+	parent := path.Dir(current)
+	parentFsString, err := s.buildFsStringWithPrefix(layoutModeNodir, "", parent)
+	if err != nil {
+		return nil, err
+	}
+	getFs := s.getFs
+	if getFs == nil {
+		getFs = cache.Get
+	}
+	parentFs, err := getFs(ctx, parentFsString)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get snapshot directory: %w", err)
+	}
+	names, err := listSnapshotPrefixes(ctx, parentFs)
+	if err != nil {
+		return nil, err
+	}
+	snapshots := []string{current}
+	for _, name := range names {
+		if prefix := path.Join(parent, name); prefix != current {
+			snapshots = append(snapshots, prefix)
+		}
+	}
+	s.snapshots = snapshots
+	return snapshots, nil
+}
+
+// fallbackPrefixes returns the prefixes in which to look for a key that is
+// missing from the "rcloneprefix" directory: the old default prefix, if any,
+// and every snapshot.
+func (s *server) fallbackPrefixes(ctx context.Context) ([]string, error) {
+	snapshots, err := s.snapshotPrefixes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if s.legacyPrefix == "" {
+		return snapshots, nil
+	}
+	return append([]string{s.legacyPrefix}, snapshots...), nil
+}
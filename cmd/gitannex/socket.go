@@ -0,0 +1,32 @@
+package gitannex
+
+import (
+	"fmt"
+	"net"
+)
+
+// Path of a Unix domain socket over which to speak with git-annex instead of
+// stdin and stdout, as set by the --socket-path flag.
+var socketPath string
+
+// acceptProtocolConn waits for git-annex to connect to `l` and returns the
+// connection. It closes `l` either way, since a session only ever has one
+// peer.
+func acceptProtocolConn(l net.Listener) (net.Conn, error) {
+	defer func() { _ = l.Close() }()
+	conn, err := l.Accept()
+	if err != nil {
+		return nil, fmt.Errorf("failed to accept connection on %s: %w", l.Addr(), err)
+	}
+	return conn, nil
+}
+
+// listenProtocolSocket listens on the Unix domain socket at `path` and returns
+// the first connection to it.
+func listenProtocolSocket(path string) (net.Conn, error) {
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on socket: %w", err)
+	}
+	return acceptProtocolConn(l)
+}
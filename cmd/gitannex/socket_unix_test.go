@@ -0,0 +1,56 @@
+//go:build unix
+
+package gitannex
+
+import (
+	"bufio"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSocketPath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gitannex.sock")
+	l, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	client, err := net.Dial("unix", path)
+	require.NoError(t, err)
+	conn, err := acceptProtocolConn(l)
+	require.NoError(t, err)
+	// The listener is closed once the one connection has been accepted.
+	_, err = net.Dial("unix", path)
+	require.Error(t, err)
+
+	h := testState{
+		t: t,
+		server: &server{
+			reader: bufio.NewReader(conn),
+			writer: conn,
+		},
+		mockStdinW:       client,
+		mockStdoutReader: bufio.NewReader(client),
+		readLineTimeout:  30 * time.Second,
+	}
+	serverErrorChan := make(chan error)
+	go func() {
+		err := h.server.run()
+		_ = conn.Close()
+		serverErrorChan <- err
+	}()
+
+	h.requireReadLineExact("VERSION 1")
+	h.requireWriteLine("INITREMOTE")
+	require.Equal(t, "INITREMOTE-SUCCESS\n", h.answerConfigs(map[string]string{
+		"rcloneremotename": ":local:",
+		"rcloneprefix":     t.TempDir(),
+	}))
+	h.requireWriteLine("PREPARE")
+	h.requireReadLineExactAfterConfigs("PREPARE-SUCCESS")
+
+	require.NoError(t, client.(*net.UnixConn).CloseWrite())
+	require.NoError(t, <-serverErrorChan)
+	require.NoError(t, client.Close())
+}
@@ -0,0 +1,41 @@
+package gitannex
+
+import "time"
+
+// SessionStats is a snapshot of what a server has done during its session.
+type SessionStats struct {
+	// Number of successful stores, retrieves, and removes, and of checkpresents
+	// that found an answer.
+	StoreCount        int
+	RetrieveCount     int
+	RemoveCount       int
+	CheckPresentCount int
+	// Number of bytes successfully stored and retrieved.
+	StoreBytes    int64
+	RetrieveBytes int64
+	// Number of requests whose handler failed. Keys that were not found do not
+	// count as failures.
+	Errors int
+	// Time since the session started, or zero if it has not started.
+	Uptime time.Duration
+}
+
+// Stats returns a snapshot of the server's session metrics. It is safe to call
+// while the server is running.
+func (s *server) Stats() SessionStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := SessionStats{
+		StoreCount:        int(s.storeCount),
+		RetrieveCount:     int(s.retrieveCount),
+		RemoveCount:       int(s.removeCount),
+		CheckPresentCount: int(s.checkpresentCount),
+		StoreBytes:        s.bytesStored,
+		RetrieveBytes:     s.bytesRetrieved,
+		Errors:            int(s.errorCount),
+	}
+	if !s.startedAt.IsZero() {
+		stats.Uptime = time.Since(s.startedAt)
+	}
+	return stats
+}
@@ -0,0 +1,81 @@
+package gitannex
+
+import (
+	"strings"
+)
+
+// backendOption is an option of an rclone backend, e.g. "acl" for s3.
+type backendOption struct {
+	name  string
+	value string
+}
+
+// remoteWithOption returns `remoteName`, e.g. "MyS3:" or ":s3,provider=AWS:",
+// with the backend option `name` overridden by `value`, e.g.
+// "MyS3,acl='private':".
+func remoteWithOption(remoteName, name, value string) string {
+	return strings.TrimSuffix(remoteName, ":") + "," + name + "=" + quoteConfigValue(value) + ":"
+}
+
+// storeOptions returns the backend options that the configs override for
+// stores, e.g. "acl" when the "rcloneacl" config is set.
+func (s *server) storeOptions() ([]backendOption, error) {
+	var options []backendOption
+	if s.configRcloneACL != "" {
+		options = append(options, backendOption{"acl", s.configRcloneACL})
+	}
+	cfg, err := s.getSessionConfig()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.serverSideEncryption != "" {
+		options = append(options, backendOption{"server_side_encryption", cfg.serverSideEncryption})
+	}
+	if s.configRcloneKMSKey != "" {
+		options = append(options, backendOption{"sse_kms_key_id", s.configRcloneKMSKey})
+	}
+	if s.configRcloneStorageClass != "" {
+		options = append(options, backendOption{"storage_class", s.configRcloneStorageClass})
+	}
+	return options, nil
+}
+
+// buildStoreFsString is like [server.buildFsString], but the returned fs string
+// overrides the backend options from [server.storeOptions], so that stored
+// objects get e.g. the configured ACL. When the "rclonesnapshotprefix" config
+// is set, the fs string is within that directory instead of "rcloneprefix".
+func (s *server) buildStoreFsString(mode layoutMode, key string) (string, error) {
+	prefix, err := s.prefixForKey(key)
+	if err != nil {
+		return "", err
+	}
+	cfg, err := s.getSessionConfig()
+	if err != nil {
+		return "", err
+	}
+	if cfg.snapshotPrefix != "" {
+		prefix = cfg.snapshotPrefix
+	}
+	return s.buildStoreFsStringWithPrefix(mode, key, prefix)
+}
+
+// buildStoreFsStringWithPrefix is like [server.buildStoreFsString], but uses
+// `prefix` in place of the "rcloneprefix" config.
+func (s *server) buildStoreFsStringWithPrefix(mode layoutMode, key, prefix string) (string, error) {
+	options, err := s.storeOptions()
+	if err != nil {
+		return "", err
+	}
+	if len(options) == 0 {
+		return s.buildFsStringWithPrefix(mode, key, prefix)
+	}
+	remoteName := s.configRcloneRemoteName
+	for _, option := range options {
+		remoteName = remoteWithOption(remoteName, option.name, option.value)
+	}
+	remoteName, prefix, err = s.wrapRemoteAndPrefix(remoteName, prefix)
+	if err != nil {
+		return "", err
+	}
+	return s.buildFsStringWithRemote(mode, key, remoteName, prefix)
+}
@@ -0,0 +1,44 @@
+package gitannex
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"slices"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// parseTagging parses the "rclonetagging" config, a JSON object mapping tag
+// keys to values, e.g. {"project":"annex","env":"prod"}. It returns the tags
+// URL-encoded as s3 expects them in the x-amz-tagging header, e.g.
+// "env=prod&project=annex", or the empty string when the config is empty.
+func parseTagging(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	var tags map[string]string
+	if err := json.Unmarshal([]byte(value), &tags); err != nil {
+		return "", fmt.Errorf("failed to parse tagging %q: %w", value, err)
+	}
+	values := make(url.Values, len(tags))
+	for key, tagValue := range tags {
+		if key == "" {
+			return "", fmt.Errorf("tag keys must not be empty: %q", value)
+		}
+		values.Set(key, tagValue)
+	}
+	// Encode sorts by key, so the header is the same for every store.
+	return values.Encode(), nil
+}
+
+// taggingContext returns `ctx` with an upload header that asks s3 to tag each
+// uploaded object with `tagging`, as returned by [parseTagging].
+func taggingContext(ctx context.Context, tagging string) context.Context {
+	ctx, ci := fs.AddConfig(ctx)
+	ci.UploadHeaders = append(slices.Clone(ci.UploadHeaders),
+		&fs.HTTPOption{Key: "X-Amz-Tagging", Value: tagging},
+	)
+	return ctx
+}
@@ -0,0 +1,43 @@
+package gitannex
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/cache"
+	"github.com/rclone/rclone/fs/operations"
+)
+
+// getTemporaryFs returns the Fs of the "rclonetemporaryprefix" directory, in
+// which STORE uploads `key` before moving it into place. It does not go through
+// [server.getRemoteFs], which would then forget the Fs of the key's directory.
+func (s *server) getTemporaryFs(ctx context.Context, key string) (fs.Fs, error) {
+	fsString, err := s.buildStoreFsStringWithPrefix(layoutModeNodir, key, s.configRcloneTemporaryPrefix)
+	if err != nil {
+		return nil, err
+	}
+	getFs := s.getFs
+	if getFs == nil {
+		getFs = cache.Get
+	}
+	return getFs(ctx, fsString)
+}
+
+// storeViaTemporary calls `upload` to store `key` in `temporaryFs`, then moves
+// it to `remoteFs`, so that the key never appears half-written where git-annex
+// looks for it. If the move fails, the temporary object is deleted.
+func storeViaTemporary(ctx context.Context, remoteFs, temporaryFs fs.Fs, key string, upload func(dst fs.Fs) error) error {
+	if err := upload(temporaryFs); err != nil {
+		return err
+	}
+	if err := operations.MoveFile(ctx, remoteFs, temporaryFs, key, key); err != nil {
+		if obj, findErr := temporaryFs.NewObject(ctx, key); findErr == nil {
+			if deleteErr := operations.DeleteFile(ctx, obj); deleteErr != nil {
+				fs.Errorf(obj, "Failed to delete temporary copy: %v", deleteErr)
+			}
+		}
+		return fmt.Errorf("failed to move from temporary prefix: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package gitannex
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/lib/random"
+	"github.com/stretchr/testify/require"
+)
+
+// transcriptReadTimeout is how long RunTranscriptFile waits for each line it
+// expects from the server.
+const transcriptReadTimeout = 10 * time.Second
+
+// RunTranscriptFile runs a server through the protocol session described by
+// the transcript file at `path` and returns an error if the server's output
+// differs from the transcript.
+//
+// Each line of a transcript is one of:
+//
+//	> MESSAGE             git-annex sends MESSAGE to the server.
+//	< MESSAGE             the server must send MESSAGE. Trailing whitespace is
+//	                      ignored.
+//	! config NAME VALUE   answer "GETCONFIG NAME" with VALUE.
+//	! file NAME CONTENT   create the file NAME, containing CONTENT, in $DIR.
+//	! eof                 git-annex closes stdin, which ends the session.
+//	# COMMENT             ignored, as are blank lines.
+//
+// GETCONFIG messages that the transcript does not expect with a "<" line are
+// answered automatically with the value from "! config", or with an empty
+// value. "$DIR" is replaced with a temporary directory and "$PREFIX" with a
+// directory name that is unique to this run, so transcripts may store keys on
+// a shared remote such as ":memory:". "$VERSION" is replaced with rclone's
+// version.
+//
+// The server may return an error, e.g. after git-annex sends ERROR, as long as
+// its output matches the transcript. Any output after the last "<" line is an
+// error.
+func RunTranscriptFile(path string) (err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", "gitannex-transcript-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if removeErr := os.RemoveAll(dir); err == nil {
+			err = removeErr
+		}
+	}()
+	replacer := strings.NewReplacer("$DIR", dir, "$PREFIX", "transcript-"+random.String(8), "$VERSION", fs.Version)
+
+	stdinR, stdinW := io.Pipe()
+	defer func() { _ = stdinW.Close() }()
+	stdoutR, stdoutW := io.Pipe()
+	s := &server{
+		reader: bufio.NewReader(stdinR),
+		writer: stdoutW,
+	}
+	serverErrChan := make(chan error, 1)
+	go func() {
+		serverErr := s.run()
+		_ = stdoutW.Close()
+		_ = stdinR.CloseWithError(errors.New("server exited"))
+		serverErrChan <- serverErr
+	}()
+
+	// Read the server's output in the background so that it never blocks on
+	// writing a line the transcript has not asked for yet.
+	outputChan := make(chan string, 1024)
+	go func() {
+		defer close(outputChan)
+		scanner := bufio.NewScanner(stdoutR)
+		for scanner.Scan() {
+			outputChan <- scanner.Text()
+		}
+	}()
+	readOutput := func() (string, bool, error) {
+		select {
+		case line, ok := <-outputChan:
+			return line, ok, nil
+		case <-time.After(transcriptReadTimeout):
+			return "", false, fmt.Errorf("timed out after %v waiting for output", transcriptReadTimeout)
+		}
+	}
+
+	configs := make(map[string]string)
+	lines := strings.Split(replacer.Replace(string(data)), "\n")
+	for i, line := range lines {
+		lineNumber := i + 1
+		line = strings.TrimRight(line, " \t\r")
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "! "):
+			directive := strings.SplitN(strings.TrimPrefix(line, "! "), " ", 3)
+			if directive[0] == "eof" {
+				_ = stdinW.Close()
+				continue
+			}
+			if len(directive) < 2 {
+				return fmt.Errorf("%s:%d: malformed directive: %q", path, lineNumber, line)
+			}
+			value := ""
+			if len(directive) == 3 {
+				value = directive[2]
+			}
+			switch directive[0] {
+			case "config":
+				configs[directive[1]] = value
+			case "file":
+				if err := os.WriteFile(filepath.Join(dir, directive[1]), []byte(value), 0600); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("%s:%d: unknown directive: %q", path, lineNumber, line)
+			}
+		case strings.HasPrefix(line, "> "):
+			if _, err := io.WriteString(stdinW, strings.TrimPrefix(line, "> ")+"\n"); err != nil {
+				return fmt.Errorf("%s:%d: failed to send message: %w", path, lineNumber, err)
+			}
+		case strings.HasPrefix(line, "< "):
+			want := strings.TrimPrefix(line, "< ")
+			for {
+				got, ok, err := readOutput()
+				if err != nil {
+					return fmt.Errorf("%s:%d: %w\n- %s", path, lineNumber, err, want)
+				}
+				if !ok {
+					return fmt.Errorf("%s:%d: server exited before sending the expected line\n- %s", path, lineNumber, want)
+				}
+				got = strings.TrimRight(got, " \t\r")
+				configName, isGetConfig := strings.CutPrefix(got, "GETCONFIG ")
+				if isGetConfig && got != want {
+					reply := strings.TrimRight("VALUE "+configs[configName], " ")
+					if _, err := io.WriteString(stdinW, reply+"\n"); err != nil {
+						return fmt.Errorf("%s:%d: failed to answer %q: %w", path, lineNumber, got, err)
+					}
+					continue
+				}
+				if got != want {
+					return fmt.Errorf("%s:%d: unexpected output\n- %s\n+ %s", path, lineNumber, want, got)
+				}
+				break
+			}
+		default:
+			return fmt.Errorf("%s:%d: line must start with \">\", \"<\", \"!\", or \"#\": %q", path, lineNumber, line)
+		}
+	}
+
+	_ = stdinW.Close()
+	var extra []string
+	for {
+		got, ok, err := readOutput()
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if !ok {
+			break
+		}
+		extra = append(extra, "+ "+got)
+	}
+	<-serverErrChan
+	if len(extra) > 0 {
+		return fmt.Errorf("%s: unexpected output after the end of the transcript\n%s", path, strings.Join(extra, "\n"))
+	}
+	return nil
+}
+
+// TestTranscriptFiles runs every transcript in testdata. See
+// [RunTranscriptFile] for the format.
+func TestTranscriptFiles(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "*.transcript"))
+	require.NoError(t, err)
+	require.NotEmpty(t, paths)
+	for _, path := range paths {
+		t.Run(strings.TrimSuffix(filepath.Base(path), ".transcript"), func(t *testing.T) {
+			require.NoError(t, RunTranscriptFile(path))
+		})
+	}
+}
+
+func TestRunTranscriptFileReportsMismatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mismatch.transcript")
+	transcript := "< VERSION 1\n> GETCOST\n< COST 100\n"
+	require.NoError(t, os.WriteFile(path, []byte(transcript), 0600))
+
+	err := RunTranscriptFile(path)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), path+":3: unexpected output\n- COST 100\n+ COST 200")
+}
+
+func TestRunTranscriptFileReportsExtraOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "extra.transcript")
+	require.NoError(t, os.WriteFile(path, []byte("< VERSION 1\n> GETCOST\n"), 0600))
+
+	err := RunTranscriptFile(path)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unexpected output after the end of the transcript\n+ COST 200")
+}
@@ -0,0 +1,143 @@
+package gitannex
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/operations"
+)
+
+// uuidFileName is the name of the file, relative to the "rcloneprefix"
+// directory, that records the UUID of the git-annex remote using the directory.
+const uuidFileName = ".gitannex-rclone-uuid"
+
+// errUUIDMismatch indicates that the "rcloneprefix" directory belongs to a
+// different git-annex remote.
+var errUUIDMismatch = errors.New("UUID mismatch")
+
+// uuidRecord is the JSON content of the file named by [uuidFileName].
+type uuidRecord struct {
+	UUID string `json:"uuid"`
+}
+
+// queryUUID asks git-annex for the UUID of this remote.
+func (s *server) queryUUID() (string, error) {
+	s.sendMsg("GETUUID")
+	message, err := s.getReply()
+	if err != nil {
+		return "", err
+	}
+	keyword, err := message.nextSpaceDelimitedParameter()
+	if err != nil || keyword != "VALUE" {
+		return "", fmt.Errorf("failed to parse UUID: %s %s", keyword, message.line)
+	}
+	uuid := message.finalParameter()
+	if uuid == "" {
+		return "", errors.New("git-annex sent an empty UUID")
+	}
+	return uuid, nil
+}
+
+// getPrefixFs returns the Fs for the "rcloneprefix" directory, regardless of
+// layout mode.
+func (s *server) getPrefixFs(ctx context.Context) (fs.Fs, error) {
+	prefixFsString, err := s.buildFsString(layoutModeNodir, "")
+	if err != nil {
+		return nil, err
+	}
+	return s.getRemoteFs(ctx, prefixFsString)
+}
+
+// createPrefix creates the "rcloneprefix" directory if it does not exist yet.
+func (s *server) createPrefix(ctx context.Context) error {
+	prefixFs, err := s.getPrefixFs(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get remote fs: %w", err)
+	}
+	if err := prefixFs.Mkdir(ctx, ""); err != nil {
+		return fmt.Errorf("failed to create prefix directory: %w", err)
+	}
+	return nil
+}
+
+// readStoredUUID returns the UUID recorded in `prefixFs`, or the empty string
+// when none has been recorded.
+func readStoredUUID(ctx context.Context, prefixFs fs.Fs) (string, error) {
+	obj, err := prefixFs.NewObject(ctx, uuidFileName)
+	if errors.Is(err, fs.ErrorObjectNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to find %s: %w", uuidFileName, err)
+	}
+	data, err := operations.ReadFile(ctx, obj)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", uuidFileName, err)
+	}
+	var record uuidRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return "", fmt.Errorf("failed to parse %s: %w", uuidFileName, err)
+	}
+	return record.UUID, nil
+}
+
+// writeStoredUUID records `uuid` in `prefixFs`.
+func writeStoredUUID(ctx context.Context, prefixFs fs.Fs, uuid string) error {
+	data, err := json.Marshal(uuidRecord{UUID: uuid})
+	if err != nil {
+		return err
+	}
+	in := io.NopCloser(bytes.NewReader(data))
+	if _, err := operations.RcatSize(ctx, prefixFs, uuidFileName, in, int64(len(data)), time.Now(), nil); err != nil {
+		return fmt.Errorf("failed to write %s: %w", uuidFileName, err)
+	}
+	return nil
+}
+
+// checkUUID compares this remote's UUID with the one recorded in the
+// "rcloneprefix" directory and returns an error wrapping [errUUIDMismatch] if
+// they differ, unless this remote was initialized with "git annex initremote
+// --sameas" and its "sameas-uuid" config names the recorded UUID. When no UUID
+// has been recorded and `record` is true, the UUID is recorded.
+func (s *server) checkUUID(ctx context.Context, record bool) error {
+	uuid, err := s.queryUUID()
+	if err != nil {
+		return fmt.Errorf("failed to get UUID: %w", err)
+	}
+	prefixFs, err := s.getPrefixFs(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get remote fs: %w", err)
+	}
+	storedUUID, err := readStoredUUID(ctx, prefixFs)
+	if err != nil {
+		return err
+	}
+	switch {
+	case storedUUID == uuid:
+		return nil
+	case storedUUID != "":
+		sameAsUUID, err := s.queryConfigWithDefault("sameas-uuid", "")
+		if err != nil && !errors.Is(err, errEmptyConfigValue) {
+			return fmt.Errorf("failed to get sameas-uuid: %w", err)
+		}
+		if sameAsUUID == storedUUID {
+			return nil
+		}
+		return fmt.Errorf("%w: expected %s got %s", errUUIDMismatch, storedUUID, uuid)
+	case !record:
+		// The directory predates UUID records, or was initialized in dry-run
+		// mode. There is nothing to compare against.
+		return nil
+	case s.dryRun:
+		s.sendInfo(fmt.Sprintf("[dry-run] skipping write %s", uuidFileName))
+		return nil
+	default:
+		return writeStoredUUID(ctx, prefixFs, uuid)
+	}
+}
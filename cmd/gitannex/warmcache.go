@@ -0,0 +1,89 @@
+package gitannex
+
+import (
+	"context"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/filter"
+	"github.com/rclone/rclone/fs/walk"
+)
+
+// presentKeysCache holds the keys found by listing the "rcloneprefix"
+// directory in the background when the "rclonewarmcache" config is enabled.
+// It is only a positive hint: a key it does not hold is looked up as usual.
+// Its methods may be called from any goroutine.
+type presentKeysCache struct {
+	mu   sync.RWMutex
+	keys map[string]bool
+	// Keys removed while the listing was running, which it may still report.
+	removed map[string]bool
+	// Closed when the listing has finished, whether or not it succeeded.
+	done chan struct{}
+}
+
+// warmPresentKeysCache starts listing every object under `prefixFs` in the
+// background and returns the cache that the listing fills. When `fi` is not
+// nil, the listing leaves out the objects that it excludes.
+func warmPresentKeysCache(ctx context.Context, prefixFs fs.Fs, fi *filter.Filter) *presentKeysCache {
+	c := &presentKeysCache{removed: map[string]bool{}, done: make(chan struct{})}
+	if fi != nil {
+		ctx = filter.ReplaceConfig(ctx, fi)
+	}
+	go func() {
+		defer close(c.done)
+		keys, partial := map[string]bool{}, map[string]bool{}
+		err := walk.ListR(ctx, prefixFs, "", false, -1, walk.ListObjects, func(entries fs.DirEntries) error {
+			for _, entry := range entries {
+				name := path.Base(entry.Remote())
+				keys[name] = true
+				// A key stored in chunks is present when its manifest is,
+				// unless a resumable store of it is in progress.
+				if key, ok := strings.CutSuffix(name, partialName("")); ok {
+					partial[key] = true
+				}
+				if key, ok := strings.CutSuffix(name, manifestName("")); ok {
+					keys[key] = true
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			fs.Debugf(prefixFs, "Failed to warm cache of present keys: %v", err)
+			return
+		}
+		for key := range partial {
+			delete(keys, key)
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for key := range c.removed {
+			delete(keys, key)
+		}
+		c.keys, c.removed = keys, nil
+	}()
+	return c
+}
+
+// has reports whether `key` was found by the listing. It returns false until
+// the listing has finished.
+func (c *presentKeysCache) has(key string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.keys[key]
+}
+
+// forget records that `key` has been removed from the remote.
+func (c *presentKeysCache) forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.keys == nil {
+		if c.removed != nil {
+			c.removed[key] = true
+		}
+		return
+	}
+	delete(c.keys, key)
+}
@@ -0,0 +1,62 @@
+package gitannex
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/operations"
+)
+
+// handleWhereis replies to "WHEREIS KEY" with a public link to the key, which
+// "git annex whereis" shows to the user, when the "rclonepubliclinks" config
+// is enabled. Keys without a link, e.g. because the backend cannot make one or
+// the key is stored in chunks, get "WHEREIS-FAILURE", which is not an error.
+func (s *server) handleWhereis(message *messageParser) error {
+	argKey := message.finalParameter()
+	if argKey == "" {
+		return &ErrProtocolParse{protocolError(codeError, errors.New("failed to parse key for WHEREIS"))}
+	}
+
+	if err := s.queryConfigs(); err != nil {
+		s.sendMsg("WHEREIS-FAILURE")
+		return &ErrConfigMissing{protocolError("WHEREIS-FAILURE", fmt.Errorf("error getting configs: %w", err))}
+	}
+
+	cfg, err := s.getSessionConfig()
+	if err != nil {
+		s.sendMsg("WHEREIS-FAILURE")
+		return &ErrConfigMissing{protocolError("WHEREIS-FAILURE", err)}
+	}
+	if !cfg.publicLinks {
+		s.sendMsg("UNSUPPORTED-REQUEST")
+		return nil
+	}
+
+	remoteFsString, err := s.buildFsString(cfg.layout, argKey)
+	if err != nil {
+		s.sendMsg("WHEREIS-FAILURE")
+		return &ErrRemoteNotFound{protocolError("WHEREIS-FAILURE", fmt.Errorf("error building fs string: %w", err))}
+	}
+
+	remoteFs, err := s.getRemoteFs(s.sessionContext(), remoteFsString)
+	if err != nil {
+		s.sendMsg("WHEREIS-FAILURE")
+		return &ErrRemoteNotFound{protocolError("WHEREIS-FAILURE", err)}
+	}
+
+	// Some backends make links to objects that do not exist.
+	if _, err := remoteFs.NewObject(s.sessionContext(), argKey); err != nil {
+		fs.Debugf(remoteFs, "No public link for %s: %v", argKey, err)
+		s.sendMsg("WHEREIS-FAILURE")
+		return nil
+	}
+	link, err := operations.PublicLink(s.sessionContext(), remoteFs, argKey, fs.DurationOff, false)
+	if err != nil {
+		fs.Debugf(remoteFs, "No public link for %s: %v", argKey, err)
+		s.sendMsg("WHEREIS-FAILURE")
+		return nil
+	}
+	s.sendMsg("WHEREIS-SUCCESS " + link)
+	return nil
+}
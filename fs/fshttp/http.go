@@ -272,6 +272,7 @@ func cleanAuth(buf, authBuf []byte) []byte {
 var authBufs = [][]byte{
 	[]byte("Authorization: "),
 	[]byte("X-Auth-Token: "),
+	[]byte("X-Amz-Security-Token: "),
 }
 
 // cleanAuths gets rid of all the possible Auth headers